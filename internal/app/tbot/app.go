@@ -7,8 +7,10 @@ import (
 	"fmt"
 	"github.com/DenisKhanov/TgBOT/internal/logcfg"
 	"github.com/DenisKhanov/TgBOT/internal/tg_bot/config"
+	botServ "github.com/DenisKhanov/TgBOT/internal/tg_bot/service"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/sirupsen/logrus"
+	"io"
 	"os"
 	"os/signal"
 	"syscall"
@@ -78,8 +80,13 @@ func (a *App) initServiceProvider(_ context.Context) error {
 		a.config.EnvGenerativeName,
 		a.config.EnvGenerativeApiKey,
 		a.config.EnvGenerativeModel,
+		a.config.EnvGenerativeBaseURL,
+		a.config.EnvGenerativeFallback,
+		a.config.EnvGenerativeFallbackKeys,
 		a.config.EnvStoragePath,
 		a.config.EnvDialogStoragePath,
+		a.config.EnvStateStorageType,
+		a.config.EnvSQLiteStoragePath,
 		a.config.EnvClientCert,
 		a.config.EnvClientKey,
 		a.config.EnvClientCa,
@@ -87,6 +94,17 @@ func (a *App) initServiceProvider(_ context.Context) error {
 		a.config.EnvClientID,
 		a.config.EnvOwnerID,
 		a.config.EnvMoviesURL,
+		botServ.HistoryPolicy{
+			Strategy:        botServ.TrimStrategy(a.config.EnvHistoryTrimStrategy),
+			TokenBudget:     a.config.EnvHistoryTokenBudget,
+			MemoryThreshold: a.config.EnvHistoryMemoryThreshold,
+		},
+		botServ.QuotaPolicy{
+			RequestsPerMinute: a.config.EnvAIRequestsPerMinute,
+			TokensPerDay:      a.config.EnvAITokensPerDay,
+			MaxConcurrent:     a.config.EnvAIMaxConcurrent,
+		},
+		a.config.EnvDefaultRole,
 	)
 	if err != nil {
 		return fmt.Errorf("initialize service provider: %w", err)
@@ -130,13 +148,20 @@ func (a *App) runTelegramBot() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	dispatcher := NewDispatcher(a.config.EnvUpdateWorkers, a.config.EnvUpdateQueueSize, func(ctx context.Context, update *tgbotapi.Update) {
+		if update.InlineQuery != nil {
+			myBot.HandleInlineQuery(update.InlineQuery)
+		} else {
+			myBot.UpdateProcessing(ctx, update)
+		}
+	})
+	// The Stop button of an AI answer must not wait until the answer it stops is finished
+	dispatcher.SetUrgent(myBot.IsUrgentUpdate)
+	dispatcher.Start(ctx)
+
 	go func() {
 		for update := range updates {
-			if update.InlineQuery != nil {
-				myBot.HandleInlineQuery(botAPI, update.InlineQuery)
-			} else {
-				myBot.UpdateProcessing(&update)
-			}
+			dispatcher.Dispatch(&update)
 		}
 		logrus.Info("Update channel closed")
 	}()
@@ -146,14 +171,25 @@ func (a *App) runTelegramBot() {
 		select {
 		case sig := <-signalChan:
 			logrus.Infof("Received signal %v, initiating shutdown", sig)
+			botAPI.StopReceivingUpdates()
 			cancel()
+			dispatcher.Stop()
 			if err = myBot.StateRepo.SaveBatchToFile(); err != nil {
 				logrus.Errorf("Failed to save state during shutdown: %v", err)
 			}
 			if err = myBot.AIDialogRepo.SaveBatchToFile(); err != nil {
 				logrus.Errorf("Failed to save dialog history during shutdown: %v", err)
 			}
-			botAPI.StopReceivingUpdates()
+			if closer, ok := myBot.StateRepo.(io.Closer); ok {
+				if err = closer.Close(); err != nil {
+					logrus.Errorf("Failed to close state storage during shutdown: %v", err)
+				}
+			}
+			if closer, ok := myBot.AIDialogRepo.(io.Closer); ok {
+				if err = closer.Close(); err != nil {
+					logrus.Errorf("Failed to close dialog history storage during shutdown: %v", err)
+				}
+			}
 			logrus.Info("Telegram bot shut down successfully")
 			return
 
@@ -0,0 +1,169 @@
+package tbot
+
+import (
+	"context"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/sirupsen/logrus"
+)
+
+// UpdateHandler processes a single Telegram update.
+type UpdateHandler func(ctx context.Context, update *tgbotapi.Update)
+
+// Dispatcher shards incoming Telegram updates by chat ID onto a bounded pool of workers.
+//
+// Every chat is always served by the same worker, so updates inside one chat are handled in the
+// order they were received, while chats assigned to different workers are handled in parallel.
+// Each worker owns a buffered queue; when the queue is full, Dispatch blocks until the worker
+// catches up and logs the back-pressure.
+//
+// Urgent updates, such as a press of the Stop button of a running AI answer, bypass the queues:
+// they must reach the chat while its worker is still busy with the previous update.
+type Dispatcher struct {
+	handler UpdateHandler               // Handler called for every update
+	urgent  func(*tgbotapi.Update) bool // Reports whether the update bypasses the chat queue, optional
+	queues  []chan *tgbotapi.Update     // Per-worker update queues
+	wg      sync.WaitGroup              // Tracks running workers
+	mu      sync.RWMutex                // Protects stopped and the queues from closing during Dispatch
+	stopped bool                        // Set once Stop has been called
+	ctx     context.Context             // Context passed to the handler
+}
+
+// NewDispatcher creates a new Dispatcher.
+// Arguments:
+//   - workers: number of workers processing updates in parallel.
+//   - queueSize: depth of the queue of every worker.
+//   - handler: function called for every update.
+//
+// Returns a pointer to a Dispatcher.
+func NewDispatcher(workers, queueSize int, handler UpdateHandler) *Dispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	queues := make([]chan *tgbotapi.Update, workers)
+	for i := range queues {
+		queues[i] = make(chan *tgbotapi.Update, queueSize)
+	}
+	return &Dispatcher{
+		handler: handler,
+		queues:  queues,
+	}
+}
+
+// SetUrgent sets the predicate of the updates that are handled immediately in their own goroutine
+// instead of waiting in the queue of their chat. Must be called before Start.
+func (d *Dispatcher) SetUrgent(urgent func(update *tgbotapi.Update) bool) {
+	d.urgent = urgent
+}
+
+// Start launches the workers. The context is passed to every handler call.
+func (d *Dispatcher) Start(ctx context.Context) {
+	d.ctx = ctx
+	for i, queue := range d.queues {
+		d.wg.Add(1)
+		go d.work(i, queue)
+	}
+	logrus.Infof("Update dispatcher started with %d workers, queue depth %d", len(d.queues), cap(d.queues[0]))
+}
+
+// Dispatch routes the update to the worker responsible for its chat.
+// It blocks while the worker queue is full and drops the update once the dispatcher is stopped.
+func (d *Dispatcher) Dispatch(update *tgbotapi.Update) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.stopped {
+		logrus.WithField("updateID", update.UpdateID).Warn("Dispatcher is stopped, update dropped")
+		return
+	}
+
+	chatID := updateChatID(update)
+	if d.urgent != nil && d.urgent(update) {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.handle(-1, update)
+		}()
+		return
+	}
+
+	worker := d.workerIndex(chatID)
+	queue := d.queues[worker]
+
+	select {
+	case queue <- update:
+		return
+	default:
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"chatID": chatID,
+		"worker": worker,
+		"depth":  cap(queue),
+	}).Warn("Update queue is full, applying back-pressure")
+
+	select {
+	case queue <- update:
+	case <-d.ctx.Done():
+		logrus.WithField("chatID", chatID).Warn("Dispatcher context canceled, update dropped")
+	}
+}
+
+// Stop closes the worker queues and waits until the queued updates are processed.
+func (d *Dispatcher) Stop() {
+	d.mu.Lock()
+	if d.stopped {
+		d.mu.Unlock()
+		return
+	}
+	d.stopped = true
+	for _, queue := range d.queues {
+		close(queue)
+	}
+	d.mu.Unlock()
+
+	d.wg.Wait()
+	logrus.Info("Update dispatcher stopped")
+}
+
+// work processes the updates of a single worker queue until it is closed.
+func (d *Dispatcher) work(id int, queue <-chan *tgbotapi.Update) {
+	defer d.wg.Done()
+	for update := range queue {
+		d.handle(id, update)
+	}
+}
+
+// handle calls the handler and keeps the worker alive if it panics.
+func (d *Dispatcher) handle(id int, update *tgbotapi.Update) {
+	defer func() {
+		if r := recover(); r != nil {
+			logrus.WithFields(logrus.Fields{
+				"worker":   id,
+				"updateID": update.UpdateID,
+			}).Errorf("Update handler panicked: %v", r)
+		}
+	}()
+	d.handler(d.ctx, update)
+}
+
+// workerIndex returns the index of the worker serving the chat.
+func (d *Dispatcher) workerIndex(chatID int64) int {
+	return int(uint64(chatID) % uint64(len(d.queues)))
+}
+
+// updateChatID returns the chat the update belongs to. Inline queries have no chat,
+// so they are keyed by the sender ID.
+func updateChatID(update *tgbotapi.Update) int64 {
+	if chat := update.FromChat(); chat != nil {
+		return chat.ID
+	}
+	if from := update.SentFrom(); from != nil {
+		return from.ID
+	}
+	return 0
+}
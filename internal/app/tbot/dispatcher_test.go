@@ -0,0 +1,118 @@
+package tbot
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func newChatUpdate(updateID int, chatID int64) *tgbotapi.Update {
+	return &tgbotapi.Update{
+		UpdateID: updateID,
+		Message: &tgbotapi.Message{
+			Chat: &tgbotapi.Chat{ID: chatID},
+			Text: "text",
+		},
+	}
+}
+
+func TestDispatcher_KeepsOrderInsideChat(t *testing.T) {
+	var mu sync.Mutex
+	got := make(map[int64][]int)
+
+	dispatcher := NewDispatcher(4, 2, func(_ context.Context, update *tgbotapi.Update) {
+		mu.Lock()
+		defer mu.Unlock()
+		chatID := update.Message.Chat.ID
+		got[chatID] = append(got[chatID], update.UpdateID)
+	})
+	dispatcher.Start(context.Background())
+
+	want := make(map[int64][]int)
+	for i := 0; i < 100; i++ {
+		chatID := int64(i%5 + 1)
+		want[chatID] = append(want[chatID], i)
+		dispatcher.Dispatch(newChatUpdate(i, chatID))
+	}
+	dispatcher.Stop()
+
+	assert.Equal(t, want, got)
+}
+
+func TestDispatcher_RunsChatsInParallel(t *testing.T) {
+	release := make(chan struct{})
+	done := make(chan int64, 1)
+
+	dispatcher := NewDispatcher(2, 1, func(_ context.Context, update *tgbotapi.Update) {
+		if update.Message.Chat.ID == 2 {
+			<-release
+			return
+		}
+		done <- update.Message.Chat.ID
+	})
+	dispatcher.Start(context.Background())
+
+	// Chat 2 blocks its worker, chat 1 must still be served by the other one.
+	dispatcher.Dispatch(newChatUpdate(1, 2))
+	dispatcher.Dispatch(newChatUpdate(2, 1))
+
+	select {
+	case chatID := <-done:
+		assert.Equal(t, int64(1), chatID)
+	case <-time.After(time.Second):
+		t.Fatal("update of an idle chat was blocked by a busy chat")
+	}
+
+	close(release)
+	dispatcher.Stop()
+}
+
+func TestDispatcher_DropsUpdatesAfterStop(t *testing.T) {
+	var calls int
+	dispatcher := NewDispatcher(1, 1, func(_ context.Context, _ *tgbotapi.Update) {
+		calls++
+	})
+	dispatcher.Start(context.Background())
+	dispatcher.Stop()
+
+	dispatcher.Dispatch(newChatUpdate(1, 1))
+	assert.Equal(t, 0, calls)
+}
+
+func TestDispatcher_UrgentUpdateBypassesBusyChat(t *testing.T) {
+	release := make(chan struct{})
+	stopped := make(chan int, 1)
+
+	dispatcher := NewDispatcher(1, 1, func(_ context.Context, update *tgbotapi.Update) {
+		if update.CallbackQuery != nil {
+			stopped <- update.UpdateID
+			return
+		}
+		<-release
+	})
+	dispatcher.SetUrgent(func(update *tgbotapi.Update) bool { return update.CallbackQuery != nil })
+	dispatcher.Start(context.Background())
+
+	// The chat's worker is busy with a long update, the urgent one must not wait behind it.
+	dispatcher.Dispatch(newChatUpdate(1, 7))
+	dispatcher.Dispatch(&tgbotapi.Update{
+		UpdateID: 2,
+		CallbackQuery: &tgbotapi.CallbackQuery{
+			Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: 7}},
+		},
+	})
+
+	select {
+	case updateID := <-stopped:
+		assert.Equal(t, 2, updateID)
+	case <-time.After(time.Second):
+		t.Fatal("urgent update waited for the busy chat worker")
+	}
+
+	close(release)
+	dispatcher.Stop()
+}
@@ -16,6 +16,12 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// Supported backends of the user chat state storage.
+const (
+	stateStorageJSON   = "json"
+	stateStorageSQLite = "sqlite"
+)
+
 // ServiceProvider manages the dependency injection for Telegram bot components.
 type ServiceProvider struct {
 	// Services
@@ -25,8 +31,9 @@ type ServiceProvider struct {
 	generativeService botServ.GenerativeModel
 
 	// ChatStateRepository
-	usersStateRepo  botServ.UsersChatStateRepository
-	aiDialogHistory botServ.AIDialogHistoryRepository
+	usersStateRepo    botServ.UsersChatStateRepository
+	usersStateRepoErr error
+	aiDialogHistory   botServ.AIDialogHistoryRepository
 
 	// Handler
 	handler    botServ.Handler
@@ -51,18 +58,26 @@ type ServiceProvider struct {
 	generativeName    string
 	generativeApiKey  string
 	generativeModel   string
+	generativeBaseURL string
+	generativeChain   []generative.ChainLink
+	generativeKeys    map[string]string
 	storagePath       string
 	dialogStoragePath string
+	stateStorageType  string
+	sqliteStoragePath string
 
 	//TLS file path
 	clientCert string
 	clientKey  string
 	clientCa   string
 
-	apiKey    string
-	clientID  string
-	ownerID   int64
-	moviesURL string
+	apiKey        string
+	clientID      string
+	ownerID       int64
+	moviesURL     string
+	historyPolicy botServ.HistoryPolicy
+	quotaPolicy   botServ.QuotaPolicy
+	defaultRole   models.AccessRole
 
 	boringOnce       sync.Once
 	translateOnce    sync.Once
@@ -80,10 +95,25 @@ func NewServiceProvider(
 	translateAPIEndpoint, dictionaryAPIEndpoint, smartHomeAPIEndpoint string,
 	serverEndpoint, translateApiKey,
 	generativeName, generativeApiKey,
-	generativeModel, storagePath, dialogStoragePath, clientCert,
+	generativeModel, generativeBaseURL, generativeFallback string, generativeKeys map[string]string,
+	storagePath, dialogStoragePath,
+	stateStorageType, sqliteStoragePath, clientCert,
 	clientKey, clientCa, apiKey,
 	clientID string, ownerID int64, moviesURL string,
+	historyPolicy botServ.HistoryPolicy,
+	quotaPolicy botServ.QuotaPolicy,
+	defaultRole string,
 ) (*ServiceProvider, error) {
+	if err := historyPolicy.Validate(); err != nil {
+		return nil, fmt.Errorf("historyPolicy: %w", err)
+	}
+	if err := quotaPolicy.Validate(); err != nil {
+		return nil, fmt.Errorf("quotaPolicy: %w", err)
+	}
+	role, ok := models.ParseAccessRole(defaultRole)
+	if !ok || role == models.AccessOwner {
+		return nil, fmt.Errorf("defaultRole must be admin, member, guest or banned, got %q", defaultRole)
+	}
 	switch {
 	case translateAPIEndpoint == "":
 		return nil, fmt.Errorf("translateAPIEndpoint is required")
@@ -97,14 +127,20 @@ func NewServiceProvider(
 		return nil, fmt.Errorf("translateApiKey is required")
 	case generativeName == "":
 		return nil, fmt.Errorf("generativeName is required")
-	case generativeApiKey == "":
+	case generativeApiKey == "" && generative.NeedsAPIKey(generativeName):
 		return nil, fmt.Errorf("generativeApiKey is required")
+	case generativeName == generative.OpenAICompatible && generativeBaseURL == "":
+		return nil, fmt.Errorf("generativeBaseURL is required for the %q provider", generative.OpenAICompatible)
 	case generativeModel == "":
 		return nil, fmt.Errorf("generativeModel is required")
 	case storagePath == "":
 		return nil, fmt.Errorf("storagePath is required")
 	case dialogStoragePath == "":
 		return nil, fmt.Errorf("dialogStoragePath is required")
+	case stateStorageType != stateStorageJSON && stateStorageType != stateStorageSQLite:
+		return nil, fmt.Errorf("stateStorageType must be %q or %q, got %q", stateStorageJSON, stateStorageSQLite, stateStorageType)
+	case stateStorageType == stateStorageSQLite && sqliteStoragePath == "":
+		return nil, fmt.Errorf("sqliteStoragePath is required for %q state storage", stateStorageSQLite)
 	case clientCert == "":
 		return nil, fmt.Errorf("clientCert is required")
 	case clientKey == "":
@@ -120,6 +156,10 @@ func NewServiceProvider(
 	case moviesURL == "":
 		return nil, fmt.Errorf("moviesURL is required")
 	}
+	generativeChain, err := generative.ParseChain(generativeFallback)
+	if err != nil {
+		return nil, fmt.Errorf("generativeFallback: %w", err)
+	}
 	return &ServiceProvider{
 		translateAPIEndpoint:  translateAPIEndpoint,
 		dictionaryAPIEndpoint: dictionaryAPIEndpoint,
@@ -129,8 +169,13 @@ func NewServiceProvider(
 		generativeName:        generativeName,
 		generativeApiKey:      generativeApiKey,
 		generativeModel:       generativeModel,
+		generativeBaseURL:     generativeBaseURL,
+		generativeChain:       generativeChain,
+		generativeKeys:        generativeKeys,
 		storagePath:           storagePath,
 		dialogStoragePath:     dialogStoragePath,
+		stateStorageType:      stateStorageType,
+		sqliteStoragePath:     sqliteStoragePath,
 		clientCert:            clientCert,
 		clientKey:             clientKey,
 		clientCa:              clientCa,
@@ -138,6 +183,9 @@ func NewServiceProvider(
 		clientID:              clientID,
 		ownerID:               ownerID,
 		moviesURL:             moviesURL,
+		historyPolicy:         historyPolicy,
+		quotaPolicy:           quotaPolicy,
+		defaultRole:           role,
 	}, nil
 }
 
@@ -169,10 +217,12 @@ func (s *ServiceProvider) SmartHomeService() botServ.SmartHome {
 }
 
 // GenerativeService returns the service for GenerativeModel generative model integration.
+// If a fallback chain is configured, the main provider is wrapped into it.
 func (s *ServiceProvider) GenerativeService() (botServ.GenerativeModel, error) {
 	var err error
 	s.generativeOnce.Do(func() {
-		s.generativeService, err = generative.ModelFactory(s.generativeName, s.generativeApiKey, s.generativeModel, 0, 1.0)
+		s.generativeService, err = generative.ChainFactory(s.generativeName, s.generativeApiKey, s.generativeModel,
+			s.generativeBaseURL, s.generativeChain, s.generativeKeys, 0, 1.0)
 		if err != nil {
 			logrus.Errorf("Failed to initialize Generative service: %v", err)
 			s.generativeService = nil // Сброс при ошибке
@@ -186,16 +236,49 @@ func (s *ServiceProvider) GenerativeService() (botServ.GenerativeModel, error) {
 }
 
 // The ChatStateRepository returns the usersStateRepo for user state management.
-func (s *ServiceProvider) ChatStateRepository() botServ.UsersChatStateRepository {
+// The storage backend is chosen by stateStorageType: the JSON snapshot file or the SQLite database.
+func (s *ServiceProvider) ChatStateRepository() (botServ.UsersChatStateRepository, error) {
 	s.stateRepoOnce.Do(func() {
+		if s.stateStorageType == stateStorageSQLite {
+			s.usersStateRepo, s.usersStateRepoErr = s.sqliteChatStateRepository()
+			return
+		}
 		s.usersStateRepo = repository.NewUsersStateMap(s.storagePath)
 		if err := s.usersStateRepo.ReadFileToMemoryURL(); err != nil {
 			logrus.Errorf("Failed to read user state from file: %v", err)
 		} else {
-			logrus.Info("AIDialogHistoryRepository initialized and state loaded")
+			logrus.Info("UsersChatStateRepository initialized and state loaded")
 		}
 	})
-	return s.usersStateRepo
+	if s.usersStateRepoErr != nil {
+		return nil, fmt.Errorf("initialize chat state repository: %w", s.usersStateRepoErr)
+	}
+	return s.usersStateRepo, nil
+}
+
+// sqliteChatStateRepository opens the SQLite state storage. On the first start with an empty
+// database it imports the user states from the JSON snapshot at storagePath.
+func (s *ServiceProvider) sqliteChatStateRepository() (botServ.UsersChatStateRepository, error) {
+	repo, err := repository.NewUsersStateSQLite(s.sqliteStoragePath)
+	if err != nil {
+		return nil, err
+	}
+	empty, err := repo.IsEmpty()
+	if err != nil {
+		_ = repo.Close()
+		return nil, err
+	}
+	if empty {
+		if _, err = repo.ImportFromJSON(s.storagePath); err != nil {
+			logrus.WithError(err).Errorf("Failed to import user state from %s", s.storagePath)
+		}
+	}
+	if err = repo.ReadFileToMemoryURL(); err != nil {
+		_ = repo.Close()
+		return nil, err
+	}
+	logrus.Info("UsersChatStateRepository initialized with SQLite storage")
+	return repo, nil
 }
 
 // The AiDialogHistoryRepository returns the aiDialogRepo for dialog with AI history management.
@@ -259,19 +342,27 @@ func (s *ServiceProvider) BotService(botAPI *tgbotapi.BotAPI) (*botServ.TgBotSer
 			s.botServiceErr = err
 			return
 		}
+		stateRepo, err := s.ChatStateRepository()
+		if err != nil {
+			s.botServiceErr = err
+			return
+		}
 		AuthURL := fmt.Sprintf("https://oauth.yandex.ru/authorize?response_type=code&client_id=%s&redirect_uri=%s/callback&state=", s.clientID, s.serverEndpoint)
 		s.botService = botServ.NewTgBot(
 			s.BoringService(),
 			s.TranslateService(),
 			s.SmartHomeService(),
 			generativeService,
-			s.ChatStateRepository(),
+			stateRepo,
 			s.AiDialogHistoryRepository(),
 			botAPI,
 			handler,
 			AuthURL,
 			s.ownerID,
 			s.moviesURL,
+			s.historyPolicy,
+			s.quotaPolicy,
+			s.defaultRole,
 		)
 	})
 	if s.botServiceErr != nil {
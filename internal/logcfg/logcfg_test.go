@@ -7,6 +7,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"os"
 	"path"
+	"path/filepath"
 	"runtime"
 	"testing"
 )
@@ -42,7 +43,7 @@ func TestRunLoggerConfig_TableDriven(t *testing.T) {
 			logrus.SetOutput(&logOutput)
 
 			// Run the logger configuration
-			err := RunLoggerConfig(tt.envLogs, "test.log")
+			err := RunLoggerConfig(tt.envLogs, filepath.Join(t.TempDir(), "test.log"))
 			assert.NoError(t, err)
 
 			// Check log level
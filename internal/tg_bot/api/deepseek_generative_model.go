@@ -7,10 +7,26 @@ import (
 	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
 	"github.com/go-deepseek/deepseek"
 	"github.com/go-deepseek/deepseek/request"
+	"github.com/go-deepseek/deepseek/response"
 	"github.com/sirupsen/logrus"
+	"io"
+	"slices"
+	"strings"
 	"time"
 )
 
+// Ограничения DeepSeek API.
+const (
+	deepseekMaxTokens     = 8192            // Наибольшая длина ответа, которую принимает API
+	deepseekStreamTimeout = 2 * time.Minute // Наибольшее время потоковой генерации ответа, deepseek-reasoner долго рассуждает
+)
+
+// deepseekModels — модели DeepSeek API, для каждой клиент вызывает свой метод.
+var deepseekModels = []models.ModelInfo{
+	{ID: deepseek.DEEPSEEK_CHAT_MODEL, Name: "DeepSeek-V3 (deepseek-chat)"},
+	{ID: deepseek.DEEPSEEK_REASONER_MODEL, Name: "DeepSeek-R1 (deepseek-reasoner)"},
+}
+
 type DeepSeekAPI struct {
 	client      deepseek.Client // Клиент для взаимодействия с API
 	ctx         context.Context // Контекст для управления запросами
@@ -42,31 +58,177 @@ func NewDeepSeekAPI(apiKey string, modelName string, maxTokens int, temperature
 	}, nil
 }
 
-func (d *DeepSeekAPI) GenerateStreamTextMsg(text string, history []models.Message) <-chan string {
-	_, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-	defer cancel()
-	return make(<-chan string)
+// deepseekMessages преобразует сообщения запроса, собранные chatMessages, в сообщения клиента DeepSeek.
+func deepseekMessages(text string, history []models.Message, opts models.GenerationOptions) []*request.Message {
+	messages := chatMessages(text, history, opts)
+	converted := make([]*request.Message, 0, len(messages))
+	for _, msg := range messages {
+		if strings.TrimSpace(msg.Content) == "" {
+			// DeepSeek отклоняет запросы с пустыми сообщениями
+			continue
+		}
+		converted = append(converted, &request.Message{Role: msg.Role, Content: msg.Content})
+	}
+	return converted
+}
+
+// chatRequest формирует запрос к DeepSeek API с учётом настроек запроса; нулевые настройки заменяются настройками провайдера.
+func (d *DeepSeekAPI) chatRequest(text string, history []models.Message, opts models.GenerationOptions, stream bool) *request.ChatCompletionsRequest {
+	temperature := d.temperature
+	if opts.Temperature != nil {
+		temperature = *opts.Temperature
+	}
+	chatReq := &request.ChatCompletionsRequest{
+		Model:       d.modelName,
+		Stream:      stream,
+		Messages:    deepseekMessages(text, history, opts),
+		MaxTokens:   d.maxTokens,
+		Temperature: &temperature,
+	}
+	if opts.Model != "" {
+		chatReq.Model = opts.Model
+	}
+	if opts.MaxTokens > 0 {
+		chatReq.MaxTokens = opts.MaxTokens
+	}
+	// DeepSeek отклоняет запросы с длиной ответа больше своего лимита
+	chatReq.MaxTokens = min(chatReq.MaxTokens, deepseekMaxTokens)
+	if stream {
+		// Расход токенов приходит последним фрагментом потока
+		chatReq.StreamOptions = &request.StreamOptions{IncludeUsage: true}
+	}
+	return chatReq
+}
+
+// call отправляет запрос без потоковой передачи методом клиента, который соответствует модели запроса.
+func (d *DeepSeekAPI) call(ctx context.Context, chatReq *request.ChatCompletionsRequest) (*response.ChatCompletionsResponse, error) {
+	if chatReq.Model == deepseek.DEEPSEEK_REASONER_MODEL {
+		return d.client.CallChatCompletionsReasoner(ctx, chatReq)
+	}
+	return d.client.CallChatCompletionsChat(ctx, chatReq)
+}
+
+// stream открывает поток ответа методом клиента, который соответствует модели запроса.
+func (d *DeepSeekAPI) stream(ctx context.Context, chatReq *request.ChatCompletionsRequest) (response.StreamReader, error) {
+	if chatReq.Model == deepseek.DEEPSEEK_REASONER_MODEL {
+		return d.client.StreamChatCompletionsReasoner(ctx, chatReq)
+	}
+	return d.client.StreamChatCompletionsChat(ctx, chatReq)
 }
 
-// GenerateTextMsg генерирует текст на основе переданного запроса
+// GenerateStreamTextMsg генерирует ответ на сообщение пользователя с учётом истории диалога и передаёт его по частям.
+//
+// Запрос ограничен по времени deepseekStreamTimeout. При отмене ctx или истечении времени поток останавливается,
+// а ошибка передаётся последним событием. Пустой текст запроса не отправляется, вместо ответа передаётся
+// models.ErrEmptyPrompt. Канал закрывается после завершения ответа или ошибки.
+func (d *DeepSeekAPI) GenerateStreamTextMsg(ctx context.Context, text string, history []models.Message, opts models.GenerationOptions) <-chan models.StreamEvent {
+	events := make(chan models.StreamEvent)
+
+	go func() {
+		defer close(events)
+		if strings.TrimSpace(text) == "" {
+			// Валидатор клиента отклонил бы запрос с непонятной ошибкой о сообщении по индексу
+			events <- models.StreamEvent{Err: fmt.Errorf("deepseek stream: %w", models.ErrEmptyPrompt)}
+			return
+		}
+		ctx, cancel := context.WithTimeout(ctx, deepseekStreamTimeout)
+		defer cancel()
+
+		stream, err := d.stream(ctx, d.chatRequest(text, history, opts, true))
+		if err != nil {
+			logrus.WithError(err).Error("Error creating DeepSeek stream")
+			events <- models.StreamEvent{Err: fmt.Errorf("deepseek stream: %w", err)}
+			return
+		}
+		for {
+			chunk, err := stream.Read()
+			if errors.Is(err, io.EOF) {
+				logrus.Info("Streaming completed")
+				return
+			}
+			if err != nil {
+				err = streamCause(ctx, err)
+				logrus.WithError(err).Error("Error during streaming from DeepSeek")
+				events <- models.StreamEvent{Err: fmt.Errorf("deepseek stream: %w", err)}
+				return
+			}
+
+			event, stop := deepseekStreamEvent(chunk)
+			if event == (models.StreamEvent{}) {
+				continue
+			}
+			if event.Delta != "" {
+				logrus.WithField("chunk", event.Delta).Debug("Received stream chunk")
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				drainDeepSeekStream(stream)
+				events <- models.StreamEvent{Err: ctx.Err()}
+				return
+			}
+			if stop {
+				cancel()
+				drainDeepSeekStream(stream)
+				return
+			}
+		}
+	}()
+	return events
+}
+
+// drainDeepSeekStream читает поток до ошибки, которой он завершается после отмены контекста запроса.
+// Клиент передаёт фрагменты без буфера, поэтому непрочитанный поток оставил бы его горутину заблокированной.
+func drainDeepSeekStream(stream response.StreamReader) {
+	for {
+		if _, err := stream.Read(); err != nil {
+			return
+		}
+	}
+}
+
+// deepseekStreamEvent преобразует фрагмент ответа DeepSeek в событие потока.
+// Возвращает true, если фрагмент содержит ошибку и поток нужно завершить.
+func deepseekStreamEvent(chunk *response.ChatCompletionsResponse) (models.StreamEvent, bool) {
+	var event models.StreamEvent
+	if chunk == nil {
+		return event, false
+	}
+	if chunk.Usage != nil {
+		event.Usage = &models.TokenUsage{
+			PromptTokens:     chunk.Usage.PromptTokens,
+			CompletionTokens: chunk.Usage.CompletionTokens,
+			TotalTokens:      chunk.Usage.TotalTokens,
+			Model:            chunk.Model,
+		}
+	}
+	if len(chunk.Choices) == 0 {
+		return event, false
+	}
+
+	choice := chunk.Choices[0]
+	if choice.Delta != nil {
+		// Рассуждения deepseek-reasoner (ReasoningContent) пользователю не показываем, только ответ
+		event.Delta = choice.Delta.Content
+	}
+	event.FinishReason = choice.FinishReason
+	if event.FinishReason == models.FinishBlocked {
+		return models.StreamEvent{Err: fmt.Errorf("%w: finish reason %s", models.ErrContentBlocked, choice.FinishReason)}, true
+	}
+	return event, false
+}
+
+// GenerateTextMsg генерирует ответ на отдельный запрос без истории диалога
 func (d *DeepSeekAPI) GenerateTextMsg(text string) (string, error) {
+	if strings.TrimSpace(text) == "" {
+		return "", models.ErrEmptyPrompt
+	}
 	// Создаем контекст с таймаутом 15 секунд
 	ctx, cancel := context.WithTimeout(d.ctx, 15*time.Second)
 	defer cancel()
 
-	// Формируем запрос к DeepSeek API
-	chatReq := &request.ChatCompletionsRequest{
-		Model:  d.modelName, // Используем модель чата DeepSeek
-		Stream: false,       // Отключаем стриминг
-		Messages: []*request.Message{
-			{Role: "user", Content: text},
-		},
-		MaxTokens:   d.maxTokens,    // Устанавливаем максимальное количество токенов
-		Temperature: &d.temperature, // Устанавливаем температуру
-	}
-
-	// Отправляем запрос
-	resp, err := d.client.CallChatCompletionsChat(ctx, chatReq)
+	// Отправляем запрос с настройками провайдера
+	resp, err := d.call(ctx, d.chatRequest(text, nil, models.GenerationOptions{}, false))
 	if err != nil {
 		err = fmt.Errorf("failed to create request: %w", err)
 		logrus.WithError(err).Error("Error creating DeepSeek request")
@@ -74,7 +236,7 @@ func (d *DeepSeekAPI) GenerateTextMsg(text string) (string, error) {
 	}
 
 	// Проверяем наличие ответа
-	if len(resp.Choices) == 0 {
+	if len(resp.Choices) == 0 || resp.Choices[0].Message == nil {
 		return "", fmt.Errorf("no choices returned from DeepSeek API")
 	}
 
@@ -82,10 +244,20 @@ func (d *DeepSeekAPI) GenerateTextMsg(text string) (string, error) {
 	return resp.Choices[0].Message.Content, nil
 }
 
-func (d *DeepSeekAPI) ChangeGenerativeModelName(modelName string) error {
+// ListModels возвращает модели DeepSeek, с которыми работает клиент.
+func (d *DeepSeekAPI) ListModels(context.Context) ([]models.ModelInfo, error) {
+	return deepseekModels, nil
+}
+
+// ValidateModelName проверяет, что модель есть в списке моделей DeepSeek и отвечает на тестовый запрос.
+// Модель по умолчанию не меняется. Для неизвестной модели возвращает models.ErrUnknownModel.
+func (d *DeepSeekAPI) ValidateModelName(modelName string) error {
 	if modelName == "" {
 		return errors.New("model name can't be empty")
 	}
+	if !slices.ContainsFunc(deepseekModels, func(m models.ModelInfo) bool { return m.ID == modelName }) {
+		return fmt.Errorf("%w: %s", models.ErrUnknownModel, modelName)
+	}
 	ctx, cancel := context.WithTimeout(d.ctx, 15*time.Second)
 	defer cancel()
 
@@ -99,7 +271,7 @@ func (d *DeepSeekAPI) ChangeGenerativeModelName(modelName string) error {
 	}
 
 	logrus.WithField("model", modelName).Info("Checking if model is working")
-	resp, err := d.client.CallChatCompletionsChat(ctx, completionsRequest)
+	resp, err := d.call(ctx, completionsRequest)
 	if err != nil {
 		return fmt.Errorf("failed to check model %s: %w", modelName, err)
 	}
@@ -107,8 +279,6 @@ func (d *DeepSeekAPI) ChangeGenerativeModelName(modelName string) error {
 	if len(resp.Choices) == 0 {
 		return fmt.Errorf("no choices returned from model %s", modelName)
 	}
-	d.modelName = modelName
-	logrus.WithField("model", modelName).Info("Model is changed and working")
+	logrus.WithField("model", modelName).Info("Model is working")
 	return nil
-
 }
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	"github.com/go-deepseek/deepseek"
+	"github.com/go-deepseek/deepseek/client"
+	"github.com/go-deepseek/deepseek/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// redirectTransport sends every request of the DeepSeek client to the test server instead of the DeepSeek API.
+type redirectTransport struct {
+	target *url.URL
+	next   http.RoundTripper
+}
+
+func (r redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = r.target.Scheme, r.target.Host
+	return r.next.RoundTrip(req)
+}
+
+// newDeepSeekServer starts a stand-in of the DeepSeek API, every request is passed to the handler.
+func newDeepSeekServer(t *testing.T, handler http.HandlerFunc) *DeepSeekAPI {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	provider, err := NewDeepSeekAPI("test-key", deepseek.DEEPSEEK_CHAT_MODEL, 0, 0.7)
+	require.NoError(t, err)
+	target, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	provider.client.(*client.Client).Transport = redirectTransport{target: target, next: server.Client().Transport}
+	return provider
+}
+
+func TestDeepSeekMessages(t *testing.T) {
+	history := []models.Message{
+		{Role: models.RoleMemory, Content: "Знакомились."},
+		{Role: models.RoleUser, Content: "Как дела?"},
+		{Role: models.RoleAssistant, Content: " \n"},
+		{Role: models.RoleAssistant, Content: "Хорошо."},
+	}
+	messages := deepseekMessages("Привет", history, models.GenerationOptions{SystemPrompt: "Будь краток."})
+
+	assert.Equal(t, []*request.Message{
+		{Role: models.RoleSystem, Content: "Будь краток."},
+		{Role: models.RoleSystem, Content: models.MemoryPrompt("Знакомились.")},
+		{Role: models.RoleUser, Content: "Как дела?"},
+		{Role: models.RoleAssistant, Content: "Хорошо."},
+		{Role: models.RoleUser, Content: "Привет"},
+	}, messages, "blank messages are skipped, DeepSeek rejects them")
+
+	messages = deepseekMessages("Привет", nil, models.GenerationOptions{})
+	assert.Equal(t, []*request.Message{{Role: models.RoleUser, Content: "Привет"}}, messages)
+}
+
+func TestDeepSeekStream(t *testing.T) {
+	var got request.ChatCompletionsRequest
+	provider := newDeepSeekServer(t, func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		assert.Equal(t, "Bearer test-key", r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range []string{
+			`{"model":"deepseek-reasoner","choices":[{"index":0,"delta":{"reasoning_content":"Думаю"}}]}`,
+			`{"model":"deepseek-reasoner","choices":[{"index":0,"delta":{"content":"При"}}]}`,
+			`{"model":"deepseek-reasoner","choices":[{"index":0,"delta":{"content":"вет!"},"finish_reason":"stop"}]}`,
+			`{"model":"deepseek-reasoner","choices":[],"usage":{"prompt_tokens":12,"completion_tokens":3,"total_tokens":15}}`,
+			`[DONE]`,
+		} {
+			fmt.Fprintf(w, "data: %s\n\n", chunk)
+		}
+	})
+
+	temperature := float32(0.2)
+	text, events := collectStream(provider.GenerateStreamTextMsg(context.Background(), "Привет",
+		[]models.Message{{Role: models.RoleUser, Content: "Как дела?"}, {Role: models.RoleAssistant, Content: "Хорошо."}},
+		models.GenerationOptions{Model: deepseek.DEEPSEEK_REASONER_MODEL, Temperature: &temperature, MaxTokens: 100000}))
+
+	assert.Equal(t, "Привет!", text, "the reasoning is not shown to the user")
+	for _, event := range events {
+		assert.NoError(t, event.Err)
+	}
+	last := events[len(events)-1]
+	require.NotNil(t, last.Usage)
+	assert.Equal(t, 15, last.Usage.TotalTokens)
+	assert.Equal(t, deepseek.DEEPSEEK_REASONER_MODEL, last.Usage.Model)
+	assert.Equal(t, models.FinishStop, events[len(events)-2].FinishReason)
+
+	assert.Equal(t, deepseek.DEEPSEEK_REASONER_MODEL, got.Model)
+	assert.True(t, got.Stream)
+	require.NotNil(t, got.StreamOptions)
+	assert.True(t, got.StreamOptions.IncludeUsage)
+	assert.Equal(t, deepseekMaxTokens, got.MaxTokens, "the answer length is capped by the API limit")
+	require.NotNil(t, got.Temperature)
+	assert.Equal(t, float32(0.2), *got.Temperature)
+	assert.Len(t, got.Messages, 3)
+}
+
+func TestDeepSeekStreamEmptyText(t *testing.T) {
+	var calls atomic.Int32
+	provider := newDeepSeekServer(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	})
+
+	for _, text := range []string{"", " \n\t"} {
+		_, events := collectStream(provider.GenerateStreamTextMsg(context.Background(), text, nil, models.GenerationOptions{}))
+		require.Len(t, events, 1)
+		assert.True(t, errors.Is(events[0].Err, models.ErrEmptyPrompt), "got %v", events[0].Err)
+
+		_, err := provider.GenerateTextMsg(text)
+		assert.True(t, errors.Is(err, models.ErrEmptyPrompt), "got %v", err)
+	}
+	assert.Zero(t, calls.Load(), "no request is sent")
+}
+
+func TestDeepSeekStreamBlocked(t *testing.T) {
+	provider := newDeepSeekServer(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Не могу\"},\"finish_reason\":\"content_filter\"}]}\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	_, events := collectStream(provider.GenerateStreamTextMsg(context.Background(), "Привет", nil, models.GenerationOptions{}))
+	require.Len(t, events, 1)
+	assert.True(t, errors.Is(events[0].Err, models.ErrContentBlocked))
+}
+
+func TestDeepSeekStreamCanceled(t *testing.T) {
+	provider := newDeepSeekServer(t, func(w http.ResponseWriter, r *http.Request) {
+		for _, delta := range []string{"Думаю", "дальше"} {
+			fmt.Fprintf(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":%q}}]}\n\n", delta)
+			w.(http.Flusher).Flush()
+		}
+		<-r.Context().Done()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	events := provider.GenerateStreamTextMsg(ctx, "Привет", nil, models.GenerationOptions{})
+	assert.Equal(t, "Думаю", (<-events).Delta)
+	cancel()
+
+	// The client's reader is drained after the cancellation, so the stream ends instead of hanging.
+	_, rest := collectStream(events)
+	require.NotEmpty(t, rest)
+	assert.True(t, errors.Is(rest[len(rest)-1].Err, context.Canceled), "got %v", rest[len(rest)-1].Err)
+}
+
+func TestDeepSeekValidateModelName(t *testing.T) {
+	var got []string
+	provider := newDeepSeekServer(t, func(w http.ResponseWriter, r *http.Request) {
+		var req request.ChatCompletionsRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		got = append(got, req.Model)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"model":   req.Model,
+			"choices": []map[string]any{{"index": 0, "message": map[string]any{"role": "assistant", "content": "Да"}}},
+		})
+	})
+
+	assert.NoError(t, provider.ValidateModelName(deepseek.DEEPSEEK_CHAT_MODEL))
+	assert.NoError(t, provider.ValidateModelName(deepseek.DEEPSEEK_REASONER_MODEL))
+	assert.Error(t, provider.ValidateModelName(""))
+	assert.True(t, errors.Is(provider.ValidateModelName("deepseek-coder"), models.ErrUnknownModel))
+	assert.Equal(t, []string{deepseek.DEEPSEEK_CHAT_MODEL, deepseek.DEEPSEEK_REASONER_MODEL}, got,
+		"only the models of the list are checked by a request")
+
+	list, err := provider.ListModels(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, deepseekModels, list)
+}
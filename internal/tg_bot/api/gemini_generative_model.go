@@ -7,7 +7,9 @@ import (
 	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
 	"github.com/google/generative-ai-go/genai"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
+	"strings"
 	"time"
 )
 
@@ -15,6 +17,7 @@ import (
 type GeminiAPI struct {
 	client      *genai.Client          // Клиент для взаимодействия с API
 	model       *genai.GenerativeModel // Модель для генерации контента
+	modelName   string                 // Название модели по умолчанию
 	ctx         context.Context        // Контекст для управления запросами
 	apiKey      string                 // API-ключ (для справки или повторной инициализации)
 	maxTokens   int                    // Максимальное количество токенов (опционально)
@@ -23,11 +26,16 @@ type GeminiAPI struct {
 
 // NewGeminiAPI создает новый экземпляр GeminiAPI
 func NewGeminiAPI(apiKey string, modelName string, maxTokens int, temperature float32) (*GeminiAPI, error) {
+	return newGeminiAPI(apiKey, modelName, maxTokens, temperature)
+}
+
+// newGeminiAPI создает экземпляр GeminiAPI с дополнительными параметрами клиента, например другим адресом API.
+func newGeminiAPI(apiKey string, modelName string, maxTokens int, temperature float32, opts ...option.ClientOption) (*GeminiAPI, error) {
 	// Создаем контекст
 	ctx := context.Background()
 
 	// Инициализируем клиент
-	client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
+	client, err := genai.NewClient(ctx, append([]option.ClientOption{option.WithAPIKey(apiKey)}, opts...)...)
 	if err != nil {
 		return nil, err
 	}
@@ -48,6 +56,7 @@ func NewGeminiAPI(apiKey string, modelName string, maxTokens int, temperature fl
 	return &GeminiAPI{
 		client:      client,
 		model:       model,
+		modelName:   modelName,
 		ctx:         ctx,
 		apiKey:      apiKey,
 		maxTokens:   maxTokens,
@@ -55,32 +64,219 @@ func NewGeminiAPI(apiKey string, modelName string, maxTokens int, temperature fl
 	}, nil
 }
 
-func (g *GeminiAPI) GenerateStreamTextMsg(text string, history []models.Message) <-chan string {
-	_, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-	defer cancel()
-	return make(<-chan string)
+// chatModel возвращает модель для одного запроса с учётом параметров генерации.
+// Системная инструкция передаётся через SystemInstruction, общая модель по умолчанию не меняется.
+func (g *GeminiAPI) chatModel(opts models.GenerationOptions) *genai.GenerativeModel {
+	copied := *g.model
+	model := &copied
+	if opts.Model != "" {
+		model = g.client.GenerativeModel(opts.Model)
+		model.GenerationConfig = g.model.GenerationConfig
+	}
+	if opts.Temperature != nil {
+		temperature := *opts.Temperature
+		model.Temperature = &temperature
+	}
+	if opts.MaxTokens > 0 {
+		maxTokens := int32(opts.MaxTokens)
+		model.MaxOutputTokens = &maxTokens
+	}
+	if opts.SystemPrompt != "" {
+		model.SystemInstruction = genai.NewUserContent(genai.Text(opts.SystemPrompt))
+	}
+	return model
+}
+
+// geminiRole возвращает роль Gemini для роли сообщения истории.
+func geminiRole(role string) string {
+	if role == models.RoleAssistant {
+		return "model"
+	}
+	return "user"
+}
+
+// geminiHistory преобразует историю диалога в историю чата Gemini.
+// Gemini принимает в истории только роли user и model, поэтому системные сообщения и пересказ старой части
+// диалога возвращаются отдельно и передаются модели через SystemInstruction.
+func geminiHistory(history []models.Message) (contents []*genai.Content, system []string) {
+	for _, msg := range history {
+		switch msg = msg.ForModel(); msg.Role {
+		case models.RoleSystem:
+			system = append(system, msg.Content)
+		default:
+			contents = append(contents, &genai.Content{
+				Role:  geminiRole(msg.Role),
+				Parts: []genai.Part{genai.Text(msg.Content)},
+			})
+		}
+	}
+	return contents, system
+}
+
+// geminiBlockedError возвращает ошибку блокировки запроса или ответа фильтром безопасности Gemini.
+func geminiBlockedError(blocked *genai.BlockedError) error {
+	if blocked.PromptFeedback != nil {
+		return fmt.Errorf("%w: prompt %s", models.ErrContentBlocked, blocked.PromptFeedback.BlockReason)
+	}
+	if blocked.Candidate != nil {
+		return fmt.Errorf("%w: response %s", models.ErrContentBlocked, blocked.Candidate.FinishReason)
+	}
+	return fmt.Errorf("%w: %v", models.ErrContentBlocked, blocked)
+}
+
+// geminiFinishReason возвращает причину завершения ответа в общем для провайдеров виде.
+func geminiFinishReason(reason genai.FinishReason) string {
+	switch reason {
+	case genai.FinishReasonUnspecified:
+		return ""
+	case genai.FinishReasonStop:
+		return models.FinishStop
+	case genai.FinishReasonMaxTokens:
+		return models.FinishLength
+	case genai.FinishReasonSafety, genai.FinishReasonRecitation:
+		return models.FinishBlocked
+	default:
+		return strings.ToLower(strings.TrimPrefix(reason.String(), "FinishReason"))
+	}
+}
+
+// geminiStreamEvent преобразует фрагмент ответа Gemini в событие потока.
+func geminiStreamEvent(resp *genai.GenerateContentResponse) models.StreamEvent {
+	var event models.StreamEvent
+	var delta strings.Builder
+	for _, candidate := range resp.Candidates {
+		if reason := geminiFinishReason(candidate.FinishReason); reason != "" {
+			event.FinishReason = reason
+		}
+		if candidate.Content == nil {
+			continue
+		}
+		for _, part := range candidate.Content.Parts {
+			if chunk, ok := part.(genai.Text); ok {
+				delta.WriteString(string(chunk))
+			}
+		}
+	}
+	event.Delta = delta.String()
+	if resp.UsageMetadata != nil {
+		event.Usage = &models.TokenUsage{
+			PromptTokens:     int(resp.UsageMetadata.PromptTokenCount),
+			CompletionTokens: int(resp.UsageMetadata.CandidatesTokenCount),
+			TotalTokens:      int(resp.UsageMetadata.TotalTokenCount),
+		}
+	}
+	return event
+}
+
+// GenerateStreamTextMsg генерирует ответ в потоковом режиме с учётом истории диалога и параметров генерации.
+//
+// Запрос выполняется через чат-сессию Gemini, фрагменты ответа передаются в канал событий по мере получения,
+// вместе с причиной завершения и расходом токенов. Генерация прерывается по таймауту в 1 минуту или при отмене ctx.
+// Ошибка, в том числе блокировка фильтром безопасности (models.ErrContentBlocked), передаётся последним событием.
+// Канал закрывается по окончании ответа.
+func (g *GeminiAPI) GenerateStreamTextMsg(ctx context.Context, text string, history []models.Message, opts models.GenerationOptions) <-chan models.StreamEvent {
+	contents, system := geminiHistory(history)
+	if opts.SystemPrompt != "" {
+		system = append([]string{opts.SystemPrompt}, system...)
+	}
+	opts.SystemPrompt = strings.Join(system, "\n\n")
+
+	chat := g.chatModel(opts).StartChat()
+	chat.History = contents
+	modelName := g.modelName
+	if opts.Model != "" {
+		modelName = opts.Model
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Minute)
+	events := make(chan models.StreamEvent)
+
+	go func() {
+		defer cancel()
+		defer close(events)
+
+		iter := chat.SendMessageStream(ctx, genai.Text(text))
+		finished := false
+		for {
+			resp, err := iter.Next()
+			if errors.Is(err, iterator.Done) {
+				logrus.Info("Streaming completed")
+				return
+			}
+			if err != nil {
+				var blocked *genai.BlockedError
+				switch {
+				case errors.As(err, &blocked):
+					logrus.WithError(err).Warn("Gemini response blocked by safety filters")
+					err = geminiBlockedError(blocked)
+				case ctx.Err() != nil:
+					logrus.WithError(ctx.Err()).Error("Streaming stopped due to context completion")
+					err = ctx.Err()
+				case finished:
+					// Ответ уже получен полностью, ошибка чтения конца потока (закрывающей скобки массива) на него не влияет
+					logrus.WithError(err).Warn("Error after the final Gemini stream chunk")
+					return
+				default:
+					logrus.WithError(err).Error("Error during streaming from Gemini")
+					err = fmt.Errorf("gemini stream: %w", err)
+				}
+				events <- models.StreamEvent{Err: err}
+				return
+			}
+
+			event := geminiStreamEvent(resp)
+			finished = event.FinishReason != ""
+			if event.Usage != nil {
+				event.Usage.Model = modelName
+			}
+			if event.Delta != "" {
+				logrus.WithField("chunk", event.Delta).Debug("Received stream chunk")
+			}
+			events <- event
+		}
+	}()
+	return events
 }
 
 func (g *GeminiAPI) GenerateTextMsg(text string) (string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer cancel()
 
-	resp, err := g.model.GenerateContent(ctx, genai.Text(text))
+	resp, err := g.chatModel(models.GenerationOptions{}).GenerateContent(ctx, genai.Text(text))
 	if err != nil {
+		var blocked *genai.BlockedError
+		if errors.As(err, &blocked) {
+			logrus.WithError(err).Warn("Gemini response blocked by safety filters")
+			return "", geminiBlockedError(blocked)
+		}
 		err = fmt.Errorf("failed to create request: %w", err)
 		logrus.WithError(err).Error("Error creating Gemini request")
 		return "", err
 	}
-	if respText, ok := resp.Candidates[0].Content.Parts[0].(genai.Text); ok {
-		return string(respText), nil
+
+	// Ответ без кандидатов или без текста приходит, например, когда его остановил фильтр безопасности
+	event := geminiStreamEvent(resp)
+	if event.Delta == "" {
+		if event.FinishReason == models.FinishBlocked {
+			return "", fmt.Errorf("%w: empty response", models.ErrContentBlocked)
+		}
+		return "", errors.New("gemini returned an empty response")
 	}
-	return "", err
+	return event.Delta, nil
 }
 
-func (g *GeminiAPI) ChangeGenerativeModelName(modelName string) error {
+// ValidateModelName проверяет, что модель существует и доступна по API-ключу. Модель по умолчанию не меняется.
+func (g *GeminiAPI) ValidateModelName(modelName string) error {
 	if modelName == "" {
 		return errors.New("model name can't be empty")
 	}
-	g.model = g.client.GenerativeModel(modelName)
+	ctx, cancel := context.WithTimeout(g.ctx, 15*time.Second)
+	defer cancel()
+
+	logrus.WithField("model", modelName).Info("Checking if model is working")
+	if _, err := g.client.GenerativeModel(modelName).Info(ctx); err != nil {
+		return fmt.Errorf("failed to check model %s: %w", modelName, err)
+	}
+	logrus.WithField("model", modelName).Info("Model is working")
 	return nil
 }
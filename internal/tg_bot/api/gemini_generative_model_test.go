@@ -0,0 +1,204 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+)
+
+// geminiRequest is the part of a Gemini generateContent request checked by the tests.
+type geminiRequest struct {
+	Model    string `json:"model"`
+	Contents []struct {
+		Role  string `json:"role"`
+		Parts []struct {
+			Text string `json:"text"`
+		} `json:"parts"`
+	} `json:"contents"`
+	SystemInstruction *struct {
+		Parts []struct {
+			Text string `json:"text"`
+		} `json:"parts"`
+	} `json:"systemInstruction"`
+	GenerationConfig struct {
+		MaxOutputTokens int     `json:"maxOutputTokens"`
+		Temperature     float32 `json:"temperature"`
+	} `json:"generationConfig"`
+}
+
+// newGeminiServer starts a stand-in of the Gemini REST API, every request is passed to the handler.
+func newGeminiServer(t *testing.T, handler http.HandlerFunc) *GeminiAPI {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	provider, err := newGeminiAPI("test-key", "gemini-2.0-flash", 0, 0.7,
+		option.WithEndpoint(server.URL), option.WithHTTPClient(server.Client()))
+	require.NoError(t, err)
+	return provider
+}
+
+// writeGeminiStream answers with a streamGenerateContent response: a JSON array of response chunks.
+func writeGeminiStream(w http.ResponseWriter, chunks ...string) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, "[")
+	for i, chunk := range chunks {
+		if i > 0 {
+			fmt.Fprint(w, ",")
+		}
+		fmt.Fprint(w, chunk)
+	}
+	fmt.Fprint(w, "]")
+}
+
+func TestGeminiStream(t *testing.T) {
+	var got geminiRequest
+	var path string
+	provider := newGeminiServer(t, func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		writeGeminiStream(w,
+			`{"candidates":[{"content":{"role":"model","parts":[{"text":"При"}]}}]}`,
+			`{"candidates":[{"content":{"role":"model","parts":[{"text":"вет!"}]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":12,"candidatesTokenCount":3,"totalTokenCount":15}}`,
+		)
+	})
+
+	history := []models.Message{
+		{Role: models.RoleSystem, Content: "Отвечай по-русски."},
+		{Role: models.RoleMemory, Content: "Знакомились."},
+		{Role: models.RoleUser, Content: "Как дела?"},
+		{Role: models.RoleAssistant, Content: "Хорошо."},
+	}
+	temperature := float32(0.2)
+	text, events := collectStream(provider.GenerateStreamTextMsg(context.Background(), "Привет", history,
+		models.GenerationOptions{Model: "gemini-2.5-pro", Temperature: &temperature, MaxTokens: 256, SystemPrompt: "Будь краток."}))
+
+	assert.Equal(t, "Привет!", text)
+	for _, event := range events {
+		assert.NoError(t, event.Err)
+	}
+	last := events[len(events)-1]
+	assert.Equal(t, models.FinishStop, last.FinishReason)
+	require.NotNil(t, last.Usage)
+	assert.Equal(t, 15, last.Usage.TotalTokens)
+	assert.Equal(t, "gemini-2.5-pro", last.Usage.Model)
+
+	assert.Equal(t, "/v1beta/models/gemini-2.5-pro:streamGenerateContent", path)
+	assert.Equal(t, 256, got.GenerationConfig.MaxOutputTokens)
+	assert.Equal(t, float32(0.2), got.GenerationConfig.Temperature)
+
+	// Gemini accepts only the user and model roles in the history, the system and memory messages
+	// go to the system instruction after the prompt of the request.
+	require.NotNil(t, got.SystemInstruction)
+	require.Len(t, got.SystemInstruction.Parts, 1)
+	assert.Equal(t, "Будь краток.\n\nОтвечай по-русски.\n\n"+models.MemoryPrompt("Знакомились."), got.SystemInstruction.Parts[0].Text)
+
+	var roles, texts []string
+	for _, content := range got.Contents {
+		roles = append(roles, content.Role)
+		require.Len(t, content.Parts, 1)
+		texts = append(texts, content.Parts[0].Text)
+	}
+	assert.Equal(t, []string{"user", "model", "user"}, roles)
+	assert.Equal(t, []string{"Как дела?", "Хорошо.", "Привет"}, texts)
+}
+
+func TestGeminiStreamWithoutSystemInstruction(t *testing.T) {
+	var got geminiRequest
+	provider := newGeminiServer(t, func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		writeGeminiStream(w, `{"candidates":[{"content":{"role":"model","parts":[{"text":"Да"}]},"finishReason":"STOP"}]}`)
+	})
+
+	text, _ := collectStream(provider.GenerateStreamTextMsg(context.Background(), "Привет",
+		[]models.Message{{Role: models.RoleUser, Content: "Ты здесь?"}}, models.GenerationOptions{}))
+	assert.Equal(t, "Да", text)
+	assert.Nil(t, got.SystemInstruction, "no system instruction is sent without system messages")
+	assert.Len(t, got.Contents, 2)
+}
+
+func TestGeminiStreamBlocked(t *testing.T) {
+	tests := []struct {
+		name  string
+		chunk string
+	}{
+		{"prompt", `{"promptFeedback":{"blockReason":"SAFETY"}}`},
+		{"response", `{"candidates":[{"content":{"role":"model","parts":[{"text":"Не могу"}]},"finishReason":"SAFETY"}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := newGeminiServer(t, func(w http.ResponseWriter, r *http.Request) {
+				writeGeminiStream(w, tt.chunk)
+			})
+			_, events := collectStream(provider.GenerateStreamTextMsg(context.Background(), "Привет", nil, models.GenerationOptions{}))
+			require.Len(t, events, 1)
+			assert.True(t, errors.Is(events[0].Err, models.ErrContentBlocked), "got %v", events[0].Err)
+		})
+	}
+}
+
+func TestGeminiStreamTruncated(t *testing.T) {
+	provider := newGeminiServer(t, func(w http.ResponseWriter, r *http.Request) {
+		// The connection is closed before the chunk with the finish reason.
+		fmt.Fprint(w, `[{"candidates":[{"content":{"role":"model","parts":[{"text":"Думаю"}]}}]}`)
+	})
+	text, events := collectStream(provider.GenerateStreamTextMsg(context.Background(), "Привет", nil, models.GenerationOptions{}))
+	assert.Equal(t, "Думаю", text)
+	assert.Error(t, events[len(events)-1].Err, "an unfinished answer is reported")
+}
+
+func TestGeminiStreamCanceled(t *testing.T) {
+	provider := newGeminiServer(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"candidates":[{"content":{"role":"model","parts":[{"text":"Думаю"}]}}]}`)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	events := provider.GenerateStreamTextMsg(ctx, "Привет", nil, models.GenerationOptions{})
+	assert.Equal(t, "Думаю", (<-events).Delta)
+	cancel()
+
+	_, rest := collectStream(events)
+	require.Len(t, rest, 1)
+	assert.True(t, errors.Is(rest[0].Err, context.Canceled), "got %v", rest[0].Err)
+}
+
+func TestGeminiGenerateTextMsg(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    string
+		blocked bool
+		wantErr bool
+	}{
+		{"text", `{"candidates":[{"content":{"role":"model","parts":[{"text":"Привет!"}]},"finishReason":"STOP"}]}`, "Привет!", false, false},
+		{"no candidates", `{}`, "", false, true},
+		{"no parts", `{"candidates":[{"finishReason":"STOP"}]}`, "", false, true},
+		{"blocked", `{"promptFeedback":{"blockReason":"SAFETY"}}`, "", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := newGeminiServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, tt.body)
+			})
+			text, err := provider.GenerateTextMsg("Привет")
+			assert.Equal(t, tt.want, text)
+			if !tt.wantErr {
+				assert.NoError(t, err)
+				return
+			}
+			assert.Error(t, err)
+			assert.Equal(t, tt.blocked, errors.Is(err, models.ErrContentBlocked))
+		})
+	}
+}
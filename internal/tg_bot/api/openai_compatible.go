@@ -0,0 +1,413 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	"github.com/sirupsen/logrus"
+)
+
+// Limits of the requests to an OpenAI-compatible server. Local models answer slower than hosted ones.
+const (
+	openAIStreamTimeout  = 5 * time.Minute // Longest streaming of one answer
+	openAIRequestTimeout = 2 * time.Minute // Timeout of a non-streaming request
+	openAIListTimeout    = 15 * time.Second
+	maxSSELineSize       = 1 << 20 // Longest line of the event stream
+	maxErrorBodySize     = 4 << 10 // Part of an error response kept in the error message
+)
+
+// openAIMessage is a message of the chat completions request.
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// openAIChatRequest is the body of the chat completions request.
+type openAIChatRequest struct {
+	Model         string               `json:"model"`
+	Messages      []openAIMessage      `json:"messages"`
+	Stream        bool                 `json:"stream"`
+	StreamOptions *openAIStreamOptions `json:"stream_options,omitempty"`
+	MaxTokens     int                  `json:"max_tokens,omitempty"`
+	Temperature   *float32             `json:"temperature,omitempty"`
+}
+
+// openAIStreamOptions asks the server to send the token usage with the last chunk of the stream.
+type openAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// openAIChatResponse is the chat completions response or one chunk of the streamed response.
+type openAIChatResponse struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Message      *openAIMessage `json:"message"`
+		Delta        *openAIMessage `json:"delta"`
+		FinishReason string         `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+		TotalTokens      int `json:"total_tokens"`
+	} `json:"usage"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// openAIModelsResponse is the response of the models endpoint.
+// Servers report the context window in different fields, vLLM in max_model_len and LM Studio in context_length.
+type openAIModelsResponse struct {
+	Data []struct {
+		ID            string `json:"id"`
+		MaxModelLen   int    `json:"max_model_len"`
+		ContextLength int    `json:"context_length"`
+	} `json:"data"`
+}
+
+// OpenAICompatibleAPI talks to any server with the OpenAI chat completions API, like llama.cpp server, Ollama,
+// vLLM or LM Studio.
+//
+// Answers are streamed as server-sent events. The configured model, maximum tokens and temperature are defaults,
+// every streaming request may override them with per-user generation options. The API key is optional,
+// local servers usually do not check it.
+type OpenAICompatibleAPI struct {
+	name        string          // Name of the provider in the errors and the logs
+	client      *http.Client    // HTTP client without a timeout, requests are limited by their contexts
+	ctx         context.Context // Context of the requests made outside of a user's request
+	baseURL     string          // Base URL of the API, like http://192.168.1.10:11434/v1
+	apiKey      string          // API key sent as a bearer token, empty for servers without authentication
+	modelName   string          // Model used when the user did not choose one
+	maxTokens   int             // Maximum number of tokens of an answer, 0 for the server's default
+	temperature float32         // Temperature of the answers
+}
+
+// NewOpenAICompatibleAPI creates a new instance of OpenAICompatibleAPI.
+//
+// Parameters:
+//   - baseURL: The base URL of the API, the endpoints /chat/completions and /models are appended to it.
+//   - apiKey: The API key, may be empty.
+//   - modelName: The model the server answers with by default.
+//   - maxTokens: The maximum number of tokens of an answer, 0 for the server's default.
+//   - temperature: The temperature of the answers.
+//
+// Returns:
+//   - *OpenAICompatibleAPI: A pointer to the initialized OpenAICompatibleAPI instance.
+//   - error: An error if the base URL is not a valid http(s) URL; nil otherwise.
+func NewOpenAICompatibleAPI(baseURL, apiKey, modelName string, maxTokens int, temperature float32) (*OpenAICompatibleAPI, error) {
+	parsed, err := url.Parse(baseURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid base URL %q of the OpenAI-compatible server", baseURL)
+	}
+	return &OpenAICompatibleAPI{
+		name:        "openai-compatible",
+		client:      &http.Client{},
+		ctx:         context.Background(),
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+		apiKey:      apiKey,
+		modelName:   modelName,
+		maxTokens:   maxTokens,
+		temperature: temperature,
+	}, nil
+}
+
+// chatMessages builds the messages of a chat completions request: the system prompt first, then the history
+// and the user's text.
+// The providers with the chat completions API convert the result into the messages of their clients.
+func chatMessages(text string, history []models.Message, opts models.GenerationOptions) []models.Message {
+	messages := make([]models.Message, 0, len(history)+2)
+	if opts.SystemPrompt != "" {
+		messages = append(messages, models.Message{Role: models.RoleSystem, Content: opts.SystemPrompt})
+	}
+	for _, msg := range history {
+		messages = append(messages, msg.ForModel())
+	}
+	return append(messages, models.Message{Role: models.RoleUser, Content: text})
+}
+
+// openAIMessages converts the messages built by chatMessages into the messages of the request.
+func openAIMessages(text string, history []models.Message, opts models.GenerationOptions) []openAIMessage {
+	messages := chatMessages(text, history, opts)
+	converted := make([]openAIMessage, 0, len(messages))
+	for _, msg := range messages {
+		converted = append(converted, openAIMessage{Role: msg.Role, Content: msg.Content})
+	}
+	return converted
+}
+
+// chatRequest builds the chat completions request; zero generation options fall back to the configured defaults.
+func (o *OpenAICompatibleAPI) chatRequest(text string, history []models.Message, opts models.GenerationOptions, stream bool) openAIChatRequest {
+	temperature := o.temperature
+	if opts.Temperature != nil {
+		temperature = *opts.Temperature
+	}
+	chatReq := openAIChatRequest{
+		Model:       o.modelName,
+		Messages:    openAIMessages(text, history, opts),
+		Stream:      stream,
+		MaxTokens:   o.maxTokens,
+		Temperature: &temperature,
+	}
+	if opts.Model != "" {
+		chatReq.Model = opts.Model
+	}
+	if opts.MaxTokens > 0 {
+		chatReq.MaxTokens = opts.MaxTokens
+	}
+	if stream {
+		chatReq.StreamOptions = &openAIStreamOptions{IncludeUsage: true}
+	}
+	return chatReq
+}
+
+// do sends the request to the endpoint and returns the body of a successful response.
+// The caller must close the body.
+func (o *OpenAICompatibleAPI) do(ctx context.Context, method, endpoint string, payload any) (io.ReadCloser, error) {
+	var body io.Reader
+	if payload != nil {
+		encoded, err := json.Marshal(payload)
+		if err != nil {
+			return nil, fmt.Errorf("encode request: %w", err)
+		}
+		body = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, o.baseURL+endpoint, body)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if o.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+o.apiKey)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("send request: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+		return nil, fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return resp.Body, nil
+}
+
+// GenerateStreamTextMsg generates a streaming text response based on the user's input and dialog history.
+//
+// The answer is read from the server-sent events of the chat completions endpoint. The streaming is limited
+// by openAIStreamTimeout; if the time is up or ctx is canceled, the streaming is stopped and the error is sent
+// as the last event.
+//
+// Parameters:
+//   - ctx: The context of the request; canceling it stops the streaming.
+//   - text: The user's input text to generate a response for.
+//   - history: The dialog history to provide context.
+//   - opts: Per-call generation options; zero values fall back to the configured defaults.
+//
+// Returns:
+//   - <-chan models.StreamEvent: A channel of stream events, closed when the streaming is complete or an error occurs.
+func (o *OpenAICompatibleAPI) GenerateStreamTextMsg(ctx context.Context, text string, history []models.Message, opts models.GenerationOptions) <-chan models.StreamEvent {
+	events := make(chan models.StreamEvent)
+
+	go func() {
+		defer close(events)
+		ctx, cancel := context.WithTimeout(ctx, openAIStreamTimeout)
+		defer cancel()
+
+		chatReq := o.chatRequest(text, history, opts, true)
+		body, err := o.do(ctx, http.MethodPost, "/chat/completions", chatReq)
+		if err != nil {
+			logrus.WithError(err).WithField("provider", o.name).Error("Error creating OpenAI-compatible stream")
+			events <- models.StreamEvent{Err: fmt.Errorf("%s stream: %w", o.name, err)}
+			return
+		}
+		defer body.Close()
+
+		err = readSSE(body, func(data string) (bool, error) {
+			event, err := openAIStreamEvent(data)
+			if err != nil || event == (models.StreamEvent{}) {
+				return false, err
+			}
+			if event.Usage != nil && event.Usage.Model == "" {
+				event.Usage.Model = chatReq.Model
+			}
+			if event.Delta != "" {
+				logrus.WithField("chunk", event.Delta).Debug("Received stream chunk")
+			}
+			select {
+			case events <- event:
+				return false, nil
+			case <-ctx.Done():
+				return true, ctx.Err()
+			}
+		})
+		if err != nil {
+			err = streamCause(ctx, err)
+			logrus.WithError(err).WithField("provider", o.name).Error("Error during streaming from the OpenAI-compatible server")
+			events <- models.StreamEvent{Err: fmt.Errorf("%s stream: %w", o.name, err)}
+			return
+		}
+		logrus.Info("Streaming completed")
+	}()
+	return events
+}
+
+// streamCause returns the error that ended the reading of a stream.
+// A read error after the context is canceled is caused by the cancellation, so the cancellation is returned instead.
+func streamCause(ctx context.Context, err error) error {
+	if ctx.Err() != nil && !errors.Is(err, models.ErrContentBlocked) {
+		return ctx.Err()
+	}
+	return err
+}
+
+// readSSE reads the data of the server-sent events until the stream ends with [DONE] or handle stops it.
+// Comments, empty lines and the other event fields are skipped.
+func readSSE(stream io.Reader, handle func(data string) (stop bool, err error)) error {
+	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxSSELineSize)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			return nil
+		}
+		if stop, err := handle(data); stop || err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// openAIStreamEvent converts the data of one server-sent event into a stream event.
+// Returns an error if the server reported one or blocked the answer.
+func openAIStreamEvent(data string) (models.StreamEvent, error) {
+	var chunk openAIChatResponse
+	if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+		return models.StreamEvent{}, fmt.Errorf("decode stream chunk: %w", err)
+	}
+	if chunk.Error != nil {
+		return models.StreamEvent{}, fmt.Errorf("server error: %s", chunk.Error.Message)
+	}
+
+	var event models.StreamEvent
+	if chunk.Usage != nil {
+		event.Usage = &models.TokenUsage{
+			PromptTokens:     chunk.Usage.PromptTokens,
+			CompletionTokens: chunk.Usage.CompletionTokens,
+			TotalTokens:      chunk.Usage.TotalTokens,
+			Model:            chunk.Model,
+		}
+	}
+	if len(chunk.Choices) == 0 {
+		return event, nil
+	}
+	choice := chunk.Choices[0]
+	if choice.Delta != nil {
+		event.Delta = choice.Delta.Content
+	}
+	event.FinishReason = choice.FinishReason
+	if event.FinishReason == models.FinishBlocked {
+		return models.StreamEvent{}, fmt.Errorf("%w: finish reason %s", models.ErrContentBlocked, choice.FinishReason)
+	}
+	return event, nil
+}
+
+// GenerateTextMsg generates a non-streaming text response to a single message without dialog history.
+//
+// Parameters:
+//   - text: The user's input text to generate a response for.
+//
+// Returns:
+//   - string: The generated text response.
+//   - error: An error if the request fails or the server returns no answer; nil otherwise.
+func (o *OpenAICompatibleAPI) GenerateTextMsg(text string) (string, error) {
+	ctx, cancel := context.WithTimeout(o.ctx, openAIRequestTimeout)
+	defer cancel()
+
+	body, err := o.do(ctx, http.MethodPost, "/chat/completions", o.chatRequest(text, nil, models.GenerationOptions{}, false))
+	if err != nil {
+		logrus.WithError(err).Errorf("Error creating %s request", o.modelName)
+		return "", fmt.Errorf("openai-compatible request: %w", err)
+	}
+	defer body.Close()
+
+	var resp openAIChatResponse
+	if err = json.NewDecoder(body).Decode(&resp); err != nil {
+		return "", fmt.Errorf("decode openai-compatible response: %w", err)
+	}
+	if len(resp.Choices) == 0 || resp.Choices[0].Message == nil {
+		return "", errors.New("no choices returned from the OpenAI-compatible server")
+	}
+	return resp.Choices[0].Message.Content, nil
+}
+
+// ListModels returns the models served by the server.
+//
+// Parameters:
+//   - ctx: The context of the request.
+//
+// Returns:
+//   - []models.ModelInfo: The models in the order the server lists them.
+//   - error: An error if the models endpoint is unavailable; nil otherwise.
+func (o *OpenAICompatibleAPI) ListModels(ctx context.Context) ([]models.ModelInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, openAIListTimeout)
+	defer cancel()
+
+	body, err := o.do(ctx, http.MethodGet, "/models", nil)
+	if err != nil {
+		return nil, fmt.Errorf("list openai-compatible models: %w", err)
+	}
+	defer body.Close()
+
+	var resp openAIModelsResponse
+	if err = json.NewDecoder(body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("decode openai-compatible models: %w", err)
+	}
+	list := make([]models.ModelInfo, 0, len(resp.Data))
+	for _, m := range resp.Data {
+		list = append(list, models.ModelInfo{ID: m.ID, ContextLength: max(m.MaxModelLen, m.ContextLength)})
+	}
+	return list, nil
+}
+
+// ValidateModelName checks that the server serves the model.
+//
+// The model is looked up in the server's model list; a test request is not sent, because a local server
+// may spend minutes loading a model.
+//
+// Parameters:
+//   - modelName: The name of the model to check.
+//
+// Returns:
+//   - error: models.ErrUnknownModel if the server does not serve the model, another error if the list is unavailable.
+func (o *OpenAICompatibleAPI) ValidateModelName(modelName string) error {
+	if modelName == "" {
+		return errors.New("model name can't be empty")
+	}
+	list, err := o.ListModels(o.ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range list {
+		if m.ID == modelName {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", models.ErrUnknownModel, modelName)
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newLocalServer starts a stand-in of a local OpenAI-compatible server.
+// Chat requests are passed to the chat handler, the models endpoint lists the models.
+func newLocalServer(t *testing.T, chat http.HandlerFunc, modelIDs ...string) *OpenAICompatibleAPI {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/chat/completions", chat)
+	mux.HandleFunc("GET /v1/models", func(w http.ResponseWriter, r *http.Request) {
+		var data []map[string]any
+		for _, id := range modelIDs {
+			data = append(data, map[string]any{"id": id, "object": "model", "max_model_len": 32768})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"object": "list", "data": data})
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	provider, err := NewOpenAICompatibleAPI(server.URL+"/v1/", "", "llama3", 0, 0.7)
+	require.NoError(t, err)
+	return provider
+}
+
+func collectStream(events <-chan models.StreamEvent) (string, []models.StreamEvent) {
+	var text strings.Builder
+	var all []models.StreamEvent
+	for event := range events {
+		text.WriteString(event.Delta)
+		all = append(all, event)
+	}
+	return text.String(), all
+}
+
+func TestOpenAICompatibleStream(t *testing.T) {
+	var got openAIChatRequest
+	provider := newLocalServer(t, func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		assert.Empty(t, r.Header.Get("Authorization"), "no API key is sent when it is not configured")
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range []string{
+			`{"choices":[{"delta":{"role":"assistant","content":"При"}}]}`,
+			`: keep-alive`,
+			`{"choices":[{"delta":{"content":"вет!"}}]}`,
+			`{"choices":[{"delta":{},"finish_reason":"stop"}]}`,
+			`{"choices":[],"usage":{"prompt_tokens":12,"completion_tokens":3,"total_tokens":15}}`,
+			`[DONE]`,
+		} {
+			if strings.HasPrefix(chunk, ":") {
+				fmt.Fprintf(w, "%s\n\n", chunk)
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", chunk)
+		}
+	})
+
+	history := []models.Message{
+		{Role: models.RoleMemory, Content: "Знакомились."},
+		{Role: models.RoleUser, Content: "Как дела?"},
+		{Role: models.RoleAssistant, Content: "Хорошо."},
+	}
+	temperature := float32(0.2)
+	text, events := collectStream(provider.GenerateStreamTextMsg(context.Background(), "Привет", history,
+		models.GenerationOptions{Model: "qwen2.5", Temperature: &temperature, MaxTokens: 256, SystemPrompt: "Будь краток."}))
+
+	assert.Equal(t, "Привет!", text)
+	last := events[len(events)-1]
+	require.NotNil(t, last.Usage)
+	assert.Equal(t, 15, last.Usage.TotalTokens)
+	assert.Equal(t, "qwen2.5", last.Usage.Model, "the requested model is reported when the server names none")
+	assert.Equal(t, models.FinishStop, events[len(events)-2].FinishReason)
+	for _, event := range events {
+		assert.NoError(t, event.Err)
+	}
+
+	assert.Equal(t, "qwen2.5", got.Model)
+	assert.True(t, got.Stream)
+	assert.Equal(t, 256, got.MaxTokens)
+	require.NotNil(t, got.Temperature)
+	assert.Equal(t, float32(0.2), *got.Temperature)
+	assert.Equal(t, []openAIMessage{
+		{Role: models.RoleSystem, Content: "Будь краток."},
+		{Role: models.RoleSystem, Content: models.MemoryPrompt("Знакомились.")},
+		{Role: models.RoleUser, Content: "Как дела?"},
+		{Role: models.RoleAssistant, Content: "Хорошо."},
+		{Role: models.RoleUser, Content: "Привет"},
+	}, got.Messages)
+}
+
+func TestOpenAICompatibleStreamErrors(t *testing.T) {
+	provider := newLocalServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":{"message":"model not loaded"}}`, http.StatusNotFound)
+	})
+	_, events := collectStream(provider.GenerateStreamTextMsg(context.Background(), "Привет", nil, models.GenerationOptions{}))
+	require.Len(t, events, 1)
+	assert.ErrorContains(t, events[0].Err, "model not loaded")
+
+	provider = newLocalServer(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Не могу\"},\"finish_reason\":\"content_filter\"}]}\n\n")
+	})
+	_, events = collectStream(provider.GenerateStreamTextMsg(context.Background(), "Привет", nil, models.GenerationOptions{}))
+	require.Len(t, events, 1)
+	assert.True(t, errors.Is(events[0].Err, models.ErrContentBlocked))
+}
+
+func TestOpenAICompatibleStreamCanceled(t *testing.T) {
+	provider := newLocalServer(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Думаю\"}}]}\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	events := provider.GenerateStreamTextMsg(ctx, "Привет", nil, models.GenerationOptions{})
+	assert.Equal(t, "Думаю", (<-events).Delta)
+	cancel()
+
+	_, rest := collectStream(events)
+	require.Len(t, rest, 1)
+	assert.True(t, errors.Is(rest[0].Err, context.Canceled))
+}
+
+func TestOpenAICompatibleModels(t *testing.T) {
+	provider := newLocalServer(t, http.NotFound, "llama3", "qwen2.5")
+
+	list, err := provider.ListModels(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []models.ModelInfo{{ID: "llama3", ContextLength: 32768}, {ID: "qwen2.5", ContextLength: 32768}}, list)
+
+	assert.NoError(t, provider.ValidateModelName("qwen2.5"))
+	assert.True(t, errors.Is(provider.ValidateModelName("gpt-4o"), models.ErrUnknownModel))
+}
+
+func TestNewOpenAICompatibleAPIBaseURL(t *testing.T) {
+	_, err := NewOpenAICompatibleAPI("", "", "llama3", 0, 0.7)
+	assert.Error(t, err)
+	_, err = NewOpenAICompatibleAPI("localhost:11434", "", "llama3", 0, 0.7)
+	assert.Error(t, err)
+}
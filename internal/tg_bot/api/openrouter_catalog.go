@@ -0,0 +1,140 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	"github.com/sirupsen/logrus"
+)
+
+// Settings of the OpenRouter model catalogue.
+const (
+	openRouterAPIURL = "https://openrouter.ai/api/v1" // Base URL of the OpenRouter API
+	catalogTTL       = 1 * time.Hour                  // How long the fetched catalogue is used before it is fetched again
+	catalogTimeout   = 15 * time.Second               // Timeout of the catalogue request
+)
+
+// openRouterModelsResponse is the response of the OpenRouter models endpoint.
+type openRouterModelsResponse struct {
+	Data []struct {
+		ID            string `json:"id"`
+		Name          string `json:"name"`
+		ContextLength int    `json:"context_length"`
+		Pricing       struct {
+			Prompt     string `json:"prompt"`
+			Completion string `json:"completion"`
+		} `json:"pricing"`
+	} `json:"data"`
+}
+
+// modelCatalog caches the list of the OpenRouter models.
+type modelCatalog struct {
+	url       string
+	client    *http.Client
+	mu        sync.Mutex // Protects the fields below
+	models    []models.ModelInfo
+	fetchedAt time.Time
+}
+
+// newModelCatalog creates the catalogue of the models listed at the URL.
+func newModelCatalog(url string) *modelCatalog {
+	return &modelCatalog{url: url, client: &http.Client{Timeout: catalogTimeout}}
+}
+
+// list returns the cached catalogue, fetching it again when it is older than catalogTTL.
+// If the fetch fails, the outdated catalogue is returned while there is one.
+func (c *modelCatalog) list(ctx context.Context) ([]models.ModelInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.models != nil && time.Since(c.fetchedAt) < catalogTTL {
+		return c.models, nil
+	}
+	fetched, err := c.fetch(ctx)
+	if err != nil {
+		if c.models != nil {
+			logrus.WithError(err).Warn("Failed to refresh the OpenRouter model catalogue, the cached one is used")
+			return c.models, nil
+		}
+		return nil, err
+	}
+	c.models, c.fetchedAt = fetched, time.Now()
+	logrus.WithField("models", len(fetched)).Info("OpenRouter model catalogue fetched")
+	return c.models, nil
+}
+
+// fetch requests the list of the models from OpenRouter.
+func (c *modelCatalog) fetch(ctx context.Context) ([]models.ModelInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create model catalogue request: %w", err)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch model catalogue: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch model catalogue: unexpected status %s", resp.Status)
+	}
+
+	var body openRouterModelsResponse
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decode model catalogue: %w", err)
+	}
+	list := make([]models.ModelInfo, 0, len(body.Data))
+	for _, m := range body.Data {
+		if m.ID == "" {
+			continue
+		}
+		list = append(list, models.ModelInfo{
+			ID:              m.ID,
+			Name:            m.Name,
+			ContextLength:   m.ContextLength,
+			Free:            strings.HasSuffix(m.ID, ":free") || isZeroPrice(m.Pricing.Prompt) && isZeroPrice(m.Pricing.Completion),
+			PromptPrice:     parsePrice(m.Pricing.Prompt),
+			CompletionPrice: parsePrice(m.Pricing.Completion),
+		})
+	}
+	return list, nil
+}
+
+// isZeroPrice reports whether the OpenRouter price, a decimal string in dollars per token, is zero.
+func isZeroPrice(price string) bool {
+	value, err := strconv.ParseFloat(price, 64)
+	return err == nil && value == 0
+}
+
+// parsePrice returns the OpenRouter price in dollars per token, 0 if the price is missing or malformed.
+// Negative prices mark the models whose price is set by the router at run time, they are unknown as well.
+func parsePrice(price string) float64 {
+	value, err := strconv.ParseFloat(price, 64)
+	if err != nil || value < 0 {
+		return 0
+	}
+	return value
+}
+
+// cached returns the model with the ID from the already fetched catalogue without fetching it.
+func (c *modelCatalog) cached(id string) (models.ModelInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return findModel(c.models, id)
+}
+
+// findModel returns the model with the ID from the catalogue.
+func findModel(list []models.ModelInfo, id string) (models.ModelInfo, bool) {
+	for _, m := range list {
+		if m.ID == id {
+			return m, true
+		}
+	}
+	return models.ModelInfo{}, false
+}
@@ -10,18 +10,23 @@ import (
 	"time"
 )
 
+// openRouterStreamTimeout is the longest streaming of one OpenRouter answer.
+const openRouterStreamTimeout = 1 * time.Minute
+
 // OpenRouterAPI provides an interface for interacting with the OpenRouter API to generate text responses.
 //
 // It manages the configuration for API requests, including the API key, model name, maximum tokens, and
-// temperature for controlling creativity. The struct supports both streaming and non-streaming text generation,
-// as well as changing the generative model dynamically.
+// temperature for controlling creativity. The configured values are defaults, every streaming request may
+// override them with per-user generation options. The struct supports both streaming and non-streaming text generation.
 type OpenRouterAPI struct {
 	client      *openrouterapigo.OpenRouterClient // Клиент для взаимодействия с API
+	stream      *OpenAICompatibleAPI              // SSE-клиент потоковых ответов, запросы ограничены их контекстом
 	ctx         context.Context                   // Контекст для управления запросами
 	apiKey      string                            // API-ключ (для справки или повторной инициализации)
 	modelName   string                            // Версия генеративной модели
 	maxTokens   int                               // Максимальное количество токенов (опционально)
 	temperature float32                           // Температура для управления креативностью (опционально)
+	catalog     *modelCatalog                     // Кэш каталога моделей OpenRouter
 }
 
 // NewOpenRouterAPI creates a new instance of OpenRouterAPI with the specified configuration.
@@ -39,102 +44,94 @@ type OpenRouterAPI struct {
 //   - *OpenRouterAPI: A pointer to the initialized OpenRouterAPI instance.
 //   - error: An error if initialization fails; nil otherwise.
 func NewOpenRouterAPI(apiKey string, modelName string, maxTokens int, temperature float32) (*OpenRouterAPI, error) {
+	return newOpenRouterAPI(openRouterAPIURL, apiKey, modelName, maxTokens, temperature)
+}
+
+// newOpenRouterAPI creates an OpenRouterAPI whose answers are streamed from the API at baseURL.
+func newOpenRouterAPI(baseURL, apiKey, modelName string, maxTokens int, temperature float32) (*OpenRouterAPI, error) {
 	// Создаем контекст
 	ctx := context.Background()
 
 	// Инициализируем клиент
 	client := openrouterapigo.NewOpenRouterClient(apiKey)
+	// Клиент библиотеки не закрывает поток при отмене контекста, поэтому ответы читаются SSE-клиентом
+	stream, err := NewOpenAICompatibleAPI(baseURL, apiKey, modelName, maxTokens, temperature)
+	if err != nil {
+		return nil, err
+	}
+	stream.name = "openrouter"
 
 	// Возвращаем структуру
 	return &OpenRouterAPI{
 		client:      client,
+		stream:      stream,
 		modelName:   modelName,
 		ctx:         ctx,
 		apiKey:      apiKey,
 		maxTokens:   maxTokens,
 		temperature: temperature,
+		catalog:     newModelCatalog(stream.baseURL + "/models"), // Список всех моделей OpenRouter
 	}, nil
 }
 
 // GenerateStreamTextMsg generates a streaming text response based on the user's input and dialog history.
 //
-// It constructs a request with the provided text and dialog history, sends it to the OpenRouter API in streaming
-// mode, and returns a channel that streams the generated text chunks. The method includes a timeout of 1 minute;
-// if the API does not respond within this time, the streaming is stopped, and an error message is sent to the channel.
+// The answer is streamed by the OpenAI-compatible SSE client from the OpenRouter chat completions endpoint, with
+// the text deltas, the finish reason and the token usage priced by the model catalogue. The request is bound to ctx:
+// when ctx is canceled, e.g. by the Stop button, or the 1 minute timeout is up, the connection is closed, no goroutine
+// is left behind, and the error is sent as the last event.
 //
 // Parameters:
+//   - ctx: The context of the request; canceling it stops the streaming.
 //   - text: The user's input text to generate a response for.
 //   - history: A slice of models.Message representing the dialog history to provide context.
+//   - opts: Per-call generation options; zero values fall back to the configured defaults.
 //
 // Returns:
-//   - <-chan string: A channel that streams the generated text chunks. The channel is closed when streaming is complete
+//   - <-chan models.StreamEvent: A channel of stream events. The channel is closed when streaming is complete
 //     or an error occurs.
-func (d *OpenRouterAPI) GenerateStreamTextMsg(text string, history []models.Message) <-chan string {
-	// Формируем список сообщений для API, начиная с истории
-	messages := make([]openrouterapigo.MessageRequest, 0, len(history)+1)
-	for _, msg := range history {
-		messages = append(messages, openrouterapigo.MessageRequest{
-			Role:    openrouterapigo.MessageRole(msg.Role), // "user" или "assistant"
-			Content: msg.Content,
-		})
+func (d *OpenRouterAPI) GenerateStreamTextMsg(ctx context.Context, text string, history []models.Message, opts models.GenerationOptions) <-chan models.StreamEvent {
+	requested := d.modelName
+	if opts.Model != "" {
+		requested = opts.Model
 	}
-	// Добавляем текущее сообщение пользователя
-	messages = append(messages, openrouterapigo.MessageRequest{
-		Role:    openrouterapigo.RoleUser,
-		Content: text,
-	})
-
-	// Формируем запрос к DeepSeek API
-	chatReq := openrouterapigo.Request{
-		Model:    d.modelName, // Используем модель чата
-		Stream:   true,
-		Messages: messages,
-	}
-
-	outputChan := make(chan openrouterapigo.Response)
-	processingChan := make(chan interface{})
-	errChan := make(chan error)
-
-	// Async send request
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
-
-	go d.client.FetchChatCompletionsStream(chatReq, outputChan, processingChan, errChan, ctx)
-
-	textChan := make(chan string)
+	ctx, cancel := context.WithTimeout(ctx, openRouterStreamTimeout)
+	stream := d.stream.GenerateStreamTextMsg(ctx, text, history, opts)
 
+	events := make(chan models.StreamEvent)
 	go func() {
 		defer cancel()
-		defer close(textChan)
-		for {
-			select {
-			case <-ctx.Done():
-				err := ctx.Err()
-				logrus.WithError(err).Error("Streaming stopped due to context completion")
-				textChan <- fmt.Sprint("Ошибка: вышло время ожидания ответа от ИИ")
-				return
-			case err := <-errChan:
-				if err != nil {
-					logrus.WithError(err).Error("Error during streaming from OpenRouter")
-					textChan <- fmt.Sprintf("Ошибка: %v", err)
-					return
-				}
-			case <-processingChan:
-			case output, ok := <-outputChan:
-				if !ok {
-					logrus.Info("Streaming completed")
-					return
-				}
-				if len(output.Choices) > 0 {
-					content := output.Choices[0].Delta.Content
-					if content != "" {
-						logrus.WithField("chunk", content).Debug("Received stream chunk")
-					}
-					textChan <- content
-				}
+		defer close(events)
+		for event := range stream {
+			if event.Usage != nil {
+				d.priceUsage(event.Usage, requested)
 			}
+			events <- event
 		}
 	}()
-	return textChan
+	return events
+}
+
+// priceUsage fills in the model and the cost of the token usage.
+//
+// OpenRouter reports the tokens but not the cost of the streamed answer, so the cost is computed
+// from the prices of the cached model catalogue. The catalogue is not fetched for it: without
+// the catalogue or the model in it the cost stays unknown.
+//
+// Parameters:
+//   - usage: The token usage of the answer, changed in place.
+//   - requested: The model of the request, used when OpenRouter did not name the model that answered.
+func (d *OpenRouterAPI) priceUsage(usage *models.TokenUsage, requested string) {
+	if usage.Model == "" {
+		usage.Model = requested
+	}
+	model, ok := d.catalog.cached(usage.Model)
+	if !ok && usage.Model != requested {
+		model, ok = d.catalog.cached(requested)
+	}
+	if ok {
+		usage.Cost = model.Cost(usage.PromptTokens, usage.CompletionTokens)
+	}
 }
 
 // GenerateTextMsg generates a non-streaming text response based on the user's input.
@@ -175,22 +172,43 @@ func (d *OpenRouterAPI) GenerateTextMsg(text string) (string, error) {
 	return resp.Choices[0].Message.Content, nil
 }
 
-// ChangeGenerativeModelName changes the generative model used by the OpenRouterAPI instance.
+// ListModels returns the catalogue of the OpenRouter models.
 //
-// It validates the new model name by sending a test request to the OpenRouter API with a simple message.
-// If the model is accessible and responds successfully, the model name is updated. The test request uses
-// minimal tokens (MaxTokens: 10) and a temperature of 0.7 to ensure a quick response. If the model name is
-// empty or the test request fails, an error is returned.
+// The catalogue is fetched from the OpenRouter models endpoint and cached for an hour. If it cannot be refreshed,
+// the outdated catalogue is returned.
 //
 // Parameters:
-//   - modelName: The name of the new generative model to use (e.g., "deepseek-coder").
+//   - ctx: The context of the request.
+//
+// Returns:
+//   - []models.ModelInfo: The models in the order OpenRouter lists them.
+//   - error: An error if the catalogue was never fetched successfully; nil otherwise.
+func (d *OpenRouterAPI) ListModels(ctx context.Context) ([]models.ModelInfo, error) {
+	return d.catalog.list(ctx)
+}
+
+// ValidateModelName checks that the generative model is available to the OpenRouterAPI account.
+//
+// The model must be in the OpenRouter catalogue, otherwise models.ErrUnknownModel is returned without
+// a request to the model; when the catalogue is unavailable, the check relies on the test request alone.
+// It sends a test request to the OpenRouter API with a simple message. The test request uses minimal tokens
+// (MaxTokens: 10) and a temperature of 0.7 to ensure a quick response. The configured model is not changed,
+// the caller stores the validated name in the user's preferences.
+//
+// Parameters:
+//   - modelName: The name of the generative model to check (e.g., "deepseek-coder").
 //
 // Returns:
 //   - error: An error if the model name is empty, the test request fails, or the model does not respond; nil on success.
-func (d *OpenRouterAPI) ChangeGenerativeModelName(modelName string) error {
+func (d *OpenRouterAPI) ValidateModelName(modelName string) error {
 	if modelName == "" {
 		return errors.New("model name can't be empty")
 	}
+	if list, err := d.ListModels(d.ctx); err != nil {
+		logrus.WithError(err).Warn("OpenRouter model catalogue is unavailable, the model is checked by a test request")
+	} else if _, ok := findModel(list, modelName); !ok {
+		return fmt.Errorf("%w: %s", models.ErrUnknownModel, modelName)
+	}
 	request := openrouterapigo.Request{
 		Model: modelName,
 		Messages: []openrouterapigo.MessageRequest{
@@ -210,8 +228,6 @@ func (d *OpenRouterAPI) ChangeGenerativeModelName(modelName string) error {
 	if len(resp.Choices) == 0 {
 		return fmt.Errorf("no choices returned from model %s", modelName)
 	}
-	d.modelName = modelName
-	logrus.WithField("model", modelName).Info("Model is changed and working")
+	logrus.WithField("model", modelName).Info("Model is working")
 	return nil
-
 }
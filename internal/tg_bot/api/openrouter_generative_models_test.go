@@ -0,0 +1,123 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newOpenRouterServer starts a stand-in of the OpenRouter API with one priced model in the catalogue.
+// Chat requests are passed to the chat handler.
+func newOpenRouterServer(t *testing.T, chat http.HandlerFunc) *OpenRouterAPI {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v1/chat/completions", chat)
+	mux.HandleFunc("GET /api/v1/models", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data":[{"id":"deepseek/deepseek-chat","name":"DeepSeek V3","context_length":64000,
+			"pricing":{"prompt":"0.000001","completion":"0.000002"}}]}`)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	provider, err := newOpenRouterAPI(server.URL+"/api/v1", "test-key", "deepseek/deepseek-chat", 0, 0.7)
+	require.NoError(t, err)
+	return provider
+}
+
+func TestOpenRouterStream(t *testing.T) {
+	var got openAIChatRequest
+	provider := newOpenRouterServer(t, func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		assert.Equal(t, "Bearer test-key", r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range []string{
+			`: OPENROUTER PROCESSING`,
+			`data: {"model":"deepseek/deepseek-chat","choices":[{"delta":{"content":"При"}}]}`,
+			`data: {"model":"deepseek/deepseek-chat","choices":[{"delta":{"content":"вет!"},"finish_reason":"stop"}]}`,
+			`data: {"model":"deepseek/deepseek-chat","choices":[],"usage":{"prompt_tokens":1000,"completion_tokens":500,"total_tokens":1500}}`,
+			`data: [DONE]`,
+		} {
+			fmt.Fprintf(w, "%s\n\n", chunk)
+		}
+	})
+	_, err := provider.ListModels(context.Background())
+	require.NoError(t, err)
+
+	text, events := collectStream(provider.GenerateStreamTextMsg(context.Background(), "Привет",
+		[]models.Message{{Role: models.RoleMemory, Content: "Знакомились."}}, models.GenerationOptions{SystemPrompt: "Будь краток."}))
+
+	assert.Equal(t, "Привет!", text)
+	for _, event := range events {
+		assert.NoError(t, event.Err)
+	}
+	last := events[len(events)-1]
+	require.NotNil(t, last.Usage)
+	assert.Equal(t, "deepseek/deepseek-chat", last.Usage.Model)
+	assert.InDelta(t, 0.002, last.Usage.Cost, 1e-9, "the usage is priced by the catalogue")
+
+	assert.Equal(t, "deepseek/deepseek-chat", got.Model)
+	assert.True(t, got.Stream)
+	assert.Equal(t, []openAIMessage{
+		{Role: models.RoleSystem, Content: "Будь краток."},
+		{Role: models.RoleSystem, Content: models.MemoryPrompt("Знакомились.")},
+		{Role: models.RoleUser, Content: "Привет"},
+	}, got.Messages)
+}
+
+func TestOpenRouterStreamError(t *testing.T) {
+	provider := newOpenRouterServer(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "data: {\"error\":{\"code\":502,\"message\":\"provider returned error\"}}\n\n")
+	})
+	_, events := collectStream(provider.GenerateStreamTextMsg(context.Background(), "Привет", nil, models.GenerationOptions{}))
+	require.Len(t, events, 1)
+	assert.ErrorContains(t, events[0].Err, "openrouter stream")
+	assert.ErrorContains(t, events[0].Err, "provider returned error")
+}
+
+// streamGoroutines returns the stacks of the goroutines streaming an OpenRouter answer, either by this package
+// or by the OpenRouter client library. The goroutines of the other tests are not counted.
+func streamGoroutines() []string {
+	buf := make([]byte, 1<<20)
+	var stacks []string
+	for _, stack := range strings.Split(string(buf[:runtime.Stack(buf, true)]), "\n\n") {
+		if strings.Contains(stack, "openrouter-api-go") || strings.Contains(stack, "tg_bot/api.(*Open") {
+			stacks = append(stacks, stack)
+		}
+	}
+	return stacks
+}
+
+func TestOpenRouterStreamStopLeavesNoGoroutines(t *testing.T) {
+	provider := newOpenRouterServer(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Думаю\"}}]}\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+
+	for i := 0; i < 5; i++ {
+		// The Stop button cancels the context of the answer
+		ctx, cancel := context.WithCancel(context.Background())
+		events := provider.GenerateStreamTextMsg(ctx, "Привет", nil, models.GenerationOptions{})
+		assert.Equal(t, "Думаю", (<-events).Delta)
+		cancel()
+
+		_, rest := collectStream(events)
+		require.Len(t, rest, 1)
+		assert.True(t, errors.Is(rest[0].Err, context.Canceled), "got %v", rest[0].Err)
+	}
+
+	// The connections of the stopped answers are closed, so their goroutines end
+	assert.Eventually(t, func() bool { return len(streamGoroutines()) == 0 }, 2*time.Second, 10*time.Millisecond,
+		"left behind: %v", streamGoroutines())
+}
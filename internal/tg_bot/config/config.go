@@ -6,6 +6,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"os"
 	"strconv"
+	"strings"
 )
 
 // Config holds the application configuration parameters.
@@ -15,6 +16,8 @@ type Config struct {
 	EnvLogFileName                 string // File's name for log (e.g., Bot.log)
 	EnvStoragePath                 string // File's name for storage user chat state (e.g., ./keep_chat.json)
 	EnvDialogStoragePath           string // File's path for storage user/AI dialog history (e.g., ./dialog_ai.json)
+	EnvStateStorageType            string // Backend of the user chat state storage: "json" or "sqlite"
+	EnvSQLiteStoragePath           string // File's path of the SQLite database with user chat state (e.g., ./bot.db)
 	EnvBotToken                    string // Telegram Bot Token for authentication with the Telegram API
 	EnvTranslateApiEndpoint        string // Endpoint URL for the translation API (e.g., Yandex Translate API)
 	EnvDictionaryDetectApiEndpoint string // Endpoint URL for the dictionary/detect language API (e.g., for language detection)
@@ -23,14 +26,27 @@ type Config struct {
 	EnvGenerativeName              string // Name of the generative AI provider to use (e.g., "gemini" or "deepseek")
 	EnvGenerativeApiKey            string // API Key for the generative AI service (e.g., Gemini or DeepSeek API)
 	EnvGenerativeModel             string // Model name for the generative AI (e.g., "gemini-2.0-flash" for Gemini)
+	EnvGenerativeFallback          string // Providers tried in order when the main one fails (e.g., "deepseek -> gemini:gemini-2.0-flash")
+	EnvGenerativeBaseURL           string // Base URL of the OpenAI-compatible server (e.g., "http://192.168.1.10:11434/v1" for Ollama)
 	EnvServerEndpoint              string // Server endpoint URL for external API or service communication
 	EnvClientCert                  string // Path to the client certificate file
 	EnvClientKey                   string // Path to the client private key file
 	EnvClientCa                    string // Path to the client CA certificate file
 	EnvApiKey                      string // Key for get access to get token from server
 	EnvClientID                    string // Program ID for OAUth URL
-	EnvOwnerID                     int64  // TG owner's ID for get access to using smart home
+	EnvOwnerID                     int64  // TG owner's ID, the owner has every access role
 	EnvMoviesURL                   string // External URL with movie подборкой
+	EnvUpdateWorkers               int    // Number of workers processing Telegram updates in parallel
+	EnvUpdateQueueSize             int    // Depth of the update queue of every worker
+	EnvHistoryTrimStrategy         string // Dialog history trimming strategy: "messages", "tokens" or "summarize"
+	EnvHistoryTokenBudget          int    // Estimated context window of the model in tokens, used by token-based trimming
+	EnvHistoryMemoryThreshold      int    // Number of dialog messages after which old turns are condensed into memory
+	EnvAIRequestsPerMinute         int    // AI requests and inline queries a chat may send per minute, 0 for no limit
+	EnvAITokensPerDay              int    // Tokens of the AI answers a chat may spend per UTC day, 0 for no limit
+	EnvAIMaxConcurrent             int    // AI answers a chat may generate at the same time, 0 for no limit
+	EnvDefaultRole                 string // Access role of the users without an assigned one: "admin", "member", "guest" or "banned"
+
+	EnvGenerativeFallbackKeys map[string]string // API keys of the fallback providers by provider name (GENERATIVE_API_KEY_<NAME>)
 }
 
 // NewConfig initializes a new Config instance by loading environment variables from a .env file.
@@ -47,6 +63,14 @@ func NewConfig() (*Config, error) {
 	config.EnvLogFileName = os.Getenv("LOG_FILE_NAME")
 	config.EnvStoragePath = os.Getenv("FILE_STORAGE_PATH")
 	config.EnvDialogStoragePath = os.Getenv("FILE_DIALOG_HISTORY_PATH")
+	config.EnvStateStorageType = os.Getenv("STATE_STORAGE_TYPE")
+	if config.EnvStateStorageType == "" {
+		config.EnvStateStorageType = "json"
+	}
+	config.EnvSQLiteStoragePath = os.Getenv("SQLITE_STORAGE_PATH")
+	if config.EnvSQLiteStoragePath == "" {
+		config.EnvSQLiteStoragePath = "./bot.db"
+	}
 	config.EnvBotToken = os.Getenv("TOKEN_BOT")
 	config.EnvTranslateApiEndpoint = os.Getenv("TRANSLATE_API_ENDPOINT")
 	config.EnvDictionaryDetectApiEndpoint = os.Getenv("DICTIONARY_DETECT_API_ENDPOINT")
@@ -55,6 +79,14 @@ func NewConfig() (*Config, error) {
 	config.EnvGenerativeName = os.Getenv("GENERATIVE_NAME")
 	config.EnvGenerativeApiKey = os.Getenv("GENERATIVE_API_KEY")
 	config.EnvGenerativeModel = os.Getenv("GENERATIVE_MODEL")
+	config.EnvGenerativeFallback = os.Getenv("GENERATIVE_FALLBACK")
+	config.EnvGenerativeBaseURL = os.Getenv("GENERATIVE_BASE_URL")
+	config.EnvGenerativeFallbackKeys = make(map[string]string)
+	for _, provider := range []string{"gemini", "deepseek", "openrouter", "openai-compatible"} {
+		if key := os.Getenv("GENERATIVE_API_KEY_" + strings.ToUpper(strings.ReplaceAll(provider, "-", "_"))); key != "" {
+			config.EnvGenerativeFallbackKeys[provider] = key
+		}
+	}
 	config.EnvServerEndpoint = os.Getenv("SERVER_ENDPOINT")
 	config.EnvClientCert = os.Getenv("CLIENT_CERT_FILE")
 	config.EnvClientKey = os.Getenv("CLIENT_KEY_FILE")
@@ -71,6 +103,51 @@ func NewConfig() (*Config, error) {
 		logrus.WithError(err).Error("Failed to parse OWNER_ID from environment")
 		return nil, err
 	}
+	if config.EnvUpdateWorkers, err = getIntEnv("UPDATE_WORKERS", 8); err != nil {
+		return nil, err
+	}
+	if config.EnvUpdateQueueSize, err = getIntEnv("UPDATE_QUEUE_SIZE", 100); err != nil {
+		return nil, err
+	}
+	config.EnvHistoryTrimStrategy = os.Getenv("HISTORY_TRIM_STRATEGY")
+	if config.EnvHistoryTrimStrategy == "" {
+		config.EnvHistoryTrimStrategy = "summarize"
+	}
+	if config.EnvHistoryTokenBudget, err = getIntEnv("HISTORY_TOKEN_BUDGET", 16000); err != nil {
+		return nil, err
+	}
+	if config.EnvHistoryMemoryThreshold, err = getIntEnv("HISTORY_MEMORY_THRESHOLD", 40); err != nil {
+		return nil, err
+	}
+	if config.EnvAIRequestsPerMinute, err = getIntEnv("AI_REQUESTS_PER_MINUTE", 5); err != nil {
+		return nil, err
+	}
+	if config.EnvAITokensPerDay, err = getIntEnv("AI_TOKENS_PER_DAY", 50000); err != nil {
+		return nil, err
+	}
+	if config.EnvAIMaxConcurrent, err = getIntEnv("AI_MAX_CONCURRENT", 1); err != nil {
+		return nil, err
+	}
+	config.EnvDefaultRole = os.Getenv("DEFAULT_ROLE")
+	if config.EnvDefaultRole == "" {
+		// A new install is closed: the owner grants the AI to the users with /grant
+		config.EnvDefaultRole = "guest"
+	}
 
 	return config, nil
 }
+
+// getIntEnv reads an optional integer environment variable.
+// It returns defaultValue if the variable is not set and an error if it is not a valid integer.
+func getIntEnv(name string, defaultValue int) (int, error) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return defaultValue, nil
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to parse %s from environment", name)
+		return 0, fmt.Errorf("parse %s: %w", name, err)
+	}
+	return value, nil
+}
@@ -34,6 +34,13 @@ const (
 	BUTTON_TEXT_STREAM_GENERATIVE_MODEL = "/start ask_ai"
 	BUTTON_TEXT_CHANGE_MODEL            = "Сменить модель ИИ"
 	BUTTON_TEXT_CHANGE_HISTORY_SIZE     = "Сменить размер памяти"
+	BUTTON_TEXT_CHANGE_TEMPERATURE      = "Сменить температуру"
+	BUTTON_TEXT_CHANGE_MAX_TOKENS       = "Сменить длину ответа"
+	BUTTON_TEXT_CHANGE_SYSTEM_PROMPT    = "Сменить инструкцию ИИ"
+	BUTTON_TEXT_THREADS                 = "Мои диалоги"
+	BUTTON_TEXT_NEW_THREAD              = "Новый диалог"
+	BUTTON_TEXT_CHOOSE_PERSONA          = "Выбрать персону"
+	BUTTON_TEXT_NEW_PERSONA             = "Создать персону"
 	BUTTON_TEXT_GENERATIVE_MENU         = "Покажи меню ИИ"
 
 	BUTTON_TEXT_PRINT_MENU = "Покажи главное меню"
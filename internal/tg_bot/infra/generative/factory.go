@@ -6,27 +6,84 @@ import (
 	botServ "github.com/DenisKhanov/TgBOT/internal/tg_bot/service"
 )
 
+// OpenAICompatible is the name of the provider for any server with the OpenAI chat completions API,
+// like llama.cpp server, Ollama, vLLM or LM Studio. It is the only provider that uses the base URL.
+const OpenAICompatible = "openai-compatible"
+
 // generativeCreator defines a function to create GenerativeModel
-type generativeCreator func(apiKey, modelName string, maxTokens int, temperature float32) (botServ.GenerativeModel, error)
+type generativeCreator func(apiKey, modelName, baseURL string, maxTokens int, temperature float32) (botServ.GenerativeModel, error)
 
 // generativeRegistry stores registered implementations
 var generativeRegistry = map[string]generativeCreator{
-	"gemini": func(apiKey, modelName string, maxTokens int, temperature float32) (botServ.GenerativeModel, error) {
+	"gemini": func(apiKey, modelName, _ string, maxTokens int, temperature float32) (botServ.GenerativeModel, error) {
 		return api.NewGeminiAPI(apiKey, modelName, maxTokens, temperature)
 	},
-	"deepseek": func(apiKey, modelName string, maxTokens int, temperature float32) (botServ.GenerativeModel, error) {
+	"deepseek": func(apiKey, modelName, _ string, maxTokens int, temperature float32) (botServ.GenerativeModel, error) {
 		return api.NewDeepSeekAPI(apiKey, modelName, maxTokens, temperature)
 	},
-	"openrouter": func(apiKey, modelName string, maxTokens int, temperature float32) (botServ.GenerativeModel, error) {
+	"openrouter": func(apiKey, modelName, _ string, maxTokens int, temperature float32) (botServ.GenerativeModel, error) {
 		return api.NewOpenRouterAPI(apiKey, modelName, maxTokens, temperature)
 	},
+	OpenAICompatible: func(apiKey, modelName, baseURL string, maxTokens int, temperature float32) (botServ.GenerativeModel, error) {
+		return api.NewOpenAICompatibleAPI(baseURL, apiKey, modelName, maxTokens, temperature)
+	},
+}
+
+// NeedsAPIKey reports whether the provider requires an API key. Local OpenAI-compatible servers usually do not check one.
+func NeedsAPIKey(generativeName string) bool {
+	return generativeName != OpenAICompatible
+}
+
+// defaultModels stores the models used when a fallback chain link does not name one.
+// OpenRouter and OpenAI-compatible servers have no default model, so their links must name the model.
+var defaultModels = map[string]string{
+	"gemini":   "gemini-2.0-flash",
+	"deepseek": "deepseek-chat",
 }
 
-// ModelFactory creates a GenerativeModel implementation based on an environment variable
-func ModelFactory(generativeName, apiKey, modelName string, maxTokens int, temperature float32) (botServ.GenerativeModel, error) {
+// ModelFactory creates a GenerativeModel implementation based on an environment variable.
+// The base URL is used by the openai-compatible provider only.
+func ModelFactory(generativeName, apiKey, modelName, baseURL string, maxTokens int, temperature float32) (botServ.GenerativeModel, error) {
 	creator, exists := generativeRegistry[generativeName]
 	if !exists {
-		return nil, fmt.Errorf("unsupported GENERATIVE_NAME: %s (expected 'gemini', 'deepseek', or 'openrouter')", generativeName)
+		return nil, fmt.Errorf("unsupported GENERATIVE_NAME: %s (expected 'gemini', 'deepseek', 'openrouter', or '%s')", generativeName, OpenAICompatible)
+	}
+	return creator(apiKey, modelName, baseURL, maxTokens, temperature)
+}
+
+// ChainFactory creates the primary GenerativeModel wrapped into a FallbackModel with the providers of the chain.
+// If the chain is empty, the primary model is returned as is.
+// Arguments:
+//   - generativeName, apiKey, modelName: the primary provider, its API key and model.
+//   - baseURL: the base URL of the openai-compatible provider, wherever it is in the chain.
+//   - chain: the fallback providers in the order they are tried after the primary one.
+//   - apiKeys: API keys of the fallback providers by provider name; the primary key is used for the primary provider.
+func ChainFactory(generativeName, apiKey, modelName, baseURL string, chain []ChainLink, apiKeys map[string]string, maxTokens int, temperature float32) (botServ.GenerativeModel, error) {
+	primary, err := ModelFactory(generativeName, apiKey, modelName, baseURL, maxTokens, temperature)
+	if err != nil || len(chain) == 0 {
+		return primary, err
+	}
+
+	names := []string{ChainLink{Name: generativeName, Model: modelName}.String()}
+	providers := []botServ.GenerativeModel{primary}
+	for _, link := range chain {
+		key := apiKeys[link.Name]
+		if key == "" && link.Name == generativeName {
+			key = apiKey
+		}
+		if key == "" && NeedsAPIKey(link.Name) {
+			return nil, fmt.Errorf("no API key for the fallback provider %s", link.Name)
+		}
+		model := link.Model
+		if model == "" {
+			model = defaultModels[link.Name]
+		}
+		provider, err := ModelFactory(link.Name, key, model, baseURL, maxTokens, temperature)
+		if err != nil {
+			return nil, fmt.Errorf("fallback provider %s: %w", link, err)
+		}
+		names = append(names, ChainLink{Name: link.Name, Model: model}.String())
+		providers = append(providers, provider)
 	}
-	return creator(apiKey, modelName, maxTokens, temperature)
+	return NewFallbackModel(names, providers)
 }
@@ -0,0 +1,50 @@
+package generative
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestChainFactoryOpenAICompatible runs a fallback chain against a stand-in of a local server
+// that has the fallback model loaded, but not the primary one.
+func TestChainFactoryOpenAICompatible(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model string `json:"model"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		if req.Model != "llama3" {
+			http.Error(w, "model not loaded", http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Привет\"},\"finish_reason\":\"stop\"}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	chain, err := ParseChain(OpenAICompatible + ":llama3")
+	require.NoError(t, err)
+	model, err := ChainFactory(OpenAICompatible, "", "qwen2.5", server.URL, chain, nil, 0, 0.7)
+	require.NoError(t, err, "the openai-compatible provider needs no API key")
+
+	var text strings.Builder
+	var provider string
+	for event := range model.GenerateStreamTextMsg(context.Background(), "Привет", nil, models.GenerationOptions{}) {
+		require.NoError(t, event.Err)
+		text.WriteString(event.Delta)
+		provider = event.Provider
+	}
+	assert.Equal(t, "Привет", text.String())
+	assert.Equal(t, OpenAICompatible+":llama3", provider)
+
+	_, err = ModelFactory(OpenAICompatible, "", "llama3", "", 0, 0.7)
+	assert.Error(t, err, "the base URL is required")
+}
@@ -0,0 +1,264 @@
+package generative
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	botServ "github.com/DenisKhanov/TgBOT/internal/tg_bot/service"
+	"github.com/sirupsen/logrus"
+)
+
+// Circuit breaker settings of the providers in a fallback chain.
+const (
+	breakerFailureThreshold = 3               // Consecutive failures after which the provider is skipped
+	breakerCooldown         = 1 * time.Minute // How long a failed provider is skipped before it is tried again
+)
+
+// ErrNoProviderAvailable is returned when every provider of the chain failed or is skipped by its circuit breaker.
+var ErrNoProviderAvailable = errors.New("no generative provider available")
+
+// ChainLink is a provider of a fallback chain with its model.
+type ChainLink struct {
+	Name  string // Provider name, one of the registered generative providers
+	Model string // Model of the provider, empty for the provider's default model
+}
+
+// String returns the link in the chain format, "name:model" or "name".
+func (l ChainLink) String() string {
+	if l.Model == "" {
+		return l.Name
+	}
+	return l.Name + ":" + l.Model
+}
+
+// ParseChain parses a fallback chain like "openrouter:deepseek/deepseek-chat-v3-0324:free -> deepseek -> gemini".
+// The model follows the first colon of a link, so it may contain colons itself.
+func ParseChain(spec string) ([]ChainLink, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	var links []ChainLink
+	for _, raw := range strings.Split(spec, "->") {
+		name, model, _ := strings.Cut(strings.TrimSpace(raw), ":")
+		link := ChainLink{Name: strings.TrimSpace(name), Model: strings.TrimSpace(model)}
+		if _, ok := generativeRegistry[link.Name]; !ok {
+			return nil, fmt.Errorf("unsupported provider %q in the fallback chain %q", link.Name, spec)
+		}
+		if link.Model == "" && defaultModels[link.Name] == "" {
+			return nil, fmt.Errorf("provider %q in the fallback chain needs a model, e.g. %s:<model>", link.Name, link.Name)
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// circuitBreaker stops sending requests to a provider that keeps failing.
+//
+// After breakerFailureThreshold consecutive failures the circuit opens and the provider is skipped
+// for breakerCooldown. Then a single trial request is let through: its success closes the circuit,
+// and its failure opens it again.
+type circuitBreaker struct {
+	mu          sync.Mutex
+	failures    int       // Consecutive failures
+	openedUntil time.Time // The provider is skipped until this time
+	trial       bool      // A trial request of the half-open circuit is running
+	now         func() time.Time
+}
+
+// allow reports whether a request may be sent to the provider.
+func (c *circuitBreaker) allow() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.failures < breakerFailureThreshold {
+		return true
+	}
+	if c.now().Before(c.openedUntil) || c.trial {
+		return false
+	}
+	c.trial = true
+	return true
+}
+
+// success closes the circuit.
+func (c *circuitBreaker) success() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures, c.trial = 0, false
+}
+
+// failure counts the failed request and opens the circuit when the threshold is reached.
+func (c *circuitBreaker) failure() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures++
+	c.trial = false
+	if c.failures >= breakerFailureThreshold {
+		c.openedUntil = c.now().Add(breakerCooldown)
+	}
+}
+
+// release ends a request that says nothing about the provider's health, like one canceled by the user.
+func (c *circuitBreaker) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.trial = false
+}
+
+// fallbackProvider is a provider of the chain with its circuit breaker.
+type fallbackProvider struct {
+	name    string
+	model   botServ.GenerativeModel
+	breaker *circuitBreaker
+}
+
+// FallbackModel is a GenerativeModel that sends every request to the first available provider of an ordered chain.
+//
+// A provider that fails before it starts answering is skipped and the request goes to the next one. The user's
+// model choice applies to the first provider only, the others answer with their configured models. Every stream
+// reports the provider that answered in StreamEvent.Provider.
+type FallbackModel struct {
+	providers []*fallbackProvider
+}
+
+// NewFallbackModel creates a FallbackModel over the providers in the order they are tried.
+// Arguments:
+//   - names: names of the providers used in logs and stream events.
+//   - providers: the generative models, one for every name.
+//
+// Returns a pointer to a FallbackModel and an error if the arguments do not match.
+func NewFallbackModel(names []string, providers []botServ.GenerativeModel) (*FallbackModel, error) {
+	if len(providers) == 0 || len(names) != len(providers) {
+		return nil, fmt.Errorf("fallback chain needs a name for every provider, got %d names and %d providers", len(names), len(providers))
+	}
+	f := &FallbackModel{}
+	for i, provider := range providers {
+		f.providers = append(f.providers, &fallbackProvider{
+			name:    names[i],
+			model:   provider,
+			breaker: &circuitBreaker{now: time.Now},
+		})
+	}
+	return f, nil
+}
+
+// GenerateStreamTextMsg streams the answer of the first provider that starts answering.
+//
+// A provider error before the first text delta moves the request to the next provider. An error after it
+// is passed to the caller, because the answer cannot be restarted without duplicating the text.
+// Errors of a canceled request and safety blocks are passed to the caller without a fallback.
+func (f *FallbackModel) GenerateStreamTextMsg(ctx context.Context, text string, history []models.Message, opts models.GenerationOptions) <-chan models.StreamEvent {
+	events := make(chan models.StreamEvent)
+	go func() {
+		defer close(events)
+		lastErr := ErrNoProviderAvailable
+		for i, provider := range f.providers {
+			if !provider.breaker.allow() {
+				logrus.WithField("provider", provider.name).Debug("Generative provider skipped by its circuit breaker")
+				continue
+			}
+			providerOpts := opts
+			if i > 0 {
+				providerOpts.Model = ""
+			}
+
+			started, err := relayStream(ctx, provider, provider.model.GenerateStreamTextMsg(ctx, text, history, providerOpts), events)
+			switch {
+			case err == nil || isRequestRejected(err):
+				provider.breaker.success()
+			case ctx.Err() != nil:
+				provider.breaker.release()
+			default:
+				provider.breaker.failure()
+			}
+			if err == nil || started || !isProviderFailure(ctx, err) {
+				if i > 0 && started {
+					logrus.WithField("provider", provider.name).Info("Fallback generative provider answered")
+				}
+				if err != nil {
+					events <- models.StreamEvent{Provider: provider.name, Err: err}
+				}
+				return
+			}
+
+			lastErr = fmt.Errorf("%s: %w", provider.name, err)
+			logrus.WithError(err).WithField("provider", provider.name).Warn("Generative provider failed, trying the next one")
+		}
+		events <- models.StreamEvent{Err: lastErr}
+	}()
+	return events
+}
+
+// relayStream forwards the provider's events, marked with its name, until the stream ends.
+// The terminal error is returned instead of being forwarded, so the caller decides whether to fall back.
+// Returns true if a text delta was forwarded.
+func relayStream(ctx context.Context, provider *fallbackProvider, in <-chan models.StreamEvent, out chan<- models.StreamEvent) (bool, error) {
+	started := false
+	for event := range in {
+		if event.Err != nil {
+			// Drain the stream, the provider closes it right after the error
+			for range in {
+			}
+			return started, event.Err
+		}
+		event.Provider = provider.name
+		started = started || event.Delta != ""
+		select {
+		case out <- event:
+		case <-ctx.Done():
+			for range in {
+			}
+			return started, ctx.Err()
+		}
+	}
+	return started, nil
+}
+
+// isProviderFailure reports whether the error means the provider could not answer, so another one may be tried.
+func isProviderFailure(ctx context.Context, err error) bool {
+	return ctx.Err() == nil && !isRequestRejected(err)
+}
+
+// isRequestRejected reports whether the provider rejected the request itself: another provider would reject it too.
+func isRequestRejected(err error) bool {
+	return errors.Is(err, models.ErrContentBlocked) || errors.Is(err, models.ErrEmptyPrompt)
+}
+
+// GenerateTextMsg returns the answer of the first provider that answers without an error.
+func (f *FallbackModel) GenerateTextMsg(text string) (string, error) {
+	lastErr := ErrNoProviderAvailable
+	for _, provider := range f.providers {
+		if !provider.breaker.allow() {
+			continue
+		}
+		answer, err := provider.model.GenerateTextMsg(text)
+		if err == nil {
+			provider.breaker.success()
+			logrus.WithField("provider", provider.name).Debug("Generative provider answered")
+			return answer, nil
+		}
+		provider.breaker.failure()
+		lastErr = fmt.Errorf("%s: %w", provider.name, err)
+		logrus.WithError(err).WithField("provider", provider.name).Warn("Generative provider failed, trying the next one")
+	}
+	return "", lastErr
+}
+
+// ValidateModelName checks the model with the first provider of the chain, the only one the user's model applies to.
+func (f *FallbackModel) ValidateModelName(modelName string) error {
+	return f.providers[0].model.ValidateModelName(modelName)
+}
+
+// ListModels returns the model catalogue of the first provider of the chain, the only one the user's model applies to.
+func (f *FallbackModel) ListModels(ctx context.Context) ([]models.ModelInfo, error) {
+	catalog, ok := f.providers[0].model.(botServ.ModelCatalog)
+	if !ok {
+		return nil, models.ErrNoModelCatalog
+	}
+	return catalog.ListModels(ctx)
+}
@@ -0,0 +1,129 @@
+package generative
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	botServ "github.com/DenisKhanov/TgBOT/internal/tg_bot/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeProvider streams the deltas and then the error, if any.
+type fakeProvider struct {
+	deltas []string
+	err    error
+	calls  int
+	models []string
+}
+
+func (f *fakeProvider) GenerateStreamTextMsg(_ context.Context, _ string, _ []models.Message, opts models.GenerationOptions) <-chan models.StreamEvent {
+	f.calls++
+	f.models = append(f.models, opts.Model)
+	events := make(chan models.StreamEvent, len(f.deltas)+1)
+	for _, delta := range f.deltas {
+		events <- models.StreamEvent{Delta: delta}
+	}
+	if f.err != nil {
+		events <- models.StreamEvent{Err: f.err}
+	}
+	close(events)
+	return events
+}
+
+func (f *fakeProvider) GenerateTextMsg(string) (string, error) { return "", f.err }
+
+func (f *fakeProvider) ValidateModelName(string) error { return nil }
+
+func collect(events <-chan models.StreamEvent) (text, provider string, err error) {
+	for event := range events {
+		text += event.Delta
+		if event.Provider != "" {
+			provider = event.Provider
+		}
+		if event.Err != nil {
+			err = event.Err
+		}
+	}
+	return text, provider, err
+}
+
+func TestParseChain(t *testing.T) {
+	links, err := ParseChain("openrouter:deepseek/deepseek-chat-v3-0324:free -> deepseek -> gemini:gemini-2.0-flash")
+	require.NoError(t, err)
+	assert.Equal(t, []ChainLink{
+		{Name: "openrouter", Model: "deepseek/deepseek-chat-v3-0324:free"},
+		{Name: "deepseek"},
+		{Name: "gemini", Model: "gemini-2.0-flash"},
+	}, links)
+
+	links, err = ParseChain(" ")
+	assert.NoError(t, err)
+	assert.Empty(t, links)
+
+	_, err = ParseChain("deepseek -> claude")
+	assert.Error(t, err, "unknown provider")
+	_, err = ParseChain("openrouter")
+	assert.Error(t, err, "openrouter has no default model")
+}
+
+func TestFallbackModel_FallsBackBeforeTheAnswerStarts(t *testing.T) {
+	primary := &fakeProvider{err: errors.New("429 rate limited")}
+	backup := &fakeProvider{deltas: []string{"При", "вет"}}
+	f, err := NewFallbackModel([]string{"openrouter:free", "deepseek:deepseek-chat"}, []botServ.GenerativeModel{primary, backup})
+	require.NoError(t, err)
+
+	text, provider, err := collect(f.GenerateStreamTextMsg(context.Background(), "Привет", nil, models.GenerationOptions{Model: "user/model"}))
+	assert.NoError(t, err)
+	assert.Equal(t, "Привет", text)
+	assert.Equal(t, "deepseek:deepseek-chat", provider)
+	assert.Equal(t, []string{"user/model"}, primary.models)
+	assert.Equal(t, []string{""}, backup.models, "the user's model applies to the first provider only")
+}
+
+func TestFallbackModel_KeepsErrorsAfterTheAnswerStarted(t *testing.T) {
+	primary := &fakeProvider{deltas: []string{"Начало"}, err: errors.New("connection reset")}
+	backup := &fakeProvider{deltas: []string{"Другой ответ"}}
+	f, err := NewFallbackModel([]string{"primary", "backup"}, []botServ.GenerativeModel{primary, backup})
+	require.NoError(t, err)
+
+	text, _, err := collect(f.GenerateStreamTextMsg(context.Background(), "Привет", nil, models.GenerationOptions{}))
+	assert.Error(t, err)
+	assert.Equal(t, "Начало", text)
+	assert.Zero(t, backup.calls)
+
+	primary.deltas, primary.err = nil, models.ErrContentBlocked
+	_, _, err = collect(f.GenerateStreamTextMsg(context.Background(), "Привет", nil, models.GenerationOptions{}))
+	assert.ErrorIs(t, err, models.ErrContentBlocked, "a safety block is not a provider failure")
+	assert.Zero(t, backup.calls)
+
+	primary.err = models.ErrEmptyPrompt
+	_, _, err = collect(f.GenerateStreamTextMsg(context.Background(), " ", nil, models.GenerationOptions{}))
+	assert.ErrorIs(t, err, models.ErrEmptyPrompt, "an empty prompt is not a provider failure")
+	assert.Zero(t, backup.calls)
+}
+
+func TestFallbackModel_CircuitBreakerSkipsFailingProvider(t *testing.T) {
+	primary := &fakeProvider{err: errors.New("503")}
+	backup := &fakeProvider{deltas: []string{"ok"}}
+	f, err := NewFallbackModel([]string{"primary", "backup"}, []botServ.GenerativeModel{primary, backup})
+	require.NoError(t, err)
+	now := time.Now()
+	f.providers[0].breaker.now = func() time.Time { return now }
+
+	for i := 0; i < breakerFailureThreshold+2; i++ {
+		_, provider, err := collect(f.GenerateStreamTextMsg(context.Background(), "Привет", nil, models.GenerationOptions{}))
+		require.NoError(t, err)
+		assert.Equal(t, "backup", provider)
+	}
+	assert.Equal(t, breakerFailureThreshold, primary.calls, "the open circuit skips the provider")
+
+	now = now.Add(breakerCooldown)
+	primary.err, primary.deltas = nil, []string{"снова работаю"}
+	_, provider, err := collect(f.GenerateStreamTextMsg(context.Background(), "Привет", nil, models.GenerationOptions{}))
+	require.NoError(t, err)
+	assert.Equal(t, "primary", provider, "the trial request after the cooldown closes the circuit")
+}
@@ -0,0 +1,37 @@
+package models
+
+import "strings"
+
+// AccessRole — роль пользователя, от которой зависят доступные ему команды и пункты меню.
+type AccessRole string
+
+// Роли пользователей бота, от самой широкой к самой узкой.
+const (
+	AccessOwner  AccessRole = "owner"  // Владелец бота, только он назначает роли
+	AccessAdmin  AccessRole = "admin"  // Администратор: умный дом, квоты и расход всех чатов
+	AccessMember AccessRole = "member" // Участник: все функции ИИ
+	AccessGuest  AccessRole = "guest"  // Гость: меню, подборки и перевод, без ИИ
+	AccessBanned AccessRole = "banned" // Заблокированный пользователь, бот его не обслуживает
+)
+
+// accessLevels задаёт порядок ролей: роль с большим уровнем имеет доступ ко всему, что доступно ролям ниже.
+var accessLevels = map[AccessRole]int{
+	AccessBanned: 0,
+	AccessGuest:  1,
+	AccessMember: 2,
+	AccessAdmin:  3,
+	AccessOwner:  4,
+}
+
+// ParseAccessRole возвращает роль по её названию без учёта регистра.
+func ParseAccessRole(name string) (AccessRole, bool) {
+	role := AccessRole(strings.ToLower(strings.TrimSpace(name)))
+	_, ok := accessLevels[role]
+	return role, ok
+}
+
+// Allows сообщает, что роли доступны функции роли required. Неизвестной роли не доступно ничего.
+func (r AccessRole) Allows(required AccessRole) bool {
+	level, ok := accessLevels[r]
+	return ok && level > 0 && level >= accessLevels[required]
+}
@@ -0,0 +1,24 @@
+package models
+
+import "errors"
+
+// Ошибки каталога генеративных моделей.
+var (
+	ErrUnknownModel   = errors.New("model is not in the provider's catalogue")    // Провайдер не знает модель с таким идентификатором
+	ErrNoModelCatalog = errors.New("provider does not publish a model catalogue") // Провайдер не умеет отдавать список моделей
+)
+
+// ModelInfo описывает модель из каталога генеративного провайдера.
+type ModelInfo struct {
+	ID              string  // Идентификатор модели, который передаётся в запросах
+	Name            string  // Название модели для пользователя
+	ContextLength   int     // Размер контекстного окна в токенах, 0 если провайдер его не сообщил
+	Free            bool    // Запрос и ответ модели бесплатны
+	PromptPrice     float64 // Цена одного токена запроса в долларах, 0 если провайдер её не сообщил
+	CompletionPrice float64 // Цена одного токена ответа в долларах, 0 если провайдер её не сообщил
+}
+
+// Cost возвращает стоимость запроса к модели в долларах по её ценам.
+func (m ModelInfo) Cost(promptTokens, completionTokens int) float64 {
+	return float64(promptTokens)*m.PromptPrice + float64(completionTokens)*m.CompletionPrice
+}
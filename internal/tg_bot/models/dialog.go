@@ -0,0 +1,55 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+// Ошибки работы с диалогами пользователя.
+var (
+	ErrThreadNotFound = errors.New("dialog thread not found")      // Диалог с таким идентификатором не существует
+	ErrTooManyThreads = errors.New("too many dialog threads")      // Достигнут лимит диалогов одного чата
+	ErrEmptyTitle     = errors.New("dialog thread title is empty") // Название диалога не может быть пустым
+)
+
+// DialogThread — именованный диалог пользователя с ИИ со своей историей и настройками.
+type DialogThread struct {
+	ID        string         `json:"id"`                 // Идентификатор диалога, уникальный в пределах чата
+	Title     string         `json:"title"`              // Название диалога
+	CreatedAt time.Time      `json:"createdAt"`          // Время создания диалога
+	Settings  *AIPreferences `json:"settings,omitempty"` // Настройки ИИ диалога, заданные поля перекрывают настройки пользователя
+	Messages  []Message      `json:"messages"`           // История сообщений диалога
+}
+
+// ChatDialogs хранит все диалоги одного чата.
+type ChatDialogs struct {
+	ActiveID string          `json:"activeID"` // Идентификатор текущего диалога, пусто если диалогов нет
+	NextID   int             `json:"nextID"`   // Номер, который получит следующий созданный диалог
+	Threads  []*DialogThread `json:"threads"`  // Диалоги в порядке создания
+}
+
+// DialogThreadInfo описывает диалог без истории сообщений, для списков и ответов пользователю.
+type DialogThreadInfo struct {
+	ID        string    // Идентификатор диалога
+	Title     string    // Название диалога
+	CreatedAt time.Time // Время создания диалога
+	Messages  int       // Количество сообщений в истории
+	Active    bool      // Является ли диалог текущим
+}
+
+// DialogExportVersion — текущая версия схемы файла экспорта диалога.
+const DialogExportVersion = 1
+
+// DialogExport — файл экспорта истории диалога с ИИ, который пользователь может скачать и загрузить обратно.
+type DialogExport struct {
+	Version    int                   `json:"version"`         // Версия схемы файла
+	Title      string                `json:"title,omitempty"` // Название экспортированного диалога
+	ExportedAt time.Time             `json:"exportedAt"`      // Время экспорта
+	Messages   []DialogExportMessage `json:"messages"`        // История сообщений диалога
+}
+
+// DialogExportMessage — сообщение диалога в файле экспорта.
+type DialogExportMessage struct {
+	Role    string `json:"role"`    // Роль автора сообщения: user, assistant, system или memory
+	Content string `json:"content"` // Текст сообщения
+}
@@ -1,12 +1,81 @@
 package models
 
+import "errors"
+
 type ResponseOAuth struct {
 	AccessToken  string `json:"access_token"`
 	ExpiresIn    int    `json:"expires_in"`
 	RefreshToken string `json:"refresh_token"`
 }
 
+// Роли сообщений в истории диалога с ИИ.
+const (
+	RoleUser      = "user"      // Сообщение пользователя
+	RoleAssistant = "assistant" // Ответ генеративной модели
+	RoleSystem    = "system"    // Закреплённая системная инструкция
+	RoleMemory    = "memory"    // Сжатый пересказ старой части диалога, провайдеры передают его как системное сообщение
+)
+
+// memoryPromptPrefix предваряет пересказ старой части диалога, когда он передаётся модели.
+const memoryPromptPrefix = "Краткое содержание предыдущей части диалога:\n"
+
 type Message struct {
 	Role    string
 	Content string
 }
+
+// MemoryPrompt возвращает текст системного сообщения, которым провайдер передаёт модели сообщение с ролью RoleMemory.
+func MemoryPrompt(memory string) string {
+	return memoryPromptPrefix + memory
+}
+
+// ForModel возвращает сообщение в том виде, в котором провайдер передаёт его модели.
+// Сообщение с ролью RoleMemory становится системным сообщением с текстом MemoryPrompt, остальные не меняются.
+func (m Message) ForModel() Message {
+	if m.Role == RoleMemory {
+		return Message{Role: RoleSystem, Content: MemoryPrompt(m.Content)}
+	}
+	return m
+}
+
+// GenerationOptions содержит параметры одного запроса к генеративной модели.
+// Нулевые значения означают настройки провайдера по умолчанию.
+type GenerationOptions struct {
+	Model        string   // Название генеративной модели
+	Temperature  *float32 // Температура для управления креативностью
+	MaxTokens    int      // Максимальное количество токенов ответа
+	SystemPrompt string   // Системная инструкция для модели
+}
+
+// Причины завершения ответа генеративной модели.
+const (
+	FinishStop    = "stop"           // Модель закончила ответ сама
+	FinishLength  = "length"         // Ответ обрезан по лимиту токенов
+	FinishBlocked = "content_filter" // Ответ прерван фильтром безопасности
+)
+
+// ErrContentBlocked передаётся в StreamEvent.Err, когда фильтр безопасности провайдера заблокировал запрос или ответ.
+var ErrContentBlocked = errors.New("content blocked by safety filters")
+
+// ErrEmptyPrompt возвращается, когда текст запроса к генеративной модели пустой или состоит из одних пробелов.
+var ErrEmptyPrompt = errors.New("prompt text is empty")
+
+// TokenUsage содержит расход токенов на один запрос к генеративной модели.
+type TokenUsage struct {
+	PromptTokens     int     // Токены запроса вместе с историей и системной инструкцией
+	CompletionTokens int     // Токены ответа
+	TotalTokens      int     // Все токены запроса и ответа
+	Model            string  // Модель, которая ответила на запрос, пусто если провайдер её не сообщил
+	Cost             float64 // Стоимость запроса в долларах, 0 если провайдер её не сообщил
+}
+
+// StreamEvent — событие потоковой генерации ответа.
+// Провайдер передаёт фрагменты текста, затем событие с причиной завершения и расходом токенов,
+// если он их сообщает. Ошибка передаётся последним событием, после неё канал закрывается.
+type StreamEvent struct {
+	Delta        string      // Очередной фрагмент текста ответа
+	FinishReason string      // Причина завершения ответа, одна из констант Finish*
+	Usage        *TokenUsage // Расход токенов, nil если провайдер его не сообщил
+	Provider     string      // Провайдер, который ответил; его сообщает цепочка резервных провайдеров
+	Err          error       // Ошибка, прервавшая генерацию
+}
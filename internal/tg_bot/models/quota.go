@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// Уровни квот ИИ, которые владелец бота назначает чатам из белого списка.
+const (
+	QuotaTierStandard  = ""          // Обычные лимиты из настроек бота
+	QuotaTierExtended  = "extended"  // Увеличенные лимиты
+	QuotaTierUnlimited = "unlimited" // Без лимитов
+)
+
+// Quota — уровень квот чата и счётчик его запросов к ИИ в текущую минуту.
+type Quota struct {
+	Tier           string    `json:"tier,omitempty"`           // Уровень квот, одна из констант QuotaTier*
+	WindowStart    time.Time `json:"windowStart"`              // Начало минуты, в которую считаются запросы
+	WindowRequests int       `json:"windowRequests,omitempty"` // Запросы с начала минуты
+}
+
+// IsZero сообщает, что чату не назначен уровень квот и он ещё не делал запросов.
+func (q Quota) IsZero() bool {
+	return q.Tier == QuotaTierStandard && q.WindowStart.IsZero() && q.WindowRequests == 0
+}
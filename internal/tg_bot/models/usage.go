@@ -0,0 +1,38 @@
+package models
+
+// UsageDayLayout — формат дня в записях журнала расхода.
+const UsageDayLayout = "2006-01-02"
+
+// UsageEntry — расход генеративной модели одного чата на одну модель за один день.
+type UsageEntry struct {
+	Day              string  `json:"day"`              // День по UTC в формате UsageDayLayout
+	Model            string  `json:"model"`            // Модель, которая отвечала на запросы
+	Requests         int     `json:"requests"`         // Количество запросов
+	PromptTokens     int     `json:"promptTokens"`     // Токены запросов вместе с историей и системной инструкцией
+	CompletionTokens int     `json:"completionTokens"` // Токены ответов
+	Cost             float64 `json:"cost,omitempty"`   // Стоимость в долларах, 0 если провайдер её не сообщил
+}
+
+// TotalTokens возвращает все токены запросов и ответов записи.
+func (e UsageEntry) TotalTokens() int {
+	return e.PromptTokens + e.CompletionTokens
+}
+
+// Add прибавляет к записи расход другой записи. День и модель записи не меняются.
+func (e *UsageEntry) Add(other UsageEntry) {
+	e.Requests += other.Requests
+	e.PromptTokens += other.PromptTokens
+	e.CompletionTokens += other.CompletionTokens
+	e.Cost += other.Cost
+}
+
+// MergeUsage добавляет расход в журнал: складывает его с записью того же дня и модели или дописывает новую запись.
+func MergeUsage(entries []UsageEntry, entry UsageEntry) []UsageEntry {
+	for i := range entries {
+		if entries[i].Day == entry.Day && entries[i].Model == entry.Model {
+			entries[i].Add(entry)
+			return entries
+		}
+	}
+	return append(entries, entry)
+}
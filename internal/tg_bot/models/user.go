@@ -1,16 +1,120 @@
 package models
 
+import "encoding/json"
+
 type UserState struct {
-	ChatID                int64              `json:"chatID"`                // Идентификатор чата
-	CurrentStep           string             `json:"currentStep"`           // Текущий этап диалога с пользователем
-	LastUserMessages      string             `json:"lastUserMessages"`      // Данные, введённые пользователем, ключ - название данных
-	CallbackQueryData     string             `json:"callbackQueryData"`     // Данные из callback-запросов, если они используются
-	IsTranslating         bool               `json:"isTranslating"`         // Флаг состояния перевода для пользователя
-	IsGenerative          bool               `json:"isGenerative"`          // Флаг состояния режима ИИ для пользователя
-	IsChangingGenModel    bool               `json:"isChangingGenModel"`    // Флаг состояния режима смены ИИ модели для пользователя
-	IsChangingHistorySize bool               `json:"isChangingHistorySize"` // Флаг состояния режима смены размера памяти ИИ
-	Token                 string             `json:"token"`                 // Токен сервиса умного дома. Сохраняется вместе с состоянием пользователя.
-	Devices               map[string]*Device `json:"devices"`               // Карта устройств пользователя
+	ChatID            int64              `json:"chatID"`            // Идентификатор чата
+	CurrentStep       string             `json:"currentStep"`       // Текущий этап диалога с пользователем
+	LastUserMessages  string             `json:"lastUserMessages"`  // Данные, введённые пользователем, ключ - название данных
+	CallbackQueryData string             `json:"callbackQueryData"` // Данные из callback-запросов, если они используются
+	Mode              string             `json:"mode"`              // Текущий режим чата в конечном автомате бота
+	Token             string             `json:"token"`             // Токен сервиса умного дома. Сохраняется вместе с состоянием пользователя.
+	Devices           map[string]*Device `json:"devices"`           // Карта устройств пользователя
+	AI                AIPreferences      `json:"ai"`                // Персональные настройки генеративной модели
+	Personas          []Persona          `json:"personas"`          // Персоны ИИ, созданные пользователем
+	Usage             []UsageEntry       `json:"usage,omitempty"`   // Расход генеративной модели по дням и моделям
+	Quota             Quota              `json:"quota"`             // Уровень квот ИИ и счётчик запросов
+	Role              AccessRole         `json:"role,omitempty"`    // Роль, назначенная владельцем; пусто для роли по умолчанию
+	Username          string             `json:"username"`          // Последнее известное имя пользователя в Telegram без @
+}
+
+// legacyModeFlags — флаги режимов, которые хранились в состоянии до появления поля Mode.
+type legacyModeFlags struct {
+	IsTranslating         bool `json:"isTranslating"`
+	IsGenerative          bool `json:"isGenerative"`
+	IsChangingGenModel    bool `json:"isChangingGenModel"`
+	IsChangingHistorySize bool `json:"isChangingHistorySize"`
+}
+
+// mode возвращает название режима чата, соответствующее флагам, или пустую строку, если флаги не заданы.
+// Названия совпадают с режимами конечного автомата бота.
+func (f legacyModeFlags) mode() string {
+	switch {
+	case f.IsChangingGenModel:
+		return "changing_model"
+	case f.IsChangingHistorySize:
+		return "changing_history_size"
+	case f.IsGenerative:
+		return "generative"
+	case f.IsTranslating:
+		return "translating"
+	default:
+		return ""
+	}
+}
+
+// UnmarshalJSON читает состояние пользователя и переводит флаги режимов из старого формата в поле Mode,
+// чтобы после обновления чат остался в своём режиме.
+func (s *UserState) UnmarshalJSON(data []byte) error {
+	type plain UserState
+	var state struct {
+		plain
+		legacyModeFlags
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	*s = UserState(state.plain)
+	if s.Mode == "" {
+		s.Mode = state.legacyModeFlags.mode()
+	}
+	return nil
+}
+
+// Persona — именованная системная инструкция, которая задаёт роль ИИ в диалоге.
+type Persona struct {
+	ID     string `json:"id"`     // Идентификатор персоны, уникальный среди встроенных и пользовательских
+	Name   string `json:"name"`   // Название персоны для меню
+	Prompt string `json:"prompt"` // Системная инструкция персоны
+}
+
+// AIPreferences хранит персональные настройки генеративной модели пользователя.
+// Нулевые значения означают настройки провайдера по умолчанию.
+type AIPreferences struct {
+	Model        string   `json:"model,omitempty"`        // Название генеративной модели
+	HistoryLimit int      `json:"historyLimit,omitempty"` // Максимальное количество сообщений в истории диалога
+	Temperature  *float32 `json:"temperature,omitempty"`  // Температура для управления креативностью
+	MaxTokens    int      `json:"maxTokens,omitempty"`    // Максимальное количество токенов ответа
+	SystemPrompt string   `json:"systemPrompt,omitempty"` // Системная инструкция для модели
+	Persona      string   `json:"persona,omitempty"`      // Идентификатор выбранной персоны
+}
+
+// WithOverrides возвращает настройки, в которых заданные поля overrides заменяют текущие.
+// Пустые поля overrides не меняют настройки, nil не меняет ничего.
+func (p AIPreferences) WithOverrides(overrides *AIPreferences) AIPreferences {
+	if overrides == nil {
+		return p
+	}
+	if overrides.Model != "" {
+		p.Model = overrides.Model
+	}
+	if overrides.HistoryLimit > 0 {
+		p.HistoryLimit = overrides.HistoryLimit
+	}
+	if overrides.Temperature != nil {
+		temperature := *overrides.Temperature
+		p.Temperature = &temperature
+	}
+	if overrides.MaxTokens > 0 {
+		p.MaxTokens = overrides.MaxTokens
+	}
+	if overrides.SystemPrompt != "" {
+		p.SystemPrompt = overrides.SystemPrompt
+	}
+	if overrides.Persona != "" {
+		p.Persona = overrides.Persona
+	}
+	return p
+}
+
+// GenerationOptions возвращает параметры генерации, которые передаются провайдеру в каждом запросе.
+func (p AIPreferences) GenerationOptions() GenerationOptions {
+	return GenerationOptions{
+		Model:        p.Model,
+		Temperature:  p.Temperature,
+		MaxTokens:    p.MaxTokens,
+		SystemPrompt: p.SystemPrompt,
+	}
 }
 
 type Device struct {
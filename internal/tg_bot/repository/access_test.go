@@ -0,0 +1,50 @@
+package repository
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsersState_RolesSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	state := NewUsersStateMap(filepath.Join(dir, "keep_chat.json"))
+	state.SaveUsername(1, "Alice")
+	state.SaveRole(1, models.AccessAdmin)
+	state.SaveRole(2, models.AccessBanned)
+	state.SaveUsername(3, "bob")
+	// No snapshot after the changes: the process is killed here.
+
+	restored := NewUsersStateMap(filepath.Join(dir, "keep_chat.json"))
+	require.NoError(t, restored.ReadFileToMemoryURL())
+	assert.Equal(t, models.AccessAdmin, restored.GetRole(1))
+	assert.Empty(t, restored.GetRole(3))
+	assert.Equal(t, map[int64]models.AccessRole{1: models.AccessAdmin, 2: models.AccessBanned}, restored.GetAllRoles())
+	userID, ok := restored.FindUserByUsername("alice")
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), userID)
+	require.NoError(t, restored.SaveBatchToFile())
+
+	sqlite, err := NewUsersStateSQLite(filepath.Join(dir, "state.db"))
+	require.NoError(t, err)
+	defer sqlite.Close()
+	_, err = sqlite.ImportFromJSON(filepath.Join(dir, "keep_chat.json"))
+	require.NoError(t, err)
+
+	assert.Equal(t, models.AccessBanned, sqlite.GetRole(2))
+	userID, ok = sqlite.FindUserByUsername("BOB")
+	assert.True(t, ok)
+	assert.Equal(t, int64(3), userID)
+	_, ok = sqlite.FindUserByUsername("carol")
+	assert.False(t, ok)
+
+	sqlite.SaveUsername(3, "bobby")
+	sqlite.SaveRole(2, "")
+	_, ok = sqlite.FindUserByUsername("bob")
+	assert.False(t, ok, "the old username no longer matches")
+	assert.Equal(t, map[int64]models.AccessRole{1: models.AccessAdmin}, sqlite.GetAllRoles())
+}
@@ -0,0 +1,172 @@
+package repository
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// journalSuffix is appended to the snapshot path to get the path of its journal.
+const journalSuffix = ".wal"
+
+// journalEntry is a single mutation recorded in the journal, one JSON object per line.
+type journalEntry struct {
+	Op     string          `json:"op"`             // Name of the mutation, interpreted by the repository
+	ChatID int64           `json:"chatID"`         // Chat the mutation applies to
+	Data   json.RawMessage `json:"data,omitempty"` // Mutation payload, depends on Op
+}
+
+// journal is an append-only write-ahead log of repository mutations.
+//
+// Every entry is fsynced before append returns, so a mutation acknowledged to the caller survives
+// a crash between two snapshots. On start the entries are replayed on top of the last snapshot,
+// and after each snapshot the journal is truncated.
+type journal struct {
+	path string     // Path to the journal file
+	file *os.File   // Journal opened for appending, nil until the first write
+	mu   sync.Mutex // Serializes writes to the file
+}
+
+// newJournal creates a journal stored at the path. The file is opened on the first write.
+func newJournal(path string) *journal {
+	return &journal{path: path}
+}
+
+// append encodes the mutation, writes it to the end of the journal and fsyncs the file.
+// Arguments:
+//   - op: name of the mutation.
+//   - chatID: chat the mutation applies to.
+//   - data: mutation payload encoded to JSON, nil for mutations without payload.
+//
+// Returns an error if the entry cannot be encoded or durably written.
+func (j *journal) append(op string, chatID int64, data any) error {
+	entry := journalEntry{Op: op, ChatID: chatID}
+	if data != nil {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return fmt.Errorf("failed to encode journal entry %s: %w", op, err)
+		}
+		entry.Data = raw
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode journal entry %s: %w", op, err)
+	}
+	line = append(line, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file == nil {
+		j.file, err = os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			j.file = nil
+			return fmt.Errorf("failed to open journal %s: %w", j.path, err)
+		}
+	}
+	if _, err = j.file.Write(line); err != nil {
+		return fmt.Errorf("failed to write journal %s: %w", j.path, err)
+	}
+	if err = j.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync journal %s: %w", j.path, err)
+	}
+	return nil
+}
+
+// replay reads the journal and passes every entry to apply in the order they were written.
+//
+// A damaged tail, left by a crash in the middle of a write, is logged and cut off so that
+// new entries are not appended after it. A missing journal replays nothing.
+//
+// Returns the number of applied entries or an error if the journal cannot be read or apply fails.
+func (j *journal) replay(apply func(entry journalEntry) error) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	file, err := os.Open(j.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to open journal %s: %w", j.path, err)
+	}
+	defer func() {
+		if err = file.Close(); err != nil {
+			logrus.WithError(err).Errorf("Failed to close file: %v", err)
+		}
+	}()
+
+	reader := bufio.NewReader(file)
+	var applied int
+	var offset int64
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return applied, fmt.Errorf("failed to read journal %s: %w", j.path, readErr)
+		}
+		if len(line) == 0 {
+			break
+		}
+
+		var entry journalEntry
+		if line[len(line)-1] != '\n' || json.Unmarshal(line, &entry) != nil {
+			logrus.Warnf("Journal %s is damaged at offset %d, dropping the rest of it", j.path, offset)
+			if err = os.Truncate(j.path, offset); err != nil {
+				return applied, fmt.Errorf("failed to cut damaged journal %s: %w", j.path, err)
+			}
+			break
+		}
+		if err = apply(entry); err != nil {
+			return applied, fmt.Errorf("failed to replay journal %s at offset %d: %w", j.path, offset, err)
+		}
+		applied++
+		offset += int64(len(line))
+
+		if errors.Is(readErr, io.EOF) {
+			break
+		}
+	}
+	return applied, nil
+}
+
+// truncate drops all entries of the journal. It is called once the entries are part of a durable snapshot.
+func (j *journal) truncate() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var err error
+	if j.file != nil {
+		err = j.file.Truncate(0)
+	} else {
+		err = os.Truncate(j.path, 0)
+		if os.IsNotExist(err) {
+			return nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to truncate journal %s: %w", j.path, err)
+	}
+	return nil
+}
+
+// close closes the journal file if it is open.
+func (j *journal) close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	if err != nil {
+		return fmt.Errorf("failed to close journal %s: %w", j.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package repository
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsersState_ReplaysJournalAfterCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keep_chat.json")
+
+	state := NewUsersStateMap(path)
+	state.SetUserMode(1, "generative", "ИИ")
+	require.NoError(t, state.SaveBatchToFile())
+	state.StoreUserState(1, "ИИ", "hello", "")
+	state.SaveUserSmartHomeInfo(2, "token", map[string]*models.Device{"lamp": {Name: "lamp", ID: "42"}})
+	// No snapshot after the last changes: the process is killed here.
+
+	restored := NewUsersStateMap(path)
+	require.NoError(t, restored.ReadFileToMemoryURL())
+
+	assert.Equal(t, "generative", restored.GetUserMode(1))
+	assert.Equal(t, "hello", restored.BatchBuffer[1].LastUserMessages)
+	token, err := restored.GetUserSmartHomeToken(2)
+	assert.NoError(t, err)
+	assert.Equal(t, "token", token)
+}
+
+func TestUsersState_SaveCompactsJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keep_chat.json")
+
+	state := NewUsersStateMap(path)
+	state.SetUserMode(1, "translating", "перевод")
+	require.NoError(t, state.SaveBatchToFile())
+
+	info, err := os.Stat(path + journalSuffix)
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+
+	restored := NewUsersStateMap(path)
+	require.NoError(t, restored.ReadFileToMemoryURL())
+	assert.Equal(t, "translating", restored.GetUserMode(1))
+}
+
+func TestAiDialogHistory_ReplayIsIdempotent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dialog_ai.json")
+	msg := func(content string) models.Message { return models.Message{Role: "user", Content: content} }
+
+	dialog := NewAiDialogHistory(path)
+	require.NoError(t, dialog.SaveMsgToDialog(1, msg("first")))
+	require.NoError(t, dialog.SaveMsgToDialog(1, msg("second")))
+	require.NoError(t, dialog.SaveMsgToDialog(2, msg("dropped")))
+	require.NoError(t, dialog.ClearHistory(2))
+
+	// Crash after the snapshot was written but before the journal was truncated.
+	journalCopy, err := os.ReadFile(path + journalSuffix)
+	require.NoError(t, err)
+	require.NoError(t, dialog.SaveBatchToFile())
+	require.NoError(t, os.WriteFile(path+journalSuffix, journalCopy, 0644))
+
+	restored := NewAiDialogHistory(path)
+	require.NoError(t, restored.LoadDialogFromFile())
+
+	history, err := restored.GetDialogHistory(1)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.Message{msg("first"), msg("second")}, history)
+	history, err = restored.GetDialogHistory(2)
+	assert.NoError(t, err)
+	assert.Empty(t, history)
+}
+
+func TestJournal_CutsDamagedTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dialog_ai.json")
+
+	dialog := NewAiDialogHistory(path)
+	require.NoError(t, dialog.SaveMsgToDialog(1, models.Message{Role: "user", Content: "kept"}))
+	require.NoError(t, dialog.Close())
+
+	file, err := os.OpenFile(path+journalSuffix, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"op":"append","chatID":1,"da`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	restored := NewAiDialogHistory(path)
+	require.NoError(t, restored.LoadDialogFromFile())
+	require.NoError(t, restored.SaveMsgToDialog(1, models.Message{Role: "assistant", Content: "after crash"}))
+
+	again := NewAiDialogHistory(path)
+	require.NoError(t, again.LoadDialogFromFile())
+	history, err := again.GetDialogHistory(1)
+	assert.NoError(t, err)
+	assert.Len(t, history, 2)
+	assert.Equal(t, "after crash", history[1].Content)
+}
@@ -0,0 +1,41 @@
+package repository
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsersState_QuotaSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	window := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+
+	state := NewUsersStateMap(filepath.Join(dir, "keep_chat.json"))
+	state.SaveQuota(1, models.Quota{Tier: models.QuotaTierUnlimited})
+	state.SaveQuota(2, models.Quota{WindowStart: window, WindowRequests: 3})
+	state.SetUserMode(3, "generative", "ИИ")
+	// No snapshot after the changes: the process is killed here.
+
+	restored := NewUsersStateMap(filepath.Join(dir, "keep_chat.json"))
+	require.NoError(t, restored.ReadFileToMemoryURL())
+	assert.Equal(t, 3, restored.GetQuota(2).WindowRequests)
+	assert.Len(t, restored.GetAllQuotas(), 2, "chats without a quota are left out")
+	require.NoError(t, restored.SaveBatchToFile())
+
+	sqlite, err := NewUsersStateSQLite(filepath.Join(dir, "state.db"))
+	require.NoError(t, err)
+	defer sqlite.Close()
+	_, err = sqlite.ImportFromJSON(filepath.Join(dir, "keep_chat.json"))
+	require.NoError(t, err)
+
+	assert.Equal(t, models.QuotaTierUnlimited, sqlite.GetQuota(1).Tier)
+	assert.True(t, window.Equal(sqlite.GetQuota(2).WindowStart))
+	sqlite.SaveQuota(2, models.Quota{Tier: models.QuotaTierExtended})
+	quotas := sqlite.GetAllQuotas()
+	assert.Len(t, quotas, 2)
+	assert.Equal(t, models.QuotaTierExtended, quotas[2].Tier)
+}
@@ -0,0 +1,75 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	_ "modernc.org/sqlite" // Pure Go SQLite driver registered as "sqlite"
+)
+
+// openSQLite opens the SQLite database at the path and applies the pending migrations.
+//
+// The migrations are applied in order, each in its own transaction, and the number of applied
+// migrations is stored in the schema_migrations table. Migration N has version N+1.
+func openSQLite(dbPath string, migrations []string) (*sql.DB, error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)", dbPath)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database %s: %w", dbPath, err)
+	}
+	// SQLite serializes writers anyway, one connection avoids SQLITE_BUSY between our own goroutines.
+	db.SetMaxOpenConns(1)
+
+	if err = db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to connect to sqlite database %s: %w", dbPath, err)
+	}
+	if err = migrateSQLite(db, migrations); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to migrate sqlite database %s: %w", dbPath, err)
+	}
+	return db, nil
+}
+
+// migrateSQLite applies the migrations that are not recorded in schema_migrations yet.
+func migrateSQLite(db *sql.DB, migrations []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TEXT NOT NULL
+	)`); err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	var current int
+	if err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+
+	for i := current; i < len(migrations); i++ {
+		version := i + 1
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("begin migration %d: %w", version, err)
+		}
+		if _, err = tx.ExecContext(ctx, migrations[i]); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("apply migration %d: %w", version, err)
+		}
+		if _, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`,
+			version, time.Now().UTC().Format(time.RFC3339)); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("record migration %d: %w", version, err)
+		}
+		if err = tx.Commit(); err != nil {
+			return fmt.Errorf("commit migration %d: %w", version, err)
+		}
+		logrus.Infof("Applied sqlite schema migration %d", version)
+	}
+	return nil
+}
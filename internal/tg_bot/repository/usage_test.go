@@ -0,0 +1,59 @@
+package repository
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testUsage = []models.UsageEntry{
+	{Day: "2026-10-16", Model: "deepseek-chat", Requests: 1, PromptTokens: 100, CompletionTokens: 20},
+	{Day: "2026-10-17", Model: "deepseek-chat", Requests: 1, PromptTokens: 150, CompletionTokens: 30},
+	{Day: "2026-10-17", Model: "openai/gpt-4o", Requests: 1, PromptTokens: 10, CompletionTokens: 5, Cost: 0.25},
+	{Day: "2026-10-17", Model: "deepseek-chat", Requests: 1, PromptTokens: 50, CompletionTokens: 10},
+}
+
+var wantUsage = []models.UsageEntry{
+	{Day: "2026-10-16", Model: "deepseek-chat", Requests: 1, PromptTokens: 100, CompletionTokens: 20},
+	{Day: "2026-10-17", Model: "deepseek-chat", Requests: 2, PromptTokens: 200, CompletionTokens: 40},
+	{Day: "2026-10-17", Model: "openai/gpt-4o", Requests: 1, PromptTokens: 10, CompletionTokens: 5, Cost: 0.25},
+}
+
+func TestUsersState_UsageSurvivesCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keep_chat.json")
+
+	state := NewUsersStateMap(path)
+	for _, entry := range testUsage {
+		state.AddUsage(1, entry)
+	}
+	state.SetUserMode(2, "generative", "ИИ")
+	// No snapshot after the changes: the process is killed here.
+
+	restored := NewUsersStateMap(path)
+	require.NoError(t, restored.ReadFileToMemoryURL())
+	assert.Equal(t, wantUsage, restored.GetUsage(1))
+	assert.Empty(t, restored.GetUsage(2))
+	assert.Equal(t, map[int64][]models.UsageEntry{1: wantUsage}, restored.GetAllUsage(), "chats without usage are left out")
+}
+
+func TestUsersStateSQLite_Usage(t *testing.T) {
+	dir := t.TempDir()
+	jsonState := NewUsersStateMap(filepath.Join(dir, "keep_chat.json"))
+	jsonState.AddUsage(2, testUsage[0])
+	require.NoError(t, jsonState.SaveBatchToFile())
+
+	state, err := NewUsersStateSQLite(filepath.Join(dir, "state.db"))
+	require.NoError(t, err)
+	defer state.Close()
+	for _, entry := range testUsage {
+		state.AddUsage(1, entry)
+	}
+	_, err = state.ImportFromJSON(filepath.Join(dir, "keep_chat.json"))
+	require.NoError(t, err)
+
+	assert.Equal(t, wantUsage, state.GetUsage(1))
+	assert.Equal(t, map[int64][]models.UsageEntry{1: wantUsage, 2: testUsage[:1]}, state.GetAllUsage())
+}
@@ -2,24 +2,69 @@ package repository
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
-	"github.com/sirupsen/logrus"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxThreadsPerChat  = 20                // Maximum number of dialog threads of one chat
+	defaultThreadTitle = "Основной диалог" // Title of the thread created implicitly or migrated from the old format
+)
+
+// Operations recorded in the dialog history journal.
+const (
+	journalOpSaveDialog   = "save"    // Replaces the messages of a thread, the payload is a dialogSave
+	journalOpAppendDialog = "append"  // Puts a message at a position of a thread, the payload is a dialogAppend
+	journalOpClearDialog  = "clear"   // Removes the messages of a thread, the payload is a dialogClear
+	journalOpThreads      = "threads" // Replaces the thread list of a chat without messages, the payload is a dialogThreads
 )
 
+// dialogSave is the payload of a save journal entry.
+type dialogSave struct {
+	Thread   string           `json:"thread"`   // Thread the messages belong to
+	Messages []models.Message `json:"messages"` // New messages of the thread
+}
+
+// dialogAppend is the payload of an append journal entry.
+// The message is stored with its position, so replaying an entry that is already part of the snapshot is harmless.
+type dialogAppend struct {
+	Thread  string         `json:"thread"`  // Thread the message belongs to, empty in entries written before threads existed
+	Index   int            `json:"index"`   // Position of the message in the thread
+	Message models.Message `json:"message"` // Appended message
+}
+
+// dialogClear is the payload of a clear journal entry.
+type dialogClear struct {
+	Thread string `json:"thread"` // Thread to clear
+}
+
+// dialogThreads is the payload of a threads journal entry: the chat's threads without their messages.
+type dialogThreads struct {
+	ActiveID string                `json:"activeID"`
+	NextID   int                   `json:"nextID"`
+	Threads  []models.DialogThread `json:"threads"`
+}
+
 // AiDialogHistory manages the storage and retrieval of dialog history for AI conversations.
 //
-// It maintains a thread-safe in-memory map of dialog histories, where each entry is associated with a chat ID.
-// The dialog history can be persisted to and loaded from a file in JSON format. The struct ensures thread safety
-// using a read-write mutex and prevents external modification by returning copies of the dialog history.
+// Every chat may have several named dialog threads, one of them active. The methods that take only a chat ID
+// work with the active thread. The struct keeps a thread-safe in-memory map of the chats' threads, which can be
+// persisted to and loaded from a file in JSON format, and prevents external modification by returning copies.
+// Every change made between two snapshots is recorded in a write-ahead journal next to the storage file.
 type AiDialogHistory struct {
-	dialogHistory   map[int64][]models.Message // In-memory map of chat ID to dialog history
-	mu              sync.RWMutex               // Mutex for thread-safe access
-	storageFilePath string                     // Path to the file where dialog history is persisted
+	dialogHistory   map[int64]*models.ChatDialogs // In-memory map of chat ID to dialog threads
+	mu              sync.RWMutex                  // Mutex for thread-safe access
+	storageFilePath string                        // Path to the file where dialog history is persisted
+	journal         *journal                      // Write-ahead journal of changes since the last snapshot
 }
 
 // NewAiDialogHistory creates a new instance of AiDialogHistory with the specified storage file path.
@@ -33,17 +78,235 @@ type AiDialogHistory struct {
 //   - *AiDialogHistory: A pointer to the initialized AiDialogHistory instance.
 func NewAiDialogHistory(storageFilePath string) *AiDialogHistory {
 	return &AiDialogHistory{
-		dialogHistory:   make(map[int64][]models.Message),
+		dialogHistory:   make(map[int64]*models.ChatDialogs),
 		mu:              sync.RWMutex{},
 		storageFilePath: storageFilePath,
+		journal:         newJournal(storageFilePath + journalSuffix),
+	}
+}
+
+// chat returns the dialogs of the chat, creating an empty set if create is true.
+// Must be called with the lock held, the write lock if create is true.
+func (d *AiDialogHistory) chat(chatID int64, create bool) *models.ChatDialogs {
+	chat, ok := d.dialogHistory[chatID]
+	if !ok && create {
+		chat = &models.ChatDialogs{NextID: 1}
+		d.dialogHistory[chatID] = chat
+	}
+	return chat
+}
+
+// findThread returns the thread with the ID, or nil if the chat has no such thread.
+func findThread(chat *models.ChatDialogs, threadID string) *models.DialogThread {
+	if chat == nil {
+		return nil
+	}
+	for _, thread := range chat.Threads {
+		if thread.ID == threadID {
+			return thread
+		}
+	}
+	return nil
+}
+
+// addThread appends a new thread to the chat and makes it active. Must be called with the write lock held.
+func addThread(chat *models.ChatDialogs, title string) *models.DialogThread {
+	if chat.NextID < 1 {
+		chat.NextID = 1
+	}
+	thread := &models.DialogThread{
+		ID:        strconv.Itoa(chat.NextID),
+		Title:     title,
+		CreatedAt: time.Now().UTC(),
+		Messages:  []models.Message{},
+	}
+	chat.NextID++
+	chat.Threads = append(chat.Threads, thread)
+	chat.ActiveID = thread.ID
+	return thread
+}
+
+// activeThread returns the active thread of the chat. If the chat has none and create is true,
+// a default thread is created and its metadata is journaled. Must be called with the write lock held if create is true.
+func (d *AiDialogHistory) activeThread(chatID int64, create bool) (*models.DialogThread, error) {
+	chat := d.chat(chatID, create)
+	if thread := findThread(chat, chatActiveID(chat)); thread != nil || !create {
+		return thread, nil
+	}
+	if len(chat.Threads) >= maxThreadsPerChat {
+		return nil, models.ErrTooManyThreads
+	}
+
+	previousActive := chat.ActiveID
+	thread := addThread(chat, defaultThreadTitle)
+	if err := d.journalThreads(chatID, chat); err != nil {
+		chat.Threads = chat.Threads[:len(chat.Threads)-1]
+		chat.NextID--
+		chat.ActiveID = previousActive
+		return nil, err
+	}
+	return thread, nil
+}
+
+// chatActiveID returns the active thread ID of the chat, or an empty string for a chat without dialogs.
+func chatActiveID(chat *models.ChatDialogs) string {
+	if chat == nil {
+		return ""
+	}
+	return chat.ActiveID
+}
+
+// journalThreads records the thread list of the chat in the journal. Must be called with the write lock held.
+func (d *AiDialogHistory) journalThreads(chatID int64, chat *models.ChatDialogs) error {
+	payload := dialogThreads{ActiveID: chat.ActiveID, NextID: chat.NextID}
+	for _, thread := range chat.Threads {
+		meta := *thread
+		meta.Messages = nil
+		payload.Threads = append(payload.Threads, meta)
+	}
+	return d.journal.append(journalOpThreads, chatID, payload)
+}
+
+// threadInfo describes the thread for the callers.
+func threadInfo(chat *models.ChatDialogs, thread *models.DialogThread) models.DialogThreadInfo {
+	return models.DialogThreadInfo{
+		ID:        thread.ID,
+		Title:     thread.Title,
+		CreatedAt: thread.CreatedAt,
+		Messages:  len(thread.Messages),
+		Active:    thread.ID == chat.ActiveID,
+	}
+}
+
+// replayJournal applies the changes recorded in the journal on top of the loaded snapshot.
+// Must be called with the write lock held.
+func (d *AiDialogHistory) replayJournal() error {
+	// replayThread returns the thread an entry applies to; entries written before threads existed use the active one.
+	replayThread := func(chatID int64, threadID string) *models.DialogThread {
+		chat := d.chat(chatID, true)
+		if threadID == "" {
+			threadID = chat.ActiveID
+		}
+		if thread := findThread(chat, threadID); thread != nil {
+			return thread
+		}
+		if threadID == "" {
+			return addThread(chat, defaultThreadTitle)
+		}
+		return nil
+	}
+
+	applied, err := d.journal.replay(func(entry journalEntry) error {
+		switch entry.Op {
+		case journalOpSaveDialog:
+			var payload dialogSave
+			if bytes.HasPrefix(bytes.TrimSpace(entry.Data), []byte("[")) {
+				// Entries written before threads existed carry only the messages of the single dialog
+				if err := json.Unmarshal(entry.Data, &payload.Messages); err != nil {
+					return fmt.Errorf("failed to decode dialog of chatID %d: %w", entry.ChatID, err)
+				}
+			} else if err := json.Unmarshal(entry.Data, &payload); err != nil {
+				return fmt.Errorf("failed to decode dialog of chatID %d: %w", entry.ChatID, err)
+			}
+			if thread := replayThread(entry.ChatID, payload.Thread); thread != nil {
+				thread.Messages = payload.Messages
+			}
+		case journalOpAppendDialog:
+			var payload dialogAppend
+			if err := json.Unmarshal(entry.Data, &payload); err != nil {
+				return fmt.Errorf("failed to decode message of chatID %d: %w", entry.ChatID, err)
+			}
+			if thread := replayThread(entry.ChatID, payload.Thread); thread != nil {
+				if payload.Index < len(thread.Messages) {
+					thread.Messages = thread.Messages[:payload.Index]
+				}
+				thread.Messages = append(thread.Messages, payload.Message)
+			}
+		case journalOpClearDialog:
+			var payload dialogClear
+			if len(entry.Data) > 0 {
+				if err := json.Unmarshal(entry.Data, &payload); err != nil {
+					return fmt.Errorf("failed to decode clear of chatID %d: %w", entry.ChatID, err)
+				}
+			}
+			if thread := replayThread(entry.ChatID, payload.Thread); thread != nil {
+				thread.Messages = []models.Message{}
+			}
+		case journalOpThreads:
+			var payload dialogThreads
+			if err := json.Unmarshal(entry.Data, &payload); err != nil {
+				return fmt.Errorf("failed to decode threads of chatID %d: %w", entry.ChatID, err)
+			}
+			old := d.chat(entry.ChatID, true)
+			chat := &models.ChatDialogs{ActiveID: payload.ActiveID, NextID: payload.NextID}
+			for _, meta := range payload.Threads {
+				thread := meta
+				thread.Messages = []models.Message{}
+				if existing := findThread(old, meta.ID); existing != nil {
+					thread.Messages = existing.Messages
+				}
+				chat.Threads = append(chat.Threads, &thread)
+			}
+			d.dialogHistory[entry.ChatID] = chat
+		default:
+			logrus.Warnf("Skipping unknown journal operation %q", entry.Op)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if applied > 0 {
+		logrus.Infof("Replayed %d dialog history changes from %s", applied, d.journal.path)
+	}
+	return nil
+}
+
+// Close closes the journal file.
+func (d *AiDialogHistory) Close() error {
+	return d.journal.close()
+}
+
+// decodeDialogSnapshot decodes the storage file. Chats stored in the format used before threads existed,
+// a plain list of messages, are migrated into a single default thread.
+func decodeDialogSnapshot(data []byte) (map[int64]*models.ChatDialogs, error) {
+	var raw map[int64]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	result := make(map[int64]*models.ChatDialogs, len(raw))
+	migrated := 0
+	for chatID, value := range raw {
+		if bytes.HasPrefix(bytes.TrimSpace(value), []byte("[")) {
+			var messages []models.Message
+			if err := json.Unmarshal(value, &messages); err != nil {
+				return nil, fmt.Errorf("chatID %d: %w", chatID, err)
+			}
+			chat := &models.ChatDialogs{NextID: 1}
+			addThread(chat, defaultThreadTitle).Messages = messages
+			result[chatID] = chat
+			migrated++
+			continue
+		}
+
+		var chat models.ChatDialogs
+		if err := json.Unmarshal(value, &chat); err != nil {
+			return nil, fmt.Errorf("chatID %d: %w", chatID, err)
+		}
+		result[chatID] = &chat
+	}
+	if migrated > 0 {
+		logrus.Infof("Migrated dialog history of %d chats to named threads", migrated)
 	}
+	return result, nil
 }
 
 // LoadDialogFromFile loads the dialog history from the configured storage file.
 //
-// It reads the file specified by storageFilePath and unmarshals its contents into the in-memory dialog history map.
-// If the file does not exist, it logs a message and returns nil. If there are errors during reading or unmarshaling,
-// it returns an error with details.
+// It reads the file specified by storageFilePath and unmarshals its contents into the in-memory dialog history map,
+// then replays the journal of changes made after the snapshot. If the file does not exist, only the journal is replayed.
+// If there are errors during reading or unmarshaling, it returns an error with details.
 //
 // Returns:
 //   - error: An error if reading or unmarshaling the file fails; nil if the file does not exist or the operation succeeds.
@@ -55,127 +318,356 @@ func (d *AiDialogHistory) LoadDialogFromFile() error {
 	if err != nil {
 		if os.IsNotExist(err) {
 			logrus.Infof("File %s was not found", d.storageFilePath)
-			return nil
+			return d.replayJournal()
 		}
 		return fmt.Errorf("failed to read dialog history from file %s: %w", d.storageFilePath, err)
 	}
 
 	if len(data) == 0 {
 		logrus.Infof("Dialog history file %s is empty, starting with empty history", d.storageFilePath)
-		return nil
+		return d.replayJournal()
 	}
 
-	if err = json.Unmarshal(data, &d.dialogHistory); err != nil {
+	history, err := decodeDialogSnapshot(data)
+	if err != nil {
 		logrus.WithError(err).Error("failed to unmarshal dialog history:")
 		return fmt.Errorf("failed to unmarshal dialog history: %w", err)
 	}
+	d.dialogHistory = history
 	logrus.Infof("File %s successfully loaded", d.storageFilePath)
-	return nil
+	return d.replayJournal()
 }
 
-// SaveDialog saves a dialog history for the specified chat ID.
+// SaveDialog replaces the history of the chat's active thread, creating a default thread if the chat has none.
 //
-// It creates a copy of the provided dialog to prevent external modifications and stores it in the in-memory map
-// under the given chat ID. The operation is thread-safe due to the use of a mutex.
+// It creates a copy of the provided dialog to prevent external modifications and stores it in the in-memory map.
+// The operation is thread-safe due to the use of a mutex.
 //
 // Parameters:
 //   - chatID: The ID of the chat associated with the dialog history.
 //   - dialog: A slice of models.Message representing the dialog history to save.
 //
 // Returns:
-//   - error: Always nil, as this operation does not currently fail.
+//   - error: An error if the change cannot be written to the journal.
 func (d *AiDialogHistory) SaveDialog(chatID int64, dialog []models.Message) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
+	thread, err := d.activeThread(chatID, true)
+	if err != nil {
+		return err
+	}
+
 	// Сохраняем копию диалога, чтобы избежать изменения внешнего среза
 	dialogCopy := make([]models.Message, len(dialog))
 	copy(dialogCopy, dialog)
 
-	d.dialogHistory[chatID] = dialogCopy
+	if err = d.journal.append(journalOpSaveDialog, chatID, dialogSave{Thread: thread.ID, Messages: dialogCopy}); err != nil {
+		return err
+	}
+	thread.Messages = dialogCopy
 	return nil
 }
 
-// SaveMsgToDialog appends a single message to the dialog history for the specified chat ID.
+// SaveMsgToDialog appends a single message to the history of the chat's active thread.
 //
-// It retrieves the current dialog history for the chat ID, appends the new message, and updates the in-memory map.
-// If no history exists for the chat ID, it creates a new history. The operation is thread-safe due to the use of a mutex.
+// If the chat has no threads, a default thread is created. The operation is thread-safe due to the use of a mutex.
 //
 // Parameters:
 //   - chatID: The ID of the chat associated with the dialog history.
 //   - msg: The models.Message to append to the dialog history.
 //
 // Returns:
-//   - error: Always nil, as this operation does not currently fail.
+//   - error: An error if the change cannot be written to the journal.
 func (d *AiDialogHistory) SaveMsgToDialog(chatID int64, msg models.Message) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	history, exists := d.dialogHistory[chatID]
-	if !exists {
-		history = []models.Message{}
+	thread, err := d.activeThread(chatID, true)
+	if err != nil {
+		return err
 	}
 
-	history = append(history, msg)
-	d.dialogHistory[chatID] = history
+	payload := dialogAppend{Thread: thread.ID, Index: len(thread.Messages), Message: msg}
+	if err = d.journal.append(journalOpAppendDialog, chatID, payload); err != nil {
+		return err
+	}
+	thread.Messages = append(thread.Messages, msg)
 	return nil
 }
 
-// GetDialogHistory retrieves the dialog history for the specified chat ID.
+// GetDialogHistory retrieves the history of the chat's active thread.
 //
-// It returns a copy of the dialog history to prevent external modifications. If no history exists for the chat ID,
+// It returns a copy of the dialog history to prevent external modifications. If the chat has no active thread,
 // an empty slice is returned. The operation is thread-safe due to the use of a read-only mutex.
 //
 // Parameters:
 //   - chatID: The ID of the chat whose dialog history is to be retrieved.
 //
 // Returns:
-//   - []models.Message: A copy of the dialog history for the chat ID, or an empty slice if none exists.
+//   - []models.Message: A copy of the dialog history of the active thread, or an empty slice if none exists.
 //   - error: Always nil, as this operation does not currently fail.
 func (d *AiDialogHistory) GetDialogHistory(chatID int64) ([]models.Message, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	history, exists := d.dialogHistory[chatID]
-	if !exists {
+	thread, _ := d.activeThread(chatID, false)
+	if thread == nil {
 		return []models.Message{}, nil
 	}
 
 	// Возвращаем копию истории, чтобы избежать изменения оригинала
-	historyCopy := make([]models.Message, len(history))
-	copy(historyCopy, history)
+	historyCopy := make([]models.Message, len(thread.Messages))
+	copy(historyCopy, thread.Messages)
 	return historyCopy, nil
 }
 
-// ClearHistory removes the dialog history for the specified chat ID.
-//
-// It deletes the dialog history entry associated with the chat ID from the in-memory map. The operation is
-// thread-safe due to the use of a mutex.
+// ClearHistory removes the messages of the chat's active thread. The thread itself and its settings are kept.
 //
 // Parameters:
 //   - chatID: The ID of the chat whose dialog history is to be cleared.
 //
 // Returns:
-//   - error: Always nil, as this operation does not currently fail.
+//   - error: An error if the change cannot be written to the journal.
 func (d *AiDialogHistory) ClearHistory(chatID int64) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	delete(d.dialogHistory, chatID)
+	thread, _ := d.activeThread(chatID, false)
+	if thread == nil {
+		return nil
+	}
+	if err := d.journal.append(journalOpClearDialog, chatID, dialogClear{Thread: thread.ID}); err != nil {
+		return err
+	}
+	thread.Messages = []models.Message{}
+	return nil
+}
+
+// CreateThread creates a new dialog thread in the chat and makes it active.
+//
+// Parameters:
+//   - chatID: The ID of the chat.
+//   - title: The title of the new thread.
+//
+// Returns:
+//   - models.DialogThreadInfo: The description of the created thread.
+//   - error: models.ErrEmptyTitle, models.ErrTooManyThreads, or an error if the change cannot be journaled.
+func (d *AiDialogHistory) CreateThread(chatID int64, title string) (models.DialogThreadInfo, error) {
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return models.DialogThreadInfo{}, models.ErrEmptyTitle
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	chat := d.chat(chatID, true)
+	if len(chat.Threads) >= maxThreadsPerChat {
+		return models.DialogThreadInfo{}, models.ErrTooManyThreads
+	}
+
+	previousActive := chat.ActiveID
+	thread := addThread(chat, title)
+	if err := d.journalThreads(chatID, chat); err != nil {
+		chat.Threads = chat.Threads[:len(chat.Threads)-1]
+		chat.NextID--
+		chat.ActiveID = previousActive
+		return models.DialogThreadInfo{}, err
+	}
+	return threadInfo(chat, thread), nil
+}
+
+// ListThreads returns the dialog threads of the chat in the order they were created.
+//
+// Parameters:
+//   - chatID: The ID of the chat.
+//
+// Returns:
+//   - []models.DialogThreadInfo: The descriptions of the threads, empty if the chat has none.
+//   - error: Always nil, as this operation does not currently fail.
+func (d *AiDialogHistory) ListThreads(chatID int64) ([]models.DialogThreadInfo, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	chat := d.chat(chatID, false)
+	if chat == nil {
+		return []models.DialogThreadInfo{}, nil
+	}
+	infos := make([]models.DialogThreadInfo, 0, len(chat.Threads))
+	for _, thread := range chat.Threads {
+		infos = append(infos, threadInfo(chat, thread))
+	}
+	return infos, nil
+}
+
+// SwitchThread makes the thread active.
+//
+// Parameters:
+//   - chatID: The ID of the chat.
+//   - threadID: The ID of the thread to switch to.
+//
+// Returns:
+//   - models.DialogThreadInfo: The description of the new active thread.
+//   - error: models.ErrThreadNotFound, or an error if the change cannot be journaled.
+func (d *AiDialogHistory) SwitchThread(chatID int64, threadID string) (models.DialogThreadInfo, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	chat := d.chat(chatID, false)
+	thread := findThread(chat, threadID)
+	if thread == nil {
+		return models.DialogThreadInfo{}, fmt.Errorf("%w: %s", models.ErrThreadNotFound, threadID)
+	}
+
+	previousActive := chat.ActiveID
+	chat.ActiveID = thread.ID
+	if err := d.journalThreads(chatID, chat); err != nil {
+		chat.ActiveID = previousActive
+		return models.DialogThreadInfo{}, err
+	}
+	return threadInfo(chat, thread), nil
+}
+
+// RenameThread changes the title of the thread.
+//
+// Parameters:
+//   - chatID: The ID of the chat.
+//   - threadID: The ID of the thread to rename.
+//   - title: The new title.
+//
+// Returns:
+//   - error: models.ErrEmptyTitle, models.ErrThreadNotFound, or an error if the change cannot be journaled.
+func (d *AiDialogHistory) RenameThread(chatID int64, threadID, title string) error {
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return models.ErrEmptyTitle
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	chat := d.chat(chatID, false)
+	thread := findThread(chat, threadID)
+	if thread == nil {
+		return fmt.Errorf("%w: %s", models.ErrThreadNotFound, threadID)
+	}
+
+	previousTitle := thread.Title
+	thread.Title = title
+	if err := d.journalThreads(chatID, chat); err != nil {
+		thread.Title = previousTitle
+		return err
+	}
+	return nil
+}
+
+// DeleteThread removes the thread with its history. If the active thread is removed,
+// the most recently created remaining thread becomes active.
+//
+// Parameters:
+//   - chatID: The ID of the chat.
+//   - threadID: The ID of the thread to delete.
+//
+// Returns:
+//   - error: models.ErrThreadNotFound, or an error if the change cannot be journaled.
+func (d *AiDialogHistory) DeleteThread(chatID int64, threadID string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	chat := d.chat(chatID, false)
+	if findThread(chat, threadID) == nil {
+		return fmt.Errorf("%w: %s", models.ErrThreadNotFound, threadID)
+	}
+
+	previous := *chat
+	remaining := make([]*models.DialogThread, 0, len(chat.Threads))
+	for _, thread := range chat.Threads {
+		if thread.ID != threadID {
+			remaining = append(remaining, thread)
+		}
+	}
+	chat.Threads = remaining
+	if chat.ActiveID == threadID {
+		chat.ActiveID = ""
+		if len(remaining) > 0 {
+			chat.ActiveID = remaining[len(remaining)-1].ID
+		}
+	}
+	if err := d.journalThreads(chatID, chat); err != nil {
+		*chat = previous
+		return err
+	}
+	return nil
+}
+
+// GetThreadSettings returns the AI settings of the chat's active thread.
+//
+// Parameters:
+//   - chatID: The ID of the chat.
+//
+// Returns:
+//   - *models.AIPreferences: A copy of the thread settings, nil if the chat has no active thread or it has no own settings.
+//   - error: Always nil, as this operation does not currently fail.
+func (d *AiDialogHistory) GetThreadSettings(chatID int64) (*models.AIPreferences, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	thread, _ := d.activeThread(chatID, false)
+	if thread == nil || thread.Settings == nil {
+		return nil, nil
+	}
+	settings := *thread.Settings
+	if settings.Temperature != nil {
+		temperature := *settings.Temperature
+		settings.Temperature = &temperature
+	}
+	return &settings, nil
+}
+
+// SaveThreadSettings replaces the AI settings of the chat's active thread, creating a default thread if the chat has none.
+//
+// Parameters:
+//   - chatID: The ID of the chat.
+//   - settings: The new thread settings, nil to inherit the user's settings.
+//
+// Returns:
+//   - error: An error if the change cannot be journaled.
+func (d *AiDialogHistory) SaveThreadSettings(chatID int64, settings *models.AIPreferences) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	thread, err := d.activeThread(chatID, true)
+	if err != nil {
+		return err
+	}
+
+	var settingsCopy *models.AIPreferences
+	if settings != nil {
+		value := *settings
+		settingsCopy = &value
+	}
+	previous := thread.Settings
+	thread.Settings = settingsCopy
+	if err = d.journalThreads(chatID, d.chat(chatID, false)); err != nil {
+		thread.Settings = previous
+		return err
+	}
 	return nil
 }
 
 // SaveBatchToFile persists the entire dialog history to the configured storage file.
 //
 // It marshals the in-memory dialog history map to JSON format and writes it to the file specified by
-// storageFilePath. The operation is thread-safe due to the use of a read-only mutex. It logs the time taken
-// to complete the operation, and the number of user states saved.
+// storageFilePath, then truncates the journal. The write lock is held for the whole save, so no change can slip
+// between the snapshot and the truncation. It logs the time taken to complete the operation, and the number
+// of user states saved.
 //
 // Returns:
 //   - error: An error if marshaling or writing to the file fails; nil on success.
 func (d *AiDialogHistory) SaveBatchToFile() error {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
 	startTime := time.Now()
 
@@ -199,10 +691,18 @@ func (d *AiDialogHistory) SaveBatchToFile() error {
 	if err = writer.Flush(); err != nil {
 		return fmt.Errorf("failed to flush temp file %s: %w", tempPath, err)
 	}
+	if err = file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync temp file %s: %w", tempPath, err)
+	}
 	if err = os.Rename(tempPath, d.storageFilePath); err != nil {
 		return fmt.Errorf("failed to rename temp file %s to %s: %w", tempPath, d.storageFilePath, err)
 	}
 
+	// The snapshot now contains every journaled change
+	if err = d.journal.truncate(); err != nil {
+		return err
+	}
+
 	elapsedTime := time.Since(startTime)
 	logrus.Infof("Saved %d user states to %s in %v", len(d.dialogHistory), d.storageFilePath, elapsedTime)
 	return nil
@@ -0,0 +1,80 @@
+package repository
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAiDialogHistory_MigratesLegacySnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dialog_ai.json")
+	legacy := `{"1": [{"role": "user", "content": "hi"}, {"role": "assistant", "content": "hello"}]}`
+	require.NoError(t, os.WriteFile(path, []byte(legacy), 0644))
+
+	dialog := NewAiDialogHistory(path)
+	require.NoError(t, dialog.LoadDialogFromFile())
+
+	threads, err := dialog.ListThreads(1)
+	require.NoError(t, err)
+	require.Len(t, threads, 1)
+	assert.Equal(t, defaultThreadTitle, threads[0].Title)
+	assert.True(t, threads[0].Active)
+	assert.Equal(t, 2, threads[0].Messages)
+
+	history, err := dialog.GetDialogHistory(1)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", history[1].Content)
+}
+
+func TestAiDialogHistory_ThreadsKeepOwnHistoryAndSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dialog_ai.json")
+	msg := func(content string) models.Message { return models.Message{Role: "user", Content: content} }
+
+	dialog := NewAiDialogHistory(path)
+	require.NoError(t, dialog.SaveMsgToDialog(1, msg("default thread")))
+	work, err := dialog.CreateThread(1, "Работа")
+	require.NoError(t, err)
+	require.NoError(t, dialog.SaveMsgToDialog(1, msg("work thread")))
+	require.NoError(t, dialog.SaveThreadSettings(1, &models.AIPreferences{SystemPrompt: "be brief"}))
+	require.NoError(t, dialog.RenameThread(1, work.ID, "Проект"))
+
+	_, err = dialog.CreateThread(1, "  ")
+	assert.ErrorIs(t, err, models.ErrEmptyTitle)
+	_, err = dialog.SwitchThread(1, "42")
+	assert.ErrorIs(t, err, models.ErrThreadNotFound)
+
+	// No snapshot: the threads are restored from the journal only.
+	restored := NewAiDialogHistory(path)
+	require.NoError(t, restored.LoadDialogFromFile())
+
+	history, err := restored.GetDialogHistory(1)
+	require.NoError(t, err)
+	assert.Equal(t, []models.Message{msg("work thread")}, history)
+	settings, err := restored.GetThreadSettings(1)
+	require.NoError(t, err)
+	assert.Equal(t, &models.AIPreferences{SystemPrompt: "be brief"}, settings)
+
+	threads, err := restored.ListThreads(1)
+	require.NoError(t, err)
+	require.Len(t, threads, 2)
+	assert.Equal(t, "Проект", threads[1].Title)
+
+	_, err = restored.SwitchThread(1, threads[0].ID)
+	require.NoError(t, err)
+	history, err = restored.GetDialogHistory(1)
+	require.NoError(t, err)
+	assert.Equal(t, []models.Message{msg("default thread")}, history)
+	settings, err = restored.GetThreadSettings(1)
+	require.NoError(t, err)
+	assert.Nil(t, settings)
+
+	require.NoError(t, restored.DeleteThread(1, threads[0].ID))
+	threads, err = restored.ListThreads(1)
+	require.NoError(t, err)
+	require.Len(t, threads, 1)
+	assert.True(t, threads[0].Active, "the remaining thread becomes active")
+}
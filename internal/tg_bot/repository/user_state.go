@@ -9,14 +9,22 @@ import (
 	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
 	"github.com/sirupsen/logrus"
 	"os"
+	"strings"
 	"sync"
 	"time"
 )
 
+// journalOpPutUserState replaces the whole state of a user, the payload is a models.UserState.
+const journalOpPutUserState = "put"
+
 // UsersState manages the state of Telegram bot users in memory and on disk.
+//
+// The buffer is periodically written to a snapshot file, and every change between snapshots
+// is recorded in a journal next to it, so that a crash does not lose the changes made since the last snapshot.
 type UsersState struct {
 	BatchBuffer     map[int64]*models.UserState `json:"batchBuffer"` // In-memory store of user states by chat ID.
 	storageFilePath string                      // File path for persisting user states.
+	journal         *journal                    // Write-ahead journal of changes since the last snapshot
 	mu              sync.RWMutex                // Protects BatchBuffer from concurrent access
 }
 
@@ -29,10 +37,50 @@ func NewUsersStateMap(envStoragePath string) *UsersState {
 	return &UsersState{
 		BatchBuffer:     make(map[int64]*models.UserState),
 		storageFilePath: envStoragePath,
+		journal:         newJournal(envStoragePath + journalSuffix),
 		mu:              sync.RWMutex{},
 	}
 }
 
+// putUserState records the changed user state in the journal.
+// Must be called with the write lock held, so that the journal keeps the order of the changes.
+func (m *UsersState) putUserState(state *models.UserState) {
+	if err := m.journal.append(journalOpPutUserState, state.ChatID, state); err != nil {
+		logrus.WithError(err).WithField("chatID", state.ChatID).Error("Failed to journal user state")
+	}
+}
+
+// replayJournal applies the changes recorded in the journal on top of the loaded snapshot.
+// Must be called with the write lock held.
+func (m *UsersState) replayJournal() error {
+	applied, err := m.journal.replay(func(entry journalEntry) error {
+		switch entry.Op {
+		case journalOpPutUserState:
+			var state models.UserState
+			if err := json.Unmarshal(entry.Data, &state); err != nil {
+				return fmt.Errorf("failed to decode user state of chatID %d: %w", entry.ChatID, err)
+			}
+			m.BatchBuffer[entry.ChatID] = &state
+		default:
+			logrus.Warnf("Skipping unknown journal operation %q", entry.Op)
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.WithError(err).Error("Error replaying user state journal")
+		return err
+	}
+	if applied > 0 {
+		logrus.Infof("Replayed %d user state changes from %s", applied, m.journal.path)
+	}
+	return nil
+}
+
+// Close closes the journal file.
+func (m *UsersState) Close() error {
+	return m.journal.close()
+}
+
 func (m *UsersState) getUserState(chatID int64) *models.UserState {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -40,32 +88,42 @@ func (m *UsersState) getUserState(chatID int64) *models.UserState {
 	return m.BatchBuffer[chatID]
 }
 
-// GetTranslateState return user's translate bool status
-func (m *UsersState) GetTranslateState(chatID int64) bool {
+// GetUserMode returns the current chat mode of the user, or an empty string if it is not set.
+func (m *UsersState) GetUserMode(chatID int64) string {
 	state := m.getUserState(chatID)
-	return state != nil && state.IsTranslating
+	if state == nil {
+		return ""
+	}
+	return state.Mode
 }
 
-// GetGenerativeState return user's generative bool status
-func (m *UsersState) GetGenerativeState(chatID int64) bool {
-	state := m.getUserState(chatID)
-	return state != nil && state.IsGenerative
-}
+// SetUserMode stores the chat mode of the user together with the current dialog step.
+// Arguments:
+//   - chatID: Telegram chat ID of the user.
+//   - mode: name of the chat mode.
+//   - currentStep: human-readable step in the bot's conversation flow.
+func (m *UsersState) SetUserMode(chatID int64, mode, currentStep string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-// GetChangeModelState return user's change generative bool status
-func (m *UsersState) GetChangeModelState(chatID int64) bool {
-	state := m.getUserState(chatID)
-	return state != nil && state.IsChangingGenModel
-}
+	state, ok := m.BatchBuffer[chatID]
+	if !ok || state == nil {
+		state = &models.UserState{}
+	}
 
-// GetChangeHistorySizeState return user's change history dialog size bool status
-func (m *UsersState) GetChangeHistorySizeState(chatID int64) bool {
-	state := m.getUserState(chatID)
-	return state != nil && state.IsChangingHistorySize
+	state.ChatID = chatID
+	state.Mode = mode
+	state.CurrentStep = currentStep
+	state.LastUserMessages = ""
+	state.CallbackQueryData = ""
+
+	m.BatchBuffer[chatID] = state
+	m.putUserState(state)
 }
 
-// ReadFileToMemoryURL reads user states from the storage file into the in-memory buffer.
-// Returns an error if the file cannot be read or parsed.
+// ReadFileToMemoryURL reads user states from the storage file into the in-memory buffer
+// and replays the journal of changes made after the snapshot.
+// Returns an error if the file or the journal cannot be read or parsed.
 func (m *UsersState) ReadFileToMemoryURL() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -74,7 +132,7 @@ func (m *UsersState) ReadFileToMemoryURL() error {
 	if err != nil {
 		if os.IsNotExist(err) {
 			logrus.Infof("Storage file %s does not exist, starting with empty buffer", m.storageFilePath)
-			return nil
+			return m.replayJournal()
 		}
 		err = fmt.Errorf("failed to open storage file %s: %w", m.storageFilePath, err)
 		logrus.WithError(err).Error("Error reading storage file")
@@ -96,7 +154,7 @@ func (m *UsersState) ReadFileToMemoryURL() error {
 
 	if len(data) == 0 {
 		logrus.Infof("Storage file %s is empty, starting with empty buffer", m.storageFilePath)
-		return nil
+		return m.replayJournal()
 	}
 
 	var buffer map[int64]*models.UserState
@@ -106,19 +164,22 @@ func (m *UsersState) ReadFileToMemoryURL() error {
 		return err
 	}
 
+	if buffer == nil {
+		buffer = make(map[int64]*models.UserState)
+	}
 	m.BatchBuffer = buffer
 	logrus.Infof("Loaded %d user states from %s", len(m.BatchBuffer), m.storageFilePath)
-	return nil
+	return m.replayJournal()
 }
 
 // StoreUserState updates or creates a user state in the in-memory buffer.
+// The chat mode is left untouched, it is changed only through SetUserMode.
 // Arguments:
 //   - chatID: Telegram chat ID of the user.
 //   - currentStep: current step in the bot's conversation flow.
 //   - lastUserMassage: last message sent by the user.
 //   - callbackQueryData: data from the last callback query.
-//   - isTranslating: whether the user is currently in translation mode.
-func (m *UsersState) StoreUserState(chatID int64, currentStep, lastUserMassage, callbackQueryData string, isTranslating, isGenerative, isChangingGenModel, isChangingHistorySize bool) {
+func (m *UsersState) StoreUserState(chatID int64, currentStep, lastUserMassage, callbackQueryData string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -131,12 +192,9 @@ func (m *UsersState) StoreUserState(chatID int64, currentStep, lastUserMassage,
 	state.CurrentStep = currentStep
 	state.LastUserMessages = lastUserMassage
 	state.CallbackQueryData = callbackQueryData
-	state.IsTranslating = isTranslating
-	state.IsGenerative = isGenerative
-	state.IsChangingGenModel = isChangingGenModel
-	state.IsChangingHistorySize = isChangingHistorySize
 
 	m.BatchBuffer[chatID] = state
+	m.putUserState(state)
 }
 
 // SaveUserSmartHomeInfo stores Smart Home token and device info for a user.
@@ -157,6 +215,231 @@ func (m *UsersState) SaveUserSmartHomeInfo(chatID int64, token string, userDevic
 	state.Token = token
 	state.Devices = userDevices
 	m.BatchBuffer[chatID] = state
+	m.putUserState(state)
+}
+
+// GetAIPreferences returns the generative model preferences the user chose before the settings moved to the dialog threads.
+// They are the defaults the thread settings override. Users without stored preferences get zero preferences,
+// meaning the provider defaults.
+func (m *UsersState) GetAIPreferences(chatID int64) models.AIPreferences {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	state, ok := m.BatchBuffer[chatID]
+	if !ok || state == nil {
+		return models.AIPreferences{}
+	}
+	prefs := state.AI
+	if prefs.Temperature != nil {
+		temperature := *prefs.Temperature
+		prefs.Temperature = &temperature
+	}
+	return prefs
+}
+
+// GetPersonas returns the AI personas created by the user.
+func (m *UsersState) GetPersonas(chatID int64) []models.Persona {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	state, ok := m.BatchBuffer[chatID]
+	if !ok || state == nil {
+		return nil
+	}
+	personas := make([]models.Persona, len(state.Personas))
+	copy(personas, state.Personas)
+	return personas
+}
+
+// SavePersonas stores the AI personas created by the user.
+// Arguments:
+//   - chatID: Telegram chat ID of the user.
+//   - personas: new list of personas, replacing the stored one.
+func (m *UsersState) SavePersonas(chatID int64, personas []models.Persona) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state, ok := m.BatchBuffer[chatID]
+	if !ok || state == nil {
+		state = &models.UserState{}
+	}
+
+	state.ChatID = chatID
+	state.Personas = append([]models.Persona(nil), personas...)
+	m.BatchBuffer[chatID] = state
+	m.putUserState(state)
+}
+
+// GetRole returns the access role assigned to the user, empty if none is assigned.
+func (m *UsersState) GetRole(userID int64) models.AccessRole {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	state, ok := m.BatchBuffer[userID]
+	if !ok || state == nil {
+		return ""
+	}
+	return state.Role
+}
+
+// SaveRole assigns the access role to the user.
+// Arguments:
+//   - userID: Telegram user ID, the same as the ID of the private chat with the user.
+//   - role: new role, empty to return the user to the default role.
+func (m *UsersState) SaveRole(userID int64, role models.AccessRole) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state, ok := m.BatchBuffer[userID]
+	if !ok || state == nil {
+		state = &models.UserState{}
+	}
+
+	state.ChatID = userID
+	state.Role = role
+	m.BatchBuffer[userID] = state
+	m.putUserState(state)
+}
+
+// GetAllRoles returns the access roles assigned to the users by user ID.
+func (m *UsersState) GetAllRoles() map[int64]models.AccessRole {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	roles := make(map[int64]models.AccessRole)
+	for userID, state := range m.BatchBuffer {
+		if state != nil && state.Role != "" {
+			roles[userID] = state.Role
+		}
+	}
+	return roles
+}
+
+// SaveUsername stores the Telegram username of the user, so that roles can be granted by the username.
+// An unchanged username is not written again.
+func (m *UsersState) SaveUsername(userID int64, username string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state, ok := m.BatchBuffer[userID]
+	if ok && state != nil && state.Username == username {
+		return
+	}
+	if !ok || state == nil {
+		state = &models.UserState{}
+	}
+
+	state.ChatID = userID
+	state.Username = username
+	m.BatchBuffer[userID] = state
+	m.putUserState(state)
+}
+
+// FindUserByUsername returns the ID of the user with the Telegram username, compared case-insensitively.
+// Returns false if no user with the username has written to the bot.
+func (m *UsersState) FindUserByUsername(username string) (int64, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for userID, state := range m.BatchBuffer {
+		if state != nil && state.Username != "" && strings.EqualFold(state.Username, username) {
+			return userID, true
+		}
+	}
+	return 0, false
+}
+
+// GetQuota returns the AI quota tier and the request counter of the user.
+func (m *UsersState) GetQuota(chatID int64) models.Quota {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	state, ok := m.BatchBuffer[chatID]
+	if !ok || state == nil {
+		return models.Quota{}
+	}
+	return state.Quota
+}
+
+// SaveQuota stores the AI quota tier and the request counter of the user.
+// Arguments:
+//   - chatID: Telegram chat ID of the user.
+//   - quota: new quota, replacing the stored one.
+func (m *UsersState) SaveQuota(chatID int64, quota models.Quota) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state, ok := m.BatchBuffer[chatID]
+	if !ok || state == nil {
+		state = &models.UserState{}
+	}
+
+	state.ChatID = chatID
+	state.Quota = quota
+	m.BatchBuffer[chatID] = state
+	m.putUserState(state)
+}
+
+// GetAllQuotas returns the AI quotas of all users by chat ID.
+// Users that never had a quota are left out.
+func (m *UsersState) GetAllQuotas() map[int64]models.Quota {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	quotas := make(map[int64]models.Quota)
+	for chatID, state := range m.BatchBuffer {
+		if state != nil && !state.Quota.IsZero() {
+			quotas[chatID] = state.Quota
+		}
+	}
+	return quotas
+}
+
+// AddUsage adds the usage of the generative model to the user's ledger.
+// The usage is summed up with the entry of the same day and model.
+// Arguments:
+//   - chatID: Telegram chat ID of the user.
+//   - entry: usage to add.
+func (m *UsersState) AddUsage(chatID int64, entry models.UsageEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state, ok := m.BatchBuffer[chatID]
+	if !ok || state == nil {
+		state = &models.UserState{}
+	}
+
+	state.ChatID = chatID
+	state.Usage = models.MergeUsage(state.Usage, entry)
+	m.BatchBuffer[chatID] = state
+	m.putUserState(state)
+}
+
+// GetUsage returns the usage ledger of the user, one entry per day and model.
+func (m *UsersState) GetUsage(chatID int64) []models.UsageEntry {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	state, ok := m.BatchBuffer[chatID]
+	if !ok || state == nil {
+		return nil
+	}
+	return append([]models.UsageEntry(nil), state.Usage...)
+}
+
+// GetAllUsage returns the usage ledgers of all users by chat ID.
+// Users without usage are left out.
+func (m *UsersState) GetAllUsage() map[int64][]models.UsageEntry {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	usage := make(map[int64][]models.UsageEntry)
+	for chatID, state := range m.BatchBuffer {
+		if state != nil && len(state.Usage) > 0 {
+			usage[chatID] = append([]models.UsageEntry(nil), state.Usage...)
+		}
+	}
+	return usage
 }
 
 // GetUserSmartHomeToken retrieves the Smart Home token for a user.
@@ -195,11 +478,12 @@ func (m *UsersState) GetUserSmartHomeDevices(chatID int64) (map[string]*models.D
 	return state.Devices, nil
 }
 
-// SaveBatchToFile persists the in-memory user state buffer to the storage file.
+// SaveBatchToFile persists the in-memory user state buffer to the storage file and truncates the journal.
+// The write lock is held for the whole save, so no change can slip between the snapshot and the truncation.
 // Returns an error if the file cannot be written.
 func (m *UsersState) SaveBatchToFile() error {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
 	startTime := time.Now() // Засекаем время начала операции
 
@@ -229,6 +513,11 @@ func (m *UsersState) SaveBatchToFile() error {
 		logrus.WithError(err).Error("Error flushing batch")
 		return err
 	}
+	if err = file.Sync(); err != nil {
+		err = fmt.Errorf("failed to sync temp file %s: %w", tempPath, err)
+		logrus.WithError(err).Error("Error syncing batch")
+		return err
+	}
 
 	// Atomically rename a temp file to final destination
 	if err = os.Rename(tempPath, m.storageFilePath); err != nil {
@@ -237,6 +526,12 @@ func (m *UsersState) SaveBatchToFile() error {
 		return err
 	}
 
+	// The snapshot now contains every journaled change
+	if err = m.journal.truncate(); err != nil {
+		logrus.WithError(err).Error("Error compacting user state journal")
+		return err
+	}
+
 	elapsedTime := time.Since(startTime)
 	logrus.Infof("Saved %d user states to %s in %v", len(m.BatchBuffer), m.storageFilePath, elapsedTime)
 	return nil
@@ -0,0 +1,571 @@
+package repository
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	"github.com/sirupsen/logrus"
+)
+
+// usersStateMigrations is the versioned schema of the users state database.
+// New migrations must be appended to the end of the list, applied ones must never change.
+var usersStateMigrations = []string{
+	`CREATE TABLE users_state (
+		chat_id             INTEGER PRIMARY KEY,
+		current_step        TEXT NOT NULL DEFAULT '',
+		last_user_message   TEXT NOT NULL DEFAULT '',
+		callback_query_data TEXT NOT NULL DEFAULT '',
+		mode                TEXT NOT NULL DEFAULT '',
+		token               TEXT NOT NULL DEFAULT '',
+		devices             TEXT NOT NULL DEFAULT '{}'
+	)`,
+	`ALTER TABLE users_state ADD COLUMN ai_preferences TEXT NOT NULL DEFAULT '{}'`,
+	`ALTER TABLE users_state ADD COLUMN personas TEXT NOT NULL DEFAULT '[]'`,
+	`CREATE TABLE ai_usage (
+		chat_id           INTEGER NOT NULL,
+		day               TEXT NOT NULL,
+		model             TEXT NOT NULL,
+		requests          INTEGER NOT NULL DEFAULT 0,
+		prompt_tokens     INTEGER NOT NULL DEFAULT 0,
+		completion_tokens INTEGER NOT NULL DEFAULT 0,
+		cost              REAL NOT NULL DEFAULT 0,
+		PRIMARY KEY (chat_id, day, model)
+	)`,
+	`ALTER TABLE users_state ADD COLUMN quota TEXT NOT NULL DEFAULT '{}'`,
+	`ALTER TABLE users_state ADD COLUMN role TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE users_state ADD COLUMN username TEXT NOT NULL DEFAULT ''`,
+}
+
+// UsersStateSQLite manages the state of Telegram bot users in an embedded SQLite database.
+//
+// Unlike UsersState it keeps nothing in memory: every change is written through to the database,
+// so a crash never loses more than the change in flight.
+type UsersStateSQLite struct {
+	db     *sql.DB // Connection to the SQLite database
+	dbPath string  // Path to the SQLite database file
+}
+
+// NewUsersStateSQLite opens the SQLite database and applies the pending schema migrations.
+// Arguments:
+//   - dbPath: path to the SQLite database file, created if it does not exist.
+//
+// Returns a pointer to a UsersStateSQLite or an error if the database cannot be opened or migrated.
+func NewUsersStateSQLite(dbPath string) (*UsersStateSQLite, error) {
+	db, err := openSQLite(dbPath, usersStateMigrations)
+	if err != nil {
+		return nil, err
+	}
+	return &UsersStateSQLite{
+		db:     db,
+		dbPath: dbPath,
+	}, nil
+}
+
+// ReadFileToMemoryURL checks the database connection and logs the number of stored users.
+// The SQLite storage is not loaded into memory, the method exists to satisfy the repository interface.
+func (m *UsersStateSQLite) ReadFileToMemoryURL() error {
+	count, err := m.count()
+	if err != nil {
+		return err
+	}
+	logrus.Infof("SQLite storage %s contains %d user states", m.dbPath, count)
+	return nil
+}
+
+// SaveBatchToFile does nothing: every change is already written through to the database.
+func (m *UsersStateSQLite) SaveBatchToFile() error {
+	return nil
+}
+
+// Close closes the database connection.
+func (m *UsersStateSQLite) Close() error {
+	return m.db.Close()
+}
+
+// IsEmpty reports whether the database contains no user states.
+func (m *UsersStateSQLite) IsEmpty() (bool, error) {
+	count, err := m.count()
+	return count == 0, err
+}
+
+// count returns the number of stored user states.
+func (m *UsersStateSQLite) count() (int, error) {
+	var count int
+	if err := m.db.QueryRow(`SELECT COUNT(*) FROM users_state`).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count user states in %s: %w", m.dbPath, err)
+	}
+	return count, nil
+}
+
+// StoreUserState updates or creates a user state. The chat mode is left untouched.
+// Arguments:
+//   - chatID: Telegram chat ID of the user.
+//   - currentStep: current step in the bot's conversation flow.
+//   - lastUserMassage: last message sent by the user.
+//   - callbackQueryData: data from the last callback query.
+func (m *UsersStateSQLite) StoreUserState(chatID int64, currentStep, lastUserMassage, callbackQueryData string) {
+	_, err := m.db.Exec(`INSERT INTO users_state (chat_id, current_step, last_user_message, callback_query_data)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (chat_id) DO UPDATE SET
+			current_step = excluded.current_step,
+			last_user_message = excluded.last_user_message,
+			callback_query_data = excluded.callback_query_data`,
+		chatID, currentStep, lastUserMassage, callbackQueryData)
+	if err != nil {
+		logrus.WithError(err).WithField("chatID", chatID).Error("Failed to store user state")
+	}
+}
+
+// GetUserMode returns the current chat mode of the user, or an empty string if it is not set.
+func (m *UsersStateSQLite) GetUserMode(chatID int64) string {
+	var mode string
+	err := m.db.QueryRow(`SELECT mode FROM users_state WHERE chat_id = ?`, chatID).Scan(&mode)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		logrus.WithError(err).WithField("chatID", chatID).Error("Failed to read user mode")
+	}
+	return mode
+}
+
+// SetUserMode stores the chat mode of the user together with the current dialog step.
+func (m *UsersStateSQLite) SetUserMode(chatID int64, mode, currentStep string) {
+	_, err := m.db.Exec(`INSERT INTO users_state (chat_id, mode, current_step)
+		VALUES (?, ?, ?)
+		ON CONFLICT (chat_id) DO UPDATE SET
+			mode = excluded.mode,
+			current_step = excluded.current_step,
+			last_user_message = '',
+			callback_query_data = ''`,
+		chatID, mode, currentStep)
+	if err != nil {
+		logrus.WithError(err).WithField("chatID", chatID).Error("Failed to store user mode")
+	}
+}
+
+// SaveUserSmartHomeInfo stores Smart Home token and device info for a user.
+// Arguments:
+//   - chatID: Telegram chat ID of the user.
+//   - token: Smart Home OAuth token.
+//   - userDevices: map of device names to device details.
+func (m *UsersStateSQLite) SaveUserSmartHomeInfo(chatID int64, token string, userDevices map[string]*models.Device) {
+	devices, err := json.Marshal(userDevices)
+	if err != nil {
+		logrus.WithError(err).WithField("chatID", chatID).Error("Failed to encode smart home devices")
+		return
+	}
+	_, err = m.db.Exec(`INSERT INTO users_state (chat_id, token, devices)
+		VALUES (?, ?, ?)
+		ON CONFLICT (chat_id) DO UPDATE SET
+			token = excluded.token,
+			devices = excluded.devices`,
+		chatID, token, string(devices))
+	if err != nil {
+		logrus.WithError(err).WithField("chatID", chatID).Error("Failed to store smart home info")
+	}
+}
+
+// GetAIPreferences returns the generative model preferences the user chose before the settings moved to the dialog threads.
+// They are the defaults the thread settings override. Users without stored preferences get zero preferences,
+// meaning the provider defaults.
+func (m *UsersStateSQLite) GetAIPreferences(chatID int64) models.AIPreferences {
+	var raw string
+	err := m.db.QueryRow(`SELECT ai_preferences FROM users_state WHERE chat_id = ?`, chatID).Scan(&raw)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		logrus.WithError(err).WithField("chatID", chatID).Error("Failed to read AI preferences")
+	}
+
+	var prefs models.AIPreferences
+	if raw != "" {
+		if err = json.Unmarshal([]byte(raw), &prefs); err != nil {
+			logrus.WithError(err).WithField("chatID", chatID).Error("Failed to decode AI preferences")
+			return models.AIPreferences{}
+		}
+	}
+	return prefs
+}
+
+// GetPersonas returns the AI personas created by the user.
+func (m *UsersStateSQLite) GetPersonas(chatID int64) []models.Persona {
+	var raw string
+	err := m.db.QueryRow(`SELECT personas FROM users_state WHERE chat_id = ?`, chatID).Scan(&raw)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		logrus.WithError(err).WithField("chatID", chatID).Error("Failed to read AI personas")
+	}
+
+	var personas []models.Persona
+	if raw != "" {
+		if err = json.Unmarshal([]byte(raw), &personas); err != nil {
+			logrus.WithError(err).WithField("chatID", chatID).Error("Failed to decode AI personas")
+			return nil
+		}
+	}
+	return personas
+}
+
+// SavePersonas stores the AI personas created by the user.
+// Arguments:
+//   - chatID: Telegram chat ID of the user.
+//   - personas: new list of personas, replacing the stored one.
+func (m *UsersStateSQLite) SavePersonas(chatID int64, personas []models.Persona) {
+	if personas == nil {
+		personas = []models.Persona{}
+	}
+	raw, err := json.Marshal(personas)
+	if err != nil {
+		logrus.WithError(err).WithField("chatID", chatID).Error("Failed to encode AI personas")
+		return
+	}
+	_, err = m.db.Exec(`INSERT INTO users_state (chat_id, personas)
+		VALUES (?, ?)
+		ON CONFLICT (chat_id) DO UPDATE SET
+			personas = excluded.personas`,
+		chatID, string(raw))
+	if err != nil {
+		logrus.WithError(err).WithField("chatID", chatID).Error("Failed to store AI personas")
+	}
+}
+
+// GetRole returns the access role assigned to the user, empty if none is assigned.
+func (m *UsersStateSQLite) GetRole(userID int64) models.AccessRole {
+	var role string
+	err := m.db.QueryRow(`SELECT role FROM users_state WHERE chat_id = ?`, userID).Scan(&role)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		logrus.WithError(err).WithField("userID", userID).Error("Failed to read access role")
+	}
+	return models.AccessRole(role)
+}
+
+// SaveRole assigns the access role to the user.
+// Arguments:
+//   - userID: Telegram user ID, the same as the ID of the private chat with the user.
+//   - role: new role, empty to return the user to the default role.
+func (m *UsersStateSQLite) SaveRole(userID int64, role models.AccessRole) {
+	_, err := m.db.Exec(`INSERT INTO users_state (chat_id, role)
+		VALUES (?, ?)
+		ON CONFLICT (chat_id) DO UPDATE SET
+			role = excluded.role`,
+		userID, string(role))
+	if err != nil {
+		logrus.WithError(err).WithField("userID", userID).Error("Failed to store access role")
+	}
+}
+
+// GetAllRoles returns the access roles assigned to the users by user ID.
+func (m *UsersStateSQLite) GetAllRoles() map[int64]models.AccessRole {
+	roles := make(map[int64]models.AccessRole)
+	rows, err := m.db.Query(`SELECT chat_id, role FROM users_state WHERE role != ''`)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to read access roles")
+		return roles
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID int64
+		var role string
+		if err = rows.Scan(&userID, &role); err != nil {
+			logrus.WithError(err).Error("Failed to scan access role")
+			continue
+		}
+		roles[userID] = models.AccessRole(role)
+	}
+	if err = rows.Err(); err != nil {
+		logrus.WithError(err).Error("Failed to read access roles")
+	}
+	return roles
+}
+
+// SaveUsername stores the Telegram username of the user, so that roles can be granted by the username.
+// An unchanged username is not written again.
+func (m *UsersStateSQLite) SaveUsername(userID int64, username string) {
+	_, err := m.db.Exec(`INSERT INTO users_state (chat_id, username)
+		VALUES (?, ?)
+		ON CONFLICT (chat_id) DO UPDATE SET
+			username = excluded.username
+		WHERE username != excluded.username`,
+		userID, username)
+	if err != nil {
+		logrus.WithError(err).WithField("userID", userID).Error("Failed to store username")
+	}
+}
+
+// FindUserByUsername returns the ID of the user with the Telegram username, compared case-insensitively.
+// Returns false if no user with the username has written to the bot.
+func (m *UsersStateSQLite) FindUserByUsername(username string) (int64, bool) {
+	var userID int64
+	err := m.db.QueryRow(`SELECT chat_id FROM users_state WHERE username != '' AND username = ? COLLATE NOCASE LIMIT 1`,
+		username).Scan(&userID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			logrus.WithError(err).WithField("username", username).Error("Failed to find user by username")
+		}
+		return 0, false
+	}
+	return userID, true
+}
+
+// GetQuota returns the AI quota tier and the request counter of the user.
+func (m *UsersStateSQLite) GetQuota(chatID int64) models.Quota {
+	var raw string
+	err := m.db.QueryRow(`SELECT quota FROM users_state WHERE chat_id = ?`, chatID).Scan(&raw)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		logrus.WithError(err).WithField("chatID", chatID).Error("Failed to read AI quota")
+	}
+
+	var quota models.Quota
+	if raw != "" {
+		if err = json.Unmarshal([]byte(raw), &quota); err != nil {
+			logrus.WithError(err).WithField("chatID", chatID).Error("Failed to decode AI quota")
+			return models.Quota{}
+		}
+	}
+	return quota
+}
+
+// SaveQuota stores the AI quota tier and the request counter of the user.
+// Arguments:
+//   - chatID: Telegram chat ID of the user.
+//   - quota: new quota, replacing the stored one.
+func (m *UsersStateSQLite) SaveQuota(chatID int64, quota models.Quota) {
+	raw, err := json.Marshal(quota)
+	if err != nil {
+		logrus.WithError(err).WithField("chatID", chatID).Error("Failed to encode AI quota")
+		return
+	}
+	_, err = m.db.Exec(`INSERT INTO users_state (chat_id, quota)
+		VALUES (?, ?)
+		ON CONFLICT (chat_id) DO UPDATE SET
+			quota = excluded.quota`,
+		chatID, string(raw))
+	if err != nil {
+		logrus.WithError(err).WithField("chatID", chatID).Error("Failed to store AI quota")
+	}
+}
+
+// GetAllQuotas returns the AI quotas of all users by chat ID.
+// Users that never had a quota are left out.
+func (m *UsersStateSQLite) GetAllQuotas() map[int64]models.Quota {
+	quotas := make(map[int64]models.Quota)
+	rows, err := m.db.Query(`SELECT chat_id, quota FROM users_state WHERE quota != '{}'`)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to read AI quotas")
+		return quotas
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var chatID int64
+		var raw string
+		if err = rows.Scan(&chatID, &raw); err != nil {
+			logrus.WithError(err).Error("Failed to scan AI quota")
+			continue
+		}
+		var quota models.Quota
+		if err = json.Unmarshal([]byte(raw), &quota); err != nil {
+			logrus.WithError(err).WithField("chatID", chatID).Error("Failed to decode AI quota")
+			continue
+		}
+		if !quota.IsZero() {
+			quotas[chatID] = quota
+		}
+	}
+	if err = rows.Err(); err != nil {
+		logrus.WithError(err).Error("Failed to read AI quotas")
+	}
+	return quotas
+}
+
+// AddUsage adds the usage of the generative model to the user's ledger.
+// The usage is summed up with the entry of the same day and model.
+// Arguments:
+//   - chatID: Telegram chat ID of the user.
+//   - entry: usage to add.
+func (m *UsersStateSQLite) AddUsage(chatID int64, entry models.UsageEntry) {
+	if err := addUsage(m.db, chatID, entry); err != nil {
+		logrus.WithError(err).WithField("chatID", chatID).Error("Failed to store AI usage")
+	}
+}
+
+// sqlExecer is implemented by both the database and its transactions.
+type sqlExecer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// addUsage sums up the usage entry with the stored one of the same day and model.
+func addUsage(db sqlExecer, chatID int64, entry models.UsageEntry) error {
+	_, err := db.Exec(`INSERT INTO ai_usage (chat_id, day, model, requests, prompt_tokens, completion_tokens, cost)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (chat_id, day, model) DO UPDATE SET
+			requests = requests + excluded.requests,
+			prompt_tokens = prompt_tokens + excluded.prompt_tokens,
+			completion_tokens = completion_tokens + excluded.completion_tokens,
+			cost = cost + excluded.cost`,
+		chatID, entry.Day, entry.Model, entry.Requests, entry.PromptTokens, entry.CompletionTokens, entry.Cost)
+	return err
+}
+
+// GetUsage returns the usage ledger of the user, one entry per day and model.
+func (m *UsersStateSQLite) GetUsage(chatID int64) []models.UsageEntry {
+	usage, err := m.queryUsage(`WHERE chat_id = ?`, chatID)
+	if err != nil {
+		logrus.WithError(err).WithField("chatID", chatID).Error("Failed to read AI usage")
+		return nil
+	}
+	return usage[chatID]
+}
+
+// GetAllUsage returns the usage ledgers of all users by chat ID.
+// Users without usage are left out.
+func (m *UsersStateSQLite) GetAllUsage() map[int64][]models.UsageEntry {
+	usage, err := m.queryUsage(``)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to read AI usage")
+		return map[int64][]models.UsageEntry{}
+	}
+	return usage
+}
+
+// queryUsage reads the usage entries matching the condition, grouped by chat ID.
+func (m *UsersStateSQLite) queryUsage(where string, args ...any) (map[int64][]models.UsageEntry, error) {
+	rows, err := m.db.Query(`SELECT chat_id, day, model, requests, prompt_tokens, completion_tokens, cost
+		FROM ai_usage `+where+` ORDER BY chat_id, day, model`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query AI usage: %w", err)
+	}
+	defer rows.Close()
+
+	usage := make(map[int64][]models.UsageEntry)
+	for rows.Next() {
+		var chatID int64
+		var entry models.UsageEntry
+		if err = rows.Scan(&chatID, &entry.Day, &entry.Model, &entry.Requests, &entry.PromptTokens, &entry.CompletionTokens, &entry.Cost); err != nil {
+			return nil, fmt.Errorf("failed to scan AI usage: %w", err)
+		}
+		usage[chatID] = append(usage[chatID], entry)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read AI usage: %w", err)
+	}
+	return usage, nil
+}
+
+// GetUserSmartHomeToken retrieves the Smart Home token for a user.
+// Returns the token or an error if not found.
+func (m *UsersStateSQLite) GetUserSmartHomeToken(chatID int64) (string, error) {
+	var token string
+	err := m.db.QueryRow(`SELECT token FROM users_state WHERE chat_id = ?`, chatID).Scan(&token)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("failed to read token for chatID %d: %w", chatID, err)
+	}
+	if token == "" {
+		err = fmt.Errorf("no token found for chatID %d", chatID)
+		logrus.WithError(err).Warn("Token retrieval failed")
+		return "", err
+	}
+	return token, nil
+}
+
+// GetUserSmartHomeDevices retrieves the Smart Home devices for a user.
+// Return the device map or an error if no devices are found.
+func (m *UsersStateSQLite) GetUserSmartHomeDevices(chatID int64) (map[string]*models.Device, error) {
+	var raw string
+	err := m.db.QueryRow(`SELECT devices FROM users_state WHERE chat_id = ?`, chatID).Scan(&raw)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to read devices for chatID %d: %w", chatID, err)
+	}
+
+	var devices map[string]*models.Device
+	if raw != "" {
+		if err = json.Unmarshal([]byte(raw), &devices); err != nil {
+			return nil, fmt.Errorf("failed to decode devices for chatID %d: %w", chatID, err)
+		}
+	}
+	if len(devices) == 0 {
+		err = fmt.Errorf("no devices found for chatID %d", chatID)
+		logrus.WithError(err).Warn("Devices retrieval failed")
+		return nil, err
+	}
+	return devices, nil
+}
+
+// ImportFromJSON copies the user states of the JSON storage written by UsersState into the database.
+// The snapshot is loaded together with its journal, so the changes made after the last snapshot are imported too.
+// Users that already exist in the database are left untouched.
+// Arguments:
+//   - jsonPath: path to the JSON snapshot, usually FILE_STORAGE_PATH.
+//
+// Returns the number of imported users. A missing or empty storage imports nothing and is not an error.
+func (m *UsersStateSQLite) ImportFromJSON(jsonPath string) (int, error) {
+	source := NewUsersStateMap(jsonPath)
+	defer func() {
+		if err := source.Close(); err != nil {
+			logrus.WithError(err).Errorf("Failed to close the journal of %s", jsonPath)
+		}
+	}()
+	if err := source.ReadFileToMemoryURL(); err != nil {
+		return 0, fmt.Errorf("failed to load JSON storage %s: %w", jsonPath, err)
+	}
+	buffer := source.BatchBuffer
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin import: %w", err)
+	}
+	imported := 0
+	for chatID, state := range buffer {
+		if state == nil {
+			continue
+		}
+		devices, err := json.Marshal(state.Devices)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, fmt.Errorf("failed to encode devices of chatID %d: %w", chatID, err)
+		}
+		prefs, err := json.Marshal(state.AI)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, fmt.Errorf("failed to encode AI preferences of chatID %d: %w", chatID, err)
+		}
+		personas := state.Personas
+		if personas == nil {
+			personas = []models.Persona{}
+		}
+		rawPersonas, err := json.Marshal(personas)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, fmt.Errorf("failed to encode AI personas of chatID %d: %w", chatID, err)
+		}
+		quota, err := json.Marshal(state.Quota)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, fmt.Errorf("failed to encode AI quota of chatID %d: %w", chatID, err)
+		}
+		res, err := tx.Exec(`INSERT OR IGNORE INTO users_state
+			(chat_id, current_step, last_user_message, callback_query_data, mode, token, devices, ai_preferences, personas, quota, role, username)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			chatID, state.CurrentStep, state.LastUserMessages, state.CallbackQueryData, state.Mode, state.Token,
+			string(devices), string(prefs), string(rawPersonas), string(quota), string(state.Role), state.Username)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, fmt.Errorf("failed to import chatID %d: %w", chatID, err)
+		}
+		rows, _ := res.RowsAffected()
+		if rows == 0 {
+			continue
+		}
+		for _, entry := range state.Usage {
+			if err = addUsage(tx, chatID, entry); err != nil {
+				_ = tx.Rollback()
+				return 0, fmt.Errorf("failed to import AI usage of chatID %d: %w", chatID, err)
+			}
+		}
+		imported++
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit import: %w", err)
+	}
+	logrus.Infof("Imported %d user states from %s into %s", imported, jsonPath, m.dbPath)
+	return imported, nil
+}
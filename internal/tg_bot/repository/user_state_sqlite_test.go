@@ -0,0 +1,142 @@
+package repository
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func schemaVersion(t *testing.T, state *UsersStateSQLite) int {
+	t.Helper()
+	var version int
+	require.NoError(t, state.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version))
+	return version
+}
+
+func TestUsersStateSQLite_Migrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+
+	// A database created by an older release has only the first migrations.
+	db, err := openSQLite(path, usersStateMigrations[:3])
+	require.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO users_state (chat_id, mode) VALUES (1, 'generative')`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	state, err := NewUsersStateSQLite(path)
+	require.NoError(t, err)
+	assert.Equal(t, len(usersStateMigrations), schemaVersion(t, state))
+	assert.Equal(t, "generative", state.GetUserMode(1), "the data survives the migrations")
+	state.SaveRole(1, models.AccessAdmin)
+	require.NoError(t, state.Close())
+
+	// Reopening an up-to-date database applies nothing.
+	state, err = NewUsersStateSQLite(path)
+	require.NoError(t, err)
+	defer state.Close()
+	assert.Equal(t, len(usersStateMigrations), schemaVersion(t, state))
+	assert.Equal(t, models.AccessAdmin, state.GetRole(1))
+}
+
+func TestUsersStateSQLite_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	state, err := NewUsersStateSQLite(path)
+	require.NoError(t, err)
+
+	empty, err := state.IsEmpty()
+	require.NoError(t, err)
+	assert.True(t, empty)
+	_, err = state.GetUserSmartHomeToken(1)
+	assert.Error(t, err, "no token is stored yet")
+	_, err = state.GetUserSmartHomeDevices(1)
+	assert.Error(t, err)
+	assert.Equal(t, models.AIPreferences{}, state.GetAIPreferences(1))
+
+	temperature := float32(0.5)
+	prefs := models.AIPreferences{Model: "deepseek-chat", Temperature: &temperature, MaxTokens: 500}
+	personas := []models.Persona{{ID: "poet", Name: "Поэт", Prompt: "Отвечай стихами."}}
+	devices := map[string]*models.Device{"Лампа": {Name: "Лампа", ID: "lamp-1", ActualState: true}}
+
+	state.StoreUserState(1, "старт", "/start", "callback")
+	state.SetUserMode(1, "translating", "перевод")
+	state.SaveUserSmartHomeInfo(1, "token", devices)
+	// The user-level preferences are only read: they were written before the settings moved to the threads.
+	_, err = state.db.Exec(`UPDATE users_state SET ai_preferences = ? WHERE chat_id = 1`,
+		`{"model":"deepseek-chat","temperature":0.5,"maxTokens":500}`)
+	require.NoError(t, err)
+	state.SavePersonas(1, personas)
+	state.SaveQuota(1, models.Quota{Tier: models.QuotaTierExtended})
+	state.SaveRole(1, models.AccessGuest)
+	state.SaveUsername(1, "alice")
+	state.AddUsage(1, testUsage[0])
+	require.NoError(t, state.SaveBatchToFile())
+	require.NoError(t, state.Close())
+
+	// Every change is written through, so a reopened database has all of them.
+	state, err = NewUsersStateSQLite(path)
+	require.NoError(t, err)
+	defer state.Close()
+	require.NoError(t, state.ReadFileToMemoryURL())
+
+	var step, message, callback string
+	require.NoError(t, state.db.QueryRow(`SELECT current_step, last_user_message, callback_query_data FROM users_state WHERE chat_id = 1`).
+		Scan(&step, &message, &callback))
+	assert.Equal(t, "перевод", step)
+	assert.Empty(t, message, "changing the mode resets the last message")
+	assert.Equal(t, "translating", state.GetUserMode(1))
+
+	token, err := state.GetUserSmartHomeToken(1)
+	require.NoError(t, err)
+	assert.Equal(t, "token", token)
+	storedDevices, err := state.GetUserSmartHomeDevices(1)
+	require.NoError(t, err)
+	assert.Equal(t, devices, storedDevices)
+
+	assert.Equal(t, prefs, state.GetAIPreferences(1))
+	assert.Equal(t, personas, state.GetPersonas(1))
+	assert.Equal(t, models.QuotaTierExtended, state.GetQuota(1).Tier)
+	assert.Equal(t, models.AccessGuest, state.GetRole(1))
+	userID, ok := state.FindUserByUsername("alice")
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), userID)
+	assert.Equal(t, testUsage[:1], state.GetUsage(1))
+
+	empty, err = state.IsEmpty()
+	require.NoError(t, err)
+	assert.False(t, empty)
+}
+
+func TestUsersStateSQLite_ImportReplaysJournal(t *testing.T) {
+	dir := t.TempDir()
+	jsonPath := filepath.Join(dir, "keep_chat.json")
+
+	jsonState := NewUsersStateMap(jsonPath)
+	jsonState.SetUserMode(1, "translating", "перевод")
+	jsonState.SetUserMode(3, "generative", "ИИ")
+	require.NoError(t, jsonState.SaveBatchToFile())
+	// Changes after the snapshot are kept only in the journal.
+	jsonState.SetUserMode(1, "generative", "ИИ")
+	jsonState.SaveUserSmartHomeInfo(2, "token", nil)
+	require.NoError(t, jsonState.Close())
+
+	state, err := NewUsersStateSQLite(filepath.Join(dir, "state.db"))
+	require.NoError(t, err)
+	defer state.Close()
+	state.SetUserMode(3, "idle", "основное меню")
+
+	imported, err := state.ImportFromJSON(jsonPath)
+	require.NoError(t, err)
+	assert.Equal(t, 2, imported, "the users already in the database are not imported")
+	assert.Equal(t, "generative", state.GetUserMode(1))
+	token, err := state.GetUserSmartHomeToken(2)
+	require.NoError(t, err)
+	assert.Equal(t, "token", token)
+	assert.Equal(t, "idle", state.GetUserMode(3))
+
+	imported, err = state.ImportFromJSON(filepath.Join(dir, "missing.json"))
+	require.NoError(t, err)
+	assert.Zero(t, imported)
+}
@@ -0,0 +1,32 @@
+package repository
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsersState_MigratesLegacyModeFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keep_chat.json")
+	legacy := `{
+		"1": {"chatID": 1, "isTranslating": true, "ai": {"model": "deepseek-chat", "historyLimit": 20}},
+		"2": {"chatID": 2, "isGenerative": true, "isChangingGenModel": true},
+		"3": {"chatID": 3, "mode": "generative", "isTranslating": true},
+		"4": {"chatID": 4}
+	}`
+	require.NoError(t, os.WriteFile(path, []byte(legacy), 0644))
+
+	state := NewUsersStateMap(path)
+	require.NoError(t, state.ReadFileToMemoryURL())
+
+	assert.Equal(t, "translating", state.GetUserMode(1))
+	assert.Equal(t, "changing_model", state.GetUserMode(2), "the most specific flag wins")
+	assert.Equal(t, "generative", state.GetUserMode(3), "the stored mode is kept")
+	assert.Empty(t, state.GetUserMode(4))
+	assert.Equal(t, models.AIPreferences{Model: "deepseek-chat", HistoryLimit: 20}, state.GetAIPreferences(1),
+		"the preferences chosen before the threads stay the defaults")
+}
@@ -0,0 +1,300 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/constant"
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/sirupsen/logrus"
+)
+
+// Commands of the access roles, available only to the owner:
+// "/grant <@username|user ID> <role>", "/revoke <@username|user ID>" and "/roles".
+const (
+	commandGrant  = "grant"
+	commandRevoke = "revoke"
+	commandRoles  = "roles"
+)
+
+// commandAccess holds the role required for every command of the bot.
+// The commands that are not listed here are handled as the input of the chat's mode.
+var commandAccess = map[string]models.AccessRole{
+	"start":             models.AccessGuest,
+	"stop":              models.AccessGuest,
+	commandNewThread:    models.AccessMember,
+	commandListThreads:  models.AccessMember,
+	commandSwitchThread: models.AccessMember,
+	commandRenameThread: models.AccessMember,
+	commandDeleteThread: models.AccessMember,
+	commandExportDialog: models.AccessMember,
+	commandImportDialog: models.AccessMember,
+	commandUsage:        models.AccessMember,
+	commandQuota:        models.AccessMember,
+	commandGrant:        models.AccessOwner,
+	commandRevoke:       models.AccessOwner,
+	commandRoles:        models.AccessOwner,
+}
+
+// buttonAccess holds the role required for every menu button of the bot.
+var buttonAccess = map[string]models.AccessRole{
+	constant.BUTTON_TEXT_PRINT_INTRO:             models.AccessGuest,
+	constant.BUTTON_TEXT_SKIP_INTRO:              models.AccessGuest,
+	constant.BUTTON_TEXT_PRINT_MENU:              models.AccessGuest,
+	constant.BUTTON_TEXT_WHAT_TO_DO:              models.AccessGuest,
+	constant.BUTTON_TEXT_WHITCH_MOVIE_TO_WATCH:   models.AccessGuest,
+	constant.BUTTON_TEXT_TRANSLATE:               models.AccessGuest,
+	constant.BUTTON_TEXT_YANDEX_DDIALOGS:         models.AccessAdmin,
+	constant.BUTTON_TEXT_YANDEX_LOGIN:            models.AccessAdmin,
+	constant.BUTTON_TEXT_YANDEX_GET_HOME_INFO:    models.AccessAdmin,
+	constant.BUTTON_TEXT_GENERATIVE_MODEL:        models.AccessMember,
+	constant.BUTTON_TEXT_STREAM_GENERATIVE_MODEL: models.AccessMember,
+	constant.BUTTON_TEXT_GENERATIVE_MENU:         models.AccessMember,
+	constant.BUTTON_TEXT_CHANGE_MODEL:            models.AccessMember,
+	constant.BUTTON_TEXT_CHANGE_HISTORY_SIZE:     models.AccessMember,
+	constant.BUTTON_TEXT_CHANGE_TEMPERATURE:      models.AccessMember,
+	constant.BUTTON_TEXT_CHANGE_MAX_TOKENS:       models.AccessMember,
+	constant.BUTTON_TEXT_CHANGE_SYSTEM_PROMPT:    models.AccessMember,
+	constant.BUTTON_TEXT_THREADS:                 models.AccessMember,
+	constant.BUTTON_TEXT_NEW_THREAD:              models.AccessMember,
+	constant.BUTTON_TEXT_CHOOSE_PERSONA:          models.AccessMember,
+	constant.BUTTON_TEXT_NEW_PERSONA:             models.AccessMember,
+}
+
+// modeAccess holds the role required for the input of the chat modes open to guests.
+// The input of every other mode goes to the AI and requires the member role.
+var modeAccess = map[ModeName]models.AccessRole{
+	ModeIdle:        models.AccessGuest,
+	ModeTranslating: models.AccessGuest,
+}
+
+// roleTitle returns the name of the access role for the user.
+func roleTitle(role models.AccessRole) string {
+	switch role {
+	case models.AccessOwner:
+		return "владелец"
+	case models.AccessAdmin:
+		return "администратор"
+	case models.AccessMember:
+		return "участник"
+	case models.AccessGuest:
+		return "гость"
+	default:
+		return "заблокирован"
+	}
+}
+
+// senderID returns the ID of the user who sent the update, or the chat ID if the sender is unknown.
+func senderID(uc *UpdateContext) int64 {
+	if uc.UserID != 0 {
+		return uc.UserID
+	}
+	return uc.ChatID
+}
+
+// roleOf returns the access role of the user: the owner is set by the config,
+// the users without an assigned role have the default one.
+func (b *TgBotServices) roleOf(userID int64) models.AccessRole {
+	if userID == b.OwnerID {
+		return models.AccessOwner
+	}
+	if role := b.StateRepo.GetRole(userID); role != "" {
+		return role
+	}
+	return b.defaultRole
+}
+
+// requiredRole returns the role required to handle the update.
+func (b *TgBotServices) requiredRole(uc *UpdateContext) models.AccessRole {
+	if uc.Callback != nil {
+		// Every inline button of the bot controls the AI answers, threads, personas or models.
+		return models.AccessMember
+	}
+	msg := uc.Update.Message
+	if msg.Document != nil {
+		return models.AccessMember
+	}
+	if role, ok := buttonAccess[uc.Text]; ok {
+		return role
+	}
+	if _, ok := b.parseDeviceToggleCommand(uc.Text); ok {
+		return models.AccessAdmin
+	}
+	if msg.IsCommand() {
+		args := strings.TrimSpace(msg.CommandArguments())
+		switch {
+		// The usage of all chats and the allowlist of the quotas are managed by the owner, like the roles.
+		case msg.Command() == commandUsage && strings.EqualFold(args, usageArgAll),
+			msg.Command() == commandQuota && args != "":
+			return models.AccessOwner
+		}
+		if role, ok := commandAccess[msg.Command()]; ok {
+			return role
+		}
+	}
+	if role, ok := modeAccess[b.modes.Current(uc.ChatID)]; ok {
+		return role
+	}
+	return models.AccessMember
+}
+
+// authorize checks the role of the sender against the role required by the update.
+// The denied update is logged and answered with the reason.
+// Returns true if the update may be handled.
+func (b *TgBotServices) authorize(uc *UpdateContext) bool {
+	userID := senderID(uc)
+	if uc.UserName != "" {
+		b.StateRepo.SaveUsername(userID, uc.UserName)
+	}
+
+	role := b.roleOf(userID)
+	required := b.requiredRole(uc)
+	if role.Allows(required) {
+		return true
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"chatID":   uc.ChatID,
+		"userID":   userID,
+		"role":     role,
+		"required": required,
+		"text":     uc.Text,
+	}).Warn("Access denied")
+
+	text := "Доступ к боту закрыт."
+	if role != models.AccessBanned {
+		text = fmt.Sprintf("Эта функция недоступна для роли «%s». Чтобы получить доступ, напиши владельцу бота.", roleTitle(role))
+	}
+	if uc.Callback != nil {
+		_ = b.answerCallback(uc, text)
+		return false
+	}
+	_ = b.sendMessage(uc.ChatID, text, uc.MessageID, nil)
+	return false
+}
+
+// parseRoleTarget returns the user named in the command by the username or the user ID.
+// Returns false if the user is unknown, that is, has not written to the bot.
+func (b *TgBotServices) parseRoleTarget(target string) (int64, bool) {
+	if userID, err := strconv.ParseInt(target, 10, 64); err == nil {
+		return userID, true
+	}
+	return b.StateRepo.FindUserByUsername(strings.TrimPrefix(target, "@"))
+}
+
+// handleAccessCommand handles the owner's commands that grant, revoke and list the access roles.
+// Returns the errors of the handling and whether the update was an access command.
+func (b *TgBotServices) handleAccessCommand(uc *UpdateContext) (error, error, bool) {
+	msg := uc.Update.Message
+	if msg == nil || !msg.IsCommand() {
+		return nil, nil, false
+	}
+
+	args := strings.Fields(msg.CommandArguments())
+	switch msg.Command() {
+	case commandGrant:
+		return b.grantRole(uc, args), nil, true
+	case commandRevoke:
+		return b.revokeRole(uc, args), nil, true
+	case commandRoles:
+		return b.sendMessage(uc.ChatID, rolesText(b.StateRepo.GetAllRoles(), b.defaultRole), uc.MessageID, nil), nil, true
+	default:
+		return nil, nil, false
+	}
+}
+
+// grantRole assigns the role to the user, the arguments are the user and the role name.
+func (b *TgBotServices) grantRole(uc *UpdateContext, args []string) error {
+	const usage = "Используй /grant <@username или ID> admin|member|guest|banned"
+	if len(args) != 2 {
+		return b.sendMessage(uc.ChatID, usage, uc.MessageID, nil)
+	}
+	role, ok := models.ParseAccessRole(args[1])
+	if !ok {
+		return b.sendMessage(uc.ChatID, usage, uc.MessageID, nil)
+	}
+	if role == models.AccessOwner {
+		return b.sendMessage(uc.ChatID, "Владелец бота задаётся только в OWNER_ID", uc.MessageID, nil)
+	}
+	return b.setRole(uc, args[0], role)
+}
+
+// revokeRole returns the user to the default role, the argument is the user.
+func (b *TgBotServices) revokeRole(uc *UpdateContext, args []string) error {
+	if len(args) != 1 {
+		return b.sendMessage(uc.ChatID, "Используй /revoke <@username или ID>", uc.MessageID, nil)
+	}
+	return b.setRole(uc, args[0], "")
+}
+
+// setRole stores the role of the user named in the command, an empty role returns the user to the default one.
+func (b *TgBotServices) setRole(uc *UpdateContext, target string, role models.AccessRole) error {
+	userID, ok := b.parseRoleTarget(target)
+	if !ok {
+		return b.sendMessage(uc.ChatID, fmt.Sprintf("Пользователь %s ещё не писал боту: сначала пользователь должен отправить боту /start, либо укажи ID", target), uc.MessageID, nil)
+	}
+	if userID == b.OwnerID {
+		return b.sendMessage(uc.ChatID, "Роль владельца бота не меняется", uc.MessageID, nil)
+	}
+
+	b.StateRepo.SaveRole(userID, role)
+	logrus.WithFields(logrus.Fields{
+		"userID": userID,
+		"role":   role,
+	}).Info("Access role changed by the owner")
+
+	if role == "" {
+		role = b.defaultRole
+	}
+	return b.sendMessage(uc.ChatID, fmt.Sprintf("Пользователь %s (%d): роль «%s»", target, userID, roleTitle(role)), uc.MessageID, nil)
+}
+
+// rolesText returns the list of the users with assigned roles, sorted by user ID.
+func rolesText(roles map[int64]models.AccessRole, defaultRole models.AccessRole) string {
+	var sb strings.Builder
+	if len(roles) == 0 {
+		sb.WriteString("Назначенных ролей нет.\n")
+	} else {
+		userIDs := make([]int64, 0, len(roles))
+		for userID := range roles {
+			userIDs = append(userIDs, userID)
+		}
+		sort.Slice(userIDs, func(i, j int) bool { return userIDs[i] < userIDs[j] })
+
+		sb.WriteString("Назначенные роли:\n")
+		for _, userID := range userIDs {
+			fmt.Fprintf(&sb, "• %d: %s\n", userID, roles[userID])
+		}
+	}
+	fmt.Fprintf(&sb, "\nОстальные пользователи: %s\n", defaultRole)
+	sb.WriteString("Выдать роль: /grant <@username или ID> admin|member|guest|banned\n")
+	sb.WriteString("Вернуть роль по умолчанию: /revoke <@username или ID>")
+	return sb.String()
+}
+
+// barMenuRows returns the rows of the main menu available to the role.
+func barMenuRows(role models.AccessRole) [][]tgbotapi.KeyboardButton {
+	rows := [][]tgbotapi.KeyboardButton{
+		tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton(constant.BUTTON_TEXT_WHAT_TO_DO),
+			tgbotapi.NewKeyboardButton(constant.BUTTON_TEXT_WHITCH_MOVIE_TO_WATCH),
+		),
+	}
+
+	translateRow := tgbotapi.NewKeyboardButtonRow(tgbotapi.NewKeyboardButton(constant.BUTTON_TEXT_TRANSLATE))
+	if role.Allows(buttonAccess[constant.BUTTON_TEXT_YANDEX_DDIALOGS]) {
+		translateRow = append(translateRow, tgbotapi.NewKeyboardButton(constant.BUTTON_TEXT_YANDEX_DDIALOGS))
+	}
+	rows = append(rows, translateRow)
+
+	if role.Allows(buttonAccess[constant.BUTTON_TEXT_GENERATIVE_MODEL]) {
+		rows = append(rows, tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton(constant.BUTTON_TEXT_GENERATIVE_MODEL),
+			tgbotapi.NewKeyboardButton(constant.BUTTON_TEXT_GENERATIVE_MENU),
+		))
+	}
+	return rows
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/constant"
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeAccessStore struct {
+	UsersChatStateRepository
+	roles map[int64]models.AccessRole
+	modes map[int64]string
+}
+
+func (f *fakeAccessStore) GetRole(userID int64) models.AccessRole {
+	return f.roles[userID]
+}
+
+func (f *fakeAccessStore) GetUserMode(chatID int64) string {
+	return f.modes[chatID]
+}
+
+func newAccessBot() (*TgBotServices, *fakeAccessStore) {
+	store := &fakeAccessStore{roles: make(map[int64]models.AccessRole), modes: make(map[int64]string)}
+	b := &TgBotServices{StateRepo: store, OwnerID: 1, defaultRole: models.AccessMember}
+	b.modes = b.newModeMachine()
+	return b, store
+}
+
+// messageContext returns the context of a message from chat 7, the text starting with "/" is a command.
+func messageContext(text string) *UpdateContext {
+	msg := &tgbotapi.Message{Text: text}
+	if strings.HasPrefix(text, "/") {
+		length := len(strings.Fields(text)[0])
+		msg.Entities = []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: length}}
+	}
+	return &UpdateContext{ChatID: 7, UserID: 7, Text: text, Update: &tgbotapi.Update{Message: msg}}
+}
+
+func TestAccessRole_Allows(t *testing.T) {
+	assert.True(t, models.AccessOwner.Allows(models.AccessAdmin))
+	assert.True(t, models.AccessMember.Allows(models.AccessGuest))
+	assert.False(t, models.AccessGuest.Allows(models.AccessMember))
+	assert.False(t, models.AccessBanned.Allows(models.AccessBanned), "banned users have no access at all")
+
+	role, ok := models.ParseAccessRole("Admin")
+	assert.True(t, ok)
+	assert.Equal(t, models.AccessAdmin, role)
+	_, ok = models.ParseAccessRole("root")
+	assert.False(t, ok)
+}
+
+func TestRoleOf(t *testing.T) {
+	b, store := newAccessBot()
+	store.roles[1] = models.AccessBanned
+	store.roles[2] = models.AccessGuest
+
+	assert.Equal(t, models.AccessOwner, b.roleOf(1), "the owner is set by the config")
+	assert.Equal(t, models.AccessGuest, b.roleOf(2))
+	assert.Equal(t, models.AccessMember, b.roleOf(3), "users without a role have the default one")
+}
+
+func TestRequiredRole(t *testing.T) {
+	b, store := newAccessBot()
+
+	tests := []struct {
+		text string
+		want models.AccessRole
+	}{
+		{"/start", models.AccessGuest},
+		{constant.BUTTON_TEXT_STREAM_GENERATIVE_MODEL, models.AccessMember},
+		{constant.BUTTON_TEXT_TRANSLATE, models.AccessGuest},
+		{constant.BUTTON_TEXT_YANDEX_DDIALOGS, models.AccessAdmin},
+		{"Включить: Лампа", models.AccessAdmin},
+		{"/chats", models.AccessMember},
+		{"/usage", models.AccessMember},
+		{"/usage all", models.AccessOwner},
+		{"/quota", models.AccessMember},
+		{"/quota list", models.AccessOwner},
+		{"/quota 7 unlimited", models.AccessOwner},
+		{"/grant @alice admin", models.AccessOwner},
+		{"hello", models.AccessGuest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			assert.Equal(t, tt.want, b.requiredRole(messageContext(tt.text)))
+		})
+	}
+
+	store.modes[7] = string(ModeGenerative)
+	assert.Equal(t, models.AccessMember, b.requiredRole(messageContext("hello")), "the AI mode input requires the member role")
+	assert.Equal(t, models.AccessMember, b.requiredRole(&UpdateContext{ChatID: 7, Callback: &tgbotapi.CallbackQuery{}}))
+}
+
+func TestBarMenuRows(t *testing.T) {
+	assert.Len(t, barMenuRows(models.AccessGuest), 2, "guests have no AI row")
+	assert.Len(t, barMenuRows(models.AccessGuest)[1], 1, "guests have no smart home button")
+	assert.Len(t, barMenuRows(models.AccessMember), 3)
+	assert.Len(t, barMenuRows(models.AccessAdmin)[1], 2)
+}
+
+func TestRolesText(t *testing.T) {
+	text := rolesText(map[int64]models.AccessRole{30: models.AccessBanned, 10: models.AccessAdmin}, models.AccessGuest)
+	assert.Contains(t, text, "• 10: admin\n• 30: banned\n")
+	assert.Contains(t, text, "Остальные пользователи: guest")
+	assert.Contains(t, rolesText(nil, models.AccessMember), "Назначенных ролей нет")
+}
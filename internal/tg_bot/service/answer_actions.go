@@ -0,0 +1,209 @@
+package service
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/sirupsen/logrus"
+)
+
+// continuePrompt is the question that asks the model to go on with its answer cut off by the length limit.
+const continuePrompt = "Продолжи свой предыдущий ответ с того места, где он оборвался, без повторов."
+
+// answer is the latest finished AI answer of a chat. Only its action buttons work,
+// because regenerating an older answer would break the dialog history that follows it.
+type answer struct {
+	messageIDs  []int  // Messages of the answer in order, the last one has the action buttons
+	threadID    string // Dialog thread the answer was saved to
+	canContinue bool   // The answer was cut off by the length limit
+}
+
+// messageID returns the message of the answer with the action buttons.
+func (a answer) messageID() int {
+	return a.messageIDs[len(a.messageIDs)-1]
+}
+
+// answerActionsMarkup returns the inline keyboard of a finished AI answer.
+// The Continue button is added only to answers cut off by the length limit.
+func answerActionsMarkup(canContinue bool) tgbotapi.InlineKeyboardMarkup {
+	rows := [][]tgbotapi.InlineKeyboardButton{tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("🔄 Заново", callbackData(callbackRegenerate, "")),
+		tgbotapi.NewInlineKeyboardButtonData("🔀 Другой моделью", callbackData(callbackRegenerateWith, "")),
+	)}
+	if canContinue {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("▶️ Продолжить", callbackData(callbackContinue, "")),
+		))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+// rememberAnswer makes the answer in the messages the latest answer of the chat's active dialog thread.
+func (b *TgBotServices) rememberAnswer(chatID int64, messageIDs []int, canContinue bool) {
+	thread, _, err := b.activeThreadInfo(chatID)
+	if err != nil {
+		logrus.WithError(err).WithField("chatID", chatID).Error("Failed to load the active dialog thread")
+	}
+
+	b.generationsMu.Lock()
+	defer b.generationsMu.Unlock()
+	b.answers[chatID] = answer{messageIDs: messageIDs, threadID: thread.ID, canContinue: canContinue}
+}
+
+// latestAnswer returns the chat's latest answer if it belongs to the active dialog thread.
+func (b *TgBotServices) latestAnswer(chatID int64) (answer, bool) {
+	b.generationsMu.Lock()
+	latest, ok := b.answers[chatID]
+	b.generationsMu.Unlock()
+	if !ok {
+		return answer{}, false
+	}
+
+	thread, _, err := b.activeThreadInfo(chatID)
+	if err != nil {
+		logrus.WithError(err).WithField("chatID", chatID).Error("Failed to load the active dialog thread")
+		return answer{}, false
+	}
+	return latest, thread.ID == latest.threadID
+}
+
+// pressedLatestAnswer returns the chat's latest answer if the pressed button belongs to it.
+// Otherwise it tells the user that the button is outdated.
+func (b *TgBotServices) pressedLatestAnswer(uc *UpdateContext) (answer, bool, error) {
+	latest, ok := b.latestAnswer(uc.ChatID)
+	if !ok || latest.messageID() != uc.MessageID {
+		return answer{}, false, b.answerCallback(uc, "Кнопки работают только у последнего ответа текущего диалога")
+	}
+	return latest, true, nil
+}
+
+// dropLastTurn removes the last question and the answers that follow it from the dialog history.
+// Returns the question and the remaining history, false if the history has no question to repeat.
+func dropLastTurn(history []models.Message) (string, []models.Message, bool) {
+	end := len(history)
+	for end > 0 && history[end-1].Role == models.RoleAssistant {
+		end--
+	}
+	if end == 0 || history[end-1].Role != models.RoleUser {
+		return "", history, false
+	}
+	return history[end-1].Content, history[:end-1], true
+}
+
+// regenerateAnswer asks the last question of the dialog again. The previous answer is removed from the history,
+// so the model does not see it, and the new answer is streamed into the message.
+// Arguments:
+//   - uc: the update context of the user's action.
+//   - messageID: the message the new answer replaces, 0 sends a new message.
+//   - model: the model that answers instead of the chat's one, empty keeps the chat's model.
+func (b *TgBotServices) regenerateAnswer(uc *UpdateContext, messageID int, model string) error {
+	history, err := b.AIDialogRepo.GetDialogHistory(uc.ChatID)
+	if err != nil {
+		logrus.WithError(err).WithField("chatID", uc.ChatID).Error("Failed to load dialog history")
+		return b.sendMessage(uc.ChatID, "Не удалось загрузить историю диалога, попробуй позже", 0, nil)
+	}
+	question, rest, ok := dropLastTurn(history)
+	if !ok {
+		return b.sendMessage(uc.ChatID, "В текущем диалоге нет вопроса, на который можно ответить заново", 0, nil)
+	}
+	if err = b.AIDialogRepo.SaveDialog(uc.ChatID, rest); err != nil {
+		logrus.WithError(err).WithField("chatID", uc.ChatID).Error("Failed to drop the last dialog turn")
+		return b.sendMessage(uc.ChatID, "Не удалось обновить историю диалога, попробуй позже", 0, nil)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"chatID": uc.ChatID,
+		"model":  model,
+	}).Info("AI answer regenerated")
+	ask := *uc
+	ask.Text = question
+	return b.streamAnswer(&ask, messageID, model, false)
+}
+
+// deleteMessages deletes the messages of a previous AI answer.
+func (b *TgBotServices) deleteMessages(chatID int64, messageIDs []int) {
+	for _, messageID := range messageIDs {
+		if _, err := b.sender.Request(tgbotapi.NewDeleteMessage(chatID, messageID)); err != nil {
+			logrus.WithError(err).WithField("chatID", chatID).Error("Failed to delete the previous AI answer")
+		}
+	}
+}
+
+// regenerateByButton answers the last question again in place of the answer whose button was pressed.
+func (b *TgBotServices) regenerateByButton(uc *UpdateContext) error {
+	latest, ok, err := b.pressedLatestAnswer(uc)
+	if !ok {
+		return err
+	}
+	release, denial := b.acquireAIQuota(uc.ChatID, senderID(uc))
+	if denial != "" {
+		return b.answerCallback(uc, denial)
+	}
+	defer release()
+	// The new answer starts in the first message of the previous one, the rest of its messages are deleted
+	b.deleteMessages(uc.ChatID, latest.messageIDs[1:])
+	return errors.Join(b.answerCallback(uc, "Отвечаю заново"), b.regenerateAnswer(uc, latest.messageIDs[0], ""))
+}
+
+// chooseRegenerateModelByButton asks the user for the model that answers the last question again.
+func (b *TgBotServices) chooseRegenerateModelByButton(uc *UpdateContext) error {
+	if _, ok, err := b.pressedLatestAnswer(uc); !ok {
+		return err
+	}
+	return errors.Join(b.answerCallback(uc, ""), b.enterMode(uc, ModeRegeneratingAnswer))
+}
+
+// regenerateWithModel answers the last question again with the model entered by the user.
+// The previous answer is deleted and the new one is sent below, the model of the dialog thread is not changed.
+// It is the input handler of ModeRegeneratingAnswer.
+func (b *TgBotServices) regenerateWithModel(uc *UpdateContext) error {
+	modelName := strings.TrimSpace(uc.Text)
+	if err := b.Generative.ValidateModelName(modelName); err != nil {
+		logrus.WithError(err).Error("Regenerate with model failed")
+		return b.sendMessage(uc.ChatID, "Эта модель недоступна. Проверь название модели и попробуй ещё раз или введи /stop для выхода.", uc.MessageID, nil)
+	}
+
+	latest, ok := b.latestAnswer(uc.ChatID)
+	if err := b.enterMode(uc, ModeGenerative); err != nil {
+		return err
+	}
+	if !ok {
+		return b.sendMessage(uc.ChatID, "Ответ, который нужно повторить, уже не последний в текущем диалоге", uc.MessageID, nil)
+	}
+	release, denial := b.acquireAIQuota(uc.ChatID, senderID(uc))
+	if denial != "" {
+		return b.sendMessage(uc.ChatID, denial, uc.MessageID, nil)
+	}
+	defer release()
+	b.deleteMessages(uc.ChatID, latest.messageIDs)
+	return b.regenerateAnswer(uc, 0, modelName)
+}
+
+// continueByButton asks the model to go on with the answer cut off by the length limit.
+// The continuation is streamed into a new message and the cut-off answer loses its buttons.
+func (b *TgBotServices) continueByButton(uc *UpdateContext) error {
+	latest, ok, err := b.pressedLatestAnswer(uc)
+	if !ok {
+		return err
+	}
+	if !latest.canContinue {
+		return b.answerCallback(uc, "Ответ не был обрезан, продолжать нечего")
+	}
+	release, denial := b.acquireAIQuota(uc.ChatID, senderID(uc))
+	if denial != "" {
+		return b.answerCallback(uc, denial)
+	}
+	defer release()
+
+	noButtons := tgbotapi.NewEditMessageReplyMarkup(uc.ChatID, latest.messageID(), tgbotapi.InlineKeyboardMarkup{InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{}})
+	if _, err = b.sender.Request(noButtons); err != nil {
+		logrus.WithError(err).WithField("chatID", uc.ChatID).Error("Failed to remove the buttons of the AI answer")
+	}
+
+	ask := *uc
+	ask.Text = continuePrompt
+	// The instruction is not a question of the user: the continuation is saved as one more answer to the last question
+	return errors.Join(b.answerCallback(uc, "Продолжаю ответ"), b.streamAnswer(&ask, 0, "", true))
+}
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDropLastTurn(t *testing.T) {
+	history := []models.Message{
+		{Role: models.RoleUser, Content: "Привет"},
+		{Role: models.RoleAssistant, Content: "Здравствуй"},
+		{Role: models.RoleUser, Content: "Расскажи сказку"},
+		{Role: models.RoleAssistant, Content: "Жили-были"},
+	}
+	question, rest, ok := dropLastTurn(history)
+	assert.True(t, ok)
+	assert.Equal(t, "Расскажи сказку", question)
+	assert.Equal(t, history[:2], rest)
+
+	question, rest, ok = dropLastTurn(history[:3])
+	assert.True(t, ok, "a question left without an answer after an error is repeated")
+	assert.Equal(t, "Расскажи сказку", question)
+	assert.Equal(t, history[:2], rest)
+
+	_, _, ok = dropLastTurn([]models.Message{{Role: models.RoleMemory, Content: "пересказ"}})
+	assert.False(t, ok)
+	_, _, ok = dropLastTurn(nil)
+	assert.False(t, ok)
+}
+
+func TestAnswerActionsMarkup(t *testing.T) {
+	assert.Len(t, answerActionsMarkup(false).InlineKeyboard, 1)
+
+	markup := answerActionsMarkup(true)
+	assert.Len(t, markup.InlineKeyboard, 2)
+	assert.Equal(t, callbackData(callbackContinue, ""), *markup.InlineKeyboard[1][0].CallbackData)
+}
+
+func TestStreamAnswer_OneOffPromptIsNotSaved(t *testing.T) {
+	model := &fakeSummarizer{}
+	b := newPreferencesBot(t, t.TempDir())
+	b.Generative = model
+	b.sender, _ = newTestSender(&fakeTelegramAPI{})
+	b.generations = make(map[int64]*generation)
+	b.answers = make(map[int64]answer)
+	uc := &UpdateContext{Ctx: context.Background(), ChatID: 1, Text: "Расскажи сказку"}
+
+	require.NoError(t, b.streamAnswer(uc, 0, "", false))
+	ask := *uc
+	ask.Text = continuePrompt
+	require.NoError(t, b.streamAnswer(&ask, 0, "", true))
+
+	assert.Equal(t, []string{"Расскажи сказку", continuePrompt}, model.prompts, "the instruction is sent to the model")
+	history, err := b.AIDialogRepo.GetDialogHistory(1)
+	require.NoError(t, err)
+	assert.Equal(t, []models.Message{
+		{Role: models.RoleUser, Content: "Расскажи сказку"},
+		{Role: models.RoleAssistant, Content: "summary 1"},
+		{Role: models.RoleAssistant, Content: "summary 2"},
+	}, history, "the continuation is one more answer to the question")
+
+	question, rest, ok := dropLastTurn(history)
+	assert.True(t, ok)
+	assert.Equal(t, "Расскажи сказку", question, "the question is answered again, not the instruction")
+	assert.Empty(t, rest)
+}
@@ -0,0 +1,189 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf16"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxMessageLength  = 4096  // Longest text of a Telegram message in UTF-16 code units
+	codeFence         = "```" // Opens and closes a Markdown code block
+	maxReopenFenceLen = 32    // Longest code block opener repeated in the next part, longer ones are reopened as a bare fence
+)
+
+// utf16Prefix returns the length in bytes of the longest prefix of the text that fits into the limit of UTF-16 code units.
+// Telegram measures the message length in UTF-16 code units, so emoji and other astral characters count twice.
+func utf16Prefix(text string, limit int) int {
+	units := 0
+	for i, r := range text {
+		n := utf16.RuneLen(r)
+		if n < 0 {
+			n = 1
+		}
+		if units+n > limit {
+			return i
+		}
+		units += n
+	}
+	return len(text)
+}
+
+// messageCut finds where the text that does not fit into the limit is split.
+// The best cut is a paragraph break or the edge of a code block, then a line break, then the limit itself.
+// Returns the cut position in bytes and the opener of the code block the cut falls into, empty if it is outside code.
+func messageCut(text string, limit int) (int, string) {
+	// A cut inside a code block closes it, so the closing fence must fit too
+	end := utf16Prefix(text, limit-len("\n"+codeFence))
+
+	var (
+		boundary, lineBreak int
+		fence, lineFence    string
+	)
+	for start := 0; start < end; {
+		n := strings.IndexByte(text[start:end], '\n')
+		if n < 0 {
+			break
+		}
+		lineEnd := start + n
+		line := strings.TrimSpace(text[start:lineEnd])
+		switch {
+		case strings.HasPrefix(line, codeFence) && fence == "":
+			if start > 0 {
+				boundary = start
+			}
+			fence = line
+		case strings.HasPrefix(line, codeFence):
+			fence = ""
+			boundary = lineEnd
+		case line == "" && fence == "" && start > 0:
+			boundary = start
+		}
+		lineBreak, lineFence = lineEnd, fence
+		start = lineEnd + 1
+	}
+
+	switch {
+	case boundary > 0:
+		return boundary, ""
+	case lineBreak > 0:
+		return lineBreak, lineFence
+	default:
+		return end, fence
+	}
+}
+
+// splitMessageText splits the text into parts that fit into Telegram messages of the limit.
+// A code block split between parts is closed at the end of the part and reopened in the next one,
+// so every part stays valid Markdown.
+func splitMessageText(text string, limit int) []string {
+	var parts []string
+	for utf16Prefix(text, limit) < len(text) {
+		cut, fence := messageCut(text, limit)
+		part, rest := strings.TrimRight(text[:cut], "\n"), strings.TrimLeft(text[cut:], "\n")
+		if fence != "" {
+			if len(fence) > maxReopenFenceLen {
+				fence = codeFence
+			}
+			part += "\n" + codeFence
+			rest = fence + "\n" + rest
+		}
+		parts = append(parts, part)
+		text = rest
+	}
+	return append(parts, text)
+}
+
+// answerMessages is the chain of Telegram messages an AI answer is streamed into.
+// When the answer outgrows the last message, it rolls over into a new one, and only the last message has the buttons.
+// Every part is split from the model's Markdown and rendered into Telegram entities on its own.
+type answerMessages struct {
+	b          *TgBotServices
+	chatID     int64
+	ids        []int               // Messages of the answer in order
+	shown      []string            // Text shown in every message
+	onRollover func(messageID int) // Called with the new last message of the answer
+}
+
+// newAnswerMessages creates the chain that starts with the message showing the text.
+func (b *TgBotServices) newAnswerMessages(chatID int64, messageID int, text string, onRollover func(messageID int)) *answerMessages {
+	return &answerMessages{
+		b:          b,
+		chatID:     chatID,
+		ids:        []int{messageID},
+		shown:      []string{text},
+		onRollover: onRollover,
+	}
+}
+
+// show displays the text of the answer. Only the parts that changed are edited, and new parts are sent as new messages.
+// The markup is attached to the last message; final forces the last message to be edited, so its buttons are replaced.
+func (m *answerMessages) show(text string, markup tgbotapi.InlineKeyboardMarkup, final bool) error {
+	parts := splitMessageText(text, maxMessageLength)
+	prevLast := len(m.ids) - 1
+
+	var err error
+	for i, part := range parts {
+		last := i == len(parts)-1
+		switch {
+		case i >= len(m.ids):
+			sent, sendErr := m.sendFormatted(part, m.b.sender.Send, func(text string, entities []tgbotapi.MessageEntity) tgbotapi.Chattable {
+				msg := tgbotapi.NewMessage(m.chatID, text)
+				msg.Entities = entities
+				if last {
+					msg.ReplyMarkup = markup
+				}
+				return msg
+			})
+			if sendErr != nil {
+				logrus.WithError(sendErr).WithField("chatID", m.chatID).Error("Failed to send the next part of the AI answer")
+				return sendErr
+			}
+			m.ids = append(m.ids, sent.MessageID)
+			m.shown = append(m.shown, part)
+			if m.onRollover != nil {
+				m.onRollover(sent.MessageID)
+			}
+		case m.shown[i] != part || i == prevLast && !last || last && final:
+			// An intermediate edit of the streamed part is skipped when the budget is exhausted, the next one carries its text
+			send := m.b.sender.Send
+			if last && !final {
+				send = m.b.sender.TrySend
+			}
+			_, editErr := m.sendFormatted(part, send, func(text string, entities []tgbotapi.MessageEntity) tgbotapi.Chattable {
+				edit := tgbotapi.NewEditMessageText(m.chatID, m.ids[i], text)
+				edit.Entities = entities
+				if last {
+					edit.ReplyMarkup = &markup
+				}
+				return edit
+			})
+			if errors.Is(editErr, ErrThrottled) {
+				continue
+			}
+			if editErr != nil {
+				logrus.WithError(editErr).WithField("chatID", m.chatID).Error("Failed to edit the AI answer")
+				err = editErr
+				continue
+			}
+			m.shown[i] = part
+		}
+	}
+	return err
+}
+
+// sendFormatted sends the request built for the part of the answer rendered from Markdown.
+// If Telegram rejects the formatting, the request is repeated with the part as plain text.
+func (m *answerMessages) sendFormatted(part string, send func(tgbotapi.Chattable) (tgbotapi.Message, error),
+	build func(text string, entities []tgbotapi.MessageEntity) tgbotapi.Chattable) (tgbotapi.Message, error) {
+	text, entities := renderMarkdown(part)
+	sent, err := send(build(text, entities))
+	if err == nil || !isFormattingError(err) {
+		return sent, err
+	}
+	logrus.WithError(err).WithField("chatID", m.chatID).Warn("Telegram rejected the AI answer formatting, sending plain text")
+	return send(build(part, nil))
+}
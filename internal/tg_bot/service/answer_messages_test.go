@@ -0,0 +1,39 @@
+package service
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitMessageText_ShortTextIsOnePart(t *testing.T) {
+	assert.Equal(t, []string{"Привет"}, splitMessageText("Привет", 100))
+}
+
+func TestSplitMessageText_PrefersParagraphs(t *testing.T) {
+	text := strings.Repeat("а", 30) + "\nвторая строка\n\n" + strings.Repeat("б", 30)
+	parts := splitMessageText(text, 60)
+	assert.Equal(t, []string{strings.Repeat("а", 30) + "\nвторая строка", strings.Repeat("б", 30)}, parts)
+}
+
+func TestSplitMessageText_ReopensCodeBlock(t *testing.T) {
+	code := strings.Repeat("fmt.Println(1)\n", 6)
+	parts := splitMessageText("```go\n"+code+"```", 60)
+
+	assert.Greater(t, len(parts), 1)
+	for _, part := range parts {
+		assert.LessOrEqual(t, len(utf16.Encode([]rune(part))), 60)
+		assert.Equal(t, 0, strings.Count(part, "```")%2, "every part closes its code block: %q", part)
+	}
+	assert.True(t, strings.HasPrefix(parts[1], "```go\n"))
+	assert.Equal(t, "```go\n"+code+"```", strings.ReplaceAll(strings.Join(parts, "\n"), "\n```\n```go\n", "\n"))
+}
+
+func TestSplitMessageText_CountsUTF16(t *testing.T) {
+	text := strings.Repeat("😀", 10) // 20 UTF-16 code units
+	parts := splitMessageText(text, 10)
+	assert.Len(t, parts, 3)
+	assert.Equal(t, text, strings.Join(parts, ""))
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/sirupsen/logrus"
+)
+
+// Actions of the inline buttons. The callback data of a button is "action:argument".
+const (
+	callbackThreadSwitch   = "thread_switch" // Switch to the dialog thread, the argument is the thread ID
+	callbackThreadDelete   = "thread_delete" // Delete the dialog thread, the argument is the thread ID
+	callbackPersonaPick    = "persona_pick"  // Select the persona for the dialog thread, an empty argument clears it
+	callbackPersonaDrop    = "persona_drop"  // Delete the user's persona, the argument is the persona ID
+	callbackStopGeneration = "gen_stop"      // Stop the AI answer streamed into the message with the button
+	callbackRegenerate     = "gen_regen"     // Answer the last question again, replacing the answer with the button
+	callbackRegenerateWith = "gen_regen_as"  // Answer the last question again with a model the user enters
+	callbackContinue       = "gen_continue"  // Continue the answer cut off by the length limit
+	callbackModelPage      = "model_page"    // Show the model picker page, the argument is "price:context:page"
+	callbackModelPick      = "model_pick"    // Select the model for the dialog thread, the argument is the picker page and the model index
+)
+
+// callbackData builds the callback data of an inline button.
+func callbackData(action, arg string) string {
+	return action + ":" + arg
+}
+
+// handleCallback processes a pressed inline button.
+// Every callback query is answered, so the Telegram client stops showing the loading indicator.
+func (b *TgBotServices) handleCallback(uc *UpdateContext) error {
+	action, arg, _ := strings.Cut(uc.Callback.Data, ":")
+	logrus.WithFields(logrus.Fields{
+		"chatID": uc.ChatID,
+		"action": action,
+	}).Debug("Callback query received")
+
+	switch action {
+	case callbackThreadSwitch:
+		return b.switchThreadByButton(uc, arg)
+	case callbackThreadDelete:
+		return b.deleteThreadByButton(uc, arg)
+	case callbackPersonaPick:
+		return b.selectPersonaByButton(uc, arg)
+	case callbackPersonaDrop:
+		return b.deletePersonaByButton(uc, arg)
+	case callbackStopGeneration:
+		return b.stopGenerationByButton(uc)
+	case callbackRegenerate:
+		return b.regenerateByButton(uc)
+	case callbackRegenerateWith:
+		return b.chooseRegenerateModelByButton(uc)
+	case callbackContinue:
+		return b.continueByButton(uc)
+	case callbackModelPage:
+		return b.modelPageByButton(uc, arg)
+	case callbackModelPick:
+		return b.pickModelByButton(uc, arg)
+	default:
+		return b.answerCallback(uc, "Эта кнопка больше не работает")
+	}
+}
+
+// answerCallback answers the callback query with an optional notification shown to the user.
+func (b *TgBotServices) answerCallback(uc *UpdateContext, text string) error {
+	if _, err := b.sender.Request(tgbotapi.NewCallback(uc.Callback.ID, text)); err != nil {
+		logrus.WithError(err).WithField("chatID", uc.ChatID).Error("Failed to answer callback query")
+		return err
+	}
+	return nil
+}
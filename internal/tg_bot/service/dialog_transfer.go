@@ -0,0 +1,282 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/sirupsen/logrus"
+)
+
+// Commands of the dialog export and import.
+const (
+	commandExportDialog = "export"
+	commandImportDialog = "import"
+)
+
+// Export formats of the dialog history.
+const (
+	exportFormatMarkdown = "md"
+	exportFormatJSON     = "json"
+)
+
+const (
+	maxImportFileSize      = 1 << 20 // Maximum size of an imported file in bytes
+	maxImportMessages      = 1000    // Maximum number of messages in an imported dialog
+	maxImportMessageLength = 32000   // Maximum length of an imported message in characters
+)
+
+// errInvalidDialogImport is returned when an imported file does not match the export schema.
+var errInvalidDialogImport = errors.New("invalid dialog import")
+
+// exportRoleTitles are the headings of the messages in the Markdown export.
+var exportRoleTitles = map[string]string{
+	models.RoleUser:      "Пользователь",
+	models.RoleAssistant: "ИИ",
+	models.RoleSystem:    "Инструкция",
+	models.RoleMemory:    "Память диалога",
+}
+
+// newDialogExport builds the export document of the dialog history.
+func newDialogExport(title string, history []models.Message, exportedAt time.Time) models.DialogExport {
+	export := models.DialogExport{
+		Version:    models.DialogExportVersion,
+		Title:      title,
+		ExportedAt: exportedAt.UTC(),
+		Messages:   make([]models.DialogExportMessage, 0, len(history)),
+	}
+	for _, msg := range history {
+		export.Messages = append(export.Messages, models.DialogExportMessage{Role: msg.Role, Content: msg.Content})
+	}
+	return export
+}
+
+// encodeDialogJSON renders the export document as indented JSON, the format accepted by /import.
+func encodeDialogJSON(export models.DialogExport) ([]byte, error) {
+	return json.MarshalIndent(export, "", "  ")
+}
+
+// encodeDialogMarkdown renders the export document as a human-readable Markdown file.
+func encodeDialogMarkdown(export models.DialogExport) []byte {
+	var sb strings.Builder
+	title := export.Title
+	if title == "" {
+		title = "Диалог с ИИ"
+	}
+	fmt.Fprintf(&sb, "# %s\n\n_Экспортировано: %s_\n", title, export.ExportedAt.Format("2006-01-02 15:04 MST"))
+	for _, msg := range export.Messages {
+		heading, ok := exportRoleTitles[msg.Role]
+		if !ok {
+			heading = msg.Role
+		}
+		fmt.Fprintf(&sb, "\n**%s:**\n\n%s\n", heading, msg.Content)
+	}
+	return []byte(sb.String())
+}
+
+// decodeDialogImport parses and validates an imported export file.
+// Arguments:
+//   - data: content of the uploaded file.
+//
+// Returns the dialog history of the file, or an error wrapping errInvalidDialogImport that describes the problem.
+func decodeDialogImport(data []byte) ([]models.Message, error) {
+	if len(data) > maxImportFileSize {
+		return nil, fmt.Errorf("%w: file is larger than %d bytes", errInvalidDialogImport, maxImportFileSize)
+	}
+
+	var export models.DialogExport
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&export); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidDialogImport, err)
+	}
+	if export.Version != models.DialogExportVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", errInvalidDialogImport, export.Version)
+	}
+	if len(export.Messages) == 0 {
+		return nil, fmt.Errorf("%w: no messages", errInvalidDialogImport)
+	}
+	if len(export.Messages) > maxImportMessages {
+		return nil, fmt.Errorf("%w: %d messages, at most %d are allowed", errInvalidDialogImport, len(export.Messages), maxImportMessages)
+	}
+
+	history := make([]models.Message, 0, len(export.Messages))
+	for i, msg := range export.Messages {
+		if _, ok := exportRoleTitles[msg.Role]; !ok {
+			return nil, fmt.Errorf("%w: message %d has unknown role %q", errInvalidDialogImport, i+1, msg.Role)
+		}
+		if strings.TrimSpace(msg.Content) == "" {
+			return nil, fmt.Errorf("%w: message %d is empty", errInvalidDialogImport, i+1)
+		}
+		if !utf8.ValidString(msg.Content) || utf8.RuneCountInString(msg.Content) > maxImportMessageLength {
+			return nil, fmt.Errorf("%w: message %d is longer than %d characters", errInvalidDialogImport, i+1, maxImportMessageLength)
+		}
+		history = append(history, models.Message{Role: msg.Role, Content: msg.Content})
+	}
+	return history, nil
+}
+
+// handleDialogTransferCommand handles the dialog export and import commands and the uploaded import files.
+// Returns the errors of the handling and whether the update was handled.
+func (b *TgBotServices) handleDialogTransferCommand(uc *UpdateContext) (error, error, bool) {
+	msg := uc.Update.Message
+	if msg.Document != nil {
+		if isImportCaption(msg.Caption) || b.modes.Current(uc.ChatID) == ModeImportingDialog {
+			return b.importDialog(uc, msg.Document), nil, true
+		}
+		return nil, nil, false
+	}
+	if !msg.IsCommand() {
+		return nil, nil, false
+	}
+
+	switch msg.Command() {
+	case commandExportDialog:
+		return b.exportDialog(uc, strings.ToLower(strings.TrimSpace(msg.CommandArguments()))), nil, true
+	case commandImportDialog:
+		return b.enterMode(uc, ModeImportingDialog), nil, true
+	default:
+		return nil, nil, false
+	}
+}
+
+// isImportCaption reports whether the caption of an uploaded file is the /import command.
+func isImportCaption(caption string) bool {
+	command, _, _ := strings.Cut(strings.TrimSpace(caption), " ")
+	command, _, _ = strings.Cut(command, "@")
+	return command == "/"+commandImportDialog
+}
+
+// exportDialog sends the history of the chat's active thread as a document.
+// Arguments:
+//   - uc: context of the update with the /export command.
+//   - format: exportFormatMarkdown, exportFormatJSON, or empty for Markdown.
+func (b *TgBotServices) exportDialog(uc *UpdateContext, format string) error {
+	if format == "" {
+		format = exportFormatMarkdown
+	}
+	if format != exportFormatMarkdown && format != exportFormatJSON {
+		return b.sendMessage(uc.ChatID, "Неизвестный формат. Используй /export md или /export json", uc.MessageID, nil)
+	}
+
+	history, err := b.AIDialogRepo.GetDialogHistory(uc.ChatID)
+	if err != nil {
+		logrus.WithError(err).WithField("chatID", uc.ChatID).Error("Failed to load dialog history for export")
+		return errors.Join(err, b.sendMessage(uc.ChatID, "Не удалось выгрузить историю, попробуй позже", uc.MessageID, nil))
+	}
+	if len(history) == 0 {
+		return b.sendMessage(uc.ChatID, "История текущего диалога пуста", uc.MessageID, nil)
+	}
+
+	var title string
+	if thread, ok, err := b.activeThreadInfo(uc.ChatID); err == nil && ok {
+		title = thread.Title
+	}
+	now := time.Now()
+	export := newDialogExport(title, history, now)
+	data := encodeDialogMarkdown(export)
+	if format == exportFormatJSON {
+		if data, err = encodeDialogJSON(export); err != nil {
+			return fmt.Errorf("failed to encode dialog export: %w", err)
+		}
+	}
+
+	doc := tgbotapi.NewDocument(uc.ChatID, tgbotapi.FileBytes{
+		Name:  fmt.Sprintf("dialog_%s.%s", now.Format("2006-01-02_15-04"), format),
+		Bytes: data,
+	})
+	doc.Caption = fmt.Sprintf("Сообщений в истории: %d", len(history))
+	doc.ReplyToMessageID = uc.MessageID
+	if _, err = b.sender.Send(doc); err != nil {
+		logrus.WithError(err).WithField("chatID", uc.ChatID).Error("Failed to send dialog export")
+		return err
+	}
+	return nil
+}
+
+// withoutURL removes the request URL from the error of the HTTP client.
+// The Telegram file and API URLs contain the bot token, which must never get into the logs.
+func withoutURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("%s: %w", urlErr.Op, urlErr.Err)
+	}
+	return err
+}
+
+// downloadImportFile downloads the uploaded file, refusing files larger than maxImportFileSize.
+func (b *TgBotServices) downloadImportFile(uc *UpdateContext, doc *tgbotapi.Document) ([]byte, error) {
+	if doc.FileSize > maxImportFileSize {
+		return nil, fmt.Errorf("%w: file is larger than %d bytes", errInvalidDialogImport, maxImportFileSize)
+	}
+	fileURL, err := b.Bot.GetFileDirectURL(doc.FileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get import file URL: %w", withoutURL(err))
+	}
+
+	req, err := http.NewRequestWithContext(uc.Ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create import file request: %w", withoutURL(err))
+	}
+	// The file is downloaded from the file server, not requested from the Bot API,
+	// so it is not limited by the sender's budgets and goes past the TelegramSender
+	resp, err := b.Bot.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download import file: %w", withoutURL(err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download import file: status %s", resp.Status)
+	}
+
+	// Read one byte over the limit to detect files whose size was not reported by Telegram
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImportFileSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read import file: %w", withoutURL(err))
+	}
+	return data, nil
+}
+
+// importDialog restores the history of the chat's active thread from an uploaded export file
+// and moves the chat to the AI mode to continue the dialog.
+func (b *TgBotServices) importDialog(uc *UpdateContext, doc *tgbotapi.Document) error {
+	data, err := b.downloadImportFile(uc, doc)
+	var history []models.Message
+	if err == nil {
+		history, err = decodeDialogImport(data)
+	}
+	if errors.Is(err, errInvalidDialogImport) {
+		logrus.WithError(err).WithField("chatID", uc.ChatID).Info("Rejected dialog import")
+		text := fmt.Sprintf("Файл не подходит для импорта: %s.\nПришли JSON-файл, полученный командой /export json (до %d КБ и %d сообщений).",
+			strings.TrimPrefix(err.Error(), errInvalidDialogImport.Error()+": "), maxImportFileSize>>10, maxImportMessages)
+		return b.sendMessage(uc.ChatID, text, uc.MessageID, nil)
+	}
+	if err == nil {
+		err = b.AIDialogRepo.SaveDialog(uc.ChatID, history)
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("chatID", uc.ChatID).Error("Failed to import dialog history")
+		return errors.Join(err, b.sendMessage(uc.ChatID, "Не удалось импортировать историю, попробуй позже", uc.MessageID, nil))
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"chatID":   uc.ChatID,
+		"messages": len(history),
+	}).Info("Dialog history imported")
+	text := fmt.Sprintf("История текущего диалога восстановлена, сообщений: %d", len(history))
+	return errors.Join(b.sendMessage(uc.ChatID, text, uc.MessageID, nil), b.enterMode(uc, ModeGenerative))
+}
+
+// askForImportFile reminds the user that the import mode waits for a file. It is the input handler of ModeImportingDialog.
+func (b *TgBotServices) askForImportFile(uc *UpdateContext) error {
+	return b.sendMessage(uc.ChatID, "Пришли JSON-файл, полученный командой /export json, или /stop для выхода.", uc.MessageID, nil)
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialogExport_JSONRoundTrip(t *testing.T) {
+	history := dialogOf("memory", "earlier", "user", "вопрос", "assistant", "ответ")
+	export := newDialogExport("Работа", history, time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC))
+
+	data, err := encodeDialogJSON(export)
+	require.NoError(t, err)
+	imported, err := decodeDialogImport(data)
+	require.NoError(t, err)
+	assert.Equal(t, history, imported)
+
+	markdown := string(encodeDialogMarkdown(export))
+	assert.True(t, strings.HasPrefix(markdown, "# Работа\n"))
+	assert.Contains(t, markdown, "**Пользователь:**\n\nвопрос")
+	assert.Contains(t, markdown, "**ИИ:**\n\nответ")
+}
+
+func TestDecodeDialogImport_Validation(t *testing.T) {
+	tooMany := `{"version":1,"messages":[` + strings.TrimSuffix(strings.Repeat(`{"role":"user","content":"x"},`, maxImportMessages+1), ",") + `]}`
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "not json", data: "# Диалог"},
+		{name: "unknown version", data: `{"version":2,"messages":[{"role":"user","content":"hi"}]}`},
+		{name: "unknown field", data: `{"version":1,"chat":1,"messages":[{"role":"user","content":"hi"}]}`},
+		{name: "no messages", data: `{"version":1,"messages":[]}`},
+		{name: "unknown role", data: `{"version":1,"messages":[{"role":"tool","content":"hi"}]}`},
+		{name: "empty content", data: `{"version":1,"messages":[{"role":"user","content":"  "}]}`},
+		{name: "too long message", data: `{"version":1,"messages":[{"role":"user","content":"` + strings.Repeat("я", maxImportMessageLength+1) + `"}]}`},
+		{name: "too many messages", data: tooMany},
+		{name: "too large file", data: strings.Repeat(" ", maxImportFileSize+1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeDialogImport([]byte(tt.data))
+			assert.ErrorIs(t, err, errInvalidDialogImport)
+		})
+	}
+
+	history, err := decodeDialogImport([]byte(`{"version":1,"title":"t","exportedAt":"2026-10-17T12:00:00Z","messages":[{"role":"user","content":"hi"}]}`))
+	require.NoError(t, err)
+	assert.Equal(t, []models.Message{{Role: models.RoleUser, Content: "hi"}}, history)
+}
+
+func TestWithoutURL(t *testing.T) {
+	err := &url.Error{Op: "Get", URL: "https://api.telegram.org/file/bot123:secret/documents/file_1.json", Err: context.Canceled}
+
+	redacted := withoutURL(err)
+	assert.NotContains(t, redacted.Error(), "secret", "the bot token is not logged")
+	assert.Equal(t, "Get: context canceled", redacted.Error())
+	assert.True(t, errors.Is(redacted, context.Canceled))
+
+	plain := errors.New("status 404")
+	assert.Equal(t, plain, withoutURL(plain))
+}
@@ -0,0 +1,170 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ModeName identifies a chat mode of the bot.
+type ModeName string
+
+// Chat modes known to the bot.
+const (
+	ModeIdle                ModeName = "idle"
+	ModeTranslating         ModeName = "translating"
+	ModeGenerative          ModeName = "generative"
+	ModeChangingModel       ModeName = "changing_model"
+	ModeChangingHistorySize ModeName = "changing_history_size"
+	ModeChangingTemperature ModeName = "changing_temperature"
+	ModeChangingMaxTokens   ModeName = "changing_max_tokens"
+	ModeChangingPrompt      ModeName = "changing_system_prompt"
+	ModeNamingThread        ModeName = "naming_thread"
+	ModeImportingDialog     ModeName = "importing_dialog"
+	ModeCreatingPersona     ModeName = "creating_persona"
+	ModeRegeneratingAnswer  ModeName = "regenerating_answer"
+)
+
+// ErrInvalidTransition is returned when a chat tries to move between modes that are not connected.
+var ErrInvalidTransition = errors.New("invalid mode transition")
+
+// ModeHandler handles an event of a chat mode.
+type ModeHandler func(uc *UpdateContext) error
+
+// Mode describes a single state of the chat finite-state machine.
+type Mode struct {
+	Name    ModeName    // Unique name of the mode, persisted with the user state
+	Step    string      // Human-readable dialog step stored when the chat enters the mode
+	OnEnter ModeHandler // Called after the chat entered the mode, optional
+	OnExit  ModeHandler // Called before the chat leaves the mode, optional
+	OnInput ModeHandler // Handles user input while the chat is in the mode, nil if the mode takes no input
+}
+
+// ModeStore persists the current mode of every chat.
+type ModeStore interface {
+	GetUserMode(chatID int64) string
+	SetUserMode(chatID int64, mode, currentStep string)
+}
+
+// ModeMachine is a declarative finite-state machine of chat modes.
+//
+// Modes are registered once with their hooks and input handlers, and the allowed transitions
+// between them are declared explicitly. The current mode of every chat is kept in a ModeStore.
+type ModeMachine struct {
+	store       ModeStore                          // Persistent storage of the chat modes
+	initial     ModeName                           // Mode of chats without a stored mode
+	modes       map[ModeName]Mode                  // Registered modes by name
+	transitions map[ModeName]map[ModeName]struct{} // Allowed transitions: from -> set of targets
+	mu          sync.RWMutex                       // Protects modes and transitions
+}
+
+// NewModeMachine creates a new ModeMachine.
+// Arguments:
+//   - store: storage of the chat modes.
+//   - initial: mode of chats that have no stored mode yet.
+//
+// Returns a pointer to a ModeMachine.
+func NewModeMachine(store ModeStore, initial ModeName) *ModeMachine {
+	return &ModeMachine{
+		store:       store,
+		initial:     initial,
+		modes:       make(map[ModeName]Mode),
+		transitions: make(map[ModeName]map[ModeName]struct{}),
+	}
+}
+
+// Register adds a mode to the machine, replacing a mode with the same name.
+func (m *ModeMachine) Register(mode Mode) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.modes[mode.Name] = mode
+}
+
+// Allow declares that chats may move from the mode to every one of the targets.
+// Re-entering the current mode is always allowed.
+func (m *ModeMachine) Allow(from ModeName, to ...ModeName) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	targets, ok := m.transitions[from]
+	if !ok {
+		targets = make(map[ModeName]struct{})
+		m.transitions[from] = targets
+	}
+	for _, name := range to {
+		targets[name] = struct{}{}
+	}
+}
+
+// Current returns the mode the chat is in.
+// Chats without a stored mode, or with a mode that is no longer registered, are in the initial mode.
+func (m *ModeMachine) Current(chatID int64) ModeName {
+	name := ModeName(m.store.GetUserMode(chatID))
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, ok := m.modes[name]; !ok {
+		return m.initial
+	}
+	return name
+}
+
+// Transition moves the chat of the update to the target mode.
+// It calls the exit hook of the current mode, persists the new mode and calls the enter hook of the target.
+//
+// Returns ErrInvalidTransition if the target is unknown or not reachable from the current mode.
+func (m *ModeMachine) Transition(uc *UpdateContext, to ModeName) error {
+	from := m.Current(uc.ChatID)
+
+	m.mu.RLock()
+	current := m.modes[from]
+	target, known := m.modes[to]
+	_, allowed := m.transitions[from][to]
+	m.mu.RUnlock()
+
+	if !known || (!allowed && from != to) {
+		logrus.WithFields(logrus.Fields{
+			"chatID": uc.ChatID,
+			"from":   from,
+			"to":     to,
+		}).Warn("Rejected chat mode transition")
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, from, to)
+	}
+
+	var exitErr error
+	if current.OnExit != nil {
+		exitErr = current.OnExit(uc)
+	}
+
+	m.store.SetUserMode(uc.ChatID, string(to), target.Step)
+	logrus.WithFields(logrus.Fields{
+		"chatID": uc.ChatID,
+		"from":   from,
+		"to":     to,
+	}).Debug("Chat mode changed")
+
+	var enterErr error
+	if target.OnEnter != nil {
+		enterErr = target.OnEnter(uc)
+	}
+	return errors.Join(exitErr, enterErr)
+}
+
+// HandleInput passes the update to the input handler of the current chat mode.
+// Returns false if the current mode does not accept input.
+func (m *ModeMachine) HandleInput(uc *UpdateContext) (bool, error) {
+	name := m.Current(uc.ChatID)
+
+	m.mu.RLock()
+	mode := m.modes[name]
+	m.mu.RUnlock()
+
+	if mode.OnInput == nil {
+		return false, nil
+	}
+	return true, mode.OnInput(uc)
+}
@@ -0,0 +1,101 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryModeStore struct {
+	modes map[int64]string
+}
+
+func (s *memoryModeStore) GetUserMode(chatID int64) string {
+	return s.modes[chatID]
+}
+
+func (s *memoryModeStore) SetUserMode(chatID int64, mode, _ string) {
+	s.modes[chatID] = mode
+}
+
+func TestModeMachine_Transition(t *testing.T) {
+	store := &memoryModeStore{modes: make(map[int64]string)}
+	var events []string
+
+	m := NewModeMachine(store, ModeIdle)
+	m.Register(Mode{Name: ModeIdle})
+	m.Register(Mode{
+		Name:    ModeTranslating,
+		OnEnter: func(*UpdateContext) error { events = append(events, "enter translating"); return nil },
+		OnExit:  func(*UpdateContext) error { events = append(events, "exit translating"); return nil },
+		OnInput: func(uc *UpdateContext) error { events = append(events, "input "+uc.Text); return nil },
+	})
+	m.Register(Mode{Name: ModeGenerative})
+	m.Allow(ModeIdle, ModeTranslating)
+	m.Allow(ModeTranslating, ModeIdle)
+
+	uc := &UpdateContext{Ctx: context.Background(), ChatID: 1, Text: "hello"}
+
+	handled, err := m.HandleInput(uc)
+	assert.NoError(t, err)
+	assert.False(t, handled, "idle mode takes no input")
+
+	assert.NoError(t, m.Transition(uc, ModeTranslating))
+	assert.Equal(t, ModeTranslating, m.Current(uc.ChatID))
+
+	handled, err = m.HandleInput(uc)
+	assert.NoError(t, err)
+	assert.True(t, handled)
+
+	err = m.Transition(uc, ModeGenerative)
+	assert.ErrorIs(t, err, ErrInvalidTransition)
+	assert.Equal(t, ModeTranslating, m.Current(uc.ChatID), "rejected transition keeps the mode")
+
+	assert.NoError(t, m.Transition(uc, ModeIdle))
+	assert.Equal(t, []string{"enter translating", "input hello", "exit translating"}, events)
+}
+
+func TestModeMachine_UnknownStoredModeFallsBackToInitial(t *testing.T) {
+	store := &memoryModeStore{modes: map[int64]string{1: "removed_mode"}}
+	m := NewModeMachine(store, ModeIdle)
+	m.Register(Mode{Name: ModeIdle})
+
+	assert.Equal(t, ModeIdle, m.Current(1))
+	assert.Equal(t, ModeIdle, m.Current(2))
+}
+
+type botModeStore struct {
+	UsersChatStateRepository
+	modes map[int64]string
+}
+
+func (s *botModeStore) GetUserMode(chatID int64) string {
+	return s.modes[chatID]
+}
+
+func (s *botModeStore) SetUserMode(chatID int64, mode, _ string) {
+	s.modes[chatID] = mode
+}
+
+func TestBotModes_RejectSettingsOutsideAIMode(t *testing.T) {
+	store := &botModeStore{modes: make(map[int64]string)}
+	b := &TgBotServices{StateRepo: store}
+	m := b.newModeMachine()
+	uc := &UpdateContext{Ctx: context.Background(), ChatID: 1}
+
+	for _, to := range []ModeName{ModeChangingModel, ModeChangingHistorySize, ModeChangingTemperature, ModeCreatingPersona, ModeRegeneratingAnswer} {
+		assert.ErrorIs(t, m.Transition(uc, to), ErrInvalidTransition, "idle -> %s", to)
+	}
+	assert.Equal(t, ModeIdle, m.Current(1))
+
+	store.modes[1] = string(ModeTranslating)
+	assert.ErrorIs(t, m.Transition(uc, ModeRegeneratingAnswer), ErrInvalidTransition)
+
+	store.modes[1] = string(ModeChangingModel)
+	assert.ErrorIs(t, m.Transition(uc, ModeRegeneratingAnswer), ErrInvalidTransition, "only the AI mode regenerates answers")
+
+	assert.Contains(t, m.transitions[ModeGenerative], ModeChangingTemperature)
+	assert.Contains(t, m.transitions[ModeChangingModel], ModeChangingTemperature)
+	assert.Contains(t, m.transitions[ModeChangingModel], ModeIdle)
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"context"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/sirupsen/logrus"
+)
+
+// generation is an AI answer being streamed into a chat.
+type generation struct {
+	messageID int                // Last message the answer is streamed into, it carries the Stop button
+	cancel    context.CancelFunc // Stops the generation
+}
+
+// startGeneration registers the AI answer streamed into the message and returns its context.
+// The chat's worker handles one update at a time, so a chat has at most one running generation.
+// The returned function must be called when the answer is finished.
+func (b *TgBotServices) startGeneration(uc *UpdateContext, messageID int) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(uc.Ctx)
+
+	b.generationsMu.Lock()
+	current := &generation{messageID: messageID, cancel: cancel}
+	b.generations[uc.ChatID] = current
+	b.generationsMu.Unlock()
+
+	return ctx, func() {
+		cancel()
+		b.generationsMu.Lock()
+		if b.generations[uc.ChatID] == current {
+			delete(b.generations, uc.ChatID)
+		}
+		b.generationsMu.Unlock()
+	}
+}
+
+// moveGeneration moves the Stop button of the chat's running AI answer to the message.
+// It is called when the answer rolls over into a new message.
+func (b *TgBotServices) moveGeneration(chatID int64, messageID int) {
+	b.generationsMu.Lock()
+	defer b.generationsMu.Unlock()
+
+	if current, ok := b.generations[chatID]; ok {
+		current.messageID = messageID
+	}
+}
+
+// stopGeneration cancels the AI answer streamed into the message.
+// Returns false if the answer is already finished.
+func (b *TgBotServices) stopGeneration(chatID int64, messageID int) bool {
+	b.generationsMu.Lock()
+	defer b.generationsMu.Unlock()
+
+	current, ok := b.generations[chatID]
+	if !ok || current.messageID != messageID {
+		return false
+	}
+	current.cancel()
+	return true
+}
+
+// stopGenerationMarkup returns the inline keyboard with the Stop button of an AI answer.
+// The button stops the answer streamed into the message that carries it.
+func stopGenerationMarkup() tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("⏹ Стоп", callbackData(callbackStopGeneration, "")),
+	))
+}
+
+// stopGenerationByButton stops the AI answer whose Stop button was pressed.
+// The streamed part of the answer is kept and marked as interrupted by streamAnswer.
+func (b *TgBotServices) stopGenerationByButton(uc *UpdateContext) error {
+	if !b.stopGeneration(uc.ChatID, uc.MessageID) {
+		return b.answerCallback(uc, "Ответ уже готов")
+	}
+	logrus.WithField("chatID", uc.ChatID).Info("AI generation stopped by the user")
+	return b.answerCallback(uc, "Останавливаю генерацию")
+}
+
+// IsUrgentUpdate reports whether the update must be handled without waiting for the previous updates of its chat.
+// The Stop button has to reach the chat while its answer is still being generated.
+func (b *TgBotServices) IsUrgentUpdate(update *tgbotapi.Update) bool {
+	return update.CallbackQuery != nil && strings.HasPrefix(update.CallbackQuery.Data, callbackStopGeneration+":")
+}
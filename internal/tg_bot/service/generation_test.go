@@ -0,0 +1,35 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeneration_StopCancelsOnlyItsAnswer(t *testing.T) {
+	b := &TgBotServices{generations: make(map[int64]*generation)}
+	uc := &UpdateContext{Ctx: context.Background(), ChatID: 1}
+
+	ctx, finish := b.startGeneration(uc, 10)
+	assert.False(t, b.stopGeneration(1, 9), "the button of an older answer does nothing")
+	assert.False(t, b.stopGeneration(2, 10), "another chat cannot stop the answer")
+	assert.NoError(t, ctx.Err())
+
+	assert.True(t, b.stopGeneration(1, 10))
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+
+	finish()
+	assert.False(t, b.stopGeneration(1, 10), "a finished answer is unregistered")
+}
+
+func TestIsUrgentUpdate(t *testing.T) {
+	b := &TgBotServices{}
+	stop := &tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{Data: callbackData(callbackStopGeneration, "")}}
+	other := &tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{Data: callbackData(callbackThreadSwitch, "1")}}
+
+	assert.True(t, b.IsUrgentUpdate(stop))
+	assert.False(t, b.IsUrgentUpdate(other))
+	assert.False(t, b.IsUrgentUpdate(&tgbotapi.Update{Message: &tgbotapi.Message{Text: "/stop"}}))
+}
@@ -1,126 +1,339 @@
 package service
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/sirupsen/logrus"
 )
 
-// changeHistorySize updates the maximum size limit for the dialog history based on user input.
-func (b *TgBotServices) changeHistorySize(update *tgbotapi.Update) error {
-	msg := update.Message.Text
+// Limits of the per-user generative model preferences.
+const (
+	defaultDialogHistorySize = 50   // History limit of users that did not choose their own
+	maxDialogHistorySize     = 200  // Largest history limit a user may choose
+	maxTemperature           = 2    // Largest temperature a user may choose
+	maxResponseTokens        = 8192 // Largest response length in tokens a user may choose
+	maxSystemPromptLength    = 2000 // Longest system prompt in characters a user may set
+	resetPreferenceText      = "сброс"
+)
+
+// isResetInput reports whether the user asked to reset the preference to its default.
+func isResetInput(text string) bool {
+	return strings.EqualFold(strings.TrimSpace(text), resetPreferenceText)
+}
+
+// historyLimit returns the dialog history limit of the user's preferences.
+func historyLimit(prefs models.AIPreferences) int {
+	if prefs.HistoryLimit > 0 {
+		return prefs.HistoryLimit
+	}
+	return defaultDialogHistorySize
+}
+
+// aiPreferences returns the effective AI settings of the chat:
+// the user's settings stored before the dialog threads, overridden by the settings of the active dialog thread.
+func (b *TgBotServices) aiPreferences(chatID int64) models.AIPreferences {
+	settings, err := b.AIDialogRepo.GetThreadSettings(chatID)
+	if err != nil {
+		logrus.WithError(err).WithField("chatID", chatID).Error("Failed to load dialog thread settings")
+	}
+	return b.StateRepo.GetAIPreferences(chatID).WithOverrides(settings)
+}
+
+// updateThreadSettings applies the change to the AI settings of the chat's active dialog thread.
+func (b *TgBotServices) updateThreadSettings(chatID int64, change func(settings *models.AIPreferences)) error {
+	settings, err := b.AIDialogRepo.GetThreadSettings(chatID)
+	if err != nil {
+		return err
+	}
+	if settings == nil {
+		settings = &models.AIPreferences{}
+	}
+	change(settings)
+	return b.AIDialogRepo.SaveThreadSettings(chatID, settings)
+}
+
+// saveThreadSetting changes the AI settings of the chat's active dialog thread and reports the result to the user.
+// Arguments:
+//   - uc: context of the update with the user's input.
+//   - change: modifies the thread settings; a zero field falls back to the user's settings.
+//   - doneText: message sent to the user when the setting is saved.
+func (b *TgBotServices) saveThreadSetting(uc *UpdateContext, change func(settings *models.AIPreferences), doneText string) error {
+	if err := b.updateThreadSettings(uc.ChatID, change); err != nil {
+		logrus.WithError(err).WithField("chatID", uc.ChatID).Error("Failed to save dialog thread settings")
+		return errors.Join(err, b.sendMessage(uc.ChatID, "Не удалось сохранить настройку, попробуй позже", uc.MessageID, nil))
+	}
+	return b.sendMessage(uc.ChatID, doneText, uc.MessageID, nil)
+}
+
+// changeHistorySize updates the maximum size limit for the dialog thread history based on user input.
+func (b *TgBotServices) changeHistorySize(uc *UpdateContext) error {
+	msg := uc.Text
 	if msg == "" {
-		return b.sendMessage(b.ChatID, "Нужно ввести целое число! Например: 50", update.Message.MessageID, nil)
+		return b.sendMessage(uc.ChatID, "Нужно ввести целое число! Например: 50", uc.MessageID, nil)
 	}
 
 	newSize, err := strconv.Atoi(msg)
 	if err != nil {
 		logrus.WithError(err).Error("Ошибка преобразования: ")
-		return b.sendMessage(b.ChatID, "Нужно ввести именно целое число от 1 до 200! Например: 50", update.Message.MessageID, nil)
+		return b.sendMessage(uc.ChatID, "Нужно ввести именно целое число от 1 до 200! Например: 50", uc.MessageID, nil)
+	}
+	if newSize < 1 || newSize > maxDialogHistorySize {
+		return b.sendMessage(uc.ChatID, "Нужно ввести именно целое число от 1 до 200! Например: 50", uc.MessageID, nil)
+	}
+
+	return b.saveThreadSetting(uc, func(settings *models.AIPreferences) { settings.HistoryLimit = newSize },
+		fmt.Sprintf("Теперь размер памяти истории диалога с ИИ = %d", newSize))
+}
+
+// changeTemperature updates the temperature of the dialog thread's generative model based on user input.
+func (b *TgBotServices) changeTemperature(uc *UpdateContext) error {
+	if isResetInput(uc.Text) {
+		return b.saveThreadSetting(uc, func(settings *models.AIPreferences) { settings.Temperature = nil },
+			"Температура сброшена к значению по умолчанию")
 	}
-	if newSize < 1 || newSize > 200 {
-		return b.sendMessage(b.ChatID, "Нужно ввести именно целое число от 1 до 200! Например: 50", update.Message.MessageID, nil)
+
+	value, err := strconv.ParseFloat(strings.ReplaceAll(strings.TrimSpace(uc.Text), ",", "."), 32)
+	if err != nil || value < 0 || value > maxTemperature {
+		return b.sendMessage(uc.ChatID, "Нужно ввести число от 0 до 2! Например: 0.7", uc.MessageID, nil)
 	}
 
-	b.dialogHistorySize = newSize
-	msg = fmt.Sprintf("Теперь размер памяти истории диалога с ИИ = %d", b.dialogHistorySize)
-	return b.sendMessage(b.ChatID, msg, update.Message.MessageID, nil)
+	temperature := float32(value)
+	return b.saveThreadSetting(uc, func(settings *models.AIPreferences) { settings.Temperature = &temperature },
+		fmt.Sprintf("Теперь температура генеративной модели = %.2g", temperature))
 }
 
-// checkSizeDialogHistory reports whether the current dialog exceeds the configured limit.
-func (b *TgBotServices) checkSizeDialogHistory(history []models.Message) bool {
-	return len(history) > b.dialogHistorySize
+// changeMaxTokens updates the maximum response length of the dialog thread's generative model based on user input.
+func (b *TgBotServices) changeMaxTokens(uc *UpdateContext) error {
+	if isResetInput(uc.Text) {
+		return b.saveThreadSetting(uc, func(settings *models.AIPreferences) { settings.MaxTokens = 0 },
+			"Длина ответа сброшена к значению по умолчанию")
+	}
+
+	maxTokens, err := strconv.Atoi(strings.TrimSpace(uc.Text))
+	if err != nil || maxTokens < 1 || maxTokens > maxResponseTokens {
+		return b.sendMessage(uc.ChatID, fmt.Sprintf("Нужно ввести целое число от 1 до %d! Например: 1000", maxResponseTokens), uc.MessageID, nil)
+	}
+
+	return b.saveThreadSetting(uc, func(settings *models.AIPreferences) { settings.MaxTokens = maxTokens },
+		fmt.Sprintf("Теперь максимальная длина ответа ИИ = %d токенов", maxTokens))
 }
 
-// generativeTextWithStream streams the AI answer into a single Telegram message.
-func (b *TgBotServices) generativeTextWithStream(update *tgbotapi.Update) error {
-	msg := tgbotapi.NewMessage(b.ChatID, "Я обрабатываю ваш запрос...")
-	lastMsg, err := b.Bot.Send(msg)
+// changeSystemPrompt updates the system prompt of the dialog thread's generative model based on user input.
+func (b *TgBotServices) changeSystemPrompt(uc *UpdateContext) error {
+	if isResetInput(uc.Text) {
+		return b.saveThreadSetting(uc, func(settings *models.AIPreferences) { settings.SystemPrompt = "" },
+			"Системная инструкция удалена")
+	}
+
+	prompt := strings.TrimSpace(uc.Text)
+	if prompt == "" || utf8.RuneCountInString(prompt) > maxSystemPromptLength {
+		return b.sendMessage(uc.ChatID, fmt.Sprintf("Инструкция должна быть непустой и не длиннее %d символов", maxSystemPromptLength), uc.MessageID, nil)
+	}
+
+	return b.saveThreadSetting(uc, func(settings *models.AIPreferences) { settings.SystemPrompt = prompt },
+		"Системная инструкция сохранена")
+}
+
+// describeAIPreferences returns a human-readable description of the effective generative model preferences.
+// Arguments:
+//   - prefs: effective preferences of the chat.
+//   - persona: name of the selected persona, empty if none is selected.
+func describeAIPreferences(prefs models.AIPreferences, persona string) string {
+	var sb strings.Builder
+	sb.WriteString("Настройки ИИ текущего диалога:\n")
+	if prefs.Model != "" {
+		fmt.Fprintf(&sb, "• модель: %s\n", prefs.Model)
+	} else {
+		sb.WriteString("• модель: по умолчанию\n")
+	}
+	fmt.Fprintf(&sb, "• размер памяти: %d\n", historyLimit(prefs))
+	if prefs.Temperature != nil {
+		fmt.Fprintf(&sb, "• температура: %.2g\n", *prefs.Temperature)
+	} else {
+		sb.WriteString("• температура: по умолчанию\n")
+	}
+	if prefs.MaxTokens > 0 {
+		fmt.Fprintf(&sb, "• длина ответа: %d токенов\n", prefs.MaxTokens)
+	} else {
+		sb.WriteString("• длина ответа: по умолчанию\n")
+	}
+	if persona != "" {
+		fmt.Fprintf(&sb, "• персона: %s\n", persona)
+	} else {
+		sb.WriteString("• персона: нет\n")
+	}
+	if prefs.SystemPrompt != "" {
+		fmt.Fprintf(&sb, "• инструкция: %s\n", prefs.SystemPrompt)
+	} else {
+		sb.WriteString("• инструкция: нет\n")
+	}
+	return sb.String()
+}
+
+// generativeTextWithStream streams the AI answer to the user's message into a new Telegram message.
+// The request is answered only within the chat's quota.
+func (b *TgBotServices) generativeTextWithStream(uc *UpdateContext) error {
+	release, denial := b.acquireAIQuota(uc.ChatID, senderID(uc))
+	if denial != "" {
+		return b.sendMessage(uc.ChatID, denial, uc.MessageID, nil)
+	}
+	defer release()
+	return b.streamAnswer(uc, 0, "", false)
+}
+
+// streamAnswer asks the AI the question in uc.Text and streams the answer into Telegram messages.
+// An answer longer than a Telegram message rolls over into the next message, but is saved as a single assistant turn.
+// Arguments:
+//   - uc: the update context, its text is the question saved to the dialog history.
+//   - messageID: the message the answer replaces, 0 sends a new message.
+//   - model: the model used instead of the chat's one for this answer only, empty keeps the chat's model.
+//   - oneOff: the question is only sent to the model and not saved, so it stays out of the history, export and summaries.
+//
+// The finished answer gets the action buttons and becomes the chat's latest answer.
+func (b *TgBotServices) streamAnswer(uc *UpdateContext, messageID int, model string, oneOff bool) error {
+	const placeholder = "Я обрабатываю ваш запрос..."
+	stopMarkup := stopGenerationMarkup()
+	var (
+		lastMsg tgbotapi.Message
+		err     error
+	)
+	if messageID == 0 {
+		msg := tgbotapi.NewMessage(uc.ChatID, placeholder)
+		msg.ReplyMarkup = stopMarkup
+		lastMsg, err = b.sender.Send(msg)
+	} else {
+		lastMsg.MessageID = messageID
+		_, err = b.sender.Send(tgbotapi.NewEditMessageTextAndMarkup(uc.ChatID, messageID, placeholder, stopMarkup))
+	}
 	if err != nil {
 		logrus.WithError(err).Error("Ошибка отправки сообщения")
 	}
+	genCtx, finish := b.startGeneration(uc, lastMsg.MessageID)
+	defer finish()
+	answerMsgs := b.newAnswerMessages(uc.ChatID, lastMsg.MessageID, placeholder, func(messageID int) {
+		b.moveGeneration(uc.ChatID, messageID)
+	})
 
-	history, err := b.AIDialogRepo.GetDialogHistory(b.ChatID)
+	prefs := b.withPersona(uc.ChatID, b.aiPreferences(uc.ChatID))
+	if model != "" {
+		prefs.Model = model
+	}
+	history, err := b.AIDialogRepo.GetDialogHistory(uc.ChatID)
 	if err != nil {
 		logrus.WithError(err).Error("Failed to load dialog history")
 		history = []models.Message{}
 	}
 
-	if b.checkSizeDialogHistory(history) {
-		if err = b.AIDialogRepo.ClearHistory(b.ChatID); err != nil {
-			logrus.WithError(err).Error("Failed to clear dialog history")
-		}
-
-		msg = tgbotapi.NewMessage(b.ChatID, "Размер истории переписки с ИИ превышен и был очищен. Создан новый чат")
-		if _, err = b.Bot.Send(msg); err != nil {
-			logrus.WithError(err).Error("Ошибка отправки сообщения")
+	if trimmed, changed := b.trimHistory(uc, history, prefs); changed {
+		history = trimmed
+		if err = b.AIDialogRepo.SaveDialog(uc.ChatID, history); err != nil {
+			logrus.WithError(err).Error("Failed to save trimmed dialog history")
 		}
 	}
 
-	userMsg := models.Message{
-		Role:    "user",
-		Content: update.Message.Text,
-	}
-	if err = b.AIDialogRepo.SaveMsgToDialog(b.ChatID, userMsg); err != nil {
-		logrus.WithError(err).Error("Failed to save user message to dialog")
+	if !oneOff {
+		userMsg := models.Message{
+			Role:    models.RoleUser,
+			Content: uc.Text,
+		}
+		if err = b.AIDialogRepo.SaveMsgToDialog(uc.ChatID, userMsg); err != nil {
+			logrus.WithError(err).Error("Failed to save user message to dialog")
+		}
 	}
 
-	responseChan := b.Generative.GenerateStreamTextMsg(update.Message.Text, history)
+	events := b.Generative.GenerateStreamTextMsg(genCtx, uc.Text, history, prefs.GenerationOptions())
 
-	var fullResponse strings.Builder
+	var (
+		fullResponse strings.Builder
+		finishReason string
+		usage        *models.TokenUsage
+		provider     string
+		streamErr    error
+	)
 	ticker := time.NewTicker(500 * time.Millisecond)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case chunk, ok := <-responseChan:
+		case event, ok := <-events:
 			if !ok {
-				if fullResponse.Len() > 0 {
-					finalMsg := tgbotapi.NewEditMessageText(b.ChatID, lastMsg.MessageID, fullResponse.String())
-					if _, err = b.Bot.Send(finalMsg); err != nil {
-						logrus.WithError(err).Error("Failed to send final message")
-					}
+				// The action buttons replace the Stop button
+				canContinue := fullResponse.Len() > 0 && finishReason == models.FinishLength
+				err = answerMsgs.show(renderStreamResult(fullResponse.String(), finishReason, streamErr), answerActionsMarkup(canContinue), true)
+
+				logrus.WithFields(logrus.Fields{
+					"chatID":       uc.ChatID,
+					"finishReason": finishReason,
+					"usage":        usage,
+					"provider":     provider,
+				}).WithError(streamErr).Debug("AI answer completed")
+
+				if usage != nil || fullResponse.Len() > 0 {
+					b.recordUsage(uc.ChatID, usage, prefs.Model)
 				}
 
-				if len(lastMsg.Text) > 0 {
+				// Only the model's own text goes to the history, error notes are shown to the user only
+				if fullResponse.Len() > 0 {
 					aiResponse := models.Message{
-						Role:    "assistant",
+						Role:    models.RoleAssistant,
 						Content: fullResponse.String(),
 					}
-					if err = b.AIDialogRepo.SaveMsgToDialog(b.ChatID, aiResponse); err != nil {
-						logrus.WithError(err).Error("Failed to save AI response to dialog")
+					// The save error is only logged, the returned error reports the failed edit of the answer
+					if saveErr := b.AIDialogRepo.SaveMsgToDialog(uc.ChatID, aiResponse); saveErr != nil {
+						logrus.WithError(saveErr).Error("Failed to save AI response to dialog")
 					}
 				}
+				b.rememberAnswer(uc.ChatID, answerMsgs.ids, canContinue)
 
 				return err
 			}
 
-			fullResponse.WriteString(chunk)
+			if event.Err != nil {
+				streamErr = event.Err
+			}
+			if event.FinishReason != "" {
+				finishReason = event.FinishReason
+			}
+			if event.Usage != nil {
+				usage = event.Usage
+			}
+			if event.Provider != "" {
+				provider = event.Provider
+			}
+			fullResponse.WriteString(event.Delta)
 
 		case <-ticker.C:
 			if fullResponse.Len() > 0 {
-				editedMsg := tgbotapi.NewEditMessageText(b.ChatID, lastMsg.MessageID, fullResponse.String())
-				if _, err = b.Bot.Send(editedMsg); err != nil {
-					logrus.WithError(err).Error("Failed to edit message")
-				}
+				_ = answerMsgs.show(fullResponse.String(), stopMarkup, false)
 			}
 		}
 	}
 }
 
-// changeGenerativeModel switches the current model to the user-selected one.
-func (b *TgBotServices) changeGenerativeModel(update *tgbotapi.Update) error {
-	if err := b.Generative.ChangeGenerativeModelName(update.Message.Text); err != nil {
+// changeGenerativeModel switches the dialog thread's model to the user-selected one.
+func (b *TgBotServices) changeGenerativeModel(uc *UpdateContext) error {
+	if isResetInput(uc.Text) {
+		return b.saveThreadSetting(uc, func(settings *models.AIPreferences) { settings.Model = "" },
+			"Модель сброшена к модели по умолчанию")
+	}
+
+	modelName := strings.TrimSpace(uc.Text)
+	if err := b.Generative.ValidateModelName(modelName); errors.Is(err, models.ErrUnknownModel) {
+		return b.sendMessage(uc.ChatID, b.unknownModelText(uc.Ctx, modelName), uc.MessageID, nil)
+	} else if err != nil {
 		logrus.WithError(err).Error("Change generative model failed")
-		b.sendMessage(b.ChatID, "На данный момент сменить генеративную модель не удалось. "+
-			"Попробуй проверить правильно ли ты указал название модели или есть ли к ней доступ у твоего аккаунта!", update.Message.MessageID, nil)
+		b.sendMessage(uc.ChatID, "На данный момент сменить генеративную модель не удалось. "+
+			"Попробуй проверить правильно ли ты указал название модели или есть ли к ней доступ у твоего аккаунта!", uc.MessageID, nil)
 		return err
 	}
 
-	return b.sendMessage(b.ChatID, "Смена произошла успешно!", update.Message.MessageID, nil)
+	return b.saveThreadSetting(uc, func(settings *models.AIPreferences) { settings.Model = modelName },
+		"Смена произошла успешно!")
 }
@@ -0,0 +1,293 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	"github.com/sirupsen/logrus"
+)
+
+// TrimStrategy selects how the oldest dialog turns are dropped when the history grows too long.
+type TrimStrategy string
+
+// Dialog history trimming strategies.
+const (
+	TrimByMessages TrimStrategy = "messages"  // Keep at most the user's history limit of messages
+	TrimByTokens   TrimStrategy = "tokens"    // Keep the history within the token budget of the context window
+	TrimBySummary  TrimStrategy = "summarize" // Condense the old turns into a rolling memory message
+)
+
+const (
+	messageTokenOverhead = 4                // Estimated tokens of the role and separators of a message
+	defaultReplyTokens   = 1024             // Tokens reserved for the answer when the user did not limit its length
+	summaryMaxTokens     = 512              // Longest dialog memory the model may write
+	summaryTimeout       = 30 * time.Second // How long the model may take to write the dialog memory
+)
+
+// HistoryPolicy configures how the dialog history is trimmed before it is sent to the model.
+type HistoryPolicy struct {
+	Strategy        TrimStrategy // How the oldest turns are dropped
+	TokenBudget     int          // Estimated size of the model context window in tokens
+	MemoryThreshold int          // Number of dialog messages after which the old turns are condensed into memory
+}
+
+// Validate checks that the policy names a known strategy and a usable token budget.
+func (p HistoryPolicy) Validate() error {
+	switch p.Strategy {
+	case TrimByMessages, TrimByTokens, TrimBySummary:
+	default:
+		return fmt.Errorf("unknown history trim strategy %q (expected %q, %q or %q)",
+			p.Strategy, TrimByMessages, TrimByTokens, TrimBySummary)
+	}
+	if p.Strategy != TrimByMessages && p.TokenBudget <= defaultReplyTokens {
+		return fmt.Errorf("history token budget must be greater than %d, got %d", defaultReplyTokens, p.TokenBudget)
+	}
+	if p.Strategy == TrimBySummary && p.MemoryThreshold < 2 {
+		return fmt.Errorf("memory threshold must be at least 2 messages, got %d", p.MemoryThreshold)
+	}
+	return nil
+}
+
+// estimateTokens returns a rough estimate of the tokens the message takes in the model context.
+// It counts about four characters per token, which is close enough for budgeting without a tokenizer.
+func estimateTokens(msg models.Message) int {
+	return (utf8.RuneCountInString(msg.Content)+3)/4 + messageTokenOverhead
+}
+
+// estimateHistoryTokens returns the estimated tokens of all the messages.
+func estimateHistoryTokens(history []models.Message) int {
+	total := 0
+	for _, msg := range history {
+		total += estimateTokens(msg)
+	}
+	return total
+}
+
+// isPinned reports whether the message is never trimmed: a system instruction or the dialog memory.
+func isPinned(msg models.Message) bool {
+	return msg.Role == models.RoleSystem || msg.Role == models.RoleMemory
+}
+
+// splitPinned separates the pinned messages from the dialog turns, keeping the order of both.
+func splitPinned(history []models.Message) (pinned, rest []models.Message) {
+	for _, msg := range history {
+		if isPinned(msg) {
+			pinned = append(pinned, msg)
+		} else {
+			rest = append(rest, msg)
+		}
+	}
+	return pinned, rest
+}
+
+// nextTurnStart returns the index where the turn after the one starting at from begins.
+// A turn is a user message together with the answers that follow it.
+func nextTurnStart(rest []models.Message, from int) int {
+	i := from + 1
+	for i < len(rest) && rest[i].Role != models.RoleUser {
+		i++
+	}
+	return i
+}
+
+// dropOldestTurns drops whole turns from the start of the dialog until fits reports true.
+// Returns the kept and the dropped messages.
+func dropOldestTurns(rest []models.Message, fits func(kept []models.Message) bool) (kept, dropped []models.Message) {
+	start := 0
+	for start < len(rest) && !fits(rest[start:]) {
+		start = nextTurnStart(rest, start)
+	}
+	return rest[start:], rest[:start]
+}
+
+// trimByMessages keeps the pinned messages and the latest turns, so that together with the new user
+// message the dialog holds at most limit messages.
+func trimByMessages(history []models.Message, limit int) (kept, dropped []models.Message) {
+	pinned, rest := splitPinned(history)
+	kept, dropped = dropOldestTurns(rest, func(kept []models.Message) bool {
+		return len(kept)+1 <= limit
+	})
+	return append(pinned, kept...), dropped
+}
+
+// trimByTokens keeps the pinned messages and the latest turns that fit into the token budget.
+// The budget must already exclude the system prompt, the new user message and the answer.
+func trimByTokens(history []models.Message, budget int) (kept, dropped []models.Message) {
+	pinned, rest := splitPinned(history)
+	budget -= estimateHistoryTokens(pinned)
+	kept, dropped = dropOldestTurns(rest, func(kept []models.Message) bool {
+		return estimateHistoryTokens(kept) <= budget
+	})
+	return append(pinned, kept...), dropped
+}
+
+// trimForMemory keeps the pinned messages and the latest turns that hold at most maxMessages messages
+// and fit into the token budget. The dropped turns are meant to be condensed into the dialog memory.
+func trimForMemory(history []models.Message, maxMessages, budget int) (kept, dropped []models.Message) {
+	pinned, rest := splitPinned(history)
+	budget -= estimateHistoryTokens(pinned)
+	kept, dropped = dropOldestTurns(rest, func(kept []models.Message) bool {
+		return len(kept) <= maxMessages && estimateHistoryTokens(kept) <= budget
+	})
+	return append(pinned, kept...), dropped
+}
+
+// historyTokenBudget returns the tokens left for the dialog history of the request.
+func (b *TgBotServices) historyTokenBudget(text string, prefs models.AIPreferences) int {
+	reply := prefs.MaxTokens
+	if reply <= 0 {
+		reply = defaultReplyTokens
+	}
+	budget := b.historyPolicy.TokenBudget - reply - estimateTokens(models.Message{Role: models.RoleUser, Content: text})
+	if prefs.SystemPrompt != "" {
+		budget -= estimateTokens(models.Message{Role: models.RoleSystem, Content: prefs.SystemPrompt})
+	}
+	return budget
+}
+
+// trimHistory trims the dialog history according to the policy before the user's text is sent to the model.
+// The user's history limit caps the dialog in every strategy, the token budget and the memory apply on top of it.
+// Pinned system instructions and the dialog memory are always kept.
+// Arguments:
+//   - uc: context of the update with the user's text.
+//   - history: current dialog history of the chat.
+//   - prefs: generative model preferences of the user.
+//
+// Returns the history to send and whether it differs from the stored one.
+func (b *TgBotServices) trimHistory(uc *UpdateContext, history []models.Message, prefs models.AIPreferences) ([]models.Message, bool) {
+	limit := historyLimit(prefs)
+	var kept, dropped []models.Message
+	switch b.historyPolicy.Strategy {
+	case TrimByTokens:
+		kept, dropped = trimByMessages(history, limit)
+		var overBudget []models.Message
+		kept, overBudget = trimByTokens(kept, b.historyTokenBudget(uc.Text, prefs))
+		dropped = append(dropped, overBudget...)
+	case TrimBySummary:
+		budget := b.historyTokenBudget(uc.Text, prefs)
+		// The turns over the user's limit are condensed into the memory like the turns over the threshold,
+		// so the limit lowers the threshold instead of dropping the turns without a trace.
+		threshold := max(min(b.historyPolicy.MemoryThreshold, limit-1), 1)
+		if _, over := trimForMemory(history, threshold, budget); len(over) == 0 {
+			return history, false
+		}
+		// Condense down to half of the threshold and the budget, so that the memory is not rebuilt on every message
+		kept, dropped = trimForMemory(history, threshold/2, budget/2)
+		kept = b.rememberDropped(uc, kept, dropped, prefs)
+	default:
+		kept, dropped = trimByMessages(history, limit)
+	}
+	if len(dropped) == 0 {
+		return history, false
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"chatID":   uc.ChatID,
+		"strategy": b.historyPolicy.Strategy,
+		"dropped":  len(dropped),
+		"kept":     len(kept),
+	}).Debug("Dialog history trimmed")
+	return kept, true
+}
+
+// summaryPrompt builds the request that condenses the dropped turns and the previous memory into a new memory.
+// The prompt is kept within the token budget: the previous memory and the latest dropped turns are kept,
+// the oldest turns that do not fit are left out of the memory.
+func summaryPrompt(previous string, dropped []models.Message, budget int) string {
+	const instruction = "Кратко перескажи диалог пользователя с ИИ, сохранив факты, договорённости, предпочтения пользователя " +
+		"и открытые вопросы. Ответь только пересказом.\n\n"
+
+	var earlier string
+	if previous != "" {
+		earlier = fmt.Sprintf("Пересказ более ранней части диалога:\n%s\n\n", truncateToTokens(previous, budget/2))
+	}
+	budget -= estimateTokens(models.Message{Content: instruction + earlier})
+
+	// Collect the latest turns first, so that the oldest ones are left out when the budget runs out
+	var lines []string
+	for i := len(dropped) - 1; i >= 0 && budget > messageTokenOverhead; i-- {
+		line := fmt.Sprintf("%s: %s\n", dropped[i].Role, truncateToTokens(dropped[i].Content, budget-messageTokenOverhead))
+		budget -= estimateTokens(models.Message{Content: line})
+		lines = append(lines, line)
+	}
+	slices.Reverse(lines)
+
+	var prompt strings.Builder
+	prompt.WriteString(instruction)
+	prompt.WriteString(earlier)
+	prompt.WriteString("Продолжение диалога:\n")
+	for _, line := range lines {
+		prompt.WriteString(line)
+	}
+	return prompt.String()
+}
+
+// truncateToTokens cuts the text to about the estimated number of tokens, marking the cut with an ellipsis.
+func truncateToTokens(text string, tokens int) string {
+	limit := max(tokens, 0) * 4
+	if utf8.RuneCountInString(text) <= limit {
+		return text
+	}
+	return string([]rune(text)[:limit]) + "…"
+}
+
+// summarize asks the dialog's model for the memory text, with the answer length capped.
+// Returns the summary and the token usage of the request.
+func (b *TgBotServices) summarize(uc *UpdateContext, prompt string, prefs models.AIPreferences) (string, *models.TokenUsage, error) {
+	ctx, cancel := context.WithTimeout(uc.Ctx, summaryTimeout)
+	defer cancel()
+
+	opts := models.GenerationOptions{Model: prefs.Model, MaxTokens: summaryMaxTokens}
+	var (
+		summary strings.Builder
+		usage   *models.TokenUsage
+		err     error
+	)
+	for event := range b.Generative.GenerateStreamTextMsg(ctx, prompt, nil, opts) {
+		summary.WriteString(event.Delta)
+		if event.Usage != nil {
+			usage = event.Usage
+		}
+		if event.Err != nil {
+			err = event.Err
+		}
+	}
+	return strings.TrimSpace(summary.String()), usage, err
+}
+
+// rememberDropped condenses the dropped turns, together with the current dialog memory, into a new memory message.
+// The memory is refreshed every time the dialog crosses the threshold again, so it covers the whole conversation.
+// The summary is written by the dialog's model; its prompt and answer fit into the history token budget.
+// If the model cannot summarize, the turns are dropped and the previous memory is kept.
+func (b *TgBotServices) rememberDropped(uc *UpdateContext, kept, dropped []models.Message, prefs models.AIPreferences) []models.Message {
+	var previous string
+	withoutMemory := make([]models.Message, 0, len(kept))
+	for _, msg := range kept {
+		if msg.Role == models.RoleMemory {
+			previous = msg.Content
+			continue
+		}
+		withoutMemory = append(withoutMemory, msg)
+	}
+
+	prompt := summaryPrompt(previous, dropped, b.historyPolicy.TokenBudget-summaryMaxTokens)
+	memory, usage, err := b.summarize(uc, prompt, prefs)
+	if usage != nil || memory != "" {
+		b.recordUsage(uc.ChatID, usage, prefs.Model)
+	}
+	if err != nil || memory == "" {
+		logrus.WithError(err).WithField("chatID", uc.ChatID).Warn("Failed to summarize dialog history, dropping the old turns")
+		return kept
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"chatID":    uc.ChatID,
+		"condensed": len(dropped),
+	}).Info("Dialog memory refreshed")
+	return append([]models.Message{{Role: models.RoleMemory, Content: memory}}, withoutMemory...)
+}
@@ -0,0 +1,192 @@
+package service
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func dialogOf(pairs ...string) []models.Message {
+	history := make([]models.Message, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		history = append(history, models.Message{Role: pairs[i], Content: pairs[i+1]})
+	}
+	return history
+}
+
+func TestTrimByMessages(t *testing.T) {
+	history := dialogOf(
+		"system", "pinned",
+		"user", "q1", "assistant", "a1",
+		"user", "q2", "assistant", "a2",
+		"user", "q3", "assistant", "a3",
+	)
+
+	tests := []struct {
+		name    string
+		limit   int
+		kept    []models.Message
+		dropped int
+	}{
+		{
+			name:  "fits",
+			limit: 10,
+			kept:  history,
+		},
+		{
+			name:    "drops whole turns and keeps the pinned prompt",
+			limit:   4,
+			kept:    dialogOf("system", "pinned", "user", "q3", "assistant", "a3"),
+			dropped: 4,
+		},
+		{
+			name:    "limit below one turn keeps only the pinned prompt",
+			limit:   1,
+			kept:    dialogOf("system", "pinned"),
+			dropped: 6,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kept, dropped := trimByMessages(history, tt.limit)
+			assert.Equal(t, tt.kept, kept)
+			assert.Len(t, dropped, tt.dropped)
+		})
+	}
+}
+
+func TestTrimByTokens(t *testing.T) {
+	long := strings.Repeat("слово ", 200) // about 300 tokens
+	history := dialogOf(
+		"user", long, "assistant", long,
+		"system", "pinned in the middle",
+		"user", "short question", "assistant", "short answer",
+	)
+
+	kept, dropped := trimByTokens(history, 100)
+	assert.Equal(t, dialogOf(
+		"system", "pinned in the middle",
+		"user", "short question", "assistant", "short answer",
+	), kept)
+	assert.Len(t, dropped, 2)
+
+	kept, dropped = trimByTokens(history, 10_000)
+	assert.Len(t, kept, len(history))
+	assert.Empty(t, dropped)
+}
+
+func TestHistoryPolicy_Validate(t *testing.T) {
+	assert.NoError(t, HistoryPolicy{Strategy: TrimByMessages}.Validate())
+	assert.NoError(t, HistoryPolicy{Strategy: TrimBySummary, TokenBudget: 16000, MemoryThreshold: 40}.Validate())
+	assert.Error(t, HistoryPolicy{Strategy: TrimBySummary, TokenBudget: 16000}.Validate())
+	assert.Error(t, HistoryPolicy{Strategy: TrimByTokens, TokenBudget: 100}.Validate())
+	assert.Error(t, HistoryPolicy{Strategy: "fifo"}.Validate())
+}
+
+type fakeSummarizer struct {
+	GenerativeModel
+	prompts []string
+	opts    []models.GenerationOptions
+}
+
+func (f *fakeSummarizer) GenerateStreamTextMsg(_ context.Context, text string, _ []models.Message, opts models.GenerationOptions) <-chan models.StreamEvent {
+	f.prompts = append(f.prompts, text)
+	f.opts = append(f.opts, opts)
+	events := make(chan models.StreamEvent, 2)
+	events <- models.StreamEvent{Delta: "summary " + strconv.Itoa(len(f.prompts))}
+	events <- models.StreamEvent{Usage: &models.TokenUsage{PromptTokens: 100, CompletionTokens: 10}}
+	close(events)
+	return events
+}
+
+type usageRecorder struct {
+	UsersChatStateRepository
+	entries []models.UsageEntry
+}
+
+func (r *usageRecorder) AddUsage(_ int64, entry models.UsageEntry) {
+	r.entries = append(r.entries, entry)
+}
+
+func TestTrimHistory_RollingMemory(t *testing.T) {
+	summarizer := &fakeSummarizer{}
+	b := &TgBotServices{
+		Generative:    summarizer,
+		StateRepo:     &usageRecorder{},
+		historyPolicy: HistoryPolicy{Strategy: TrimBySummary, TokenBudget: 16000, MemoryThreshold: 4},
+	}
+	uc := &UpdateContext{Ctx: context.Background(), ChatID: 1, Text: "next question"}
+
+	history := dialogOf("user", "q1", "assistant", "a1", "user", "q2", "assistant", "a2")
+	kept, changed := b.trimHistory(uc, history, models.AIPreferences{})
+	assert.False(t, changed, "threshold is not crossed yet")
+	assert.Equal(t, history, kept)
+
+	history = append(history, dialogOf("user", "q3", "assistant", "a3")...)
+	kept, changed = b.trimHistory(uc, history, models.AIPreferences{})
+	assert.True(t, changed)
+	assert.Equal(t, dialogOf("memory", "summary 1", "user", "q3", "assistant", "a3"), kept)
+
+	history = append(kept, dialogOf("user", "q4", "assistant", "a4", "user", "q5", "assistant", "a5")...)
+	kept, changed = b.trimHistory(uc, history, models.AIPreferences{})
+	assert.True(t, changed)
+	assert.Equal(t, dialogOf("memory", "summary 2", "user", "q5", "assistant", "a5"), kept)
+	assert.Contains(t, summarizer.prompts[1], "summary 1", "the previous memory is folded into the new one")
+	assert.Contains(t, summarizer.prompts[1], "q4")
+}
+
+func TestTrimHistory_UserLimitCapsEveryStrategy(t *testing.T) {
+	uc := &UpdateContext{Ctx: context.Background(), ChatID: 1, Text: "next question"}
+	history := dialogOf("system", "be brief", "user", "q1", "assistant", "a1", "user", "q2", "assistant", "a2", "user", "q3", "assistant", "a3")
+	prefs := models.AIPreferences{HistoryLimit: 3}
+
+	b := &TgBotServices{historyPolicy: HistoryPolicy{Strategy: TrimByTokens, TokenBudget: 16000}}
+	kept, changed := b.trimHistory(uc, history, prefs)
+	assert.True(t, changed, "the budget is large, but the user's limit is not")
+	assert.Equal(t, dialogOf("system", "be brief", "user", "q3", "assistant", "a3"), kept)
+
+	summarizer := &fakeSummarizer{}
+	b = &TgBotServices{
+		Generative:    summarizer,
+		StateRepo:     &usageRecorder{},
+		historyPolicy: HistoryPolicy{Strategy: TrimBySummary, TokenBudget: 16000, MemoryThreshold: 40},
+	}
+	kept, changed = b.trimHistory(uc, history, prefs)
+	assert.True(t, changed, "the user's limit lowers the memory threshold")
+	assert.Equal(t, dialogOf("memory", "summary 1", "system", "be brief"), kept)
+	assert.Contains(t, summarizer.prompts[0], "q3", "the turns over the limit are condensed, not lost")
+
+	kept, changed = b.trimHistory(uc, history[:3], prefs)
+	assert.False(t, changed)
+	assert.Equal(t, history[:3], kept)
+}
+
+func TestRememberDropped_UsesDialogModelWithinBudget(t *testing.T) {
+	summarizer := &fakeSummarizer{}
+	usage := &usageRecorder{}
+	b := &TgBotServices{
+		Generative:    summarizer,
+		StateRepo:     usage,
+		historyPolicy: HistoryPolicy{Strategy: TrimBySummary, TokenBudget: 2000, MemoryThreshold: 4},
+	}
+	uc := &UpdateContext{Ctx: context.Background(), ChatID: 1}
+	long := strings.Repeat("очень длинная реплика ", 1000)
+	dropped := dialogOf("user", "first "+long, "assistant", long, "user", "latest question")
+
+	kept := b.rememberDropped(uc, dialogOf("memory", "old memory"), dropped, models.AIPreferences{Model: "deepseek-chat"})
+	assert.Equal(t, dialogOf("memory", "summary 1"), kept)
+
+	assert.Equal(t, models.GenerationOptions{Model: "deepseek-chat", MaxTokens: summaryMaxTokens}, summarizer.opts[0])
+	prompt := summarizer.prompts[0]
+	assert.LessOrEqual(t, estimateTokens(models.Message{Content: prompt}), 2000-summaryMaxTokens, "the prompt fits into the budget")
+	assert.Contains(t, prompt, "old memory")
+	assert.Contains(t, prompt, "latest question", "the latest turns are kept")
+	assert.NotContains(t, prompt, "first", "the oldest turns that do not fit are left out")
+	assert.Equal(t, []models.UsageEntry{{Day: usageDay(time.Now()), Model: "deepseek-chat", Requests: 1, PromptTokens: 100, CompletionTokens: 10}},
+		usage.entries, "the summary is counted in the usage")
+}
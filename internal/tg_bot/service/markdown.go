@@ -0,0 +1,223 @@
+package service
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Inline Markdown markers and the Telegram entities they turn into, longer markers first.
+var inlineMarkers = []struct {
+	marker string
+	entity string
+}{
+	{"**", "bold"},
+	{"__", "bold"},
+	{"~~", "strikethrough"},
+	{"*", "italic"},
+	{"_", "italic"},
+}
+
+// markdownRenderer converts the Markdown of model answers into plain text with Telegram message entities.
+// Telegram measures entity offsets in UTF-16 code units, so the renderer counts them while writing the text.
+type markdownRenderer struct {
+	out      strings.Builder
+	units    int                      // Length of the written text in UTF-16 code units
+	entities []tgbotapi.MessageEntity // Entities of the written text
+}
+
+// renderMarkdown converts the Markdown of a model answer into text and Telegram message entities.
+// It supports code blocks, inline code, bold, italic, strikethrough, links, headings and lists.
+// The answer may be incomplete while it is streamed: an unclosed code block lasts until the end of the text,
+// and an inline marker without its closing pair is kept as is.
+func renderMarkdown(text string) (string, []tgbotapi.MessageEntity) {
+	var r markdownRenderer
+	var (
+		inCode    bool
+		codeStart int
+		language  string
+	)
+	for i, line := range strings.Split(text, "\n") {
+		if i > 0 && !(inCode && codeStart == r.units) {
+			r.write("\n")
+		}
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, codeFence) && !inCode:
+			inCode, codeStart, language = true, r.units, strings.TrimSpace(strings.TrimPrefix(trimmed, codeFence))
+		case strings.HasPrefix(trimmed, codeFence):
+			inCode = false
+			r.closeCode(codeStart, language)
+		case inCode:
+			r.write(line)
+		default:
+			r.line(line)
+		}
+	}
+	if inCode {
+		r.closeCode(codeStart, language)
+	}
+
+	sort.SliceStable(r.entities, func(i, j int) bool { return r.entities[i].Offset < r.entities[j].Offset })
+	return r.out.String(), r.entities
+}
+
+// write appends the text to the output.
+func (r *markdownRenderer) write(text string) {
+	r.out.WriteString(text)
+	for _, c := range text {
+		if n := utf16.RuneLen(c); n > 0 {
+			r.units += n
+		} else {
+			r.units++
+		}
+	}
+}
+
+// entity adds the entity that covers the output written since start. Empty entities are skipped.
+func (r *markdownRenderer) entity(kind string, start int, url, language string) {
+	if r.units == start {
+		return
+	}
+	r.entities = append(r.entities, tgbotapi.MessageEntity{
+		Type:     kind,
+		Offset:   start,
+		Length:   r.units - start,
+		URL:      url,
+		Language: language,
+	})
+}
+
+// closeCode adds the code block that started at the offset.
+// The line break before the closing fence belongs to the markup, so it is removed from the block.
+func (r *markdownRenderer) closeCode(start int, language string) {
+	text := r.out.String()
+	if strings.HasSuffix(text, "\n") && r.units > start {
+		r.out.Reset()
+		r.out.WriteString(strings.TrimSuffix(text, "\n"))
+		r.units--
+	}
+	r.entity("pre", start, "", language)
+}
+
+// line renders a line outside code blocks: headings become bold and list markers become bullets.
+func (r *markdownRenderer) line(line string) {
+	body := strings.TrimLeft(line, " \t")
+	indent := line[:len(line)-len(body)]
+
+	if level := len(body) - len(strings.TrimLeft(body, "#")); level > 0 && level <= 6 && strings.HasPrefix(body[level:], " ") {
+		start := r.units
+		r.inline(strings.TrimSpace(body[level:]))
+		r.entity("bold", start, "", "")
+		return
+	}
+	for _, bullet := range []string{"- ", "* ", "+ "} {
+		if strings.HasPrefix(body, bullet) {
+			r.write(indent + "• ")
+			r.inline(body[len(bullet):])
+			return
+		}
+	}
+	r.write(indent)
+	r.inline(body)
+}
+
+// inline renders the inline markup of the text.
+func (r *markdownRenderer) inline(text string) {
+	prev := ' '
+	for len(text) > 0 {
+		// An underscore inside a word, like in snake_case, is not a marker
+		if text[0] != '_' || !unicode.IsLetter(prev) && !unicode.IsDigit(prev) {
+			if rest, ok := r.inlineSpan(text); ok {
+				text, prev = rest, ' '
+				continue
+			}
+		}
+		c, size := utf8.DecodeRuneInString(text)
+		prev = c
+		if c == '\\' && len(text) > size && strings.ContainsRune("\\`*_~[]()#+-.!>", rune(text[size])) {
+			// An escaped marker is written as is
+			r.write(text[size : size+1])
+			text = text[size+1:]
+			continue
+		}
+		r.write(text[:size])
+		text = text[size:]
+	}
+}
+
+// inlineSpan renders the span of inline markup the text starts with.
+// Returns the text after the span, false if the text does not start with a complete span.
+func (r *markdownRenderer) inlineSpan(text string) (string, bool) {
+	switch text[0] {
+	case '`':
+		end := strings.IndexByte(text[1:], '`')
+		if end <= 0 {
+			return text, false
+		}
+		start := r.units
+		r.write(text[1 : end+1])
+		r.entity("code", start, "", "")
+		return text[end+2:], true
+	case '[':
+		label, rest, ok := strings.Cut(text[1:], "](")
+		if !ok || label == "" || strings.Contains(label, "]") {
+			return text, false
+		}
+		url, after, ok := strings.Cut(rest, ")")
+		if !ok || !strings.Contains(url, "://") || strings.ContainsAny(url, " \t") {
+			return text, false
+		}
+		start := r.units
+		r.inline(label)
+		r.entity("text_link", start, url, "")
+		return after, true
+	}
+
+	for _, m := range inlineMarkers {
+		if !strings.HasPrefix(text, m.marker) {
+			continue
+		}
+		inner := text[len(m.marker):]
+		end := strings.Index(inner, m.marker)
+		if end <= 0 || !markerEdges(inner[:end], inner[end+len(m.marker):], m.marker) {
+			return text, false
+		}
+		start := r.units
+		r.inline(inner[:end])
+		r.entity(m.entity, start, "", "")
+		return inner[end+len(m.marker):], true
+	}
+	return text, false
+}
+
+// markerEdges reports whether the content between a pair of markers is emphasized text.
+// The content must not start or end with a space, and an underscore must not be a part of a word like snake_case.
+func markerEdges(content, after, marker string) bool {
+	first, _ := utf8.DecodeRuneInString(content)
+	last, _ := utf8.DecodeLastRuneInString(content)
+	if unicode.IsSpace(first) || unicode.IsSpace(last) {
+		return false
+	}
+	if strings.HasPrefix(marker, "_") {
+		next, _ := utf8.DecodeRuneInString(after)
+		return next == utf8.RuneError || !unicode.IsLetter(next) && !unicode.IsDigit(next)
+	}
+	return true
+}
+
+// isFormattingError reports whether Telegram rejected the formatting of the message,
+// so it has to be sent as plain text.
+func isFormattingError(err error) bool {
+	var tgErr *tgbotapi.Error
+	if !errors.As(err, &tgErr) {
+		return false
+	}
+	message := strings.ToLower(tgErr.Message)
+	return strings.Contains(message, "entit") || strings.Contains(message, "text is empty") || strings.Contains(message, "text must be non-empty")
+}
@@ -0,0 +1,44 @@
+package service
+
+import (
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderMarkdown_Inline(t *testing.T) {
+	text, entities := renderMarkdown("**Жирный** и *курсив*, `код` и [ссылка](https://example.com) в snake_case_name")
+	assert.Equal(t, "Жирный и курсив, код и ссылка в snake_case_name", text)
+	assert.Equal(t, []tgbotapi.MessageEntity{
+		{Type: "bold", Offset: 0, Length: 6},
+		{Type: "italic", Offset: 9, Length: 6},
+		{Type: "code", Offset: 17, Length: 3},
+		{Type: "text_link", Offset: 23, Length: 6, URL: "https://example.com"},
+	}, entities)
+}
+
+func TestRenderMarkdown_Blocks(t *testing.T) {
+	text, entities := renderMarkdown("## План\n- первый\n- второй\n```go\nfmt.Println(\"😀\")\n```\nГотово")
+	assert.Equal(t, "План\n• первый\n• второй\nfmt.Println(\"😀\")\nГотово", text)
+	assert.Equal(t, []tgbotapi.MessageEntity{
+		{Type: "bold", Offset: 0, Length: 4},
+		{Type: "pre", Offset: 23, Length: 17, Language: "go"},
+	}, entities, "the emoji counts as two UTF-16 code units")
+}
+
+func TestRenderMarkdown_IncompleteWhileStreaming(t *testing.T) {
+	text, entities := renderMarkdown("Пример:\n```python\nprint(1)\n")
+	assert.Equal(t, "Пример:\nprint(1)", text)
+	assert.Equal(t, []tgbotapi.MessageEntity{{Type: "pre", Offset: 8, Length: 8, Language: "python"}}, entities,
+		"an unclosed code block lasts until the end of the text")
+
+	text, entities = renderMarkdown("Это **важно и `ещё")
+	assert.Equal(t, "Это **важно и `ещё", text)
+	assert.Empty(t, entities, "unclosed inline markers are kept as is")
+}
+
+func TestIsFormattingError(t *testing.T) {
+	assert.True(t, isFormattingError(&tgbotapi.Error{Code: 400, Message: "Bad Request: can't parse entities: unsupported start tag"}))
+	assert.False(t, isFormattingError(&tgbotapi.Error{Code: 400, Message: "Bad Request: message is not modified"}))
+}
@@ -1,6 +1,9 @@
 package service
 
 import (
+	"fmt"
+	"slices"
+
 	"github.com/DenisKhanov/TgBOT/internal/tg_bot/constant"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/sirupsen/logrus"
@@ -8,9 +11,9 @@ import (
 )
 
 // sendIntroMessageWithDelay sends an introductory message after a specified delay.
-func (b *TgBotServices) sendIntroMessageWithDelay(delayInSec uint8, text string) {
+func (b *TgBotServices) sendIntroMessageWithDelay(uc *UpdateContext, delayInSec uint8, text string) {
 	time.Sleep(time.Duration(delayInSec) * time.Second)
-	if err := b.sendMessage(b.ChatID, text, 0, nil); err != nil {
+	if err := b.sendMessage(uc.ChatID, text, 0, nil); err != nil {
 		logrus.WithError(err).Error("Error sending intro message")
 	}
 }
@@ -20,60 +23,47 @@ func (b *TgBotServices) getKeyboardRow(buttonText, buttonCode string) []tgbotapi
 	return tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(buttonText, buttonCode))
 }
 
-// printIntro sends a sequence of introductory messages with delays to the current chat.
-func (b *TgBotServices) printIntro() {
-	b.sendIntroMessageWithDelay(1, "Привет, пока что я небольшой bot-проект")
-	b.sendIntroMessageWithDelay(2, "Но мои возможности регулярно растут")
-	b.sendIntroMessageWithDelay(1, constant.EMOJI_BICEPS)
+// printIntro sends a sequence of introductory messages with delays to the update chat.
+func (b *TgBotServices) printIntro(uc *UpdateContext) {
+	b.sendIntroMessageWithDelay(uc, 1, "Привет, пока что я небольшой bot-проект")
+	b.sendIntroMessageWithDelay(uc, 2, "Но мои возможности регулярно растут")
+	b.sendIntroMessageWithDelay(uc, 1, constant.EMOJI_BICEPS)
 }
 
 // askToPrintIntro prompts the user to choose whether to view the introductory messages.
-func (b *TgBotServices) askToPrintIntro() error {
+func (b *TgBotServices) askToPrintIntro(uc *UpdateContext) error {
 	markup := tgbotapi.NewReplyKeyboard(
 		tgbotapi.NewKeyboardButtonRow(
 			tgbotapi.NewKeyboardButton(constant.BUTTON_TEXT_PRINT_INTRO),
 			tgbotapi.NewKeyboardButton(constant.BUTTON_TEXT_SKIP_INTRO),
 		),
 	)
-	return b.sendMessage(b.ChatID, "Это приветственное вступление, в нем описываются возможности бота, но ты можешь пропустить его. Что ты выберешь?", 0, markup)
+	return b.sendMessage(uc.ChatID, "Это приветственное вступление, в нем описываются возможности бота, но ты можешь пропустить его. Что ты выберешь?", 0, markup)
 }
 
 // sendSorryMsg sends an apologetic message in response to an unsupported action.
-func (b *TgBotServices) sendSorryMsg(update *tgbotapi.Update) error {
-	return b.sendMessage(b.ChatID, "Я пока этого не умею, но я учусь", update.Message.MessageID, nil)
+func (b *TgBotServices) sendSorryMsg(uc *UpdateContext) error {
+	return b.sendMessage(uc.ChatID, "Я пока этого не умею, но я учусь", uc.MessageID, nil)
 }
 
-// showBarMenu displays the main keyboard menu.
-func (b *TgBotServices) showBarMenu() error {
-	markup := tgbotapi.NewReplyKeyboard(
-		tgbotapi.NewKeyboardButtonRow(
-			tgbotapi.NewKeyboardButton(constant.BUTTON_TEXT_WHAT_TO_DO),
-			tgbotapi.NewKeyboardButton(constant.BUTTON_TEXT_WHITCH_MOVIE_TO_WATCH),
-		),
-		tgbotapi.NewKeyboardButtonRow(
-			tgbotapi.NewKeyboardButton(constant.BUTTON_TEXT_TRANSLATE),
-			tgbotapi.NewKeyboardButton(constant.BUTTON_TEXT_YANDEX_DDIALOGS),
-		),
-		tgbotapi.NewKeyboardButtonRow(
-			tgbotapi.NewKeyboardButton(constant.BUTTON_TEXT_GENERATIVE_MODEL),
-			tgbotapi.NewKeyboardButton(constant.BUTTON_TEXT_GENERATIVE_MENU),
-		),
-	)
+// showBarMenu displays the main keyboard menu with the buttons available to the sender's role.
+func (b *TgBotServices) showBarMenu(uc *UpdateContext) error {
+	markup := tgbotapi.NewReplyKeyboard(barMenuRows(b.roleOf(senderID(uc)))...)
 	markup.ResizeKeyboard = true
 	markup.OneTimeKeyboard = true
 
-	return b.sendMessage(b.ChatID, "Меню ↓", 0, markup)
+	return b.sendMessage(uc.ChatID, "Меню ↓", 0, markup)
 }
 
 // showHeadMenu displays the main inline menu with bot capabilities.
-func (b *TgBotServices) showHeadMenu() error {
+func (b *TgBotServices) showHeadMenu(uc *UpdateContext) error {
 	markup := tgbotapi.NewInlineKeyboardMarkup(
 		b.getKeyboardRow(constant.BUTTON_TEXT_WHAT_TO_DO, constant.BUTTON_CODE_WHAT_TO_DO),
 		b.getKeyboardRow(constant.BUTTON_TEXT_WHITCH_MOVIE_TO_WATCH, constant.BUTTON_CODE_WHITCH_MOVIE_TO_WATCH),
 		b.getKeyboardRow(constant.BUTTON_TEXT_TRANSLATE, constant.BUTTON_CODE_TRANSLATE),
 		b.getKeyboardRow(constant.BUTTON_TEXT_YANDEX_DDIALOGS, constant.BUTTON_CODE_YANDEX_DDIALOGS),
 	)
-	return b.sendMessage(b.ChatID, "Выберите способность:", 0, markup)
+	return b.sendMessage(uc.ChatID, "Выберите способность:", 0, markup)
 }
 
 func (b *TgBotServices) getDefaultInlineResults() []interface{} {
@@ -103,40 +93,59 @@ func (b *TgBotServices) getDefaultInlineResults() []interface{} {
 	return results
 }
 
-// SendActivityMsg sends a random activity suggestion to the current chat.
-func (b *TgBotServices) SendActivityMsg() error {
+// SendActivityMsg sends a random activity suggestion to the update chat.
+func (b *TgBotServices) SendActivityMsg(uc *UpdateContext) error {
 	text := b.Boring.WhatToDo()
-	return b.sendMessage(b.ChatID, text, 0, nil)
+	return b.sendMessage(uc.ChatID, text, 0, nil)
 }
 
 // SendMoviesLink sends a message with a link to a movie recommendation site.
-func (b *TgBotServices) SendMoviesLink() error {
+func (b *TgBotServices) SendMoviesLink(uc *UpdateContext) error {
 	markup := tgbotapi.NewInlineKeyboardMarkup(
 		tgbotapi.NewInlineKeyboardRow(
 			tgbotapi.NewInlineKeyboardButtonURL(constant.BUTTON_TEXT_WHITCH_MOVIE_TO_WATCH, b.MoviesURL),
 		),
 	)
-	return b.sendMessage(b.ChatID, "Тут представлена подборка отличных фильмов по мнению Дениса!", 0, markup)
+	return b.sendMessage(uc.ChatID, "Тут представлена подборка отличных фильмов по мнению Дениса!", 0, markup)
 }
 
-// showGenerativeMenu displays a menu for Generative models controls, restricted to the bot owner.
-func (b *TgBotServices) showGenerativeMenu() error {
-	if b.ChatID != b.OwnerID {
-		if err := b.showBarMenu(); err != nil {
-			logrus.WithError(err).Error("Ошибка отображения основного меню:")
+// showGenerativeMenu displays the user's generative model preferences and a menu to change them.
+// The preferences are personal, so the menu is available to every user.
+// The settings are changed in the AI mode, so the chat outside of it enters the AI mode first.
+func (b *TgBotServices) showGenerativeMenu(uc *UpdateContext) error {
+	if current := b.modes.Current(uc.ChatID); current != ModeGenerative && !slices.Contains(aiSettingsModes, current) {
+		if err := b.enterMode(uc, ModeGenerative); err != nil {
+			return err
 		}
-		return b.sendMessage(b.ChatID, "Извини, но доступ к этому меню есть только у моего Хозяина.", 0, nil)
 	}
-
 	rows := [][]tgbotapi.KeyboardButton{
 		tgbotapi.NewKeyboardButtonRow(
 			tgbotapi.NewKeyboardButton(constant.BUTTON_TEXT_CHANGE_MODEL),
 			tgbotapi.NewKeyboardButton(constant.BUTTON_TEXT_PRINT_MENU),
 			tgbotapi.NewKeyboardButton(constant.BUTTON_TEXT_CHANGE_HISTORY_SIZE),
 		),
+		tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton(constant.BUTTON_TEXT_CHANGE_TEMPERATURE),
+			tgbotapi.NewKeyboardButton(constant.BUTTON_TEXT_CHANGE_MAX_TOKENS),
+			tgbotapi.NewKeyboardButton(constant.BUTTON_TEXT_CHANGE_SYSTEM_PROMPT),
+		),
+		tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton(constant.BUTTON_TEXT_THREADS),
+			tgbotapi.NewKeyboardButton(constant.BUTTON_TEXT_NEW_THREAD),
+		),
+		tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton(constant.BUTTON_TEXT_CHOOSE_PERSONA),
+			tgbotapi.NewKeyboardButton(constant.BUTTON_TEXT_NEW_PERSONA),
+		),
 	}
 	markup := tgbotapi.NewReplyKeyboard(rows...)
 	markup.ResizeKeyboard = true
 	markup.OneTimeKeyboard = true
-	return b.sendMessage(b.ChatID, "Выберите пункт ↓", 0, markup)
+	prefs := b.aiPreferences(uc.ChatID)
+	persona, _ := b.findPersona(uc.ChatID, prefs.Persona)
+	text := describeAIPreferences(prefs, persona.Name) + "\nВыберите пункт ↓"
+	if thread, ok, err := b.activeThreadInfo(uc.ChatID); err == nil && ok {
+		text = fmt.Sprintf("Текущий диалог: «%s»\n%s", thread.Title, text)
+	}
+	return b.sendMessage(uc.ChatID, text, 0, markup)
 }
@@ -0,0 +1,273 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/sirupsen/logrus"
+)
+
+// Settings of the model picker.
+const (
+	modelsPerPage       = 8  // Models on one page of the picker
+	maxModelLabelLength = 40 // Longest model name on a button, in characters
+	maxSimilarModels    = 3  // Models suggested when the typed name is not in the catalogue
+)
+
+// Price filters of the model picker.
+const (
+	priceAll  = "a" // All models
+	priceFree = "f" // Only free models
+	pricePaid = "p" // Only paid models
+)
+
+// contextFilters are the smallest context windows the picker filters by, in thousands of tokens.
+var contextFilters = []int{0, 32, 128}
+
+// modelFilter is the state of the model picker kept in the callback data of its buttons.
+type modelFilter struct {
+	price      string // One of the price filters
+	minContext int    // Smallest context window in thousands of tokens, 0 for any
+	page       int    // Page of the filtered models, starting from 0
+}
+
+// arg returns the filter as a callback argument, "price:context:page".
+func (f modelFilter) arg() string {
+	return fmt.Sprintf("%s:%d:%d", f.price, f.minContext, f.page)
+}
+
+// parseModelFilter parses the filter from the callback argument parts.
+// Unknown values fall back to the unfiltered first page.
+func parseModelFilter(parts []string) modelFilter {
+	f := modelFilter{price: priceAll}
+	if len(parts) > 0 && (parts[0] == priceFree || parts[0] == pricePaid) {
+		f.price = parts[0]
+	}
+	if len(parts) > 1 {
+		f.minContext, _ = strconv.Atoi(parts[1])
+	}
+	if len(parts) > 2 {
+		f.page, _ = strconv.Atoi(parts[2])
+	}
+	if f.page < 0 {
+		f.page = 0
+	}
+	return f
+}
+
+// filterModels returns the models of the catalogue that match the filter.
+func filterModels(list []models.ModelInfo, f modelFilter) []models.ModelInfo {
+	filtered := make([]models.ModelInfo, 0, len(list))
+	for _, m := range list {
+		if f.price == priceFree && !m.Free || f.price == pricePaid && m.Free {
+			continue
+		}
+		if m.ContextLength < f.minContext*1000 {
+			continue
+		}
+		filtered = append(filtered, m)
+	}
+	return filtered
+}
+
+// formatContext returns the context window in a short form like "128K" or "1M".
+func formatContext(tokens int) string {
+	if tokens >= 1000000 && tokens%1000000 == 0 {
+		return fmt.Sprintf("%dM", tokens/1000000)
+	}
+	return fmt.Sprintf("%dK", tokens/1000)
+}
+
+// modelLabel returns the text of the model's button.
+func modelLabel(m models.ModelInfo, current string) string {
+	name := m.Name
+	if name == "" {
+		name = m.ID
+	}
+	if utf8.RuneCountInString(name) > maxModelLabelLength {
+		name = string([]rune(name)[:maxModelLabelLength-1]) + "…"
+	}
+	if m.Free {
+		name = "🆓 " + name
+	}
+	if m.ContextLength > 0 {
+		name += " · " + formatContext(m.ContextLength)
+	}
+	if m.ID == current {
+		name = "✅ " + name
+	}
+	return name
+}
+
+// filterButton returns a button of the filter rows, marked if its filter is the selected one.
+func filterButton(title string, selected bool, f modelFilter) tgbotapi.InlineKeyboardButton {
+	if selected {
+		title = "✅ " + title
+	}
+	return tgbotapi.NewInlineKeyboardButtonData(title, callbackData(callbackModelPage, f.arg()))
+}
+
+// modelPickerView builds the text and the inline keyboard of one page of the model picker.
+// Arguments:
+//   - list: the model catalogue.
+//   - f: the filter and the page to show, the page is moved into the range of the filtered models.
+//   - current: the model of the dialog thread, empty for the default model.
+func modelPickerView(list []models.ModelInfo, f modelFilter, current string) (string, tgbotapi.InlineKeyboardMarkup) {
+	filtered := filterModels(list, f)
+	pages := max(1, (len(filtered)+modelsPerPage-1)/modelsPerPage)
+	f.page = min(f.page, pages-1)
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i := f.page * modelsPerPage; i < min(len(filtered), (f.page+1)*modelsPerPage); i++ {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(
+			modelLabel(filtered[i], current), callbackData(callbackModelPick, f.arg()+":"+strconv.Itoa(i)))))
+	}
+
+	first := modelFilter{price: f.price, minContext: f.minContext}
+	var priceRow, contextRow []tgbotapi.InlineKeyboardButton
+	for _, price := range []struct{ value, title string }{{priceAll, "Все"}, {priceFree, "Бесплатные"}, {pricePaid, "Платные"}} {
+		filter := first
+		filter.price = price.value
+		priceRow = append(priceRow, filterButton(price.title, f.price == price.value, filter))
+	}
+	for _, minContext := range contextFilters {
+		filter := first
+		filter.minContext = minContext
+		title := "Любой контекст"
+		if minContext > 0 {
+			title = fmt.Sprintf("≥%dK", minContext)
+		}
+		contextRow = append(contextRow, filterButton(title, f.minContext == minContext, filter))
+	}
+	rows = append(rows, priceRow, contextRow)
+
+	if pages > 1 {
+		prev, next := f, f
+		prev.page = (f.page - 1 + pages) % pages
+		next.page = (f.page + 1) % pages
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("◀️", callbackData(callbackModelPage, prev.arg())),
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("%d/%d", f.page+1, pages), callbackData(callbackModelPage, f.arg())),
+			tgbotapi.NewInlineKeyboardButtonData("▶️", callbackData(callbackModelPage, next.arg())),
+		))
+	}
+
+	if current == "" {
+		current = "по умолчанию"
+	}
+	text := fmt.Sprintf("Каталог моделей: подходит %d из %d.\nТекущая модель: %s\nВыбери модель ↓ или введи её название.",
+		len(filtered), len(list), current)
+	if len(filtered) == 0 {
+		text = fmt.Sprintf("Каталог моделей: под фильтр не подходит ни одна из %d моделей.\nТекущая модель: %s", len(list), current)
+	}
+	return text, tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+// similarModels returns the models of the catalogue whose ID or name contains the query.
+func similarModels(list []models.ModelInfo, query string) []string {
+	query = strings.ToLower(strings.TrimSpace(query))
+	var similar []string
+	for _, m := range list {
+		if len(similar) == maxSimilarModels {
+			break
+		}
+		if query != "" && (strings.Contains(strings.ToLower(m.ID), query) || strings.Contains(strings.ToLower(m.Name), query)) {
+			similar = append(similar, m.ID)
+		}
+	}
+	return similar
+}
+
+// listModels returns the catalogue of the generative provider.
+// Returns models.ErrNoModelCatalog if the provider does not publish one.
+func (b *TgBotServices) listModels(ctx context.Context) ([]models.ModelInfo, error) {
+	catalog, ok := b.Generative.(ModelCatalog)
+	if !ok {
+		return nil, models.ErrNoModelCatalog
+	}
+	return catalog.ListModels(ctx)
+}
+
+// withModelPicker returns a mode hook that sends the model picker after the hook.
+// Without the catalogue only the hook runs, the user can still type the model name.
+func (b *TgBotServices) withModelPicker(handler ModeHandler) ModeHandler {
+	return func(uc *UpdateContext) error {
+		if err := handler(uc); err != nil {
+			return err
+		}
+		list, err := b.listModels(uc.Ctx)
+		if err != nil {
+			if !errors.Is(err, models.ErrNoModelCatalog) {
+				logrus.WithError(err).WithField("chatID", uc.ChatID).Error("Failed to load the model catalogue")
+			}
+			return nil
+		}
+		text, markup := modelPickerView(list, modelFilter{price: priceAll}, b.aiPreferences(uc.ChatID).Model)
+		return b.sendMessage(uc.ChatID, text, 0, markup)
+	}
+}
+
+// refreshModelPicker replaces the model picker with the pressed button by the page of the filter.
+func (b *TgBotServices) refreshModelPicker(uc *UpdateContext, list []models.ModelInfo, f modelFilter) error {
+	text, markup := modelPickerView(list, f, b.aiPreferences(uc.ChatID).Model)
+	if _, err := b.sender.Send(tgbotapi.NewEditMessageTextAndMarkup(uc.ChatID, uc.MessageID, text, markup)); err != nil {
+		logrus.WithError(err).WithField("chatID", uc.ChatID).Error("Failed to refresh the model picker")
+		return err
+	}
+	return nil
+}
+
+// modelPageByButton shows the page or the filter of the model picker chosen by the button.
+func (b *TgBotServices) modelPageByButton(uc *UpdateContext, arg string) error {
+	list, err := b.listModels(uc.Ctx)
+	if err != nil {
+		logrus.WithError(err).WithField("chatID", uc.ChatID).Error("Failed to load the model catalogue")
+		return b.answerCallback(uc, "Каталог моделей сейчас недоступен, попробуй позже")
+	}
+	return errors.Join(b.answerCallback(uc, ""), b.refreshModelPicker(uc, list, parseModelFilter(strings.Split(arg, ":"))))
+}
+
+// pickModelByButton switches the dialog thread's model to the one chosen in the picker.
+// The argument is the picker filter followed by the index of the model among the filtered ones.
+func (b *TgBotServices) pickModelByButton(uc *UpdateContext, arg string) error {
+	list, err := b.listModels(uc.Ctx)
+	if err != nil {
+		logrus.WithError(err).WithField("chatID", uc.ChatID).Error("Failed to load the model catalogue")
+		return b.answerCallback(uc, "Каталог моделей сейчас недоступен, попробуй позже")
+	}
+	parts := strings.Split(arg, ":")
+	f := parseModelFilter(parts)
+	filtered := filterModels(list, f)
+	index, err := strconv.Atoi(parts[len(parts)-1])
+	if len(parts) != 4 || err != nil || index < 0 || index >= len(filtered) {
+		return errors.Join(b.answerCallback(uc, "Список моделей обновился, выбери модель ещё раз"), b.refreshModelPicker(uc, list, f))
+	}
+
+	model := filtered[index]
+	if err = b.updateThreadSettings(uc.ChatID, func(settings *models.AIPreferences) { settings.Model = model.ID }); err != nil {
+		logrus.WithError(err).WithField("chatID", uc.ChatID).Error("Failed to save dialog thread settings")
+		return errors.Join(err, b.answerCallback(uc, "Не удалось сохранить настройку, попробуй позже"))
+	}
+	logrus.WithFields(logrus.Fields{
+		"chatID": uc.ChatID,
+		"model":  model.ID,
+	}).Info("Generative model picked from the catalogue")
+	return errors.Join(b.answerCallback(uc, "Выбрана модель "+model.ID), b.refreshModelPicker(uc, list, f))
+}
+
+// unknownModelText returns the reply to a model name that is not in the catalogue, with the similar models if there are any.
+func (b *TgBotServices) unknownModelText(ctx context.Context, modelName string) string {
+	text := fmt.Sprintf("Модели «%s» нет в каталоге провайдера.", modelName)
+	if list, err := b.listModels(ctx); err == nil {
+		if similar := similarModels(list, modelName); len(similar) > 0 {
+			text += "\nВозможно, ты имел в виду:\n" + strings.Join(similar, "\n")
+		}
+	}
+	return text + "\nВыбери модель в списке или введи название ещё раз, /stop для выхода."
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testCatalog = []models.ModelInfo{
+	{ID: "deepseek/deepseek-chat-v3-0324:free", Name: "DeepSeek V3 (free)", ContextLength: 163840, Free: true},
+	{ID: "openai/gpt-4o", Name: "OpenAI: GPT-4o", ContextLength: 128000},
+	{ID: "mistralai/mistral-7b-instruct:free", Name: "Mistral 7B (free)", ContextLength: 32768, Free: true},
+	{ID: "gryphe/mythomax-l2-13b", Name: "MythoMax 13B", ContextLength: 4096},
+}
+
+func TestFilterModels(t *testing.T) {
+	ids := func(list []models.ModelInfo) []string {
+		var ids []string
+		for _, m := range list {
+			ids = append(ids, m.ID)
+		}
+		return ids
+	}
+
+	assert.Len(t, filterModels(testCatalog, modelFilter{price: priceAll}), 4)
+	assert.Equal(t, []string{"deepseek/deepseek-chat-v3-0324:free", "mistralai/mistral-7b-instruct:free"},
+		ids(filterModels(testCatalog, modelFilter{price: priceFree})))
+	assert.Equal(t, []string{"openai/gpt-4o"}, ids(filterModels(testCatalog, modelFilter{price: pricePaid, minContext: 32})))
+	assert.Equal(t, []string{"deepseek/deepseek-chat-v3-0324:free", "openai/gpt-4o"},
+		ids(filterModels(testCatalog, modelFilter{price: priceAll, minContext: 128})))
+}
+
+func TestParseModelFilter(t *testing.T) {
+	f := modelFilter{price: priceFree, minContext: 128, page: 2}
+	assert.Equal(t, f, parseModelFilter([]string{"f", "128", "2"}))
+	assert.Equal(t, modelFilter{price: priceAll}, parseModelFilter([]string{"x", "bad", "-1"}))
+}
+
+func TestModelPickerViewPages(t *testing.T) {
+	var list []models.ModelInfo
+	for i := 0; i < modelsPerPage*2+1; i++ {
+		list = append(list, models.ModelInfo{ID: fmt.Sprintf("vendor/model-%d", i), ContextLength: 8192})
+	}
+
+	text, markup := modelPickerView(list, modelFilter{price: priceAll, page: 5}, "vendor/model-16")
+	assert.Contains(t, text, "vendor/model-16")
+	rows := markup.InlineKeyboard
+	require.Len(t, rows, 4, "the last page has one model, two filter rows and the navigation")
+	assert.Equal(t, "✅ vendor/model-16 · 8K", rows[0][0].Text)
+	assert.Equal(t, "model_pick:a:0:2:16", *rows[0][0].CallbackData, "the page is moved into the range")
+	assert.Equal(t, "3/3", rows[3][1].Text)
+	assert.Equal(t, "model_page:a:0:0", *rows[3][2].CallbackData, "the next page wraps around")
+
+	_, markup = modelPickerView(list[:2], modelFilter{price: priceAll}, "")
+	assert.Len(t, markup.InlineKeyboard, 4, "a single page has no navigation")
+}
+
+func TestModelLabel(t *testing.T) {
+	long := models.ModelInfo{ID: "x/long", Name: "A very long model name that does not fit on the button", ContextLength: 1000000, Free: true}
+	label := modelLabel(long, "")
+	assert.Equal(t, "🆓 A very long model name that does not fi… · 1M", label)
+}
+
+func TestSimilarModels(t *testing.T) {
+	assert.Equal(t, []string{"deepseek/deepseek-chat-v3-0324:free"}, similarModels(testCatalog, "DeepSeek"))
+	assert.Equal(t, []string{"deepseek/deepseek-chat-v3-0324:free", "mistralai/mistral-7b-instruct:free"}, similarModels(testCatalog, "free"))
+	assert.Empty(t, similarModels(testCatalog, "claude"))
+}
@@ -0,0 +1,137 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+)
+
+// aiSettingsModes are the modes that change the settings of the AI dialog, entered from the AI menu.
+var aiSettingsModes = []ModeName{ModeChangingModel, ModeChangingHistorySize, ModeChangingTemperature,
+	ModeChangingMaxTokens, ModeChangingPrompt, ModeNamingThread, ModeCreatingPersona}
+
+// newModeMachine registers the chat modes of the bot and the transitions between them.
+func (b *TgBotServices) newModeMachine() *ModeMachine {
+	m := NewModeMachine(b.StateRepo, ModeIdle)
+
+	m.Register(Mode{
+		Name: ModeIdle,
+		Step: "основное меню",
+	})
+	m.Register(Mode{
+		Name:    ModeTranslating,
+		Step:    "перевод",
+		OnEnter: b.replyOnEnter("Вы в режиме перевода.\nВведите текст для перевода или /stop для выхода."),
+		OnInput: b.translateText,
+	})
+	m.Register(Mode{
+		Name:    ModeGenerative,
+		Step:    "ИИ",
+		OnEnter: b.replyOnEnter("Вы в режиме общения с ИИ.\nВведите свой вопрос или /stop для выхода."),
+		OnInput: b.generativeTextWithStream,
+	})
+	m.Register(Mode{
+		Name: ModeChangingModel,
+		Step: "смена ИИ",
+		OnEnter: b.withModelPicker(b.replyOnEnter("Ты в режиме смены генеративной модели.\nВыбери модель в каталоге ниже или введи её название " +
+			"с сайта https://openrouter.ai/models. Например: deepseek/deepseek-chat-v3-0324:free, 'сброс' для модели по умолчанию или /stop для выхода.")),
+		OnInput: b.withBarMenu(b.changeGenerativeModel),
+	})
+	m.Register(Mode{
+		Name:    ModeChangingHistorySize,
+		Step:    "смена памяти ИИ",
+		OnEnter: b.replyOnEnter("Ты в режиме смены размера памяти генеративной модели.\nВведи целое число от 1 до 200 или /stop для выхода."),
+		OnInput: b.withBarMenu(b.changeHistorySize),
+	})
+	m.Register(Mode{
+		Name: ModeChangingTemperature,
+		Step: "смена температуры ИИ",
+		OnEnter: b.replyOnEnter("Ты в режиме смены температуры генеративной модели.\nВведи число от 0 до 2, например 0.7 " +
+			"(чем выше, тем креативнее ответы), 'сброс' для значения по умолчанию или /stop для выхода."),
+		OnInput: b.withBarMenu(b.changeTemperature),
+	})
+	m.Register(Mode{
+		Name: ModeChangingMaxTokens,
+		Step: "смена длины ответа ИИ",
+		OnEnter: b.replyOnEnter(fmt.Sprintf("Ты в режиме смены максимальной длины ответа генеративной модели.\n"+
+			"Введи количество токенов от 1 до %d, 'сброс' для значения по умолчанию или /stop для выхода.", maxResponseTokens)),
+		OnInput: b.withBarMenu(b.changeMaxTokens),
+	})
+	m.Register(Mode{
+		Name: ModeChangingPrompt,
+		Step: "смена инструкции ИИ",
+		OnEnter: b.replyOnEnter(fmt.Sprintf("Ты в режиме смены системной инструкции генеративной модели.\n"+
+			"Опиши, как ИИ должен отвечать (до %d символов), 'сброс' для удаления инструкции или /stop для выхода.", maxSystemPromptLength)),
+		OnInput: b.withBarMenu(b.changeSystemPrompt),
+	})
+	m.Register(Mode{
+		Name:    ModeNamingThread,
+		Step:    "новый диалог ИИ",
+		OnEnter: b.replyOnEnter("Введи название нового диалога с ИИ или /stop для выхода."),
+		OnInput: b.withBarMenu(b.nameNewThread),
+	})
+	m.Register(Mode{
+		Name: ModeImportingDialog,
+		Step: "импорт диалога ИИ",
+		OnEnter: b.replyOnEnter(fmt.Sprintf("Пришли JSON-файл, полученный командой /export json (до %d КБ). "+
+			"Он заменит историю текущего диалога. Введи /stop для выхода.", maxImportFileSize>>10)),
+		OnInput: b.askForImportFile,
+	})
+	m.Register(Mode{
+		Name: ModeCreatingPersona,
+		Step: "создание персоны ИИ",
+		OnEnter: b.replyOnEnter(fmt.Sprintf("Ты в режиме создания персоны ИИ.\nВ первой строке напиши название (до %d символов), "+
+			"со второй — инструкцию, кем должен быть ИИ и как отвечать (до %d символов). Например:\nПоэт\nОтвечай только стихами.\n"+
+			"Введи /stop для выхода.", maxPersonaNameLength, maxSystemPromptLength)),
+		OnInput: b.withBarMenu(b.createPersona),
+	})
+	m.Register(Mode{
+		Name: ModeRegeneratingAnswer,
+		Step: "повтор ответа ИИ другой моделью",
+		OnEnter: b.replyOnEnter("Введи название модели с сайта https://openrouter.ai/models, которая заново ответит на последний вопрос. " +
+			"Модель диалога не изменится. Введи /stop для выхода."),
+		OnInput: b.regenerateWithModel,
+	})
+
+	// The main modes are switched by the keyboard buttons of the main menu, so they are reachable from each other.
+	mainModes := []ModeName{ModeIdle, ModeTranslating, ModeGenerative}
+	for _, from := range mainModes {
+		m.Allow(from, mainModes...)
+		m.Allow(from, ModeImportingDialog)
+	}
+	// The AI settings are changed from the AI menu, which is shown in the AI mode.
+	// The settings modes lead to each other, back to the AI mode or out by the main menu and /stop.
+	for _, from := range aiSettingsModes {
+		m.Allow(from, mainModes...)
+		m.Allow(from, aiSettingsModes...)
+		m.Allow(from, ModeImportingDialog)
+	}
+	m.Allow(ModeGenerative, aiSettingsModes...)
+	m.Allow(ModeImportingDialog, mainModes...)
+	// Another model answers the last question again only in the AI mode, after which the chat returns to it.
+	m.Allow(ModeGenerative, ModeRegeneratingAnswer)
+	m.Allow(ModeRegeneratingAnswer, mainModes...)
+	return m
+}
+
+// enterMode moves the chat to the mode and tells the user if the transition is not allowed.
+func (b *TgBotServices) enterMode(uc *UpdateContext, mode ModeName) error {
+	err := b.modes.Transition(uc, mode)
+	if errors.Is(err, ErrInvalidTransition) {
+		return b.sendMessage(uc.ChatID, "Сейчас нельзя перейти в этот режим. Введи /stop, чтобы вернуться в основное меню.", uc.MessageID, nil)
+	}
+	return err
+}
+
+// replyOnEnter returns a mode hook that sends the text to the chat.
+func (b *TgBotServices) replyOnEnter(text string) ModeHandler {
+	return func(uc *UpdateContext) error {
+		return b.sendMessage(uc.ChatID, text, 0, nil)
+	}
+}
+
+// withBarMenu returns a mode handler that shows the main keyboard menu after the handler.
+func (b *TgBotServices) withBarMenu(handler ModeHandler) ModeHandler {
+	return func(uc *UpdateContext) error {
+		return errors.Join(handler(uc), b.showBarMenu(uc))
+	}
+}
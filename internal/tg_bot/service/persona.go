@@ -0,0 +1,208 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxCustomPersonas     = 10   // Maximum number of personas one user may create
+	maxPersonaNameLength  = 32   // Longest persona name in characters
+	customPersonaIDPrefix = "my" // Prefix of the IDs of the personas created by users
+)
+
+// builtinPersonas are the persona presets available to every user.
+var builtinPersonas = []models.Persona{
+	{
+		ID:   "translator",
+		Name: "Переводчик",
+		Prompt: "Ты профессиональный переводчик. Переводи присланный текст с русского на английский, а с других языков на русский. " +
+			"Сохраняй смысл, стиль и форматирование оригинала и не добавляй пояснений, если о них не просят.",
+	},
+	{
+		ID:   "coder",
+		Name: "Программист",
+		Prompt: "Ты опытный разработчик программного обеспечения. Отвечай точно и по делу, приводи рабочие примеры кода " +
+			"в блоках с указанием языка, объясняй неочевидные решения и предупреждай о возможных ошибках.",
+	},
+	{
+		ID:   "tutor",
+		Name: "Репетитор",
+		Prompt: "Ты терпеливый репетитор. Объясняй тему простыми словами, шаг за шагом и с примерами. " +
+			"Проверяй понимание вопросами и не давай сразу готовый ответ на задачу, а подводи к нему.",
+	},
+}
+
+// personas returns the built-in personas followed by the ones created by the user.
+func (b *TgBotServices) personas(chatID int64) []models.Persona {
+	return append(append([]models.Persona(nil), builtinPersonas...), b.StateRepo.GetPersonas(chatID)...)
+}
+
+// findPersona returns the persona with the ID available to the user.
+func (b *TgBotServices) findPersona(chatID int64, id string) (models.Persona, bool) {
+	if id == "" {
+		return models.Persona{}, false
+	}
+	for _, persona := range b.personas(chatID) {
+		if persona.ID == id {
+			return persona, true
+		}
+	}
+	return models.Persona{}, false
+}
+
+// withPersona returns the preferences whose system prompt starts with the instruction of the selected persona.
+// The user's own instruction follows the persona, so it can refine it.
+func (b *TgBotServices) withPersona(chatID int64, prefs models.AIPreferences) models.AIPreferences {
+	persona, ok := b.findPersona(chatID, prefs.Persona)
+	if !ok {
+		return prefs
+	}
+	if prefs.SystemPrompt == "" {
+		prefs.SystemPrompt = persona.Prompt
+	} else {
+		prefs.SystemPrompt = persona.Prompt + "\n\n" + prefs.SystemPrompt
+	}
+	return prefs
+}
+
+// parsePersona parses the user's input: the name on the first line and the instruction on the following ones.
+func parsePersona(text string) (name, prompt string, err error) {
+	name, prompt, _ = strings.Cut(strings.TrimSpace(text), "\n")
+	name, prompt = strings.TrimSpace(name), strings.TrimSpace(prompt)
+	switch {
+	case name == "" || utf8.RuneCountInString(name) > maxPersonaNameLength:
+		return "", "", fmt.Errorf("название персоны должно быть непустым и не длиннее %d символов", maxPersonaNameLength)
+	case prompt == "":
+		return "", "", errors.New("со второй строки напиши инструкцию персоны")
+	case utf8.RuneCountInString(prompt) > maxSystemPromptLength:
+		return "", "", fmt.Errorf("инструкция персоны должна быть не длиннее %d символов", maxSystemPromptLength)
+	}
+	return name, prompt, nil
+}
+
+// nextPersonaID returns an ID that none of the user's personas has.
+func nextPersonaID(personas []models.Persona) string {
+	next := 1
+	for _, persona := range personas {
+		if n, err := strconv.Atoi(strings.TrimPrefix(persona.ID, customPersonaIDPrefix)); err == nil && n >= next {
+			next = n + 1
+		}
+	}
+	return customPersonaIDPrefix + strconv.Itoa(next)
+}
+
+// createPersona saves the persona written by the user and selects it for the active dialog thread.
+// It is the input handler of ModeCreatingPersona.
+func (b *TgBotServices) createPersona(uc *UpdateContext) error {
+	name, prompt, err := parsePersona(uc.Text)
+	if err != nil {
+		return b.sendMessage(uc.ChatID, "Не получилось создать персону: "+err.Error(), uc.MessageID, nil)
+	}
+
+	custom := b.StateRepo.GetPersonas(uc.ChatID)
+	if len(custom) >= maxCustomPersonas {
+		return b.sendMessage(uc.ChatID, fmt.Sprintf("Можно создать не больше %d персон. Удали ненужные в меню «Выбрать персону»", maxCustomPersonas), uc.MessageID, nil)
+	}
+	persona := models.Persona{ID: nextPersonaID(custom), Name: name, Prompt: prompt}
+	b.StateRepo.SavePersonas(uc.ChatID, append(custom, persona))
+	logrus.WithFields(logrus.Fields{
+		"chatID":  uc.ChatID,
+		"persona": persona.ID,
+	}).Info("AI persona created")
+
+	return b.saveThreadSetting(uc, func(settings *models.AIPreferences) { settings.Persona = persona.ID },
+		fmt.Sprintf("Персона «%s» создана и выбрана для текущего диалога", name))
+}
+
+// personasView builds the text and the inline keyboard of the persona picker.
+func personasView(personas []models.Persona, selected string) (string, tgbotapi.InlineKeyboardMarkup) {
+	rows := make([][]tgbotapi.InlineKeyboardButton, 0, len(personas)+1)
+	for _, persona := range personas {
+		title := persona.Name
+		if persona.ID == selected {
+			title = "✅ " + title
+		}
+		row := tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(title, callbackData(callbackPersonaPick, persona.ID)))
+		if strings.HasPrefix(persona.ID, customPersonaIDPrefix) {
+			row = append(row, tgbotapi.NewInlineKeyboardButtonData("🗑", callbackData(callbackPersonaDrop, persona.ID)))
+		}
+		rows = append(rows, row)
+	}
+	none := "Без персоны"
+	if selected == "" {
+		none = "✅ " + none
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(none, callbackData(callbackPersonaPick, ""))))
+
+	text := "Персона задаёт роль ИИ в текущем диалоге и передаётся модели первым сообщением.\nВыбери персону ↓"
+	return text, tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+// selectedPersona returns the ID of the persona selected for the chat's active dialog thread.
+func (b *TgBotServices) selectedPersona(chatID int64) string {
+	selected := b.aiPreferences(chatID).Persona
+	if _, ok := b.findPersona(chatID, selected); !ok {
+		return ""
+	}
+	return selected
+}
+
+// showPersonas sends the persona picker.
+func (b *TgBotServices) showPersonas(uc *UpdateContext) error {
+	text, markup := personasView(b.personas(uc.ChatID), b.selectedPersona(uc.ChatID))
+	return b.sendMessage(uc.ChatID, text, uc.MessageID, markup)
+}
+
+// refreshPersonas replaces the persona picker with the pressed button by the current one.
+func (b *TgBotServices) refreshPersonas(uc *UpdateContext) error {
+	text, markup := personasView(b.personas(uc.ChatID), b.selectedPersona(uc.ChatID))
+	if _, err := b.sender.Send(tgbotapi.NewEditMessageTextAndMarkup(uc.ChatID, uc.MessageID, text, markup)); err != nil {
+		logrus.WithError(err).WithField("chatID", uc.ChatID).Error("Failed to refresh the persona picker")
+		return err
+	}
+	return nil
+}
+
+// selectPersonaByButton selects the persona chosen in the picker for the active dialog thread.
+func (b *TgBotServices) selectPersonaByButton(uc *UpdateContext, id string) error {
+	persona, ok := b.findPersona(uc.ChatID, id)
+	if id != "" && !ok {
+		return errors.Join(b.answerCallback(uc, "Такой персоны больше нет"), b.refreshPersonas(uc))
+	}
+	if err := b.updateThreadSettings(uc.ChatID, func(settings *models.AIPreferences) { settings.Persona = id }); err != nil {
+		logrus.WithError(err).WithField("chatID", uc.ChatID).Error("Failed to save dialog thread settings")
+		return errors.Join(err, b.answerCallback(uc, "Не удалось сохранить настройку, попробуй позже"))
+	}
+
+	text := "Персона отключена"
+	if ok {
+		text = fmt.Sprintf("Персона «%s» выбрана", persona.Name)
+	}
+	return errors.Join(b.answerCallback(uc, text), b.refreshPersonas(uc))
+}
+
+// deletePersonaByButton removes the persona created by the user.
+// Threads that used it continue without a persona.
+func (b *TgBotServices) deletePersonaByButton(uc *UpdateContext, id string) error {
+	custom := b.StateRepo.GetPersonas(uc.ChatID)
+	remaining := make([]models.Persona, 0, len(custom))
+	for _, persona := range custom {
+		if persona.ID != id {
+			remaining = append(remaining, persona)
+		}
+	}
+	if len(remaining) == len(custom) {
+		return errors.Join(b.answerCallback(uc, "Такой персоны больше нет"), b.refreshPersonas(uc))
+	}
+
+	b.StateRepo.SavePersonas(uc.ChatID, remaining)
+	return errors.Join(b.answerCallback(uc, "Персона удалена"), b.refreshPersonas(uc))
+}
@@ -0,0 +1,48 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakePersonaStore struct {
+	UsersChatStateRepository
+	personas []models.Persona
+}
+
+func (f *fakePersonaStore) GetPersonas(int64) []models.Persona {
+	return f.personas
+}
+
+func TestWithPersona(t *testing.T) {
+	b := &TgBotServices{StateRepo: &fakePersonaStore{personas: []models.Persona{{ID: "my1", Name: "Поэт", Prompt: "Отвечай стихами."}}}}
+
+	prefs := b.withPersona(1, models.AIPreferences{Persona: "my1", SystemPrompt: "Коротко."})
+	assert.Equal(t, "Отвечай стихами.\n\nКоротко.", prefs.SystemPrompt)
+
+	prefs = b.withPersona(1, models.AIPreferences{Persona: "coder"})
+	assert.Equal(t, builtinPersonas[1].Prompt, prefs.SystemPrompt)
+
+	prefs = b.withPersona(1, models.AIPreferences{Persona: "my2", SystemPrompt: "Коротко."})
+	assert.Equal(t, "Коротко.", prefs.SystemPrompt, "a deleted persona is ignored")
+}
+
+func TestParsePersona(t *testing.T) {
+	name, prompt, err := parsePersona("  Поэт \n Отвечай стихами.\nБез прозы. ")
+	require.NoError(t, err)
+	assert.Equal(t, "Поэт", name)
+	assert.Equal(t, "Отвечай стихами.\nБез прозы.", prompt)
+
+	_, _, err = parsePersona("Только название")
+	assert.Error(t, err)
+	_, _, err = parsePersona("Очень-очень-очень длинное название персоны\nинструкция")
+	assert.Error(t, err)
+}
+
+func TestNextPersonaID(t *testing.T) {
+	assert.Equal(t, "my1", nextPersonaID(nil))
+	assert.Equal(t, "my4", nextPersonaID([]models.Persona{{ID: "my3"}, {ID: "my1"}}))
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newPreferencesBot(t *testing.T, dir string) *TgBotServices {
+	t.Helper()
+	state := repository.NewUsersStateMap(filepath.Join(dir, "keep_chat.json"))
+	require.NoError(t, state.ReadFileToMemoryURL())
+	dialogs := repository.NewAiDialogHistory(filepath.Join(dir, "dialog_ai.json"))
+	require.NoError(t, dialogs.LoadDialogFromFile())
+	return &TgBotServices{StateRepo: state, AIDialogRepo: dialogs}
+}
+
+func TestAIPreferences_IndependentPerChat(t *testing.T) {
+	dir := t.TempDir()
+	b := newPreferencesBot(t, dir)
+
+	cold, hot := float32(0.2), float32(1.5)
+	require.NoError(t, b.updateThreadSettings(1, func(settings *models.AIPreferences) {
+		settings.Model = "deepseek-chat"
+		settings.Temperature = &cold
+	}))
+	require.NoError(t, b.updateThreadSettings(2, func(settings *models.AIPreferences) {
+		settings.Model = "openai/gpt-4o"
+		settings.Temperature = &hot
+	}))
+
+	check := func(b *TgBotServices) {
+		first, second := b.aiPreferences(1).GenerationOptions(), b.aiPreferences(2).GenerationOptions()
+		assert.Equal(t, "deepseek-chat", first.Model)
+		require.NotNil(t, first.Temperature)
+		assert.Equal(t, cold, *first.Temperature)
+		assert.Equal(t, "openai/gpt-4o", second.Model)
+		require.NotNil(t, second.Temperature)
+		assert.Equal(t, hot, *second.Temperature)
+		assert.Equal(t, models.GenerationOptions{}, b.aiPreferences(3).GenerationOptions(), "other chats keep the provider defaults")
+	}
+	check(b)
+
+	require.NoError(t, b.StateRepo.SaveBatchToFile())
+	require.NoError(t, b.AIDialogRepo.SaveBatchToFile())
+	check(newPreferencesBot(t, dir))
+}
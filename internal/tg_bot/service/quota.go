@@ -0,0 +1,306 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/sirupsen/logrus"
+)
+
+// Command of the AI quotas: "/quota" shows the caller's limits,
+// the owner manages the allowlist with "/quota list" and "/quota <chat ID> <tier>".
+const (
+	commandQuota  = "quota"
+	quotaArgList  = "list"
+	quotaTierName = "standard" // Name of models.QuotaTierStandard in the command
+)
+
+// Settings of the AI quotas.
+const (
+	quotaWindow         = time.Minute // Window of the requests per minute limit
+	quotaExtendedFactor = 5           // How many times the extended tier's limits exceed the standard ones
+)
+
+// QuotaPolicy configures the limits of the AI requests of every chat outside the allowlist.
+// A zero limit is not enforced.
+type QuotaPolicy struct {
+	RequestsPerMinute int // AI requests and inline queries a chat may send per minute
+	TokensPerDay      int // Tokens of the AI answers a chat may spend per UTC day
+	MaxConcurrent     int // AI answers a chat may generate at the same time
+}
+
+// Validate checks that none of the limits is negative.
+func (p QuotaPolicy) Validate() error {
+	if p.RequestsPerMinute < 0 || p.TokensPerDay < 0 || p.MaxConcurrent < 0 {
+		return fmt.Errorf("quota limits must not be negative, got %d requests per minute, %d tokens per day, %d concurrent answers",
+			p.RequestsPerMinute, p.TokensPerDay, p.MaxConcurrent)
+	}
+	return nil
+}
+
+// forTier returns the limits of the quota tier: the extended tier multiplies them, the unlimited one drops them.
+func (p QuotaPolicy) forTier(tier string) QuotaPolicy {
+	switch tier {
+	case models.QuotaTierUnlimited:
+		return QuotaPolicy{}
+	case models.QuotaTierExtended:
+		return QuotaPolicy{
+			RequestsPerMinute: p.RequestsPerMinute * quotaExtendedFactor,
+			TokensPerDay:      p.TokensPerDay * quotaExtendedFactor,
+			MaxConcurrent:     p.MaxConcurrent * quotaExtendedFactor,
+		}
+	default:
+		return p
+	}
+}
+
+// parseQuotaTier returns the quota tier named in the command.
+func parseQuotaTier(name string) (string, bool) {
+	switch strings.ToLower(name) {
+	case quotaTierName:
+		return models.QuotaTierStandard, true
+	case models.QuotaTierExtended, models.QuotaTierUnlimited:
+		return strings.ToLower(name), true
+	default:
+		return "", false
+	}
+}
+
+// quotaTierTitle returns the name of the quota tier for the user.
+func quotaTierTitle(tier string) string {
+	switch tier {
+	case models.QuotaTierExtended:
+		return "расширенный"
+	case models.QuotaTierUnlimited:
+		return "без лимитов"
+	default:
+		return "обычный"
+	}
+}
+
+// countRequest counts the request in the quota's window of quotaWindow.
+// Returns false and the time until the window ends if the limit is already reached; the request is not counted then.
+func countRequest(quota *models.Quota, limit int, now time.Time) (time.Duration, bool) {
+	if now.Sub(quota.WindowStart) >= quotaWindow || now.Before(quota.WindowStart) {
+		quota.WindowStart, quota.WindowRequests = now, 0
+	}
+	if quota.WindowRequests >= limit {
+		return quota.WindowStart.Add(quotaWindow).Sub(now), false
+	}
+	quota.WindowRequests++
+	return 0, true
+}
+
+// untilNextDay returns the time until the next UTC day, when the daily token limit is renewed.
+func untilNextDay(now time.Time) time.Duration {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC).Sub(now)
+}
+
+// formatWait returns the waiting time in a short form like "3 ч 15 мин" or "40 с".
+func formatWait(d time.Duration) string {
+	switch {
+	case d >= time.Hour:
+		return fmt.Sprintf("%d ч %d мин", int(d.Hours()), int(d.Minutes())%60)
+	case d >= time.Minute:
+		return fmt.Sprintf("%d мин", int(d.Round(time.Minute).Minutes()))
+	default:
+		return fmt.Sprintf("%d с", max(1, int(d.Round(time.Second).Seconds())))
+	}
+}
+
+// quotaLimits returns the limits of the chat and its stored quota.
+// The quota is counted per chat, but the roles are given to users: the owner and the admins have no limits
+// in any chat they write to.
+// Arguments:
+//   - chatID: chat the quota is counted for.
+//   - userID: user who sent the request.
+func (b *TgBotServices) quotaLimits(chatID, userID int64) (QuotaPolicy, models.Quota) {
+	quota := b.StateRepo.GetQuota(chatID)
+	if b.roleOf(userID).Allows(models.AccessAdmin) {
+		return QuotaPolicy{}, quota
+	}
+	return b.quotaPolicy.forTier(quota.Tier), quota
+}
+
+// checkRequestRate counts the request of the chat against its requests per minute limit.
+// Returns false and the time until the limit is renewed if the limit is reached.
+// Must be called with quotaMu held.
+func (b *TgBotServices) checkRequestRate(chatID int64, limits QuotaPolicy, quota models.Quota, now time.Time) (time.Duration, bool) {
+	if limits.RequestsPerMinute == 0 {
+		return 0, true
+	}
+	wait, ok := countRequest(&quota, limits.RequestsPerMinute, now)
+	if ok {
+		b.StateRepo.SaveQuota(chatID, quota)
+	}
+	return wait, ok
+}
+
+// acquireAIQuota checks the quotas of the chat before a request to the AI and counts the request.
+// The denied request is logged and not counted.
+// Arguments:
+//   - chatID: chat the request is counted for.
+//   - userID: user who sent the request, the owner and the admins have no limits.
+//
+// Returns the function that must be called when the answer is finished, or the message for the user
+// if a limit is reached.
+func (b *TgBotServices) acquireAIQuota(chatID, userID int64) (func(), string) {
+	now := time.Now()
+	b.quotaMu.Lock()
+	defer b.quotaMu.Unlock()
+
+	limits, quota := b.quotaLimits(chatID, userID)
+	denial := ""
+	if limits.MaxConcurrent > 0 && b.runningAI[chatID] >= limits.MaxConcurrent {
+		denial = "Я ещё отвечаю на предыдущий вопрос. Дождись ответа или останови его кнопкой «⏹ Стоп»."
+	}
+	if denial == "" && limits.TokensPerDay > 0 {
+		if used := sumUsage(b.StateRepo.GetUsage(chatID), usageDay(now)).TotalTokens(); used >= limits.TokensPerDay {
+			denial = fmt.Sprintf("Дневной лимит ИИ исчерпан: %d из %d токенов. Лимит обновится через %s.",
+				used, limits.TokensPerDay, formatWait(untilNextDay(now)))
+		}
+	}
+	if denial == "" {
+		if wait, ok := b.checkRequestRate(chatID, limits, quota, now); !ok {
+			denial = fmt.Sprintf("Слишком много запросов: не больше %d в минуту. Попробуй через %s.", limits.RequestsPerMinute, formatWait(wait))
+		}
+	}
+	if denial != "" {
+		logrus.WithFields(logrus.Fields{
+			"chatID": chatID,
+			"userID": userID,
+			"tier":   quota.Tier,
+		}).Info("AI request denied by quota: ", denial)
+		return nil, denial
+	}
+
+	b.runningAI[chatID]++
+	return func() {
+		b.quotaMu.Lock()
+		defer b.quotaMu.Unlock()
+		if b.runningAI[chatID]--; b.runningAI[chatID] <= 0 {
+			delete(b.runningAI, chatID)
+		}
+	}, ""
+}
+
+// allowInlineQuery counts the inline query of the user against the requests per minute limit.
+// Inline queries have no chat, so the quota is counted for the user who sent the query.
+// Returns the short message for the inline answer if the limit is reached, empty if the query is allowed.
+func (b *TgBotServices) allowInlineQuery(chatID int64) string {
+	b.quotaMu.Lock()
+	defer b.quotaMu.Unlock()
+
+	limits, quota := b.quotaLimits(chatID, chatID)
+	wait, ok := b.checkRequestRate(chatID, limits, quota, time.Now())
+	if ok {
+		return ""
+	}
+	logrus.WithField("chatID", chatID).Info("Inline query denied by quota")
+	return "Лимит запросов, попробуй через " + formatWait(wait)
+}
+
+// quotaText returns the AI limits of the chat and what is left of them today.
+func quotaText(tier string, limits QuotaPolicy, usedToday int) string {
+	if limits == (QuotaPolicy{}) {
+		return "Для тебя ИИ работает без лимитов."
+	}
+	limit := func(value int) string {
+		if value == 0 {
+			return "без лимита"
+		}
+		return strconv.Itoa(value)
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Твои лимиты ИИ (уровень: %s):\n", quotaTierTitle(tier))
+	fmt.Fprintf(&sb, "• запросов в минуту: %s\n", limit(limits.RequestsPerMinute))
+	fmt.Fprintf(&sb, "• токенов в день: %s, израсходовано сегодня: %d\n", limit(limits.TokensPerDay), usedToday)
+	fmt.Fprintf(&sb, "• одновременных ответов: %s", limit(limits.MaxConcurrent))
+	return sb.String()
+}
+
+// allowlistText returns the chats with a quota tier assigned by the owner.
+func allowlistText(quotas map[int64]models.Quota) string {
+	var chatIDs []int64
+	for chatID, quota := range quotas {
+		if quota.Tier != models.QuotaTierStandard {
+			chatIDs = append(chatIDs, chatID)
+		}
+	}
+	if len(chatIDs) == 0 {
+		return "Белый список пуст. Добавить чат: /quota <ID чата> extended|unlimited"
+	}
+	sort.Slice(chatIDs, func(i, j int) bool { return chatIDs[i] < chatIDs[j] })
+
+	var sb strings.Builder
+	sb.WriteString("Белый список квот ИИ:\n")
+	for _, chatID := range chatIDs {
+		fmt.Fprintf(&sb, "• %d: %s\n", chatID, quotas[chatID].Tier)
+	}
+	sb.WriteString("Убрать чат из списка: /quota <ID чата> " + quotaTierName)
+	return sb.String()
+}
+
+// handleQuotaCommand handles the command that shows the AI limits and manages the allowlist.
+// Returns the errors of the handling and whether the update was the quota command.
+func (b *TgBotServices) handleQuotaCommand(uc *UpdateContext) (error, error, bool) {
+	msg := uc.Update.Message
+	if msg == nil || !msg.IsCommand() || msg.Command() != commandQuota {
+		return nil, nil, false
+	}
+
+	args := strings.Fields(msg.CommandArguments())
+	if len(args) == 0 {
+		limits, quota := b.quotaLimits(uc.ChatID, senderID(uc))
+		used := sumUsage(b.StateRepo.GetUsage(uc.ChatID), usageDay(time.Now())).TotalTokens()
+		return b.sendMessage(uc.ChatID, quotaText(quota.Tier, limits, used), uc.MessageID, nil), nil, true
+	}
+	if len(args) == 1 && strings.EqualFold(args[0], quotaArgList) {
+		return b.sendMessage(uc.ChatID, allowlistText(b.StateRepo.GetAllQuotas()), uc.MessageID, nil), nil, true
+	}
+	return b.setQuotaTier(uc, args), nil, true
+}
+
+// setQuotaTier assigns the quota tier to the chat, the arguments are the chat ID and the tier name.
+func (b *TgBotServices) setQuotaTier(uc *UpdateContext, args []string) error {
+	const usage = "Используй /quota <ID чата> standard|extended|unlimited или /quota list"
+	if len(args) != 2 {
+		return b.sendMessage(uc.ChatID, usage, uc.MessageID, nil)
+	}
+	chatID, err := strconv.ParseInt(args[0], 10, 64)
+	tier, ok := parseQuotaTier(args[1])
+	if err != nil || !ok {
+		return b.sendMessage(uc.ChatID, usage, uc.MessageID, nil)
+	}
+
+	b.quotaMu.Lock()
+	quota := b.StateRepo.GetQuota(chatID)
+	quota.Tier = tier
+	b.StateRepo.SaveQuota(chatID, quota)
+	b.quotaMu.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"chatID":  chatID,
+		"tier":    tier,
+		"ownerID": senderID(uc),
+	}).Info("AI quota tier changed by the owner")
+	return b.sendMessage(uc.ChatID, fmt.Sprintf("Чат %d: уровень квот «%s»", chatID, quotaTierTitle(tier)), uc.MessageID, nil)
+}
+
+// inlineQuotaDenial returns the answer to an inline query denied by the quota, with the reason in the switch button.
+func inlineQuotaDenial(queryID, denial string) tgbotapi.InlineConfig {
+	return tgbotapi.InlineConfig{
+		InlineQueryID:     queryID,
+		Results:           []interface{}{},
+		CacheTime:         0,
+		IsPersonal:        true,
+		SwitchPMText:      denial,
+		SwitchPMParameter: commandQuota,
+	}
+}
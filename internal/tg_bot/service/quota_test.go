@@ -0,0 +1,135 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeQuotaStore struct {
+	UsersChatStateRepository
+	quotas map[int64]models.Quota
+	roles  map[int64]models.AccessRole
+	usage  []models.UsageEntry
+}
+
+func (f *fakeQuotaStore) GetQuota(chatID int64) models.Quota {
+	return f.quotas[chatID]
+}
+
+func (f *fakeQuotaStore) SaveQuota(chatID int64, quota models.Quota) {
+	f.quotas[chatID] = quota
+}
+
+func (f *fakeQuotaStore) GetUsage(int64) []models.UsageEntry {
+	return f.usage
+}
+
+func (f *fakeQuotaStore) GetRole(userID int64) models.AccessRole {
+	return f.roles[userID]
+}
+
+func newQuotaBot(policy QuotaPolicy) (*TgBotServices, *fakeQuotaStore) {
+	store := &fakeQuotaStore{quotas: make(map[int64]models.Quota), roles: make(map[int64]models.AccessRole)}
+	return &TgBotServices{StateRepo: store, OwnerID: 1, defaultRole: models.AccessMember, quotaPolicy: policy, runningAI: make(map[int64]int)}, store
+}
+
+func TestCountRequest(t *testing.T) {
+	start := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	var quota models.Quota
+	for i := 0; i < 2; i++ {
+		_, ok := countRequest(&quota, 2, start.Add(time.Duration(i)*time.Second))
+		require.True(t, ok)
+	}
+	wait, ok := countRequest(&quota, 2, start.Add(20*time.Second))
+	assert.False(t, ok)
+	assert.Equal(t, 40*time.Second, wait)
+	assert.Equal(t, 2, quota.WindowRequests, "a denied request is not counted")
+
+	_, ok = countRequest(&quota, 2, start.Add(time.Minute))
+	assert.True(t, ok, "the next window starts a new count")
+	assert.Equal(t, 1, quota.WindowRequests)
+}
+
+func TestAcquireAIQuota(t *testing.T) {
+	b, store := newQuotaBot(QuotaPolicy{RequestsPerMinute: 2, MaxConcurrent: 1})
+
+	release, denial := b.acquireAIQuota(7, 7)
+	require.Empty(t, denial)
+	_, denial = b.acquireAIQuota(7, 7)
+	assert.Contains(t, denial, "ещё отвечаю", "one answer at a time")
+	release()
+
+	release, denial = b.acquireAIQuota(7, 7)
+	require.Empty(t, denial)
+	release()
+	_, denial = b.acquireAIQuota(7, 7)
+	assert.Contains(t, denial, "не больше 2 в минуту")
+	assert.Equal(t, 2, store.quotas[7].WindowRequests, "the counter is stored to survive restarts")
+
+	for i := 0; i < 5; i++ {
+		release, denial = b.acquireAIQuota(1, 1)
+		require.Empty(t, denial, "the owner has no limits")
+	}
+}
+
+func TestAcquireAIQuotaRoleOfSender(t *testing.T) {
+	b, store := newQuotaBot(QuotaPolicy{RequestsPerMinute: 1})
+	store.roles[5] = models.AccessAdmin
+	const group = -100
+
+	// The roles are given to users, the group chat itself has none.
+	for _, userID := range []int64{1, 5} {
+		for i := 0; i < 3; i++ {
+			_, denial := b.acquireAIQuota(group, userID)
+			require.Empty(t, denial, "the owner and the admins have no limits in a group")
+		}
+	}
+
+	_, denial := b.acquireAIQuota(group, 7)
+	require.Empty(t, denial)
+	_, denial = b.acquireAIQuota(group, 7)
+	assert.Contains(t, denial, "не больше 1 в минуту", "the other members of the group are limited")
+
+	store.roles[group] = models.AccessAdmin
+	_, denial = b.acquireAIQuota(group, 8)
+	assert.NotEmpty(t, denial, "a role stored for the chat ID does not lift the limits of its members")
+
+	limits, _ := b.quotaLimits(group, 5)
+	assert.Equal(t, QuotaPolicy{}, limits)
+}
+
+func TestAcquireAIQuotaTokensAndTiers(t *testing.T) {
+	b, store := newQuotaBot(QuotaPolicy{TokensPerDay: 1000})
+	store.usage = []models.UsageEntry{{Day: usageDay(time.Now()), Model: "deepseek-chat", Requests: 3, PromptTokens: 900, CompletionTokens: 300}}
+
+	_, denial := b.acquireAIQuota(7, 7)
+	assert.Contains(t, denial, "Дневной лимит ИИ исчерпан: 1200 из 1000 токенов")
+
+	store.quotas[7] = models.Quota{Tier: models.QuotaTierExtended}
+	_, denial = b.acquireAIQuota(7, 7)
+	assert.Empty(t, denial, "the extended tier has a larger limit")
+
+	store.quotas[8] = models.Quota{Tier: models.QuotaTierUnlimited}
+	limits, _ := b.quotaLimits(8, 8)
+	assert.Equal(t, QuotaPolicy{}, limits)
+}
+
+func TestFormatWait(t *testing.T) {
+	assert.Equal(t, "3 ч 15 мин", formatWait(3*time.Hour+15*time.Minute+10*time.Second))
+	assert.Equal(t, "2 мин", formatWait(110*time.Second))
+	assert.Equal(t, "1 с", formatWait(100*time.Millisecond))
+}
+
+func TestAllowlistText(t *testing.T) {
+	text := allowlistText(map[int64]models.Quota{
+		30: {Tier: models.QuotaTierUnlimited},
+		20: {WindowRequests: 3},
+		10: {Tier: models.QuotaTierExtended},
+	})
+	assert.Contains(t, text, "• 10: extended\n• 30: unlimited\n")
+	assert.NotContains(t, text, "20")
+}
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"context"
+	"errors"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+)
+
+// streamErrorText returns the note shown to the user when the AI answer was interrupted by the error.
+func streamErrorText(err error) string {
+	switch {
+	case errors.Is(err, models.ErrContentBlocked):
+		return "ИИ отказался отвечать: сработал фильтр безопасности. Попробуй переформулировать запрос"
+	case errors.Is(err, models.ErrEmptyPrompt):
+		return "Пустой запрос: напиши текст сообщения для ИИ"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "Вышло время ожидания ответа от ИИ"
+	case errors.Is(err, context.Canceled):
+		return "Генерация ответа остановлена"
+	default:
+		return "Не удалось получить ответ от ИИ, попробуй позже"
+	}
+}
+
+// renderStreamResult returns the final text of the AI answer message.
+// Errors and a cut-off answer are rendered as a note after the received text; the note is never saved to the history.
+// Arguments:
+//   - content: text received from the model.
+//   - finishReason: why the model stopped, one of the models.Finish* constants or empty.
+//   - err: error that interrupted the stream, nil if the stream completed.
+func renderStreamResult(content, finishReason string, err error) string {
+	var note string
+	switch {
+	case err != nil:
+		note = "⚠️ " + streamErrorText(err)
+	case finishReason == models.FinishLength:
+		note = "✂️ Ответ обрезан по лимиту длины. Увеличь длину ответа в меню ИИ"
+	case content == "":
+		return "ИИ вернул пустой ответ, попробуй переформулировать запрос"
+	}
+	if note == "" {
+		return content
+	}
+	if content == "" {
+		return note
+	}
+	return content + "\n\n" + note
+}
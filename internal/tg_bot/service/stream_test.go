@@ -0,0 +1,41 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderStreamResult(t *testing.T) {
+	blocked := fmt.Errorf("%w: prompt BlockReasonSafety", models.ErrContentBlocked)
+
+	tests := []struct {
+		name         string
+		content      string
+		finishReason string
+		err          error
+		want         string
+	}{
+		{name: "completed", content: "ответ", finishReason: models.FinishStop, want: "ответ"},
+		{name: "cut by length", content: "ответ", finishReason: models.FinishLength,
+			want: "ответ\n\n✂️ Ответ обрезан по лимиту длины. Увеличь длину ответа в меню ИИ"},
+		{name: "empty", want: "ИИ вернул пустой ответ, попробуй переформулировать запрос"},
+		{name: "blocked", err: blocked,
+			want: "⚠️ ИИ отказался отвечать: сработал фильтр безопасности. Попробуй переформулировать запрос"},
+		{name: "empty prompt", err: fmt.Errorf("deepseek stream: %w", models.ErrEmptyPrompt),
+			want: "⚠️ Пустой запрос: напиши текст сообщения для ИИ"},
+		{name: "timeout after partial answer", content: "нача", err: context.DeadlineExceeded,
+			want: "нача\n\n⚠️ Вышло время ожидания ответа от ИИ"},
+		{name: "provider error", err: errors.New("unexpected status code: 500"),
+			want: "⚠️ Не удалось получить ответ от ИИ, попробуй позже"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, renderStreamResult(tt.content, tt.finishReason, tt.err))
+		})
+	}
+}
@@ -0,0 +1,318 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// Default budgets of the outgoing Telegram requests, see https://core.telegram.org/bots/faq#my-bot-is-hitting-limits-how-do-i-avoid-this
+const (
+	defaultGlobalRate  = 30               // Requests per second to all chats
+	defaultChatRate    = 1                // Requests per second to one chat
+	defaultChatBurst   = 3                // Requests to one chat that may be sent at once
+	maxSendRetries     = 3                // Attempts to repeat a request rejected with 429 Too Many Requests
+	maxSendWait        = 30 * time.Second // Longest time a request waits for its budget
+	maxTrackedMessages = 10000            // Edited messages whose last content is kept to skip unchanged edits
+	idleChatBudgetTTL  = 10 * time.Minute // Budgets of chats without requests for this long are dropped
+)
+
+// ErrThrottled is returned by TrySend when the request is skipped, because its budget is exhausted.
+var ErrThrottled = errors.New("telegram request skipped by the rate limiter")
+
+// telegramAPI is the part of the Telegram Bot API client used by the sender.
+type telegramAPI interface {
+	Send(c tgbotapi.Chattable) (tgbotapi.Message, error)
+	Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error)
+}
+
+// chatBudget is the request budget of one chat.
+type chatBudget struct {
+	limiter     *rate.Limiter
+	pausedUntil time.Time // Telegram asked to retry the chat's requests after this time
+	lastUsed    time.Time
+}
+
+// messageKey identifies an edited message.
+type messageKey struct {
+	chatID    int64
+	messageID int
+}
+
+// TelegramSender sends all outgoing requests of the bot to the Telegram Bot API within its rate limits.
+//
+// Every request spends the global budget and, if it is addressed to a chat, the budget of the chat.
+// A request rejected with 429 Too Many Requests pauses its chat, or the whole bot, for the retry_after
+// period and is repeated. An edit that would not change the message is not sent at all.
+type TelegramSender struct {
+	api         telegramAPI
+	global      *rate.Limiter
+	chatRate    rate.Limit
+	chatBurst   int
+	mu          sync.Mutex            // Protects the fields below
+	chats       map[int64]*chatBudget // Budgets of the chats by ID
+	pausedUntil time.Time             // Telegram asked to retry all requests after this time
+	edits       map[messageKey]string // Last content of the edited messages
+	now         func() time.Time      // Current time, replaced in tests
+	sleep       func(context.Context, time.Duration) error
+}
+
+// NewTelegramSender creates a TelegramSender with the default budgets.
+// Arguments:
+//   - api: the Telegram Bot API client, usually *tgbotapi.BotAPI.
+//
+// Returns a pointer to a TelegramSender.
+func NewTelegramSender(api telegramAPI) *TelegramSender {
+	return &TelegramSender{
+		api:       api,
+		global:    rate.NewLimiter(defaultGlobalRate, defaultGlobalRate),
+		chatRate:  defaultChatRate,
+		chatBurst: defaultChatBurst,
+		chats:     make(map[int64]*chatBudget),
+		edits:     make(map[messageKey]string),
+		now:       time.Now,
+		sleep:     sleepContext,
+	}
+}
+
+// Send sends the message or the edit and waits for its budget if it is exhausted.
+func (s *TelegramSender) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	var msg tgbotapi.Message
+	err := s.do(c, true, func() (err error) {
+		msg, err = s.api.Send(c)
+		return err
+	})
+	return msg, err
+}
+
+// TrySend sends the message or the edit only if its budget allows it right now.
+// Otherwise it returns ErrThrottled, so intermediate edits of a streamed answer are coalesced into the next one.
+func (s *TelegramSender) TrySend(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	var msg tgbotapi.Message
+	err := s.do(c, false, func() (err error) {
+		msg, err = s.api.Send(c)
+		return err
+	})
+	return msg, err
+}
+
+// Request sends the request whose result is not a message, like a callback answer or a deletion,
+// and waits for its budget if it is exhausted.
+func (s *TelegramSender) Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	var resp *tgbotapi.APIResponse
+	err := s.do(c, true, func() (err error) {
+		resp, err = s.api.Request(c)
+		return err
+	})
+	return resp, err
+}
+
+// do performs the request within the budgets and repeats it when Telegram asks to retry later.
+func (s *TelegramSender) do(c tgbotapi.Chattable, wait bool, call func() error) error {
+	chatID, hasChat := requestChat(c)
+	key, content, isEdit := editContent(c)
+	if isEdit && s.unchanged(key, content) {
+		return nil
+	}
+	if changed, ok := changedMessage(c); ok {
+		s.forgetEdit(changed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), maxSendWait)
+	defer cancel()
+
+	for attempt := 0; ; attempt++ {
+		if err := s.acquire(ctx, chatID, hasChat, wait); err != nil {
+			return err
+		}
+		err := call()
+		var tgErr *tgbotapi.Error
+		if !errors.As(err, &tgErr) || tgErr.RetryAfter <= 0 || attempt == maxSendRetries {
+			if err == nil && isEdit {
+				s.rememberEdit(key, content)
+			}
+			return err
+		}
+
+		retryAfter := time.Duration(tgErr.RetryAfter) * time.Second
+		s.pause(chatID, hasChat, retryAfter)
+		logrus.WithFields(logrus.Fields{
+			"chatID":     chatID,
+			"retryAfter": retryAfter,
+		}).Warn("Telegram rate limit exceeded, the request is delayed")
+		if !wait {
+			return ErrThrottled
+		}
+	}
+}
+
+// acquire takes the global budget and the budget of the chat, waiting for them if wait is true.
+func (s *TelegramSender) acquire(ctx context.Context, chatID int64, hasChat, wait bool) error {
+	s.mu.Lock()
+	now := s.now()
+	pausedUntil := s.pausedUntil
+	var chat *chatBudget
+	if hasChat {
+		chat = s.chatBudget(chatID, now)
+		if chat.pausedUntil.After(pausedUntil) {
+			pausedUntil = chat.pausedUntil
+		}
+	}
+	s.mu.Unlock()
+
+	if pausedUntil.After(now) {
+		if !wait {
+			return ErrThrottled
+		}
+		if err := s.sleep(ctx, pausedUntil.Sub(now)); err != nil {
+			return err
+		}
+	}
+
+	// The chat's budget is taken first, so a request waiting for its chat does not hold a token of the global one
+	var limiters []*rate.Limiter
+	if chat != nil {
+		limiters = append(limiters, chat.limiter)
+	}
+	limiters = append(limiters, s.global)
+	if !wait {
+		return reserveNow(limiters...)
+	}
+	for _, limiter := range limiters {
+		if err := limiter.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reserveNow takes a token from every limiter if all of them have one right now.
+func reserveNow(limiters ...*rate.Limiter) error {
+	reservations := make([]*rate.Reservation, 0, len(limiters))
+	for _, limiter := range limiters {
+		r := limiter.Reserve()
+		reservations = append(reservations, r)
+		if !r.OK() || r.Delay() > 0 {
+			for _, taken := range reservations {
+				taken.Cancel()
+			}
+			return ErrThrottled
+		}
+	}
+	return nil
+}
+
+// chatBudget returns the budget of the chat, creating it on first use. The caller must hold s.mu.
+func (s *TelegramSender) chatBudget(chatID int64, now time.Time) *chatBudget {
+	budget, ok := s.chats[chatID]
+	if !ok {
+		// Drop the budgets of idle chats, they are full again anyway
+		for id, idle := range s.chats {
+			if now.Sub(idle.lastUsed) > idleChatBudgetTTL {
+				delete(s.chats, id)
+			}
+		}
+		budget = &chatBudget{limiter: rate.NewLimiter(s.chatRate, s.chatBurst)}
+		s.chats[chatID] = budget
+	}
+	budget.lastUsed = now
+	return budget
+}
+
+// pause stops the requests to the chat, or to all chats, for the period Telegram asked for.
+func (s *TelegramSender) pause(chatID int64, hasChat bool, period time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	until := s.now().Add(period)
+	if hasChat {
+		s.chatBudget(chatID, s.now()).pausedUntil = until
+		return
+	}
+	s.pausedUntil = until
+}
+
+// unchanged reports whether the message already has the content of the edit.
+func (s *TelegramSender) unchanged(key messageKey, content string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.edits[key] == content
+}
+
+// rememberEdit stores the content of the edited message.
+func (s *TelegramSender) rememberEdit(key messageKey, content string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.edits) >= maxTrackedMessages {
+		s.edits = make(map[messageKey]string)
+	}
+	s.edits[key] = content
+}
+
+// forgetEdit drops the stored content of the message changed by a request other than a text edit.
+func (s *TelegramSender) forgetEdit(key messageKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.edits, key)
+}
+
+// requestChat returns the chat the request is addressed to, false if it is not addressed to a chat.
+func requestChat(c tgbotapi.Chattable) (int64, bool) {
+	switch r := c.(type) {
+	case tgbotapi.MessageConfig:
+		return r.ChatID, true
+	case tgbotapi.DocumentConfig:
+		return r.ChatID, true
+	case tgbotapi.EditMessageTextConfig:
+		return r.ChatID, true
+	case tgbotapi.EditMessageReplyMarkupConfig:
+		return r.ChatID, true
+	case tgbotapi.DeleteMessageConfig:
+		return r.ChatID, true
+	default:
+		return 0, false
+	}
+}
+
+// editContent returns the edited message and the new content of a text edit, false for other requests.
+func editContent(c tgbotapi.Chattable) (messageKey, string, bool) {
+	edit, ok := c.(tgbotapi.EditMessageTextConfig)
+	if !ok || edit.InlineMessageID != "" {
+		return messageKey{}, "", false
+	}
+	content, err := json.Marshal(edit)
+	if err != nil {
+		return messageKey{}, "", false
+	}
+	return messageKey{chatID: edit.ChatID, messageID: edit.MessageID}, string(content), true
+}
+
+// changedMessage returns the message whose markup is edited or which is deleted by the request.
+func changedMessage(c tgbotapi.Chattable) (messageKey, bool) {
+	switch r := c.(type) {
+	case tgbotapi.EditMessageReplyMarkupConfig:
+		return messageKey{chatID: r.ChatID, messageID: r.MessageID}, true
+	case tgbotapi.DeleteMessageConfig:
+		return messageKey{chatID: r.ChatID, messageID: r.MessageID}, true
+	default:
+		return messageKey{}, false
+	}
+}
+
+// sleepContext waits for the duration or until the context is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
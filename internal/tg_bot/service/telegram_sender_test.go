@@ -0,0 +1,92 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+type fakeTelegramAPI struct {
+	sent      []tgbotapi.Chattable
+	rejectFor int // Number of the next requests rejected with 429 Too Many Requests
+}
+
+func (f *fakeTelegramAPI) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	if f.rejectFor > 0 {
+		f.rejectFor--
+		return tgbotapi.Message{}, &tgbotapi.Error{Code: 429, Message: "Too Many Requests: retry after 2", ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 2}}
+	}
+	f.sent = append(f.sent, c)
+	return tgbotapi.Message{MessageID: len(f.sent)}, nil
+}
+
+func (f *fakeTelegramAPI) Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	_, err := f.Send(c)
+	return &tgbotapi.APIResponse{Ok: err == nil}, err
+}
+
+func newTestSender(api telegramAPI) (*TelegramSender, *[]time.Duration) {
+	s := NewTelegramSender(api)
+	s.global = rate.NewLimiter(rate.Inf, 1)
+	var slept []time.Duration
+	s.sleep = func(_ context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return nil
+	}
+	return s, &slept
+}
+
+func TestTelegramSender_SkipsUnchangedEdits(t *testing.T) {
+	api := &fakeTelegramAPI{}
+	s, _ := newTestSender(api)
+
+	edit := tgbotapi.NewEditMessageText(1, 10, "текст")
+	_, err := s.Send(edit)
+	require.NoError(t, err)
+	_, err = s.Send(edit)
+	require.NoError(t, err)
+	assert.Len(t, api.sent, 1, "the second edit would not change the message")
+
+	_, err = s.Request(tgbotapi.NewEditMessageReplyMarkup(1, 10, tgbotapi.InlineKeyboardMarkup{InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{}}))
+	require.NoError(t, err)
+	_, err = s.Send(edit)
+	require.NoError(t, err)
+	assert.Len(t, api.sent, 3, "the message was changed by another request")
+}
+
+func TestTelegramSender_TrySendRespectsChatBudget(t *testing.T) {
+	api := &fakeTelegramAPI{}
+	s, _ := newTestSender(api)
+
+	for i := 0; i < defaultChatBurst; i++ {
+		_, err := s.TrySend(tgbotapi.NewMessage(1, "сообщение"))
+		require.NoError(t, err)
+	}
+	_, err := s.TrySend(tgbotapi.NewMessage(1, "лишнее"))
+	assert.ErrorIs(t, err, ErrThrottled)
+
+	_, err = s.TrySend(tgbotapi.NewMessage(2, "другой чат"))
+	assert.NoError(t, err, "chats have their own budgets")
+}
+
+func TestTelegramSender_HonoursRetryAfter(t *testing.T) {
+	api := &fakeTelegramAPI{rejectFor: 1}
+	s, slept := newTestSender(api)
+
+	_, err := s.Send(tgbotapi.NewMessage(1, "сообщение"))
+	require.NoError(t, err)
+	assert.Len(t, api.sent, 1)
+	require.Len(t, *slept, 1)
+	assert.InDelta(t, 2*time.Second, (*slept)[0], float64(100*time.Millisecond))
+
+	api.rejectFor = 1
+	_, err = s.TrySend(tgbotapi.NewEditMessageText(1, 1, "новый текст"))
+	assert.ErrorIs(t, err, ErrThrottled)
+	_, err = s.TrySend(tgbotapi.NewEditMessageText(1, 1, "ещё новее"))
+	assert.ErrorIs(t, err, ErrThrottled, "the chat is paused for the retry_after period")
+}
@@ -3,6 +3,8 @@
 package service
 
 import (
+	"context"
+
 	"github.com/DenisKhanov/TgBOT/internal/tg_bot/constant"
 	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
@@ -36,32 +38,61 @@ type SmartHome interface {
 	TurnOnOffAction(token, id string, value bool) error
 }
 
+// GenerativeModel defines the interface for AI text generation.
+// Per-user settings are passed with every call, so one instance safely serves all chats.
+// GenerateStreamTextMsg streams typed events: text deltas, the finish reason, the token usage and a terminal error.
 type GenerativeModel interface {
 	GenerateTextMsg(text string) (string, error)
-	GenerateStreamTextMsg(text string, history []models.Message) <-chan string
-	ChangeGenerativeModelName(modelName string) error
+	GenerateStreamTextMsg(ctx context.Context, text string, history []models.Message, opts models.GenerationOptions) <-chan models.StreamEvent
+	ValidateModelName(modelName string) error
+}
+
+// ModelCatalog is implemented by generative models that list the models the user may switch to.
+// ListModels returns models.ErrNoModelCatalog if the provider does not publish a catalogue.
+type ModelCatalog interface {
+	ListModels(ctx context.Context) ([]models.ModelInfo, error)
 }
 
 // The UsersChatStateRepository defines the interface for user state persistence.
 type UsersChatStateRepository interface {
 	ReadFileToMemoryURL() error
 	SaveBatchToFile() error
-	StoreUserState(chatID int64, currentStep, lastUserMassage, callbackQueryData string, isTranslating, isGenerative, isChangingGenModel, isChangingHistorySize bool)
+	StoreUserState(chatID int64, currentStep, lastUserMassage, callbackQueryData string)
 	SaveUserSmartHomeInfo(chatID int64, token string, devices map[string]*models.Device)
 	GetUserSmartHomeToken(chatID int64) (string, error)
 	GetUserSmartHomeDevices(chatID int64) (map[string]*models.Device, error)
-	GetTranslateState(chatID int64) bool
-	GetGenerativeState(chatID int64) bool
-	GetChangeModelState(chatID int64) bool
-	GetChangeHistorySizeState(chatID int64) bool
+	GetAIPreferences(chatID int64) models.AIPreferences
+	GetPersonas(chatID int64) []models.Persona
+	SavePersonas(chatID int64, personas []models.Persona)
+	AddUsage(chatID int64, entry models.UsageEntry)
+	GetUsage(chatID int64) []models.UsageEntry
+	GetAllUsage() map[int64][]models.UsageEntry
+	GetQuota(chatID int64) models.Quota
+	SaveQuota(chatID int64, quota models.Quota)
+	GetAllQuotas() map[int64]models.Quota
+	GetRole(userID int64) models.AccessRole
+	SaveRole(userID int64, role models.AccessRole)
+	GetAllRoles() map[int64]models.AccessRole
+	SaveUsername(userID int64, username string)
+	FindUserByUsername(username string) (int64, bool)
+	ModeStore
 }
 
+// AIDialogHistoryRepository defines the interface for the AI dialog threads of every chat.
+// The methods without a thread ID work with the chat's active thread.
 type AIDialogHistoryRepository interface {
 	LoadDialogFromFile() error
 	SaveDialog(chatID int64, dialog []models.Message) error
 	SaveMsgToDialog(chatID int64, msg models.Message) error
 	GetDialogHistory(chatID int64) ([]models.Message, error)
 	ClearHistory(chatID int64) error
+	CreateThread(chatID int64, title string) (models.DialogThreadInfo, error)
+	ListThreads(chatID int64) ([]models.DialogThreadInfo, error)
+	SwitchThread(chatID int64, threadID string) (models.DialogThreadInfo, error)
+	RenameThread(chatID int64, threadID, title string) error
+	DeleteThread(chatID int64, threadID string) error
+	GetThreadSettings(chatID int64) (*models.AIPreferences, error)
+	SaveThreadSettings(chatID int64, settings *models.AIPreferences) error
 	SaveBatchToFile() error
 }
 
@@ -72,26 +103,34 @@ type Handler interface {
 
 // TgBotServices is the main service struct for the Telegram bot, integrating all dependencies.
 type TgBotServices struct {
-	Boring            Boring    // Activity suggestion service.
-	Translate         Translate // Translation service.
-	SmartHome         SmartHome // Smart home service.
-	Generative        GenerativeModel
-	StateRepo         UsersChatStateRepository  // User state repository.
-	AIDialogRepo      AIDialogHistoryRepository // User's & AI dialog history
-	dialogHistorySize int                       // Max count messages in dialog history for one user
-	ChatID            int64                     // Current chat ID.
-	Bot               *tgbotapi.BotAPI          // Telegram Bot API instance.
-	Handler           Handler                   // OAuth handler.
-	OAuthURL          string                    // URL for OAuth authentication.
-	OwnerID           int64                     // Owner's chatID for access to Yandex smart home menu button
-	MoviesURL         string                    // External URL with movie подборкой
-	debounceTimers    map[int64]*time.Timer     // Per-chat debounce timers
-	lastQueries       map[int64]string
-	pendingReplies    map[string]struct {
+	Boring         Boring    // Activity suggestion service.
+	Translate      Translate // Translation service.
+	SmartHome      SmartHome // Smart home service.
+	Generative     GenerativeModel
+	StateRepo      UsersChatStateRepository  // User state repository.
+	AIDialogRepo   AIDialogHistoryRepository // User's & AI dialog history
+	historyPolicy  HistoryPolicy             // How the dialog history is trimmed to fit the model context
+	quotaPolicy    QuotaPolicy               // Limits of the AI requests of the chats outside the allowlist
+	Bot            *tgbotapi.BotAPI          // Telegram Bot API instance.
+	sender         *TelegramSender           // Rate-limited sender of all outgoing Telegram requests
+	Handler        Handler                   // OAuth handler.
+	OAuthURL       string                    // URL for OAuth authentication.
+	OwnerID        int64                     // Owner's user ID, the owner has every access role
+	defaultRole    models.AccessRole         // Access role of the users without an assigned one
+	MoviesURL      string                    // External URL with movie подборкой
+	debounceTimers map[int64]*time.Timer     // Per-chat debounce timers
+	lastQueries    map[int64]string
+	pendingReplies map[string]struct {
 		ChatID    int64
 		MessageID int
 	}
-	mu *sync.Mutex // Protects debounceTimers
+	mu            *sync.Mutex           // Protects debounceTimers
+	modes         *ModeMachine          // Finite-state machine of chat modes
+	generations   map[int64]*generation // Running AI answers by chat
+	answers       map[int64]answer      // Latest finished AI answers by chat
+	generationsMu sync.Mutex            // Protects generations and answers
+	runningAI     map[int64]int         // AI answers being generated by chat, counted against the quota
+	quotaMu       sync.Mutex            // Protects runningAI and serializes the quota counters
 }
 
 // NewTgBot creates a new TgBotServices instance with the specified dependencies.
@@ -103,30 +142,41 @@ type TgBotServices struct {
 //   - bot: Telegram Bot API instance.
 //   - handler: OAuth handler.
 //   - URL: OAuth URL.
+//   - historyPolicy: how the dialog history is trimmed to fit the model context.
+//   - quotaPolicy: limits of the AI requests of the chats outside the allowlist.
+//   - defaultRole: access role of the users without an assigned one.
 //
 // Returns a pointer to a TgBotServices.
-func NewTgBot(boring Boring, translate Translate, smartHome SmartHome, generative GenerativeModel, stateRepository UsersChatStateRepository, aiDialogRepository AIDialogHistoryRepository, bot *tgbotapi.BotAPI, handler Handler, URL string, ownerID int64, moviesURL string) *TgBotServices {
-	return &TgBotServices{
-		Boring:            boring,
-		Translate:         translate,
-		SmartHome:         smartHome,
-		Generative:        generative,
-		StateRepo:         stateRepository,
-		AIDialogRepo:      aiDialogRepository,
-		dialogHistorySize: 50,
-		Bot:               bot,
-		Handler:           handler,
-		OAuthURL:          URL,
-		OwnerID:           ownerID,
-		MoviesURL:         moviesURL,
-		debounceTimers:    make(map[int64]*time.Timer),
-		lastQueries:       make(map[int64]string),
+func NewTgBot(boring Boring, translate Translate, smartHome SmartHome, generative GenerativeModel, stateRepository UsersChatStateRepository, aiDialogRepository AIDialogHistoryRepository, bot *tgbotapi.BotAPI, handler Handler, URL string, ownerID int64, moviesURL string, historyPolicy HistoryPolicy, quotaPolicy QuotaPolicy, defaultRole models.AccessRole) *TgBotServices {
+	b := &TgBotServices{
+		Boring:         boring,
+		Translate:      translate,
+		SmartHome:      smartHome,
+		Generative:     generative,
+		StateRepo:      stateRepository,
+		AIDialogRepo:   aiDialogRepository,
+		historyPolicy:  historyPolicy,
+		quotaPolicy:    quotaPolicy,
+		Bot:            bot,
+		sender:         NewTelegramSender(bot),
+		Handler:        handler,
+		OAuthURL:       URL,
+		OwnerID:        ownerID,
+		defaultRole:    defaultRole,
+		MoviesURL:      moviesURL,
+		debounceTimers: make(map[int64]*time.Timer),
+		lastQueries:    make(map[int64]string),
 		pendingReplies: make(map[string]struct {
 			ChatID    int64
 			MessageID int
 		}),
-		mu: &sync.Mutex{},
+		mu:          &sync.Mutex{},
+		generations: make(map[int64]*generation),
+		answers:     make(map[int64]answer),
+		runningAI:   make(map[int64]int),
 	}
+	b.modes = b.newModeMachine()
+	return b
 }
 
 // sendMessage sends a message to the specified chat with optional reply and markup.
@@ -145,7 +195,7 @@ func (b *TgBotServices) sendMessage(chatID int64, text string, replyToID int, ma
 	if markup != nil {
 		msg.ReplyMarkup = markup
 	}
-	_, err := b.Bot.Send(msg)
+	_, err := b.sender.Send(msg)
 	if err != nil {
 		logrus.WithError(err).Errorf("Failed to send message to chat %d: %s", chatID, text)
 	}
@@ -154,11 +204,17 @@ func (b *TgBotServices) sendMessage(chatID int64, text string, replyToID int, ma
 
 // HandleInlineQuery processes inline queries for translation or activity suggestions with debouncing.
 // Arguments:
-//   - bot: Telegram Bot API instance.
 //   - query: the inline query from the user.
-func (b *TgBotServices) HandleInlineQuery(bot *tgbotapi.BotAPI, query *tgbotapi.InlineQuery) {
+func (b *TgBotServices) HandleInlineQuery(query *tgbotapi.InlineQuery) {
 	chatID := query.From.ID
 	currentInput := query.Query
+	if role := b.roleOf(chatID); !role.Allows(models.AccessGuest) {
+		logrus.WithFields(logrus.Fields{
+			"userID": chatID,
+			"role":   role,
+		}).Warn("Access denied to inline query")
+		return
+	}
 
 	b.mu.Lock()
 	b.lastQueries[chatID] = currentInput
@@ -181,11 +237,17 @@ func (b *TgBotServices) HandleInlineQuery(bot *tgbotapi.BotAPI, query *tgbotapi.
 			SwitchPMParameter: "ask_ai",
 		}
 
-		if _, err := bot.Request(inlineConf); err != nil {
+		if _, err := b.sender.Request(inlineConf); err != nil {
 			logrus.WithError(err).Error("Failed to send inline query response")
 		}
 	} else {
 		b.debounceTimers[chatID] = time.AfterFunc(1500*time.Millisecond, func() {
+			if denial := b.allowInlineQuery(chatID); denial != "" {
+				if _, err := b.sender.Request(inlineQuotaDenial(query.ID, denial)); err != nil {
+					logrus.WithError(err).Error("Failed to send inline query response")
+				}
+				return
+			}
 			results = b.handleTranslation(query.ID, chatID, currentInput)
 			inlineConf := tgbotapi.InlineConfig{
 				InlineQueryID: query.ID,
@@ -194,7 +256,7 @@ func (b *TgBotServices) HandleInlineQuery(bot *tgbotapi.BotAPI, query *tgbotapi.
 				IsPersonal:    true,
 			}
 
-			if _, err := bot.Request(inlineConf); err != nil {
+			if _, err := b.sender.Request(inlineConf); err != nil {
 				logrus.WithError(err).Error("Failed to send inline query response")
 			}
 		})
@@ -236,23 +298,10 @@ func (b *TgBotServices) handleTranslation(queryID string, chatID int64, input st
 	return results
 }
 
-func (b *TgBotServices) setModeState(currentStep string, isTranslating, isGenerative, isChangingGenModel, isChangingHistorySize bool) {
-	b.StateRepo.StoreUserState(b.ChatID, currentStep, "", "", isTranslating, isGenerative, isChangingGenModel, isChangingHistorySize)
-}
-
-func (b *TgBotServices) handleModeInput(update *tgbotapi.Update) (error, error, bool) {
-	switch {
-	case b.StateRepo.GetChangeHistorySizeState(b.ChatID):
-		return b.changeHistorySize(update), b.showBarMenu(), true
-	case b.StateRepo.GetChangeModelState(b.ChatID):
-		return b.changeGenerativeModel(update), b.showBarMenu(), true
-	case b.StateRepo.GetTranslateState(b.ChatID):
-		return b.translateText(update), nil, true
-	case b.StateRepo.GetGenerativeState(b.ChatID):
-		return b.generativeTextWithStream(update), nil, true
-	default:
-		return nil, nil, false
-	}
+// handleModeInput passes the update to the input handler of the chat's current mode.
+func (b *TgBotServices) handleModeInput(uc *UpdateContext) (error, error, bool) {
+	handled, err := b.modes.HandleInput(uc)
+	return err, nil, handled
 }
 
 func (b *TgBotServices) parseDeviceToggleCommand(text string) (string, bool) {
@@ -265,74 +314,119 @@ func (b *TgBotServices) parseDeviceToggleCommand(text string) (string, bool) {
 	return "", false
 }
 
-func (b *TgBotServices) handleTextCommand(update *tgbotapi.Update, text string) (error, error, bool) {
-	switch text {
+func (b *TgBotServices) handleTextCommand(uc *UpdateContext) (error, error, bool) {
+	switch uc.Text {
 	case constant.BUTTON_TEXT_PRINT_INTRO:
-		b.printIntro()
-		return b.showBarMenu(), nil, true
+		b.printIntro(uc)
+		return b.showBarMenu(uc), nil, true
 	case constant.BUTTON_TEXT_SKIP_INTRO, constant.BUTTON_TEXT_PRINT_MENU:
-		return b.showBarMenu(), nil, true
+		return b.showBarMenu(uc), nil, true
 	case constant.BUTTON_TEXT_WHAT_TO_DO:
-		return b.SendActivityMsg(), b.showBarMenu(), true
+		return b.SendActivityMsg(uc), b.showBarMenu(uc), true
 	case constant.BUTTON_TEXT_WHITCH_MOVIE_TO_WATCH:
-		return b.SendMoviesLink(), b.showBarMenu(), true
+		return b.SendMoviesLink(uc), b.showBarMenu(uc), true
 	case constant.BUTTON_TEXT_YANDEX_DDIALOGS:
-		return b.showSmartMenu(), nil, true
+		return b.showSmartMenu(uc), nil, true
 	case constant.BUTTON_TEXT_YANDEX_LOGIN:
-		return b.showOAuthButton(), nil, true
+		return b.showOAuthButton(uc), nil, true
 	case constant.BUTTON_TEXT_YANDEX_GET_HOME_INFO:
-		return b.showSmartHomeInfo(), b.showSmartMenu(), true
+		return b.showSmartHomeInfo(uc), b.showSmartMenu(uc), true
 	case constant.BUTTON_TEXT_GENERATIVE_MENU:
-		return b.showGenerativeMenu(), nil, true
+		return b.showGenerativeMenu(uc), nil, true
 	case constant.BUTTON_TEXT_CHANGE_HISTORY_SIZE:
-		b.setModeState("смена памяти ИИ", false, false, false, true)
-		return b.sendMessage(b.ChatID, "Ты в режиме смены размера памяти генеративной модели.\nВведи целое число от 1 до 200 или /stop для выхода.", 0, nil), nil, true
+		return b.enterMode(uc, ModeChangingHistorySize), nil, true
 	case constant.BUTTON_TEXT_CHANGE_MODEL:
-		b.setModeState("смена ИИ", false, false, true, false)
-		return b.sendMessage(b.ChatID, "Ты в режиме смены генеративной модели.\nВведи название генеративной модели с сайта https://openrouter.ai/models. Например: deepseek/deepseek-chat-v3-0324:free или /stop для выхода.", 0, nil), nil, true
+		return b.enterMode(uc, ModeChangingModel), nil, true
+	case constant.BUTTON_TEXT_CHANGE_TEMPERATURE:
+		return b.enterMode(uc, ModeChangingTemperature), nil, true
+	case constant.BUTTON_TEXT_CHANGE_MAX_TOKENS:
+		return b.enterMode(uc, ModeChangingMaxTokens), nil, true
+	case constant.BUTTON_TEXT_CHANGE_SYSTEM_PROMPT:
+		return b.enterMode(uc, ModeChangingPrompt), nil, true
+	case constant.BUTTON_TEXT_THREADS:
+		return b.showThreads(uc), nil, true
+	case constant.BUTTON_TEXT_NEW_THREAD:
+		return b.enterMode(uc, ModeNamingThread), nil, true
+	case constant.BUTTON_TEXT_CHOOSE_PERSONA:
+		return b.showPersonas(uc), nil, true
+	case constant.BUTTON_TEXT_NEW_PERSONA:
+		return b.enterMode(uc, ModeCreatingPersona), nil, true
 	case constant.BUTTON_TEXT_GENERATIVE_MODEL, constant.BUTTON_TEXT_STREAM_GENERATIVE_MODEL:
-		b.setModeState("ИИ", false, true, false, false)
-		return b.sendMessage(b.ChatID, "Вы в режиме общения с ИИ.\nВведите свой вопрос или /stop для выхода.", 0, nil), nil, true
+		return b.enterMode(uc, ModeGenerative), nil, true
 	case constant.BUTTON_TEXT_TRANSLATE:
-		b.setModeState("перевод", true, false, false, false)
-		return b.sendMessage(b.ChatID, "Вы в режиме перевода.\nВведите текст для перевода или /stop для выхода.", 0, nil), nil, true
+		return b.enterMode(uc, ModeTranslating), nil, true
 	case "/start":
-		logrus.Infof("Message [%s] from %s (chat %d)", update.Message.Text, update.Message.From.UserName, b.ChatID)
-		b.StateRepo.StoreUserState(b.ChatID, "старт", update.Message.Text, "", false, false, false, false)
-		return b.askToPrintIntro(), nil, true
+		logrus.Infof("Message [%s] from %s (chat %d)", uc.Text, uc.UserName, uc.ChatID)
+		if err := b.enterMode(uc, ModeIdle); err != nil {
+			return err, nil, true
+		}
+		b.StateRepo.StoreUserState(uc.ChatID, "старт", uc.Text, "")
+		return b.askToPrintIntro(uc), nil, true
 	case "/stop":
-		b.StateRepo.StoreUserState(b.ChatID, "стоп", update.Message.Text, "", false, false, false, false)
-		return b.sendMessage(b.ChatID, "Возврат в основное меню", 0, nil), b.showBarMenu(), true
+		if err := b.enterMode(uc, ModeIdle); err != nil {
+			return err, nil, true
+		}
+		b.StateRepo.StoreUserState(uc.ChatID, "стоп", uc.Text, "")
+		return b.sendMessage(uc.ChatID, "Возврат в основное меню", 0, nil), b.showBarMenu(uc), true
 	default:
-		deviceName, ok := b.parseDeviceToggleCommand(text)
+		deviceName, ok := b.parseDeviceToggleCommand(uc.Text)
 		if !ok {
 			return nil, nil, false
 		}
-		return b.setDeviceTurnOnOffStatus(deviceName), b.showSmartMenu(), true
+		return b.setDeviceTurnOnOffStatus(uc, deviceName), b.showSmartMenu(uc), true
 	}
 }
 
 // UpdateProcessing handles incoming Telegram updates (messages and callback queries).
 // Arguments:
+//   - ctx: parent context for the update, canceled on application shutdown.
 //   - update: the Telegram update to process.
-//   - usersState: the user state repository instance.
-func (b *TgBotServices) UpdateProcessing(update *tgbotapi.Update) {
-	if update.Message == nil || update.Message.Text == "" {
+func (b *TgBotServices) UpdateProcessing(ctx context.Context, update *tgbotapi.Update) {
+	if update.CallbackQuery != nil {
+		uc := NewUpdateContext(ctx, update)
+		defer uc.Cancel()
+		if !b.authorize(uc) {
+			return
+		}
+		if err := b.handleCallback(uc); err != nil {
+			logrus.WithError(err).WithField("chatID", uc.ChatID).Error("Failed to handle callback query")
+		}
+		return
+	}
+	if update.Message == nil || (update.Message.Text == "" && update.Message.Document == nil) {
 		return
 	}
 
-	b.ChatID = update.Message.Chat.ID
-	text := update.Message.Text
+	uc := NewUpdateContext(ctx, update)
+	defer uc.Cancel()
+	if !b.authorize(uc) {
+		return
+	}
 
-	errOne, errTwo, handled := b.handleTextCommand(update, text)
+	errOne, errTwo, handled := b.handleTextCommand(uc)
+	if !handled {
+		errOne, errTwo, handled = b.handleThreadCommand(uc)
+	}
 	if !handled {
-		errOne, errTwo, handled = b.handleModeInput(update)
+		errOne, errTwo, handled = b.handleDialogTransferCommand(uc)
+	}
+	if !handled {
+		errOne, errTwo, handled = b.handleUsageCommand(uc)
+	}
+	if !handled {
+		errOne, errTwo, handled = b.handleQuotaCommand(uc)
+	}
+	if !handled {
+		errOne, errTwo, handled = b.handleAccessCommand(uc)
+	}
+	if !handled && uc.Text != "" {
+		errOne, errTwo, handled = b.handleModeInput(uc)
 	}
 	if !handled {
-		b.StateRepo.StoreUserState(b.ChatID, "i can't do it now", update.Message.Text, "", false, false, false, false)
-		errOne = b.sendSorryMsg(update)
+		b.StateRepo.StoreUserState(uc.ChatID, "i can't do it now", uc.Text, "")
+		errOne = b.sendSorryMsg(uc)
 	}
 	if errOne != nil || errTwo != nil {
-		logrus.Error("errOne: ", errOne, "\n", "errTwo: ", errTwo)
+		logrus.WithField("chatID", uc.ChatID).Error("errOne: ", errOne, "\n", "errTwo: ", errTwo)
 	}
 }
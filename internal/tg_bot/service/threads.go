@@ -0,0 +1,258 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/sirupsen/logrus"
+)
+
+// Commands of the AI dialog threads.
+const (
+	commandNewThread    = "new"
+	commandListThreads  = "chats"
+	commandSwitchThread = "switch"
+	commandRenameThread = "rename"
+	commandDeleteThread = "delete"
+)
+
+// handleThreadCommand handles the commands that manage the AI dialog threads of the chat.
+// Returns the errors of the handling and whether the update was a thread command.
+func (b *TgBotServices) handleThreadCommand(uc *UpdateContext) (error, error, bool) {
+	msg := uc.Update.Message
+	if msg == nil || !msg.IsCommand() {
+		return nil, nil, false
+	}
+
+	arg := strings.TrimSpace(msg.CommandArguments())
+	switch msg.Command() {
+	case commandNewThread:
+		return b.createThread(uc, arg), nil, true
+	case commandListThreads:
+		return b.showThreads(uc), nil, true
+	case commandSwitchThread:
+		return b.switchThread(uc, arg), nil, true
+	case commandRenameThread:
+		return b.renameThread(uc, arg), nil, true
+	case commandDeleteThread:
+		return b.deleteThread(uc, arg), nil, true
+	default:
+		return nil, nil, false
+	}
+}
+
+// threadErrorText returns the message for the user about a failed thread operation.
+func threadErrorText(err error) string {
+	switch {
+	case errors.Is(err, models.ErrTooManyThreads):
+		return "Слишком много диалогов. Удали ненужные через /chats"
+	case errors.Is(err, models.ErrThreadNotFound):
+		return "Такого диалога нет. Список диалогов: /chats"
+	case errors.Is(err, models.ErrEmptyTitle):
+		return "Укажи название диалога, например: /new Путешествие"
+	default:
+		return "Не удалось изменить диалоги, попробуй позже"
+	}
+}
+
+// isThreadInputError reports whether the thread operation failed because of the user's input, not the storage.
+func isThreadInputError(err error) bool {
+	return errors.Is(err, models.ErrTooManyThreads) || errors.Is(err, models.ErrThreadNotFound) || errors.Is(err, models.ErrEmptyTitle)
+}
+
+// replyThreadError reports a failed thread operation to the user.
+// Errors caused by the user's input are not returned, only the storage ones.
+func (b *TgBotServices) replyThreadError(uc *UpdateContext, err error) error {
+	sendErr := b.sendMessage(uc.ChatID, threadErrorText(err), uc.MessageID, nil)
+	if isThreadInputError(err) {
+		return sendErr
+	}
+	logrus.WithError(err).WithField("chatID", uc.ChatID).Error("Failed to change dialog threads")
+	return errors.Join(err, sendErr)
+}
+
+// findThreadByRef returns the thread of the chat with the ID or the title (case-insensitive) given by the user.
+func (b *TgBotServices) findThreadByRef(chatID int64, ref string) (models.DialogThreadInfo, error) {
+	threads, err := b.AIDialogRepo.ListThreads(chatID)
+	if err != nil {
+		return models.DialogThreadInfo{}, err
+	}
+	for _, thread := range threads {
+		if thread.ID == ref {
+			return thread, nil
+		}
+	}
+	for _, thread := range threads {
+		if strings.EqualFold(thread.Title, ref) {
+			return thread, nil
+		}
+	}
+	return models.DialogThreadInfo{}, fmt.Errorf("%w: %s", models.ErrThreadNotFound, ref)
+}
+
+// activeThreadInfo returns the active thread of the chat, or false if the chat has no dialogs.
+func (b *TgBotServices) activeThreadInfo(chatID int64) (models.DialogThreadInfo, bool, error) {
+	threads, err := b.AIDialogRepo.ListThreads(chatID)
+	if err != nil {
+		return models.DialogThreadInfo{}, false, err
+	}
+	for _, thread := range threads {
+		if thread.Active {
+			return thread, true, nil
+		}
+	}
+	return models.DialogThreadInfo{}, false, nil
+}
+
+// createThread creates a new dialog thread with the title and makes it active.
+func (b *TgBotServices) createThread(uc *UpdateContext, title string) error {
+	thread, err := b.AIDialogRepo.CreateThread(uc.ChatID, title)
+	if err != nil {
+		return b.replyThreadError(uc, err)
+	}
+	text := fmt.Sprintf("Создан диалог «%s» (№%s), он стал текущим.\nВопросы в режиме ИИ теперь попадают в него.", thread.Title, thread.ID)
+	return b.sendMessage(uc.ChatID, text, uc.MessageID, nil)
+}
+
+// nameNewThread creates a dialog thread titled with the user's input. It is the input handler of ModeNamingThread.
+func (b *TgBotServices) nameNewThread(uc *UpdateContext) error {
+	return b.createThread(uc, uc.Text)
+}
+
+// switchThread makes the thread given by its ID or title active.
+func (b *TgBotServices) switchThread(uc *UpdateContext, ref string) error {
+	if ref == "" {
+		return b.showThreads(uc)
+	}
+	thread, err := b.findThreadByRef(uc.ChatID, ref)
+	if err == nil {
+		thread, err = b.AIDialogRepo.SwitchThread(uc.ChatID, thread.ID)
+	}
+	if err != nil {
+		return b.replyThreadError(uc, err)
+	}
+	return b.sendMessage(uc.ChatID, fmt.Sprintf("Текущий диалог: «%s»", thread.Title), uc.MessageID, nil)
+}
+
+// renameThread changes the title of the active thread.
+func (b *TgBotServices) renameThread(uc *UpdateContext, title string) error {
+	thread, ok, err := b.activeThreadInfo(uc.ChatID)
+	if err == nil && !ok {
+		err = models.ErrThreadNotFound
+	}
+	if err == nil {
+		err = b.AIDialogRepo.RenameThread(uc.ChatID, thread.ID, title)
+	}
+	if err != nil {
+		return b.replyThreadError(uc, err)
+	}
+	return b.sendMessage(uc.ChatID, fmt.Sprintf("Диалог «%s» переименован в «%s»", thread.Title, strings.TrimSpace(title)), uc.MessageID, nil)
+}
+
+// deleteThread removes the thread given by its ID or title, or the active thread if ref is empty.
+func (b *TgBotServices) deleteThread(uc *UpdateContext, ref string) error {
+	var (
+		thread models.DialogThreadInfo
+		err    error
+	)
+	if ref == "" {
+		var ok bool
+		thread, ok, err = b.activeThreadInfo(uc.ChatID)
+		if err == nil && !ok {
+			err = models.ErrThreadNotFound
+		}
+	} else {
+		thread, err = b.findThreadByRef(uc.ChatID, ref)
+	}
+	if err == nil {
+		err = b.AIDialogRepo.DeleteThread(uc.ChatID, thread.ID)
+	}
+	if err != nil {
+		return b.replyThreadError(uc, err)
+	}
+	return b.sendMessage(uc.ChatID, fmt.Sprintf("Диалог «%s» удалён", thread.Title), uc.MessageID, nil)
+}
+
+// threadsView builds the text and the inline keyboard of the chat's thread list.
+func threadsView(threads []models.DialogThreadInfo) (string, *tgbotapi.InlineKeyboardMarkup) {
+	if len(threads) == 0 {
+		return "У тебя пока нет диалогов с ИИ.\nСоздай первый командой /new <название> или просто задай вопрос в режиме ИИ.", nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString("Твои диалоги с ИИ. Нажми на название, чтобы переключиться, или 🗑, чтобы удалить:\n")
+	rows := make([][]tgbotapi.InlineKeyboardButton, 0, len(threads))
+	for _, thread := range threads {
+		title := fmt.Sprintf("%s (%d)", thread.Title, thread.Messages)
+		if thread.Active {
+			title = "✅ " + title
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(title, callbackData(callbackThreadSwitch, thread.ID)),
+			tgbotapi.NewInlineKeyboardButtonData("🗑", callbackData(callbackThreadDelete, thread.ID)),
+		))
+	}
+	sb.WriteString("\n/new <название> — новый диалог\n/rename <название> — переименовать текущий")
+	markup := tgbotapi.NewInlineKeyboardMarkup(rows...)
+	return sb.String(), &markup
+}
+
+// showThreads sends the list of the chat's dialog threads with inline buttons to switch and delete them.
+func (b *TgBotServices) showThreads(uc *UpdateContext) error {
+	threads, err := b.AIDialogRepo.ListThreads(uc.ChatID)
+	if err != nil {
+		return b.replyThreadError(uc, err)
+	}
+	text, markup := threadsView(threads)
+	if markup == nil {
+		return b.sendMessage(uc.ChatID, text, uc.MessageID, nil)
+	}
+	return b.sendMessage(uc.ChatID, text, uc.MessageID, *markup)
+}
+
+// refreshThreads replaces the thread list message with the pressed button by the current list.
+func (b *TgBotServices) refreshThreads(uc *UpdateContext) error {
+	threads, err := b.AIDialogRepo.ListThreads(uc.ChatID)
+	if err != nil {
+		return err
+	}
+	text, markup := threadsView(threads)
+	edit := tgbotapi.NewEditMessageText(uc.ChatID, uc.MessageID, text)
+	edit.ReplyMarkup = markup
+	if _, err = b.sender.Send(edit); err != nil {
+		logrus.WithError(err).WithField("chatID", uc.ChatID).Error("Failed to refresh the dialog thread list")
+		return err
+	}
+	return nil
+}
+
+// replyThreadButtonError reports a failed thread operation started by an inline button.
+// A button of a thread that no longer exists refreshes the outdated list.
+func (b *TgBotServices) replyThreadButtonError(uc *UpdateContext, err error) error {
+	answerErr := b.answerCallback(uc, threadErrorText(err))
+	if isThreadInputError(err) {
+		return errors.Join(answerErr, b.refreshThreads(uc))
+	}
+	logrus.WithError(err).WithField("chatID", uc.ChatID).Error("Failed to change dialog threads")
+	return errors.Join(err, answerErr)
+}
+
+// switchThreadByButton switches to the thread chosen in the thread list.
+func (b *TgBotServices) switchThreadByButton(uc *UpdateContext, threadID string) error {
+	thread, err := b.AIDialogRepo.SwitchThread(uc.ChatID, threadID)
+	if err != nil {
+		return b.replyThreadButtonError(uc, err)
+	}
+	return errors.Join(b.answerCallback(uc, fmt.Sprintf("Текущий диалог: «%s»", thread.Title)), b.refreshThreads(uc))
+}
+
+// deleteThreadByButton removes the thread chosen in the thread list.
+func (b *TgBotServices) deleteThreadByButton(uc *UpdateContext, threadID string) error {
+	if err := b.AIDialogRepo.DeleteThread(uc.ChatID, threadID); err != nil {
+		return b.replyThreadButtonError(uc, err)
+	}
+	return errors.Join(b.answerCallback(uc, "Диалог удалён"), b.refreshThreads(uc))
+}
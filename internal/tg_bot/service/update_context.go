@@ -0,0 +1,64 @@
+package service
+
+import (
+	"context"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// UpdateContext carries the per-update request data through the bot handlers.
+//
+// A new UpdateContext is built for every incoming update, so handlers never share chat-specific
+// state through TgBotServices and updates from different chats can be processed concurrently.
+type UpdateContext struct {
+	Ctx       context.Context         // Cancellable context bound to the lifetime of the update
+	Update    *tgbotapi.Update        // Original Telegram update
+	ChatID    int64                   // Chat the update came from
+	UserID    int64                   // Telegram user who sent the update
+	UserName  string                  // Telegram username of the sender, may be empty
+	MessageID int                     // ID of the incoming message, or of the message with the pressed inline button
+	Language  string                  // Language code of the sender's Telegram client, may be empty
+	Text      string                  // Text of the incoming message
+	Callback  *tgbotapi.CallbackQuery // Pressed inline button, nil if the update is not a callback query
+	cancel    context.CancelFunc
+}
+
+// NewUpdateContext creates an UpdateContext for the given update.
+// Arguments:
+//   - parent: parent context, usually the application lifetime context.
+//   - update: the Telegram update to process.
+//
+// Returns a pointer to an UpdateContext. The caller must call Cancel when the update is processed.
+func NewUpdateContext(parent context.Context, update *tgbotapi.Update) *UpdateContext {
+	ctx, cancel := context.WithCancel(parent)
+	uc := &UpdateContext{
+		Ctx:    ctx,
+		Update: update,
+		cancel: cancel,
+	}
+
+	if from := update.SentFrom(); from != nil {
+		uc.UserID = from.ID
+		uc.UserName = from.UserName
+		uc.Language = from.LanguageCode
+	}
+	if chat := update.FromChat(); chat != nil {
+		uc.ChatID = chat.ID
+	}
+	if update.Message != nil {
+		uc.MessageID = update.Message.MessageID
+		uc.Text = update.Message.Text
+	}
+	if update.CallbackQuery != nil {
+		uc.Callback = update.CallbackQuery
+		if update.CallbackQuery.Message != nil {
+			uc.MessageID = update.CallbackQuery.Message.MessageID
+		}
+	}
+	return uc
+}
+
+// Cancel releases the resources associated with the update context.
+func (uc *UpdateContext) Cancel() {
+	uc.cancel()
+}
@@ -0,0 +1,215 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	"github.com/sirupsen/logrus"
+)
+
+// Command of the AI usage statistics, "/usage all" shows the owner the usage of all chats.
+const (
+	commandUsage = "usage"
+	usageArgAll  = "all"
+)
+
+// Settings of the AI usage statistics.
+const (
+	usageModelDays    = 30        // Days of the usage broken down by model and by chat
+	usageTopChats     = 10        // Chats listed in the owner's view of all usage
+	unknownUsageModel = "default" // Model of the usage when neither the provider nor the settings name it
+)
+
+// usagePeriod is a period of the usage statistics ending today.
+type usagePeriod struct {
+	title string
+	days  int // Days of the period including today, 0 for the whole ledger
+}
+
+// usagePeriods are the periods the usage statistics are summed up for.
+var usagePeriods = []usagePeriod{{"сегодня", 1}, {"7 дней", 7}, {"30 дней", 30}, {"всё время", 0}}
+
+// usageDay returns the ledger day of the time.
+func usageDay(t time.Time) string {
+	return t.UTC().Format(models.UsageDayLayout)
+}
+
+// usageSince returns the first ledger day of the period of days ending on now, empty for the whole ledger.
+func usageSince(now time.Time, days int) string {
+	if days <= 0 {
+		return ""
+	}
+	return usageDay(now.AddDate(0, 0, 1-days))
+}
+
+// newUsageEntry returns the ledger entry of one AI answer.
+// Arguments:
+//   - now: time of the answer.
+//   - usage: token usage reported by the provider, nil if it reported none.
+//   - model: model of the chat settings, used when the provider did not name the model.
+func newUsageEntry(now time.Time, usage *models.TokenUsage, model string) models.UsageEntry {
+	entry := models.UsageEntry{Day: usageDay(now), Model: model, Requests: 1}
+	if usage != nil {
+		entry.PromptTokens = usage.PromptTokens
+		entry.CompletionTokens = usage.CompletionTokens
+		entry.Cost = usage.Cost
+		if usage.Model != "" {
+			entry.Model = usage.Model
+		}
+	}
+	if entry.Model == "" {
+		entry.Model = unknownUsageModel
+	}
+	return entry
+}
+
+// sumUsage sums up the entries of the ledger starting from the day, all of them if the day is empty.
+func sumUsage(entries []models.UsageEntry, since string) models.UsageEntry {
+	var total models.UsageEntry
+	for _, entry := range entries {
+		if entry.Day >= since {
+			total.Add(entry)
+		}
+	}
+	return total
+}
+
+// usageByModel sums up the entries of the ledger starting from the day by model, the most used models first.
+func usageByModel(entries []models.UsageEntry, since string) []models.UsageEntry {
+	byModel := make(map[string]*models.UsageEntry)
+	var result []models.UsageEntry
+	for _, entry := range entries {
+		if entry.Day < since {
+			continue
+		}
+		total, ok := byModel[entry.Model]
+		if !ok {
+			total = &models.UsageEntry{Model: entry.Model}
+			byModel[entry.Model] = total
+		}
+		total.Add(entry)
+	}
+	for _, total := range byModel {
+		result = append(result, *total)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].TotalTokens() != result[j].TotalTokens() {
+			return result[i].TotalTokens() > result[j].TotalTokens()
+		}
+		return result[i].Model < result[j].Model
+	})
+	return result
+}
+
+// formatUsage returns the usage totals in one line, the cost only if it is known.
+func formatUsage(entry models.UsageEntry) string {
+	text := fmt.Sprintf("запросов: %d, токенов: %d (запрос %d, ответ %d)",
+		entry.Requests, entry.TotalTokens(), entry.PromptTokens, entry.CompletionTokens)
+	if entry.Cost > 0 {
+		text += fmt.Sprintf(", $%.4f", entry.Cost)
+	}
+	return text
+}
+
+// writeUsagePeriods writes the usage totals of every period of usagePeriods.
+func writeUsagePeriods(sb *strings.Builder, entries []models.UsageEntry, now time.Time) {
+	for _, period := range usagePeriods {
+		fmt.Fprintf(sb, "• %s: %s\n", period.title, formatUsage(sumUsage(entries, usageSince(now, period.days))))
+	}
+}
+
+// writeUsageByModel writes the usage of the last usageModelDays days by model.
+func writeUsageByModel(sb *strings.Builder, entries []models.UsageEntry, now time.Time) {
+	byModel := usageByModel(entries, usageSince(now, usageModelDays))
+	if len(byModel) == 0 {
+		return
+	}
+	fmt.Fprintf(sb, "\nПо моделям за %d дней:\n", usageModelDays)
+	for _, entry := range byModel {
+		fmt.Fprintf(sb, "• %s: %s\n", entry.Model, formatUsage(entry))
+	}
+}
+
+// usageText returns the usage statistics of one chat.
+func usageText(entries []models.UsageEntry, now time.Time) string {
+	if len(entries) == 0 {
+		return "Ты ещё не обращался к ИИ, расход токенов пока нулевой."
+	}
+	var sb strings.Builder
+	sb.WriteString("Расход токенов ИИ:\n")
+	writeUsagePeriods(&sb, entries, now)
+	writeUsageByModel(&sb, entries, now)
+	return strings.TrimSpace(sb.String())
+}
+
+// globalUsageText returns the usage statistics of all chats with the chats that used the most tokens.
+func globalUsageText(all map[int64][]models.UsageEntry, now time.Time) string {
+	if len(all) == 0 {
+		return "К ИИ ещё никто не обращался."
+	}
+	since := usageSince(now, usageModelDays)
+	type chatUsage struct {
+		chatID int64
+		total  models.UsageEntry
+	}
+	var entries []models.UsageEntry
+	var chats []chatUsage
+	for chatID, chatEntries := range all {
+		entries = append(entries, chatEntries...)
+		if total := sumUsage(chatEntries, since); total.Requests > 0 {
+			chats = append(chats, chatUsage{chatID: chatID, total: total})
+		}
+	}
+	sort.Slice(chats, func(i, j int) bool {
+		if chats[i].total.TotalTokens() != chats[j].total.TotalTokens() {
+			return chats[i].total.TotalTokens() > chats[j].total.TotalTokens()
+		}
+		return chats[i].chatID < chats[j].chatID
+	})
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Расход токенов ИИ всех чатов (%d):\n", len(all))
+	writeUsagePeriods(&sb, entries, now)
+	writeUsageByModel(&sb, entries, now)
+	if len(chats) > 0 {
+		fmt.Fprintf(&sb, "\nАктивные чаты за %d дней: %d, больше всего токенов:\n", usageModelDays, len(chats))
+		for _, chat := range chats[:min(len(chats), usageTopChats)] {
+			fmt.Fprintf(&sb, "• %d: %s\n", chat.chatID, formatUsage(chat.total))
+		}
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// recordUsage adds the usage of one AI answer to the chat's ledger.
+// Arguments:
+//   - chatID: the chat that asked the AI.
+//   - usage: token usage reported by the provider, nil if it reported none.
+//   - model: model of the chat settings, used when the provider did not name the model.
+func (b *TgBotServices) recordUsage(chatID int64, usage *models.TokenUsage, model string) {
+	entry := newUsageEntry(time.Now(), usage, model)
+	b.StateRepo.AddUsage(chatID, entry)
+	logrus.WithFields(logrus.Fields{
+		"chatID":           chatID,
+		"model":            entry.Model,
+		"promptTokens":     entry.PromptTokens,
+		"completionTokens": entry.CompletionTokens,
+		"cost":             entry.Cost,
+	}).Debug("AI usage recorded")
+}
+
+// handleUsageCommand handles the command that shows the AI usage statistics.
+// Returns the errors of the handling and whether the update was the usage command.
+func (b *TgBotServices) handleUsageCommand(uc *UpdateContext) (error, error, bool) {
+	msg := uc.Update.Message
+	if msg == nil || !msg.IsCommand() || msg.Command() != commandUsage {
+		return nil, nil, false
+	}
+
+	if !strings.EqualFold(strings.TrimSpace(msg.CommandArguments()), usageArgAll) {
+		return b.sendMessage(uc.ChatID, usageText(b.StateRepo.GetUsage(uc.ChatID), time.Now()), uc.MessageID, nil), nil, true
+	}
+	return b.sendMessage(uc.ChatID, globalUsageText(b.StateRepo.GetAllUsage(), time.Now()), uc.MessageID, nil), nil, true
+}
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DenisKhanov/TgBOT/internal/tg_bot/models"
+	"github.com/stretchr/testify/assert"
+)
+
+var usageNow = time.Date(2026, 10, 17, 21, 0, 0, 0, time.UTC)
+
+var testLedger = []models.UsageEntry{
+	{Day: "2026-08-01", Model: "deepseek-chat", Requests: 4, PromptTokens: 4000, CompletionTokens: 1000},
+	{Day: "2026-10-12", Model: "openai/gpt-4o", Requests: 1, PromptTokens: 100, CompletionTokens: 50, Cost: 0.0125},
+	{Day: "2026-10-17", Model: "deepseek-chat", Requests: 2, PromptTokens: 300, CompletionTokens: 60},
+}
+
+func TestNewUsageEntry(t *testing.T) {
+	usage := &models.TokenUsage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15, Model: "openai/gpt-4o", Cost: 0.001}
+	assert.Equal(t, models.UsageEntry{Day: "2026-10-17", Model: "openai/gpt-4o", Requests: 1, PromptTokens: 10, CompletionTokens: 5, Cost: 0.001},
+		newUsageEntry(usageNow, usage, "deepseek-chat"))
+
+	assert.Equal(t, models.UsageEntry{Day: "2026-10-17", Model: "deepseek-chat", Requests: 1},
+		newUsageEntry(usageNow, nil, "deepseek-chat"), "the request is counted even without the usage")
+	assert.Equal(t, unknownUsageModel, newUsageEntry(usageNow, &models.TokenUsage{}, "").Model)
+}
+
+func TestSumUsage(t *testing.T) {
+	assert.Equal(t, 2, sumUsage(testLedger, usageSince(usageNow, 1)).Requests)
+	week := sumUsage(testLedger, usageSince(usageNow, 7))
+	assert.Equal(t, 3, week.Requests)
+	assert.Equal(t, 510, week.TotalTokens())
+	assert.Equal(t, 7, sumUsage(testLedger, usageSince(usageNow, 0)).Requests)
+}
+
+func TestUsageText(t *testing.T) {
+	text := usageText(testLedger, usageNow)
+	assert.Contains(t, text, "• сегодня: запросов: 2, токенов: 360 (запрос 300, ответ 60)")
+	assert.Contains(t, text, "• 7 дней: запросов: 3, токенов: 510 (запрос 400, ответ 110), $0.0125")
+	assert.Contains(t, text, "• всё время: запросов: 7")
+	assert.Contains(t, text, "По моделям за 30 дней:\n• deepseek-chat: запросов: 2, токенов: 360 (запрос 300, ответ 60)\n• openai/gpt-4o:")
+
+	assert.Contains(t, usageText(nil, usageNow), "пока нулевой")
+}
+
+func TestGlobalUsageText(t *testing.T) {
+	all := map[int64][]models.UsageEntry{
+		1: testLedger,
+		2: {{Day: "2026-10-16", Model: "deepseek-chat", Requests: 1, PromptTokens: 1000, CompletionTokens: 200}},
+		3: {{Day: "2026-01-01", Model: "deepseek-chat", Requests: 1, PromptTokens: 5, CompletionTokens: 5}},
+	}
+	text := globalUsageText(all, usageNow)
+	assert.Contains(t, text, "всех чатов (3)")
+	assert.Contains(t, text, "Активные чаты за 30 дней: 2, больше всего токенов:\n• 2: запросов: 1, токенов: 1200 (запрос 1000, ответ 200)\n• 1:")
+}